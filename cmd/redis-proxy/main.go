@@ -2,34 +2,78 @@ package main
 
 import (
 	"flag"
+	"fmt"
+	"io/ioutil"
 	"log"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 
 	"github.com/Codility/redis-proxy/rproxy"
 )
 
 var (
-	config_file = flag.String("f", "config.json", "Config file (or \"-\" for standard input)")
+	config_file = flag.String("f", "config.json", "Config file: JSON, or YAML/TOML by extension (or \"-\" for standard input, http[s]://... or redis[s]://host:port/key)")
+	format      = flag.String("format", "", "Format of the config: json, yaml or toml (default: by extension or Content-Type, json for standard input)")
+	token_file  = flag.String("config-token-file", "", "File with the bearer token for config over HTTP")
+	ca_cert     = flag.String("config-cacert", "", "CA cert to verify the server of config over HTTPS or Redis TLS")
+	check       = flag.Bool("check", false, "Validate the config file (also against the running proxy) and exit")
+	watch       = flag.Bool("watch", false, "Reload when the config file (or a file it refers to, or the key in Redis) changes")
+	debounce    = flag.Duration("watch-debounce", rproxy.DefaultWatchDebounce, "With -watch, reload once the config didn't change for this long")
+	admin_url   = flag.String("admin", "", "Admin URL of the running proxy for -check (default: from admin.addr in the config file)")
 )
 
 func main() {
 	flag.Parse()
-	var configLoader rproxy.ConfigLoader
-	if *config_file == "-" {
-		configLoader = rproxy.NewInputConfigLoader(os.Stdin)
-	} else {
-		configLoader = rproxy.NewFileConfigLoader(*config_file)
+	configLoader, err := newConfigLoader()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *check {
+		os.Exit(checkConfig(configLoader))
 	}
 	proxy, err := rproxy.NewProxy(configLoader)
 	if err != nil {
 		panic(err)
 	}
+	if *watch {
+		switch loader := configLoader.(type) {
+		case *rproxy.FileConfigLoader:
+			loader.Watch(proxy, *debounce)
+		case *rproxy.RedisConfigLoader:
+			loader.Watch(proxy, *debounce)
+		default:
+			log.Fatal("-watch requires a config file or a key in Redis")
+		}
+	}
 	go watchSignals(proxy)
 	proxy.Run()
 }
 
+func newConfigLoader() (rproxy.ConfigLoader, error) {
+	switch {
+	case *config_file == "-":
+		return rproxy.NewInputConfigLoader(os.Stdin, *format), nil
+	case strings.HasPrefix(*config_file, "http://") || strings.HasPrefix(*config_file, "https://"):
+		token := ""
+		if *token_file != "" {
+			data, err := ioutil.ReadFile(*token_file)
+			if err != nil {
+				return nil, err
+			}
+			token = strings.TrimSpace(string(data))
+		}
+		return rproxy.NewHTTPConfigLoader(*config_file, token, *ca_cert, *format)
+	case strings.HasPrefix(*config_file, "redis://") || strings.HasPrefix(*config_file, "rediss://"):
+		return rproxy.NewRedisConfigLoaderFromURL(*config_file, *ca_cert, *format)
+	}
+	if *format != "" {
+		return nil, fmt.Errorf("-format can't be used with a config file (it's detected by extension)")
+	}
+	return rproxy.NewFileConfigLoader(*config_file), nil
+}
+
 func watchSignals(proxy *rproxy.Proxy) {
 	reload := make(chan os.Signal, 1)
 	signal.Notify(reload, syscall.SIGHUP)
@@ -49,3 +93,46 @@ func watchSignals(proxy *rproxy.Proxy) {
 		}
 	}
 }
+
+// checkConfig prints all problems with the config, and returns the
+// exit code.
+func checkConfig(configLoader rproxy.ConfigLoader) int {
+	config, err := configLoader.Load()
+	if err != nil {
+		fmt.Println("Could not load config:", err)
+		return 1
+	}
+
+	adminURL := *admin_url
+	if adminURL == "" && config.Admin.Addr != "" {
+		adminURL = config.Admin.AdminURL()
+	}
+	var running *rproxy.Config
+	if adminURL != "" {
+		running, err = rproxy.FetchRunningConfig(adminURL, &config.Admin)
+		if err != nil {
+			if *admin_url != "" {
+				fmt.Println("Could not fetch running config:", err)
+				return 1
+			}
+			fmt.Println("Not checking against the running proxy:", err)
+		}
+	}
+
+	res := rproxy.ValidateConfig(config, running)
+	for _, change := range res.Changes {
+		fmt.Printf("Change: `%s` (%s)\n", change.Field, change.Applied)
+	}
+	for _, e := range res.Errors {
+		if e.Field != "" {
+			fmt.Printf("%s: %s: %s\n", e.Severity, e.Field, e.Message)
+		} else {
+			fmt.Printf("%s: %s\n", e.Severity, e.Message)
+		}
+	}
+	if !res.Ok {
+		return 1
+	}
+	fmt.Println("Config OK")
+	return 0
+}
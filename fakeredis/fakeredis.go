@@ -4,7 +4,29 @@ package fakeredis
 // Minimal Redis-like server that exposes RESP via TCP.
 //
 // It responds with:
-//  - "+OK\r\n" to "SELECT n" and "AUTH x"
+//  - "+OK\r\n" to "SELECT n", "AUTH [user] pass", "MULTI", "DISCARD", "WATCH ..."
+//    and "UNWATCH"
+//  - "+QUEUED\r\n" to requests sent between MULTI and EXEC, and an
+//    array of their replies to EXEC
+//  - subscription confirmations to SUBSCRIBE/PSUBSCRIBE and their
+//    UNSUBSCRIBE counterparts, and the number of receivers to PUBLISH
+//  - connection id to "CLIENT ID"
+//  - null array to blocking commands (BLPOP etc.), after their timeout
+//    passes or the connection gets unblocked with "CLIENT UNBLOCK"
+//  - master address (as set with SetMaster()) to "SENTINEL
+//    get-master-addr-by-name", which makes it usable as a fake sentinel
+//  - "+OK\r\n" to "REPLICAOF host port", "REPLICAOF NO ONE" and
+//    "CONFIG SET ...", and role, link status (see SetMasterLinkDown())
+//    and offset (as set with SetReplOffset()) to "INFO replication"
+//  - slot ranges (as set with SetClusterSlots()) to "CLUSTER SLOTS",
+//    "-MOVED ..." to requests for keys in slots owned by other nodes,
+//    and "-ASK ..." to requests for keys in slots migrating to other
+//    nodes (see SetMigrating()), unless preceded by "ASKING"
+//  - server name and protocol version to "HELLO [protover ...]"; after
+//    "HELLO 3" Pub/Sub replies and messages are sent as RESP3 push
+//    messages, and blocking commands time out with RESP3 null
+//  - values set with SetValue() to "GET key" (setting a value also
+//    sends its keyspace notification, as for db 0)
 //  - its name (as passed to New()) to all other requests
 
 import (
@@ -15,6 +37,9 @@ import (
 	"log"
 	"net"
 	"os"
+	"path"
+	"sort"
+	"strings"
 	"sync"
 	"time"
 
@@ -30,6 +55,37 @@ type FakeRedisServer struct {
 	mu       sync.Mutex
 	shutdown bool
 	requests []*resp.Msg
+	conns    map[*fakeConn]bool
+	lastID   int64
+	masters  map[string]string
+
+	replicaOf  string
+	replOffset int64
+	linkDown   bool
+
+	clusterSlots []ClusterSlotRange
+	migrating    map[int]string
+
+	values map[string]string
+}
+
+type ClusterSlotRange struct {
+	Start, End int
+	Addr       string
+}
+
+type fakeConn struct {
+	rc      *resp.Conn
+	unblock chan struct{}
+
+	asking bool
+
+	// Guarded by FakeRedisServer.mu
+	proto    int
+	id       int64
+	blocked  bool
+	channels map[string]bool
+	patterns map[string]bool
 }
 
 func New(name string) *FakeRedisServer {
@@ -37,19 +93,28 @@ func New(name string) *FakeRedisServer {
 }
 
 func Start(name, network string) *FakeRedisServer {
-	return start(name, network, false)
+	return StartWithTLSConfig(name, network, nil)
 }
 
+// StartTLS starts a server with the certificate from test_data.
 func StartTLS(name, network string) *FakeRedisServer {
-	return start(name, network, true)
+	cer, err := tls.LoadX509KeyPair("../test_data/tls/server/cert.pem", "../test_data/tls/server/key.pem")
+	if err != nil {
+		panic(err)
+	}
+	return StartWithTLSConfig(name, network, &tls.Config{
+		Certificates: []tls.Certificate{cer},
+	})
 }
 
-func start(name, network string, useTLS bool) *FakeRedisServer {
+// StartWithTLSConfig starts a server that accepts TLS connections
+// with tlsConfig (or plain ones, if it's nil).
+func StartWithTLSConfig(name, network string, tlsConfig *tls.Config) *FakeRedisServer {
 	startedChan := make(chan struct{})
 
 	srv := New(name)
 
-	go srv.Run(startedChan, network, useTLS)
+	go srv.Run(startedChan, network, tlsConfig)
 	<-startedChan
 
 	return srv
@@ -69,7 +134,7 @@ func (s *FakeRedisServer) Requests() []*resp.Msg {
 	return s.requests
 }
 
-func (s *FakeRedisServer) Run(startedChan chan struct{}, network string, useTLS bool) {
+func (s *FakeRedisServer) Run(startedChan chan struct{}, network string, tlsConfig *tls.Config) {
 	var err error
 
 	switch network {
@@ -92,14 +157,8 @@ func (s *FakeRedisServer) Run(startedChan chan struct{}, network string, useTLS
 	if err != nil {
 		panic(err)
 	}
-	if useTLS {
-		cer, err := tls.LoadX509KeyPair("../test_data/tls/server/cert.pem", "../test_data/tls/server/key.pem")
-		if err != nil {
-			panic(err)
-		}
-		s.listener = tls.NewListener(s.originalListener, &tls.Config{
-			Certificates: []tls.Certificate{cer},
-		})
+	if tlsConfig != nil {
+		s.listener = tls.NewListener(s.originalListener, tlsConfig)
 	} else {
 		s.listener = s.originalListener
 	}
@@ -143,11 +202,34 @@ func (s *FakeRedisServer) Addr() net.Addr {
 }
 
 func (s *FakeRedisServer) handleConnection(conn net.Conn) {
-	rc := resp.NewConn(conn, 100, false)
-	defer rc.Close()
+	fc := &fakeConn{
+		rc:       resp.NewConn(conn, 100, false),
+		proto:    2,
+		unblock:  make(chan struct{}, 1),
+		channels: map[string]bool{},
+		patterns: map[string]bool{},
+	}
+	s.mu.Lock()
+	if s.conns == nil {
+		s.conns = map[*fakeConn]bool{}
+	}
+	s.conns[fc] = true
+	s.lastID++
+	fc.id = s.lastID
+	s.mu.Unlock()
+
+	defer func() {
+		s.mu.Lock()
+		delete(s.conns, fc)
+		s.mu.Unlock()
+		fc.rc.Close()
+	}()
+
+	// Requests queued after MULTI, nil when not in a transaction.
+	var queued []*resp.Msg
 
 	for !s.IsShuttingDown() {
-		req, err := rc.ReadMsg()
+		req, err := fc.rc.ReadMsg()
 		if err != nil {
 			if resp.IsNetTimeout(err) {
 				continue
@@ -159,13 +241,407 @@ func (s *FakeRedisServer) handleConnection(conn net.Conn) {
 		}
 		s.RecordRequest(req)
 
-		if (req.Op() == resp.MsgOpAuth) || (req.Op() == resp.MsgOpSelect) {
-			rc.MustWrite([]byte("+OK\r\n"))
+		if redirect := s.clusterRedirect(fc, req); redirect != nil {
+			s.write(fc, redirect)
+			continue
+		}
+
+		switch {
+		case req.Op() == resp.MsgOpMulti:
+			queued = []*resp.Msg{}
+			s.write(fc, resp.MsgOk)
+		case req.Op() == resp.MsgOpExec && queued != nil:
+			res := []byte(fmt.Sprintf("*%d\r\n", len(queued)))
+			for _, q := range queued {
+				res = append(res, s.reply(q)...)
+			}
+			queued = nil
+			s.write(fc, res)
+		case req.Op() == resp.MsgOpDiscard && queued != nil:
+			queued = nil
+			s.write(fc, resp.MsgOk)
+		case queued != nil:
+			queued = append(queued, req)
+			s.write(fc, resp.MsgQueued)
+		case req.Op() == resp.MsgOpSubscribe || req.Op() == resp.MsgOpUnsubscribe:
+			s.write(fc, s.subscribe(fc, req))
+		case req.Command() == "PUBLISH" && len(req.Args()) == 2:
+			cnt := s.Publish(req.Args()[0], req.Args()[1])
+			s.write(fc, []byte(fmt.Sprintf(":%d\r\n", cnt)))
+		case req.Command() == "SENTINEL" && len(req.Args()) == 2:
+			s.write(fc, s.sentinel(req.Args()))
+		case req.Command() == "REPLICAOF" && len(req.Args()) == 2:
+			s.mu.Lock()
+			s.replicaOf = strings.Join(req.Args(), ":")
+			if strings.EqualFold(s.replicaOf, "NO:ONE") {
+				s.replicaOf = ""
+			}
+			s.mu.Unlock()
+			s.write(fc, resp.MsgOk)
+		case req.Command() == "CONFIG" && len(req.Args()) == 3:
+			s.write(fc, resp.MsgOk)
+		case req.Command() == "ASKING":
+			fc.asking = true
+			s.write(fc, resp.MsgOk)
+		case req.Command() == "CLUSTER" && len(req.Args()) == 1 && strings.EqualFold(req.Args()[0], "SLOTS"):
+			s.write(fc, s.slots())
+		case req.Op() == resp.MsgOpHello:
+			s.write(fc, s.hello(fc, req.Args()))
+		case req.Command() == "INFO":
+			s.write(fc, s.info())
+		case req.Command() == "CLIENT" && len(req.Args()) > 0:
+			s.write(fc, s.client(fc, req.Args()))
+		case isBlocking(req):
+			s.block(fc, req)
+		default:
+			s.write(fc, s.reply(req))
+		}
+	}
+}
+
+func (s *FakeRedisServer) write(fc *fakeConn, data []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	fc.rc.MustWrite(data)
+}
+
+// subscribe handles (P)SUBSCRIBE and (P)UNSUBSCRIBE, returns all
+// confirmations.
+func (s *FakeRedisServer) subscribe(fc *fakeConn, req *resp.Msg) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	kind := strings.ToLower(req.Command())
+	set := fc.channels
+	if strings.HasPrefix(kind, "p") {
+		set = fc.patterns
+	}
+
+	names := req.Args()
+	if req.Op() == resp.MsgOpUnsubscribe && len(names) == 0 {
+		for name := range set {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		if len(names) == 0 {
+			return []byte(fmt.Sprintf("%c3\r\n$%d\r\n%s\r\n$-1\r\n:0\r\n", fc.pushPrefix(), len(kind), kind))
+		}
+	}
+
+	res := []byte{}
+	for _, name := range names {
+		if req.Op() == resp.MsgOpSubscribe {
+			set[name] = true
 		} else {
-			res := fmt.Sprintf("$%d\r\n%s\r\n", len(s.name), s.name)
-			rc.MustWrite([]byte(res))
+			delete(set, name)
+		}
+		res = append(res, []byte(fmt.Sprintf("%c3\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n:%d\r\n",
+			fc.pushPrefix(), len(kind), kind, len(name), name, len(fc.channels)+len(fc.patterns)))...)
+	}
+	return res
+}
+
+// Publish sends a message to all clients subscribed to channel (or a
+// matching pattern), returns the number of receivers.
+func (s *FakeRedisServer) Publish(channel, message string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	cnt := 0
+	for fc := range s.conns {
+		if fc.channels[channel] {
+			fc.rc.MustWrite(pushMsg(fc.pushPrefix(), "message", channel, message))
+			cnt++
+		}
+		for pattern := range fc.patterns {
+			if ok, _ := path.Match(pattern, channel); ok {
+				fc.rc.MustWrite(pushMsg(fc.pushPrefix(), "pmessage", pattern, channel, message))
+				cnt++
+			}
+		}
+	}
+	return cnt
+}
+
+// SetValue makes GET return value for key, and notifies subscribers
+// of `__keyspace@0__:<key>`.
+func (s *FakeRedisServer) SetValue(key, value string) {
+	s.mu.Lock()
+	if s.values == nil {
+		s.values = map[string]string{}
+	}
+	s.values[key] = value
+	s.mu.Unlock()
+
+	s.Publish("__keyspace@0__:"+key, "set")
+}
+
+func isBlocking(req *resp.Msg) bool {
+	_, ok := req.BlockingTimeout()
+	return ok
+}
+
+// block waits until the command times out or the connection gets
+// unblocked, and replies with a null array in either case.
+func (s *FakeRedisServer) block(fc *fakeConn, req *resp.Msg) {
+	timeout, _ := req.BlockingTimeout()
+	var timeoutChan <-chan time.Time
+	if timeout > 0 {
+		timeoutChan = time.After(timeout)
+	}
+
+	s.mu.Lock()
+	fc.blocked = true
+	s.mu.Unlock()
+
+	select {
+	case <-fc.unblock:
+	case <-timeoutChan:
+	}
+
+	s.mu.Lock()
+	fc.blocked = false
+	proto := fc.proto
+	s.mu.Unlock()
+
+	if proto == 3 {
+		s.write(fc, []byte("_\r\n"))
+	} else {
+		s.write(fc, []byte("*-1\r\n"))
+	}
+}
+
+// client handles "CLIENT ID" and "CLIENT UNBLOCK id".
+func (s *FakeRedisServer) client(fc *fakeConn, args []string) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	switch strings.ToUpper(args[0]) {
+	case "ID":
+		return []byte(fmt.Sprintf(":%d\r\n", fc.id))
+	case "UNBLOCK":
+		if len(args) < 2 {
+			break
+		}
+		for other := range s.conns {
+			if fmt.Sprint(other.id) == args[1] && other.blocked {
+				other.blocked = false
+				other.unblock <- struct{}{}
+				return []byte(":1\r\n")
+			}
+		}
+		return []byte(":0\r\n")
+	}
+	return []byte(fmt.Sprintf("$%d\r\n%s\r\n", len(s.name), s.name))
+}
+
+// SetMaster sets the address returned for a master name, like a
+// sentinel would.  Changing it publishes +switch-master.
+func (s *FakeRedisServer) SetMaster(name, addr string) {
+	s.mu.Lock()
+	if s.masters == nil {
+		s.masters = map[string]string{}
+	}
+	oldAddr, existed := s.masters[name]
+	s.masters[name] = addr
+	s.mu.Unlock()
+
+	if existed {
+		oldHost, oldPort, _ := net.SplitHostPort(oldAddr)
+		host, port, _ := net.SplitHostPort(addr)
+		s.Publish("+switch-master", strings.Join([]string{name, oldHost, oldPort, host, port}, " "))
+	}
+}
+
+// sentinel handles "SENTINEL get-master-addr-by-name name".
+func (s *FakeRedisServer) sentinel(args []string) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if !strings.EqualFold(args[0], "get-master-addr-by-name") {
+		return []byte("-ERR Unknown sentinel subcommand\r\n")
+	}
+	addr, ok := s.masters[args[1]]
+	if !ok {
+		return []byte("*-1\r\n")
+	}
+	host, port, _ := net.SplitHostPort(addr)
+	return []byte(fmt.Sprintf("*2\r\n$%d\r\n%s\r\n$%d\r\n%s\r\n", len(host), host, len(port), port))
+}
+
+// SetReplOffset sets master_repl_offset reported by INFO.
+func (s *FakeRedisServer) SetReplOffset(offset int64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.replOffset = offset
+}
+
+// SetMasterLinkDown sets master_link_status reported by INFO of a
+// replica.
+func (s *FakeRedisServer) SetMasterLinkDown(down bool) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.linkDown = down
+}
+
+func (s *FakeRedisServer) ReplicaOf() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.replicaOf
+}
+
+func (s *FakeRedisServer) info() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	info := "# Replication\r\nrole:master\r\n"
+	if s.replicaOf != "" {
+		linkStatus := "up"
+		if s.linkDown {
+			linkStatus = "down"
 		}
+		info = "# Replication\r\nrole:slave\r\nmaster_link_status:" + linkStatus + "\r\n"
 	}
+	info += fmt.Sprintf("master_repl_offset:%d\r\n", s.replOffset)
+	return []byte(fmt.Sprintf("$%d\r\n%s\r\n", len(info), info))
+}
+
+// SetClusterSlots makes the server act as a cluster node.
+func (s *FakeRedisServer) SetClusterSlots(slots []ClusterSlotRange) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.clusterSlots = slots
+}
+
+// SetMigrating marks slot as being migrated to addr (empty: not
+// migrating anymore).
+func (s *FakeRedisServer) SetMigrating(slot int, addr string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if s.migrating == nil {
+		s.migrating = map[int]string{}
+	}
+	if addr == "" {
+		delete(s.migrating, slot)
+	} else {
+		s.migrating[slot] = addr
+	}
+}
+
+func (s *FakeRedisServer) slots() []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	res := []byte(fmt.Sprintf("*%d\r\n", len(s.clusterSlots)))
+	for _, r := range s.clusterSlots {
+		host, port, _ := net.SplitHostPort(r.Addr)
+		res = append(res, []byte(fmt.Sprintf("*3\r\n:%d\r\n:%d\r\n*2\r\n$%d\r\n%s\r\n:%s\r\n",
+			r.Start, r.End, len(host), host, port))...)
+	}
+	return res
+}
+
+// clusterRedirect returns MOVED or ASK error if the request refers to
+// keys this node doesn't serve, nil otherwise.
+func (s *FakeRedisServer) clusterRedirect(fc *fakeConn, req *resp.Msg) []byte {
+	asking := fc.asking
+	if req.Command() != "ASKING" {
+		fc.asking = false
+	}
+
+	keys := req.Keys()
+	if len(keys) == 0 {
+		return nil
+	}
+	slot := resp.HashSlot(keys[0])
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if addr, ok := s.migrating[slot]; ok {
+		return []byte(fmt.Sprintf("-ASK %d %s\r\n", slot, addr))
+	}
+	for _, r := range s.clusterSlots {
+		if r.Start <= slot && slot <= r.End && r.Addr != s.listener.Addr().String() && !asking {
+			return []byte(fmt.Sprintf("-MOVED %d %s\r\n", slot, r.Addr))
+		}
+	}
+	return nil
+}
+
+// pushPrefix returns type prefix of Pub/Sub messages in the protocol
+// the connection uses.
+func (fc *fakeConn) pushPrefix() byte {
+	if fc.proto == 3 {
+		return '>'
+	}
+	return '*'
+}
+
+// hello handles "HELLO [protover ...]", ignoring options.
+func (s *FakeRedisServer) hello(fc *fakeConn, args []string) []byte {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if len(args) > 0 {
+		switch args[0] {
+		case "2":
+			fc.proto = 2
+		case "3":
+			fc.proto = 3
+		default:
+			return resp.MsgNoProto
+		}
+	}
+	prefix := "*4"
+	if fc.proto == 3 {
+		prefix = "%2"
+	}
+	return []byte(fmt.Sprintf("%s\r\n$6\r\nserver\r\n$%d\r\n%s\r\n$5\r\nproto\r\n:%d\r\n",
+		prefix, len(s.name), s.name, fc.proto))
+}
+
+func pushMsg(prefix byte, kind string, args ...string) []byte {
+	res := []byte(fmt.Sprintf("%c%d\r\n$%d\r\n%s\r\n", prefix, len(args)+1, len(kind), kind))
+	for _, arg := range args {
+		res = append(res, []byte(fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg))...)
+	}
+	return res
+}
+
+func (s *FakeRedisServer) reply(req *resp.Msg) []byte {
+	if req.Command() == "AUTH" {
+		// Also "AUTH user pass", which is not MsgOpAuth.
+		return resp.MsgOk
+	}
+	if req.Command() == "GET" && len(req.Args()) == 1 {
+		s.mu.Lock()
+		val, ok := s.values[req.Args()[0]]
+		s.mu.Unlock()
+		if ok {
+			return []byte(fmt.Sprintf("$%d\r\n%s\r\n", len(val), val))
+		}
+	}
+	switch req.Op() {
+	case resp.MsgOpSelect, resp.MsgOpWatch, resp.MsgOpUnwatch:
+		return resp.MsgOk
+	default:
+		return []byte(fmt.Sprintf("$%d\r\n%s\r\n", len(s.name), s.name))
+	}
+}
+
+// ConnCnt returns the number of open client connections.
+func (s *FakeRedisServer) ConnCnt() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.conns)
 }
 
 func (s *FakeRedisServer) ReqCnt() int {
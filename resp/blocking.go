@@ -0,0 +1,107 @@
+package resp
+
+import (
+	"math"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Blocking commands
+//
+// Commands that may wait (on Redis side) for something to happen
+// before they reply.  The proxy needs to know how long they may
+// block, so that it doesn't apply the usual time limit to them.
+
+type blockingSpec struct {
+	// Position of the timeout among arguments: counted from the
+	// beginning if >= 0, from the end if < 0.  Ignored if
+	// `option` is set.
+	argIdx int
+	// Timeout is the argument right after this one (e.g. "BLOCK").
+	option string
+	unit   time.Duration
+}
+
+var blockingCommands = map[string]blockingSpec{
+	"BLPOP":      {argIdx: -1, unit: time.Second},
+	"BRPOP":      {argIdx: -1, unit: time.Second},
+	"BRPOPLPUSH": {argIdx: -1, unit: time.Second},
+	"BLMOVE":     {argIdx: -1, unit: time.Second},
+	"BZPOPMIN":   {argIdx: -1, unit: time.Second},
+	"BZPOPMAX":   {argIdx: -1, unit: time.Second},
+	"BLMPOP":     {argIdx: 0, unit: time.Second},
+	"BZMPOP":     {argIdx: 0, unit: time.Second},
+	"XREAD":      {option: "BLOCK", unit: time.Millisecond},
+	"XREADGROUP": {option: "BLOCK", unit: time.Millisecond},
+	"WAIT":       {argIdx: -1, unit: time.Millisecond},
+	"WAITAOF":    {argIdx: -1, unit: time.Millisecond},
+}
+
+// timeoutArg returns index (in Args()) of the timeout argument, or -1
+// if the message is not a blocking command.
+func (m *Msg) timeoutArg() (int, blockingSpec) {
+	spec, ok := blockingCommands[m.Command()]
+	args := m.Args()
+	if !ok || len(args) == 0 {
+		return -1, spec
+	}
+
+	if spec.option != "" {
+		for i, arg := range args[:len(args)-1] {
+			if strings.EqualFold(arg, "STREAMS") {
+				break
+			}
+			if strings.EqualFold(arg, spec.option) {
+				return i + 1, spec
+			}
+		}
+		return -1, spec
+	}
+
+	idx := spec.argIdx
+	if idx < 0 {
+		idx += len(args)
+	}
+	if idx < 0 || idx >= len(args) {
+		return -1, spec
+	}
+	return idx, spec
+}
+
+// BlockingTimeout returns true if the message is a blocking command,
+// and how long it may block (0: indefinitely).  Commands with invalid
+// timeout are not considered blocking, Redis rejects them right away.
+func (m *Msg) BlockingTimeout() (time.Duration, bool) {
+	idx, spec := m.timeoutArg()
+	if idx == -1 {
+		return 0, false
+	}
+	val, err := strconv.ParseFloat(m.Args()[idx], 64)
+	if err != nil || val < 0 || math.IsInf(val, 0) || math.IsNaN(val) {
+		return 0, false
+	}
+	return time.Duration(val * float64(spec.unit)), true
+}
+
+// WithBlockingTimeout returns a copy of the blocking command with a
+// different timeout (rounded up to the unit the command uses).
+func (m *Msg) WithBlockingTimeout(timeout time.Duration) *Msg {
+	idx, spec := m.timeoutArg()
+	if idx == -1 {
+		return m
+	}
+
+	args := append([]string{m.Command()}, m.Args()...)
+	if spec.unit == time.Second && strings.Contains(args[idx+1], ".") {
+		args[idx+1] = strconv.FormatFloat(
+			math.Ceil(timeout.Seconds()*1000)/1000, 'f', -1, 64)
+	} else {
+		units := int64(timeout / spec.unit)
+		if timeout%spec.unit != 0 {
+			units++
+		}
+		args[idx+1] = strconv.FormatInt(units, 10)
+	}
+	return MsgFromStrings(args...)
+}
@@ -0,0 +1,277 @@
+package resp
+
+import (
+	"strconv"
+	"strings"
+)
+
+// Key positions
+//
+// Where keys are among arguments of a command, needed to route
+// commands by key.  Positions are indexes in Args(), i.e. not
+// counting the command name.
+
+const (
+	keysNone = iota
+	// Keys at first..last (last < 0: counted from the end), every
+	// `step` arguments.
+	keysRange
+	// Number of keys at `first`, keys right after it.  With
+	// `step` == 1, the argument before numkeys is a key too
+	// (destination of ZUNIONSTORE etc.)
+	keysNumKeys
+	// Keys after STREAMS, in the first half of remaining
+	// arguments (XREAD, XREADGROUP).
+	keysStreams
+	// Key first, then STORE destination and BY and GET patterns
+	// (those that refer to keys, i.e. contain "*").
+	keysSort
+	// Key first, options from `first` on, with STORE and STOREDIST
+	// destinations (GEORADIUS, GEORADIUSBYMEMBER).
+	keysGeoRadius
+	// Key at 2 (if not empty), or all after KEYS.
+	keysMigrate
+)
+
+type keySpec struct {
+	kind  int
+	first int
+	last  int
+	step  int
+}
+
+var (
+	oneKey         = keySpec{keysRange, 0, 0, 1}
+	twoKeys        = keySpec{keysRange, 0, 1, 1}
+	allKeys        = keySpec{keysRange, 0, -1, 1}
+	allButLastKeys = keySpec{keysRange, 0, -2, 1}
+	keyValuePairs  = keySpec{keysRange, 0, -1, 2}
+	secondKey      = keySpec{keysRange, 1, 1, 1}
+	allButFirst    = keySpec{keysRange, 1, -1, 1}
+	numKeysFirst   = keySpec{kind: keysNumKeys, first: 0}
+	numKeysSecond  = keySpec{kind: keysNumKeys, first: 1}
+	destAndNumKeys = keySpec{kind: keysNumKeys, first: 1, step: 1}
+	streamKeys     = keySpec{kind: keysStreams}
+	sortKeys       = keySpec{kind: keysSort}
+	geoRadiusKeys  = keySpec{kind: keysGeoRadius, first: 5}
+	geoMemberKeys  = keySpec{kind: keysGeoRadius, first: 4}
+	migrateKeys    = keySpec{kind: keysMigrate}
+)
+
+var commandKeys = map[string]keySpec{}
+
+func init() {
+	for spec, commands := range map[keySpec]string{
+		oneKey: "GET SET SETNX SETEX PSETEX GETSET GETDEL GETEX APPEND STRLEN " +
+			"INCR DECR INCRBY DECRBY INCRBYFLOAT GETRANGE SETRANGE SUBSTR " +
+			"GETBIT SETBIT BITCOUNT BITPOS BITFIELD BITFIELD_RO " +
+			"EXPIRE PEXPIRE EXPIREAT PEXPIREAT EXPIRETIME PEXPIRETIME TTL PTTL " +
+			"PERSIST TYPE DUMP RESTORE " +
+			"HSET HSETNX HGET HMSET HMGET HDEL HLEN HKEYS HVALS HGETALL HEXISTS " +
+			"HINCRBY HINCRBYFLOAT HSTRLEN HSCAN HRANDFIELD " +
+			"LPUSH RPUSH LPUSHX RPUSHX LPOP RPOP LLEN LRANGE LINDEX LSET LREM " +
+			"LTRIM LINSERT LPOS " +
+			"SADD SREM SMEMBERS SISMEMBER SMISMEMBER SCARD SPOP SRANDMEMBER SSCAN " +
+			"ZADD ZREM ZSCORE ZMSCORE ZINCRBY ZCARD ZCOUNT ZRANGE ZRANGEBYSCORE " +
+			"ZRANGEBYLEX ZREVRANGE ZREVRANGEBYSCORE ZREVRANGEBYLEX ZRANK ZREVRANK " +
+			"ZREMRANGEBYRANK ZREMRANGEBYSCORE ZREMRANGEBYLEX ZLEXCOUNT ZPOPMIN " +
+			"ZPOPMAX ZSCAN ZRANDMEMBER " +
+			"PFADD GEOADD GEODIST GEOHASH GEOPOS GEOSEARCH GEORADIUS_RO " +
+			"GEORADIUSBYMEMBER_RO " +
+			"XADD XLEN XRANGE XREVRANGE XDEL XTRIM XACK XCLAIM XAUTOCLAIM " +
+			"XPENDING XSETID",
+		twoKeys:        "RENAME RENAMENX SMOVE RPOPLPUSH LMOVE COPY GEOSEARCHSTORE ZRANGESTORE BRPOPLPUSH BLMOVE LCS",
+		allKeys:        "DEL UNLINK EXISTS TOUCH MGET WATCH SINTER SUNION SDIFF SINTERSTORE SUNIONSTORE SDIFFSTORE PFCOUNT PFMERGE",
+		allButLastKeys: "BLPOP BRPOP BZPOPMIN BZPOPMAX",
+		keyValuePairs:  "MSET MSETNX",
+		secondKey:      "XGROUP XINFO OBJECT MEMORY",
+		allButFirst:    "BITOP",
+		numKeysFirst:   "ZUNION ZINTER ZDIFF ZINTERCARD SINTERCARD LMPOP ZMPOP",
+		numKeysSecond:  "EVAL EVALSHA EVAL_RO EVALSHA_RO FCALL FCALL_RO BLMPOP BZMPOP",
+		destAndNumKeys: "ZUNIONSTORE ZINTERSTORE ZDIFFSTORE",
+		streamKeys:     "XREAD XREADGROUP",
+		sortKeys:       "SORT SORT_RO",
+		geoRadiusKeys:  "GEORADIUS",
+		geoMemberKeys:  "GEORADIUSBYMEMBER",
+		migrateKeys:    "MIGRATE",
+	} {
+		for _, cmd := range strings.Fields(commands) {
+			commandKeys[cmd] = spec
+		}
+	}
+}
+
+// Commands that never refer to keys (KEYS, SCAN, RANDOMKEY refer to
+// key names in other ways, and are not here).
+var keylessCommands = map[string]bool{}
+
+func init() {
+	for _, cmd := range strings.Fields(
+		"PING ECHO QUIT RESET AUTH HELLO SELECT INFO TIME ROLE LASTSAVE " +
+			"MULTI EXEC DISCARD UNWATCH WAIT WAITAOF CLIENT COMMAND " +
+			"READONLY READWRITE ASKING " +
+			"SUBSCRIBE UNSUBSCRIBE PSUBSCRIBE PUNSUBSCRIBE SSUBSCRIBE " +
+			"SUNSUBSCRIBE PUBLISH SPUBLISH") {
+		keylessCommands[cmd] = true
+	}
+}
+
+// KeysKnown returns true if the proxy knows which arguments of the
+// command are keys (possibly none).
+func (m *Msg) KeysKnown() bool {
+	cmd := m.Command()
+	_, ok := commandKeys[cmd]
+	return ok || keylessCommands[cmd]
+}
+
+// KeyPositions returns indexes (in Args()) of all keys the command
+// refers to.  Returns nil for commands without keys, or unknown to
+// the proxy.
+func (m *Msg) KeyPositions() []int {
+	spec, ok := commandKeys[m.Command()]
+	args := m.Args()
+	if !ok {
+		return nil
+	}
+
+	res := []int{}
+	switch spec.kind {
+	case keysRange:
+		last := spec.last
+		if last < 0 {
+			last += len(args)
+		}
+		for i := spec.first; i <= last && i < len(args); i += spec.step {
+			res = append(res, i)
+		}
+	case keysNumKeys:
+		if spec.first >= len(args) {
+			return nil
+		}
+		if spec.step == 1 {
+			res = append(res, spec.first-1)
+		}
+		n, err := strconv.Atoi(args[spec.first])
+		if err != nil || n < 0 {
+			return nil
+		}
+		for i := spec.first + 1; i <= spec.first+n && i < len(args); i++ {
+			res = append(res, i)
+		}
+	case keysStreams:
+		for i, arg := range args {
+			if strings.EqualFold(arg, "STREAMS") {
+				n := (len(args) - i - 1) / 2
+				for j := i + 1; j <= i+n; j++ {
+					res = append(res, j)
+				}
+				break
+			}
+		}
+	case keysSort:
+		if len(args) > 0 {
+			res = append(res, 0)
+		}
+		for i := 1; i+1 < len(args); i++ {
+			switch strings.ToUpper(args[i]) {
+			case "BY", "GET":
+				if strings.Contains(args[i+1], "*") {
+					res = append(res, i+1)
+				}
+				i++
+			case "STORE":
+				res = append(res, i+1)
+				i++
+			case "LIMIT":
+				i += 2
+			}
+		}
+	case keysGeoRadius:
+		if len(args) > 0 {
+			res = append(res, 0)
+		}
+		for i := spec.first; i+1 < len(args); i++ {
+			switch strings.ToUpper(args[i]) {
+			case "STORE", "STOREDIST":
+				res = append(res, i+1)
+				i++
+			case "COUNT":
+				i++
+			}
+		}
+	case keysMigrate:
+		if len(args) > 2 && args[2] != "" {
+			res = append(res, 2)
+		}
+	options:
+		for i := 5; i < len(args); i++ {
+			switch strings.ToUpper(args[i]) {
+			case "AUTH":
+				i++
+			case "AUTH2":
+				i += 2
+			case "KEYS":
+				for j := i + 1; j < len(args); j++ {
+					res = append(res, j)
+				}
+				break options
+			}
+		}
+	}
+	if len(res) == 0 {
+		return nil
+	}
+	return res
+}
+
+// Keys returns all keys the command refers to.
+func (m *Msg) Keys() []string {
+	positions := m.KeyPositions()
+	if positions == nil {
+		return nil
+	}
+	args := m.Args()
+	res := make([]string, len(positions))
+	for i, pos := range positions {
+		res[i] = args[pos]
+	}
+	return res
+}
+
+////////////////////
+// Redis Cluster hash slots
+
+const ClusterSlots = 16384
+
+// HashTag returns the part of key that should be hashed: content of
+// the first non-empty "{...}", or the whole key if there is none.
+func HashTag(key string) string {
+	if start := strings.IndexByte(key, '{'); start != -1 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			return key[start+1 : start+1+end]
+		}
+	}
+	return key
+}
+
+// HashSlot returns the cluster slot of key, taking hash tags into
+// account.
+func HashSlot(key string) int {
+	return int(crc16(HashTag(key)) % ClusterSlots)
+}
+
+// crc16 implements CRC16-CCITT (XMODEM), as used by Redis Cluster.
+func crc16(s string) uint16 {
+	crc := uint16(0)
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
@@ -0,0 +1,52 @@
+package resp
+
+import (
+	"testing"
+
+	"github.com/stvp/assert"
+)
+
+func TestKeys(t *testing.T) {
+	keys := func(args ...string) []string {
+		return MsgFromStrings(args...).Keys()
+	}
+
+	assert.Equal(t, keys("GET", "a"), []string{"a"})
+	assert.Equal(t, keys("get", "a"), []string{"a"})
+	assert.Equal(t, keys("MGET", "a", "b", "c"), []string{"a", "b", "c"})
+	assert.Equal(t, keys("MSET", "a", "1", "b", "2"), []string{"a", "b"})
+	assert.Equal(t, keys("BLPOP", "a", "b", "0"), []string{"a", "b"})
+	assert.Equal(t, keys("RENAME", "a", "b"), []string{"a", "b"})
+	assert.Equal(t, keys("EVAL", "return 1", "2", "a", "b", "arg"), []string{"a", "b"})
+	assert.Equal(t, keys("ZUNIONSTORE", "dst", "2", "a", "b", "WEIGHTS", "1", "2"), []string{"dst", "a", "b"})
+	assert.Equal(t, keys("BLMPOP", "0", "2", "a", "b", "LEFT"), []string{"a", "b"})
+	assert.Equal(t, keys("XREAD", "COUNT", "1", "STREAMS", "a", "b", "0", "0"), []string{"a", "b"})
+	assert.Equal(t, keys("XINFO", "STREAM", "a"), []string{"a"})
+	assert.Equal(t, keys("BITOP", "AND", "dst", "a", "b"), []string{"dst", "a", "b"})
+	assert.Equal(t, keys("LCS", "a", "b", "LEN"), []string{"a", "b"})
+	assert.Equal(t, keys("SORT", "a", "BY", "w_*", "LIMIT", "0", "10", "GET", "#", "GET", "o_*->f", "STORE", "dst"),
+		[]string{"a", "w_*", "o_*->f", "dst"})
+	assert.Equal(t, keys("SORT", "a", "BY", "nosort", "ALPHA"), []string{"a"})
+	assert.Equal(t, keys("GEORADIUS", "a", "1", "2", "3", "km", "COUNT", "5", "STORE", "dst", "STOREDIST", "d"),
+		[]string{"a", "dst", "d"})
+	assert.Equal(t, keys("GEORADIUSBYMEMBER", "a", "STORE", "3", "km", "WITHDIST"), []string{"a"})
+	assert.Equal(t, keys("MIGRATE", "host", "6379", "a", "0", "1000", "COPY"), []string{"a"})
+	assert.Equal(t, keys("MIGRATE", "host", "6379", "", "0", "1000", "AUTH", "KEYS", "KEYS", "a", "b"),
+		[]string{"a", "b"})
+
+	assert.Nil(t, keys("PING"))
+	assert.Nil(t, keys("GET"))
+	assert.Nil(t, keys("EVAL", "return 1", "0"))
+	assert.Nil(t, keys("EVAL", "return 1", "x"))
+	assert.Nil(t, keys("UNKNOWN", "a"))
+}
+
+func TestHashSlot(t *testing.T) {
+	assert.Equal(t, crc16("123456789"), uint16(0x31C3))
+	assert.Equal(t, HashSlot("foo"), 12182)
+	assert.Equal(t, HashSlot("bar"), 5061)
+	assert.Equal(t, HashSlot("{user1000}.following"), HashSlot("{user1000}.followers"))
+	assert.Equal(t, HashSlot("{user1000}.following"), HashSlot("user1000"))
+	assert.Equal(t, HashSlot("foo{}{bar}"), HashSlot("foo{}{bar}"))
+	assert.NotEqual(t, HashSlot("foo{}{bar}"), HashSlot("bar"))
+}
@@ -0,0 +1,137 @@
+package resp
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+// RESP reader
+//
+// Reads complete RESP2 and RESP3 objects, without interpreting them
+// beyond what's needed to find where they end.  Streamed strings and
+// aggregates (RESP3 "?" lengths) are not supported, Redis doesn't
+// send them.
+
+const maxLoggedSyntaxError = 200
+
+// Type prefixes
+const (
+	typeSimpleString = '+'
+	typeError        = '-'
+	typeInteger      = ':'
+	typeBulkString   = '$'
+	typeArray        = '*'
+	typeNull         = '_'
+	typeDouble       = ','
+	typeBoolean      = '#'
+	typeBigNumber    = '('
+	typeBlobError    = '!'
+	typeVerbatim     = '='
+	typeMap          = '%'
+	typeSet          = '~'
+	typeAttribute    = '|'
+	typePush         = '>'
+)
+
+type Reader struct {
+	*bufio.Reader
+}
+
+func NewReader(r io.Reader) *Reader {
+	return &Reader{bufio.NewReaderSize(r, 32*1024)}
+}
+
+// ReadObject returns raw data of the next object.  Attributes are
+// returned together with the object that follows them.
+func (r *Reader) ReadObject() ([]byte, error) {
+	return r.readObject(nil)
+}
+
+func (r *Reader) readObject(buf []byte) ([]byte, error) {
+	line, err := r.readLine()
+	if err != nil {
+		return nil, err
+	}
+	buf = append(buf, line...)
+
+	switch line[0] {
+	case typeSimpleString, typeError, typeInteger, typeNull, typeDouble, typeBoolean, typeBigNumber:
+		return buf, nil
+
+	case typeBulkString, typeBlobError, typeVerbatim:
+		n, err := lineCount(line)
+		if err != nil {
+			return nil, err
+		}
+		if n == -1 && line[0] == typeBulkString {
+			return buf, nil
+		}
+		if n < 0 {
+			return nil, errInvalidSyntax(line)
+		}
+		start := len(buf)
+		buf = append(buf, make([]byte, n+2)...)
+		if _, err := io.ReadFull(r, buf[start:]); err != nil {
+			return nil, err
+		}
+		if buf[len(buf)-2] != '\r' || buf[len(buf)-1] != '\n' {
+			return nil, errInvalidSyntax(buf[start-len(line):])
+		}
+		return buf, nil
+
+	case typeArray, typeSet, typePush, typeMap, typeAttribute:
+		n, err := lineCount(line)
+		if err != nil {
+			return nil, err
+		}
+		if n == -1 && line[0] == typeArray {
+			return buf, nil
+		}
+		if n < 0 {
+			return nil, errInvalidSyntax(line)
+		}
+		if line[0] == typeMap || line[0] == typeAttribute {
+			n *= 2
+		}
+		for i := 0; i < n; i++ {
+			if buf, err = r.readObject(buf); err != nil {
+				return nil, err
+			}
+		}
+		if line[0] == typeAttribute {
+			return r.readObject(buf)
+		}
+		return buf, nil
+	}
+	return nil, errInvalidSyntax(line)
+}
+
+func (r *Reader) readLine() ([]byte, error) {
+	line, err := r.ReadBytes('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 2 || line[len(line)-2] != '\r' {
+		return nil, errInvalidSyntax(line)
+	}
+	return line, nil
+}
+
+func lineCount(line []byte) (int, error) {
+	n, err := strconv.Atoi(string(line[1 : len(line)-2]))
+	if err != nil {
+		return 0, errInvalidSyntax(line)
+	}
+	return n, nil
+}
+
+func errInvalidSyntax(data []byte) error {
+	suffix := ""
+	if len(data) > maxLoggedSyntaxError {
+		data = data[:maxLoggedSyntaxError]
+		suffix = "[...]"
+	}
+	return fmt.Errorf("resp: invalid syntax in %#v%s", string(data), suffix)
+}
@@ -0,0 +1,66 @@
+package resp
+
+import (
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stvp/assert"
+)
+
+func TestReaderRESP3(t *testing.T) {
+	objects := []string{
+		"+OK\r\n",
+		"+\r\n",
+		"-ERR error\r\n",
+		"-\r\n",
+		":42\r\n",
+		"$3\r\nfoo\r\n",
+		"$-1\r\n",
+		"*-1\r\n",
+		"*2\r\n$1\r\na\r\n:1\r\n",
+		"_\r\n",
+		",3.14\r\n",
+		"#t\r\n",
+		"(3492890328409238509324850943850943825024385\r\n",
+		"!21\r\nSYNTAX invalid syntax\r\n",
+		"=15\r\ntxt:Some string\r\n",
+		"%2\r\n+first\r\n:1\r\n+second\r\n*1\r\n:2\r\n",
+		"~2\r\n+a\r\n+b\r\n",
+		">3\r\n$7\r\nmessage\r\n$2\r\nch\r\n$3\r\nmsg\r\n",
+		"|1\r\n+key-popularity\r\n%1\r\n$1\r\na\r\n,0.19\r\n*1\r\n:2\r\n",
+	}
+
+	r := NewReader(strings.NewReader(strings.Join(objects, "")))
+	for _, obj := range objects {
+		data, err := r.ReadObject()
+		assert.Nil(t, err)
+		assert.Equal(t, string(data), obj)
+
+		l, ok := objectLen([]byte(obj + "+tail\r\n"))
+		assert.True(t, ok, obj)
+		assert.Equal(t, l, len(obj))
+	}
+	_, err := r.ReadObject()
+	assert.Equal(t, err, io.EOF)
+
+	for _, broken := range []string{"?3\r\n", "$3\r\nfoobar\r\n", "%x\r\n", "~-1\r\n", "+OK\n"} {
+		_, err := NewReader(strings.NewReader(broken)).ReadObject()
+		assert.NotNil(t, err, broken)
+	}
+}
+
+func TestRESP3Helpers(t *testing.T) {
+	assert.True(t, msg("_\r\n").IsNil())
+	assert.True(t, msg("!3\r\nERR\r\n").IsError())
+	assert.True(t, msg(">1\r\n+a\r\n").IsPush())
+	assert.False(t, msg("*1\r\n+a\r\n").IsPush())
+
+	elements := msg("%2\r\n+a\r\n:1\r\n+b\r\n:2\r\n").Elements()
+	assert.Equal(t, len(elements), 4)
+	assert.Equal(t, elements[2].String(), "+b\r\n")
+	assert.Equal(t, len(msg(">2\r\n+a\r\n+b\r\n").Elements()), 2)
+	assert.Nil(t, msg("$1\r\na\r\n").Elements())
+
+	assert.Equal(t, msg("*2\r\n$5\r\nHELLO\r\n$1\r\n3\r\n").Op(), MsgOpHello)
+}
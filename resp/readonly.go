@@ -0,0 +1,39 @@
+package resp
+
+import "strings"
+
+// Read-only commands
+//
+// Commands that never modify data, and so can be served by a
+// replica.  Scripts (including EVAL_RO and FCALL_RO) and blocking
+// commands are deliberately left out.
+
+var readOnlyCommands = map[string]bool{}
+
+func init() {
+	for _, cmd := range strings.Fields(
+		"GET MGET STRLEN GETRANGE SUBSTR GETBIT BITCOUNT BITPOS BITFIELD_RO LCS " +
+			"EXISTS TYPE TTL PTTL EXPIRETIME PEXPIRETIME DUMP OBJECT KEYS SCAN " +
+			"RANDOMKEY DBSIZE SORT_RO " +
+			"HGET HMGET HLEN HKEYS HVALS HGETALL HEXISTS HSTRLEN HSCAN HRANDFIELD " +
+			"LLEN LRANGE LINDEX LPOS " +
+			"SMEMBERS SISMEMBER SMISMEMBER SCARD SRANDMEMBER SSCAN SINTER SUNION " +
+			"SDIFF SINTERCARD " +
+			"ZSCORE ZMSCORE ZCARD ZCOUNT ZRANGE ZRANGEBYSCORE ZRANGEBYLEX ZREVRANGE " +
+			"ZREVRANGEBYSCORE ZREVRANGEBYLEX ZRANK ZREVRANK ZLEXCOUNT ZSCAN " +
+			"ZRANDMEMBER ZUNION ZINTER ZDIFF ZINTERCARD " +
+			"PFCOUNT GEODIST GEOHASH GEOPOS GEOSEARCH GEORADIUS_RO GEORADIUSBYMEMBER_RO " +
+			"XLEN XRANGE XREVRANGE XREAD XINFO XPENDING") {
+		readOnlyCommands[cmd] = true
+	}
+}
+
+// IsReadOnly returns true if the message is a command that doesn't
+// modify data.  Blocking forms (e.g. XREAD BLOCK) don't count.
+func (m *Msg) IsReadOnly() bool {
+	if !readOnlyCommands[m.Command()] {
+		return false
+	}
+	_, blocking := m.BlockingTimeout()
+	return !blocking
+}
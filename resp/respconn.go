@@ -8,13 +8,11 @@ import (
 	"strconv"
 	"strings"
 	"time"
-
-	"redisgreen.net/respio"
 )
 
 type Conn struct {
 	raw    net.Conn
-	reader *respio.RESPReader
+	reader *Reader
 	writer *bufio.Writer
 	log    bool
 
@@ -25,8 +23,10 @@ func NewConn(rawConn net.Conn, readTimeLimitMs int64, log bool) *Conn {
 	return &Conn{
 		raw:    rawConn,
 		log:    log,
-		reader: respio.NewReader(bufio.NewReader(rawConn)),
+		reader: NewReader(rawConn),
 		writer: bufio.NewWriter(rawConn),
+
+		readTimeLimitMs: readTimeLimitMs,
 	}
 }
 
@@ -79,6 +79,31 @@ func (rc *Conn) MustWriteMsg(msg *Msg) int {
 	return res
 }
 
+// WriteMsgs sends all messages in a single write, so that a pipeline
+// of requests reaches the other side in as few packets as possible.
+func (rc *Conn) WriteMsgs(msgs []*Msg) (int, error) {
+	res := 0
+	for _, msg := range msgs {
+		if rc.log {
+			rc.logMessage(false, msg.data)
+		}
+		n, err := rc.writer.Write(msg.data)
+		res += n
+		if err != nil {
+			return res, err
+		}
+	}
+	return res, rc.writer.Flush()
+}
+
+func (rc *Conn) MustWriteMsgs(msgs []*Msg) int {
+	res, err := rc.WriteMsgs(msgs)
+	if err != nil {
+		panic(err)
+	}
+	return res
+}
+
 func (rc *Conn) Read(p []byte) (n int, err error) {
 	return rc.raw.Read(p)
 }
@@ -101,6 +126,27 @@ func (rc *Conn) ReadMsg() (*Msg, error) {
 	return &Msg{data: res}, nil
 }
 
+// Buffered returns the number of bytes that were already received
+// but not yet consumed by ReadMsg.  Non-zero value means that the
+// other side has sent more data (e.g. pipelined requests) and the
+// next ReadMsg will most likely not block.
+func (rc *Conn) Buffered() int {
+	return rc.reader.Buffered()
+}
+
+// WaitForData waits up to `timeout` for the other side to send
+// anything, without consuming it.  Returns nil if there is data to
+// read, and an error (see IsNetTimeout) otherwise.
+func (rc *Conn) WaitForData(timeout time.Duration) error {
+	if rc.reader.Buffered() > 0 {
+		return nil
+	}
+	rc.raw.SetReadDeadline(time.Now().Add(timeout))
+	defer rc.raw.SetReadDeadline(time.Time{})
+	_, err := rc.reader.Peek(1)
+	return err
+}
+
 func (rc *Conn) MustReadMsg() *Msg {
 	res, err := rc.ReadMsg()
 	if err != nil {
@@ -118,6 +164,23 @@ func (rc *Conn) Call(req *Msg) (*Msg, error) {
 	return rc.ReadMsg()
 }
 
+// CallPipeline sends all requests at once and reads their replies.
+func (rc *Conn) CallPipeline(reqs []*Msg) ([]*Msg, error) {
+	if _, err := rc.WriteMsgs(reqs); err != nil {
+		return nil, err
+	}
+
+	res := make([]*Msg, 0, len(reqs))
+	for range reqs {
+		msg, err := rc.ReadMsg()
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, msg)
+	}
+	return res, nil
+}
+
 func (rc *Conn) MustCall(req *Msg) *Msg {
 	resp, err := rc.Call(req)
 	if err != nil {
@@ -138,12 +201,33 @@ func (rc *Conn) Close() error {
 	return rc.raw.Close()
 }
 
+func (rc *Conn) SetReadDeadline(t time.Time) error {
+	return rc.raw.SetReadDeadline(t)
+}
+
+// SetOptions changes the read time limit and logging of an open
+// connection.  Must not be called concurrently with reads or writes.
+func (rc *Conn) SetOptions(readTimeLimitMs int64, log bool) {
+	rc.readTimeLimitMs = readTimeLimitMs
+	rc.log = log
+}
+
 func (rc *Conn) RemoteAddr() net.Addr {
 	return rc.raw.RemoteAddr()
 }
 
 func (rc *Conn) Authenticate(pass string) error {
-	resp, err := rc.Call(MsgFromStrings("AUTH", pass))
+	return rc.AuthenticateUser("", pass)
+}
+
+// AuthenticateUser sends "AUTH user pass" (Redis 6 ACL), or "AUTH
+// pass" if user is empty.
+func (rc *Conn) AuthenticateUser(user, pass string) error {
+	req := MsgFromStrings("AUTH", pass)
+	if user != "" {
+		req = MsgFromStrings("AUTH", user, pass)
+	}
+	resp, err := rc.Call(req)
 	if err != nil {
 		return err
 	}
@@ -168,6 +252,20 @@ func (rc *Conn) Select(db int) error {
 	return nil
 }
 
+// Hello switches the connection to the given protocol version.
+func (rc *Conn) Hello(proto int) error {
+	resp, err := rc.Call(MsgFromStrings("HELLO", strconv.Itoa(proto)))
+	if err != nil {
+		return err
+	}
+	if resp.IsError() {
+		return fmt.Errorf(
+			"HELLO error: Redis responded with '%s'",
+			resp.String())
+	}
+	return nil
+}
+
 func (rc *Conn) logMessage(inbound bool, data []byte) {
 	dirStr := "<"
 	if inbound {
@@ -2,7 +2,9 @@ package resp
 
 import (
 	"bytes"
+	"fmt"
 	"strconv"
+	"strings"
 
 	"redisgreen.net/respio"
 )
@@ -13,6 +15,14 @@ const (
 	MsgOpUnchecked = MessageOp(iota)
 	MsgOpAuth
 	MsgOpSelect
+	MsgOpMulti
+	MsgOpExec
+	MsgOpDiscard
+	MsgOpWatch
+	MsgOpUnwatch
+	MsgOpSubscribe
+	MsgOpUnsubscribe
+	MsgOpHello
 	MsgOpBroken
 	MsgOpOther
 )
@@ -21,6 +31,14 @@ var msgOps = [...]string{
 	"unchecked",
 	"auth",
 	"select",
+	"multi",
+	"exec",
+	"discard",
+	"watch",
+	"unwatch",
+	"subscribe",
+	"unsubscribe",
+	"hello",
 	"-broken-",
 	"-other-",
 }
@@ -29,12 +47,30 @@ func (m MessageOp) String() string {
 	return msgOps[m]
 }
 
-var msgPrefixMap = []struct {
-	prefix []byte
+// Commands recognised by the proxy, with the number of arguments they
+// take (-1: any number).  Commands with a different number of
+// arguments are treated as MsgOpOther and left for Redis to deal
+// with.
+var msgCommandMap = map[string]struct {
 	op     MessageOp
+	argCnt int
 }{
-	{[]byte("*2\r\n$4\r\nAUTH\r\n$"), MsgOpAuth},
-	{[]byte("*2\r\n$6\r\nSELECT\r\n$"), MsgOpSelect},
+	"AUTH":    {MsgOpAuth, 1},
+	"SELECT":  {MsgOpSelect, 1},
+	"MULTI":   {MsgOpMulti, 0},
+	"EXEC":    {MsgOpExec, 0},
+	"DISCARD": {MsgOpDiscard, 0},
+	"WATCH":   {MsgOpWatch, -1},
+	"UNWATCH": {MsgOpUnwatch, 0},
+
+	"SUBSCRIBE":    {MsgOpSubscribe, -1},
+	"PSUBSCRIBE":   {MsgOpSubscribe, -1},
+	"SSUBSCRIBE":   {MsgOpSubscribe, -1},
+	"UNSUBSCRIBE":  {MsgOpUnsubscribe, -1},
+	"PUNSUBSCRIBE": {MsgOpUnsubscribe, -1},
+	"SUNSUBSCRIBE": {MsgOpUnsubscribe, -1},
+
+	"HELLO": {MsgOpHello, -1},
 }
 
 var (
@@ -43,14 +79,24 @@ var (
 	MsgInvalidPass   = []byte("-ERR invalid password\r\n")
 	MsgNoPasswordSet = []byte("-ERR Client sent AUTH, but no password is set\r\n")
 	MsgParseError    = []byte("-ERR Command parse error (redis-proxy)\r\n")
+	MsgQueued        = []byte("+QUEUED\r\n")
+	MsgWrongPass     = []byte("-WRONGPASS invalid username-password pair or user is disabled.\r\n")
+	MsgNoProto       = []byte("-NOPROTO unsupported protocol version\r\n")
+	MsgNoAuthHello   = []byte("-NOAUTH HELLO must be called with the client already authenticated, " +
+		"otherwise the HELLO <proto> AUTH <user> <pass> option can be used to authenticate " +
+		"the client and select the RESP protocol version at the same time\r\n")
 )
 
 type Msg struct {
 	data []byte
 
 	op          MessageOp
+	command     string
 	firstArg    string
 	firstArgInt int
+
+	args       []string
+	argsParsed bool
 }
 
 func NewMsg(data []byte) *Msg {
@@ -86,6 +132,49 @@ func (m *Msg) Op() MessageOp {
 	return m.op
 }
 
+// Command returns the name of the command (upper case), or an empty
+// string if the message is not a command.
+func (m *Msg) Command() string {
+	m.analyse()
+	return m.command
+}
+
+// Args returns all arguments of the command (excluding its name), or
+// nil if the message is not a well-formed command.
+func (m *Msg) Args() []string {
+	if m.argsParsed {
+		return m.args
+	}
+	m.argsParsed = true
+
+	argCnt, rest, ok := readHeader(m.data, '*')
+	if !ok || argCnt < 1 {
+		return nil
+	}
+	args := make([]string, 0, argCnt)
+	for i := 0; i < argCnt; i++ {
+		var arg []byte
+		arg, rest, ok = readBulkString(rest)
+		if !ok {
+			return nil
+		}
+		args = append(args, string(arg))
+	}
+	m.args = args[1:]
+	return m.args
+}
+
+// SetCommand replaces the name of the command, keeping its
+// arguments.
+func (m *Msg) SetCommand(name string) {
+	*m = *MsgFromStrings(append([]string{name}, m.Args()...)...)
+}
+
+// SetArgs replaces arguments of the command, keeping its name.
+func (m *Msg) SetArgs(args []string) {
+	*m = *MsgFromStrings(append([]string{m.Command()}, args...)...)
+}
+
 func (m *Msg) FirstArg() string {
 	return m.firstArg
 }
@@ -98,32 +187,60 @@ func (m *Msg) IsOk() bool {
 	return bytes.Equal(m.data, MsgOk)
 }
 
+func (m *Msg) IsQueued() bool {
+	return bytes.Equal(m.data, MsgQueued)
+}
+
+// IsError is true for error replies (simple and RESP3 blob errors).
+func (m *Msg) IsError() bool {
+	return len(m.data) > 0 && (m.data[0] == typeError || m.data[0] == typeBlobError)
+}
+
+// IsNil is true for nil bulk strings, nil arrays and RESP3 null.
+func (m *Msg) IsNil() bool {
+	return bytes.Equal(m.data, []byte("$-1\r\n")) || bytes.Equal(m.data, []byte("*-1\r\n")) ||
+		bytes.Equal(m.data, []byte("_\r\n"))
+}
+
+// IsPush is true for RESP3 push messages (e.g. Pub/Sub messages).
+func (m *Msg) IsPush() bool {
+	return len(m.data) > 0 && m.data[0] == typePush
+}
+
+// IsArray is true for non-nil arrays (e.g. successful EXEC reply).
+func (m *Msg) IsArray() bool {
+	return len(m.data) > 0 && m.data[0] == '*' && !bytes.HasPrefix(m.data, []byte("*-1\r\n"))
+}
+
 func (m *Msg) analyse() {
 	if m.op != MsgOpUnchecked {
 		return
 	}
 
 	m.op = MsgOpOther
-	for _, def := range msgPrefixMap {
-		if len(def.prefix) > len(m.data) {
-			continue
-		}
-		if bytes.EqualFold(def.prefix, m.data[:len(def.prefix)]) {
-			m.op = def.op
-
-			suff := m.data[len(def.prefix):]
-			end := bytes.IndexByte(suff, '\r')
-			if end == -1 {
-				m.op = MsgOpBroken
-				return
-			}
-			n, err := strconv.Atoi(string(suff[:end]))
-			if err != nil {
-				m.op = MsgOpBroken
-				return
-			}
-			m.firstArg = string(suff[end+2 : end+2+n])
+	argCnt, rest, ok := readHeader(m.data, '*')
+	if !ok || argCnt < 1 {
+		return
+	}
+	name, rest, ok := readBulkString(rest)
+	if !ok {
+		return
+	}
+	m.command = strings.ToUpper(string(name))
+
+	def, known := msgCommandMap[m.command]
+	if !known || (def.argCnt != -1 && def.argCnt != argCnt-1) {
+		return
+	}
+	m.op = def.op
+
+	if def.argCnt == 1 {
+		arg, _, ok := readBulkString(rest)
+		if !ok {
+			m.op = MsgOpBroken
+			return
 		}
+		m.firstArg = string(arg)
 	}
 
 	if m.op == MsgOpSelect {
@@ -135,3 +252,153 @@ func (m *Msg) analyse() {
 		}
 	}
 }
+
+// readHeader parses "<prefix><number>\r\n" at the beginning of data.
+func readHeader(data []byte, prefix byte) (int, []byte, bool) {
+	if len(data) == 0 || data[0] != prefix {
+		return 0, nil, false
+	}
+	end := bytes.Index(data, []byte("\r\n"))
+	if end == -1 {
+		return 0, nil, false
+	}
+	n, err := strconv.Atoi(string(data[1:end]))
+	if err != nil {
+		return 0, nil, false
+	}
+	return n, data[end+2:], true
+}
+
+// readBulkString parses "$<len>\r\n<content>\r\n" at the beginning of
+// data, returns content and remaining part of data.
+func readBulkString(data []byte) ([]byte, []byte, bool) {
+	n, rest, ok := readHeader(data, '$')
+	if !ok || n < 0 || len(rest) < n+2 {
+		return nil, nil, false
+	}
+	if rest[n] != '\r' || rest[n+1] != '\n' {
+		return nil, nil, false
+	}
+	return rest[:n], rest[n+2:], true
+}
+
+////////////////////
+// Reply analysis.
+
+// Elements splits an array (or RESP3 set, push message or map) into
+// separate messages, one per element (for maps: keys and values in
+// turn).  Returns nil if the message is not an aggregate.
+func (m *Msg) Elements() []*Msg {
+	if len(m.data) == 0 {
+		return nil
+	}
+	prefix := m.data[0]
+	switch prefix {
+	case typeArray, typeSet, typePush, typeMap:
+	default:
+		return nil
+	}
+	n, rest, ok := readHeader(m.data, prefix)
+	if !ok || n < 0 {
+		return nil
+	}
+	if prefix == typeMap {
+		n *= 2
+	}
+	res := make([]*Msg, 0, n)
+	for i := 0; i < n; i++ {
+		l, ok := objectLen(rest)
+		if !ok {
+			return nil
+		}
+		res = append(res, &Msg{data: rest[:l]})
+		rest = rest[l:]
+	}
+	return res
+}
+
+// WithElements returns an aggregate of the same type (array, set,
+// push message or map) as m, with different elements.
+func (m *Msg) WithElements(elems []*Msg) *Msg {
+	n := len(elems)
+	if m.data[0] == typeMap {
+		n /= 2
+	}
+	buf := new(bytes.Buffer)
+	fmt.Fprintf(buf, "%c%d\r\n", m.data[0], n)
+	for _, elem := range elems {
+		buf.Write(elem.data)
+	}
+	return &Msg{data: buf.Bytes()}
+}
+
+// NewBulkString returns a bulk string reply.
+func NewBulkString(s string) *Msg {
+	return &Msg{data: []byte(fmt.Sprintf("$%d\r\n%s\r\n", len(s), s))}
+}
+
+// Str returns content of a simple or bulk string.
+func (m *Msg) Str() (string, bool) {
+	if len(m.data) > 0 && m.data[0] == '+' {
+		return string(bytes.TrimSuffix(m.data[1:], []byte("\r\n"))), true
+	}
+	s, _, ok := readBulkString(m.data)
+	return string(s), ok
+}
+
+// Int returns value of an integer reply.
+func (m *Msg) Int() (int64, bool) {
+	n, rest, ok := readHeader(m.data, ':')
+	return int64(n), ok && len(rest) == 0
+}
+
+// objectLen returns length of the first RESP object in data.
+func objectLen(data []byte) (int, bool) {
+	if len(data) == 0 {
+		return 0, false
+	}
+	switch data[0] {
+	case typeSimpleString, typeError, typeInteger, typeNull, typeDouble, typeBoolean, typeBigNumber:
+		end := bytes.Index(data, []byte("\r\n"))
+		if end == -1 {
+			return 0, false
+		}
+		return end + 2, true
+	case typeBulkString, typeBlobError, typeVerbatim:
+		n, rest, ok := readHeader(data, data[0])
+		if !ok {
+			return 0, false
+		}
+		headerLen := len(data) - len(rest)
+		if n < 0 {
+			return headerLen, true
+		}
+		if len(rest) < n+2 {
+			return 0, false
+		}
+		return headerLen + n + 2, true
+	case typeArray, typeSet, typePush, typeMap, typeAttribute:
+		n, rest, ok := readHeader(data, data[0])
+		if !ok {
+			return 0, false
+		}
+		if data[0] == typeMap || data[0] == typeAttribute {
+			n *= 2
+		}
+		if data[0] == typeAttribute {
+			// Attributes precede the actual object.
+			n++
+		}
+		total := len(data) - len(rest)
+		for i := 0; i < n; i++ {
+			l, ok := objectLen(rest)
+			if !ok {
+				return 0, false
+			}
+			total += l
+			rest = rest[l:]
+		}
+		return total, true
+	}
+	return 0, false
+}
@@ -2,6 +2,7 @@ package resp
 
 import (
 	"testing"
+	"time"
 
 	"github.com/stvp/assert"
 )
@@ -34,8 +35,120 @@ func TestAnalysis(t *testing.T) {
 	assert.Equal(t, mSelectBroken.FirstArg(), "")
 }
 
+func TestTransactionAnalysis(t *testing.T) {
+	assert.Equal(t, msg("*1\r\n$5\r\nMULTI\r\n").Op(), MsgOpMulti)
+	assert.Equal(t, msg("*1\r\n$5\r\nmulti\r\n").Op(), MsgOpMulti)
+	assert.Equal(t, msg("*1\r\n$4\r\nEXEC\r\n").Op(), MsgOpExec)
+	assert.Equal(t, msg("*1\r\n$7\r\nDISCARD\r\n").Op(), MsgOpDiscard)
+	assert.Equal(t, msg("*1\r\n$7\r\nUNWATCH\r\n").Op(), MsgOpUnwatch)
+	assert.Equal(t, msg("*2\r\n$5\r\nWATCH\r\n$1\r\na\r\n").Op(), MsgOpWatch)
+	assert.Equal(t, msg("*3\r\n$5\r\nWATCH\r\n$1\r\na\r\n$1\r\nb\r\n").Op(), MsgOpWatch)
+
+	// wrong number of arguments: let Redis complain
+	assert.Equal(t, msg("*2\r\n$5\r\nMULTI\r\n$1\r\na\r\n").Op(), MsgOpOther)
+
+	assert.Equal(t, msg("*2\r\n$3\r\nGET\r\n$1\r\na\r\n").Command(), "GET")
+	assert.Equal(t, msg("+OK\r\n").Command(), "")
+}
+
 func TestHelpers(t *testing.T) {
 	assert.True(t, msg("+OK\r\n").IsOk())
 	assert.False(t, msg("+OK\r").IsOk())
 	assert.False(t, msg("-ERR some error\r\n").IsOk())
+
+	assert.True(t, msg("+QUEUED\r\n").IsQueued())
+	assert.True(t, msg("*1\r\n+OK\r\n").IsArray())
+	assert.False(t, msg("*-1\r\n").IsArray())
+	assert.False(t, msg("-EXECABORT\r\n").IsArray())
+}
+
+func TestArgs(t *testing.T) {
+	assert.Equal(t, msg("*3\r\n$9\r\nSUBSCRIBE\r\n$1\r\na\r\n$2\r\nbc\r\n").Args(), []string{"a", "bc"})
+	assert.Equal(t, msg("*1\r\n$11\r\nUNSUBSCRIBE\r\n").Args(), []string{})
+	assert.Nil(t, msg("*2\r\n$3\r\nGET\r\n$1\r\n").Args())
+	assert.Nil(t, msg("+OK\r\n").Args())
+
+	assert.Equal(t, msg("*2\r\n$9\r\nSUBSCRIBE\r\n$1\r\na\r\n").Op(), MsgOpSubscribe)
+	assert.Equal(t, msg("*1\r\n$12\r\nPUNSUBSCRIBE\r\n").Op(), MsgOpUnsubscribe)
+}
+
+func TestElements(t *testing.T) {
+	elements := msg("*4\r\n$8\r\npmessage\r\n$-1\r\n:3\r\n*1\r\n+OK\r\n").Elements()
+	assert.Equal(t, len(elements), 4)
+
+	s, ok := elements[0].Str()
+	assert.True(t, ok)
+	assert.Equal(t, s, "pmessage")
+	assert.True(t, elements[1].IsNil())
+	n, ok := elements[2].Int()
+	assert.True(t, ok)
+	assert.Equal(t, n, int64(3))
+	assert.Equal(t, elements[3].String(), "*1\r\n+OK\r\n")
+
+	assert.Nil(t, msg("$2\r\nab\r\n").Elements())
+	assert.Nil(t, msg("*2\r\n$2\r\nab\r\n").Elements())
+}
+
+func TestBlockingTimeout(t *testing.T) {
+	check := func(m *Msg, expTimeout time.Duration, expOk bool) {
+		timeout, ok := m.BlockingTimeout()
+		assert.Equal(t, ok, expOk)
+		assert.Equal(t, timeout, expTimeout)
+	}
+
+	check(MsgFromStrings("BLPOP", "a", "b", "5"), 5*time.Second, true)
+	check(MsgFromStrings("blpop", "a", "0.5"), 500*time.Millisecond, true)
+	check(MsgFromStrings("BRPOPLPUSH", "a", "b", "0"), 0, true)
+	check(MsgFromStrings("BLMPOP", "2", "2", "a", "b", "LEFT"), 2*time.Second, true)
+	check(MsgFromStrings("XREAD", "COUNT", "2", "BLOCK", "100", "STREAMS", "s", "$"), 100*time.Millisecond, true)
+	check(MsgFromStrings("WAIT", "1", "250"), 250*time.Millisecond, true)
+
+	check(MsgFromStrings("XREAD", "STREAMS", "BLOCK", "0"), 0, false)
+	check(MsgFromStrings("BLPOP", "a", "-1"), 0, false)
+	check(MsgFromStrings("BLPOP", "a", "x"), 0, false)
+	check(MsgFromStrings("GET", "a"), 0, false)
+
+	assert.True(t, MsgFromStrings("BLPOP", "a", "5").WithBlockingTimeout(1500*time.Millisecond).Equal(
+		MsgFromStrings("BLPOP", "a", "2")))
+	assert.True(t, MsgFromStrings("BLPOP", "a", "0.5").WithBlockingTimeout(250*time.Millisecond).Equal(
+		MsgFromStrings("BLPOP", "a", "0.25")))
+	assert.True(t, MsgFromStrings("XREAD", "BLOCK", "1000", "STREAMS", "s", "$").WithBlockingTimeout(300*time.Millisecond).Equal(
+		MsgFromStrings("XREAD", "BLOCK", "300", "STREAMS", "s", "$")))
+}
+
+func TestIsReadOnly(t *testing.T) {
+	assert.True(t, MsgFromStrings("GET", "a").IsReadOnly())
+	assert.True(t, MsgFromStrings("hgetall", "a").IsReadOnly())
+	assert.True(t, MsgFromStrings("XREAD", "STREAMS", "s", "0").IsReadOnly())
+
+	assert.False(t, MsgFromStrings("SET", "a", "1").IsReadOnly())
+	assert.False(t, MsgFromStrings("EVAL_RO", "return 1", "0").IsReadOnly())
+	assert.False(t, MsgFromStrings("XREAD", "BLOCK", "0", "STREAMS", "s", "$").IsReadOnly())
+	assert.False(t, MsgFromStrings("SELECT", "1").IsReadOnly())
+}
+
+func TestSetCommand(t *testing.T) {
+	msg := MsgFromStrings("admin-flushall", "ASYNC")
+	assert.Equal(t, msg.Command(), "ADMIN-FLUSHALL")
+	msg.SetCommand("FLUSHALL")
+	assert.Equal(t, msg.Command(), "FLUSHALL")
+	assert.Equal(t, msg.Args(), []string{"ASYNC"})
+	assert.True(t, msg.Equal(MsgFromStrings("FLUSHALL", "ASYNC")))
+}
+
+func TestWithElements(t *testing.T) {
+	arr := NewMsg([]byte("*2\r\n$1\r\na\r\n:1\r\n"))
+	elems := arr.Elements()
+	elems[0] = NewBulkString("bc")
+	assert.Equal(t, arr.WithElements(elems).String(), "*2\r\n$2\r\nbc\r\n:1\r\n")
+
+	m := NewMsg([]byte("%1\r\n$1\r\nk\r\n$1\r\nv\r\n"))
+	assert.Equal(t, m.WithElements(m.Elements()).String(), m.String())
+}
+
+func TestKeysKnown(t *testing.T) {
+	assert.True(t, MsgFromStrings("GET", "a").KeysKnown())
+	assert.True(t, MsgFromStrings("PING").KeysKnown())
+	assert.False(t, MsgFromStrings("NEWCOMMAND", "a").KeysKnown())
+	assert.Equal(t, MsgFromStrings("MEMORY", "USAGE", "a").Keys(), []string{"a"})
 }
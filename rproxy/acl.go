@@ -0,0 +1,409 @@
+package rproxy
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/hex"
+	"fmt"
+	"strings"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/Codility/redis-proxy/resp"
+)
+
+// Users
+//
+// With `users` configured, clients authenticate with "AUTH <user>
+// <pass>" (or HELLO ... AUTH), and the proxy checks every request
+// against the user's permissions before it reaches uplink:
+//
+//  - `commands`: command names ("GET"), subcommands ("CLIENT|SETNAME"),
+//    or "*" for all commands.  Entries starting with "-" deny, and win
+//    over entries that allow.
+//  - `keys`: glob patterns (as in Redis: *, ?, [...], \) all keys of a
+//    request must match, "*" for all keys.  Users without "*" can't
+//    run commands whose keys the proxy doesn't know (including KEYS,
+//    SCAN and RANDOMKEY), nor scripts and functions (EVAL, FCALL,
+//    SCRIPT, FUNCTION...), which can reach any key from inside.
+//
+// Passwords are stored as bcrypt hashes ("$2a$...") or hex-encoded
+// SHA-256 digests.  Users with `cert_names` can log in with a client
+// certificate instead (see client_certs.go).  Users are off unless
+// `enabled`.  "AUTH <pass>" means user "default"; without such entry
+// in `users`, the default user is the one with `listen.pass` and no
+// restrictions.
+//
+// Users can be changed with RELOAD: existing connections keep their
+// user, and get the new permissions with their next request.  Clients
+// whose user got removed or disabled have to authenticate again.
+// Pub/Sub channels are not restricted.
+//
+// With `uplink_user` set, connections of the user's clients to uplink
+// (and to cluster nodes, shards and replicas) authenticate as that
+// Redis ACL user, with `uplink_pass`, instead of with `uplink.user`
+// and `uplink.pass`, so Redis logs and CLIENT LIST show who is
+// calling.  Such clients don't use the connection pool.  Their Redis
+// users need CLIENT ID and CLIENT UNBLOCK for blocking commands to
+// let PAUSE through.
+
+const DefaultUser = "default"
+
+var MsgNoKeyPermissions = []byte("-NOPERM No permissions to access a key\r\n")
+
+// Commands that run scripts or functions (or manage them).  Their
+// declared keys say nothing about what the code accesses.
+var scriptCommands = map[string]bool{
+	"EVAL": true, "EVALSHA": true, "EVAL_RO": true, "EVALSHA_RO": true,
+	"FCALL": true, "FCALL_RO": true, "SCRIPT": true, "FUNCTION": true,
+}
+
+type UserConfig struct {
+	Name         string   `json:"name"`
+	PasswordHash string   `json:"password_hash"`
+	Enabled      bool     `json:"enabled"`
+	Commands     []string `json:"commands"`
+	Keys         []string `json:"keys"`
+	UplinkUser   string   `json:"uplink_user,omitempty"`
+	UplinkPass   string   `json:"uplink_pass,omitempty"`
+	Namespace    string   `json:"namespace,omitempty"`
+	CertNames    []string `json:"cert_names,omitempty"` // log in with a client certificate
+
+	RequestsPerSec float64 `json:"requests_per_sec,omitempty"`
+	BytesPerSec    float64 `json:"bytes_per_sec,omitempty"`
+
+	allCommands bool
+	allKeys     bool
+	allowed     map[string]bool
+	denied      map[string]bool
+}
+
+func (u *UserConfig) Prepare(name string) ErrorList {
+	errList := ErrorList{}
+	if u.Name == "" {
+		errList.Add(name + ": name is required")
+	}
+	certOnly := u.PasswordHash == "" && len(u.CertNames) > 0
+	if !certOnly && !isBcryptHash(u.PasswordHash) && !isSha256Hash(u.PasswordHash) {
+		errList.Add(name + ": password_hash must be a bcrypt hash or a hex-encoded SHA-256 digest")
+	}
+
+	u.allCommands = false
+	u.allowed = map[string]bool{}
+	u.denied = map[string]bool{}
+	for _, cmd := range u.Commands {
+		cmd = strings.ToUpper(strings.TrimSpace(cmd))
+		switch {
+		case cmd == "*":
+			u.allCommands = true
+		case strings.HasPrefix(cmd, "-") && len(cmd) > 1:
+			u.denied[cmd[1:]] = true
+		case cmd != "" && !strings.HasPrefix(cmd, "-"):
+			u.allowed[cmd] = true
+		default:
+			errList.Add(fmt.Sprintf("%s: invalid command entry '%s'", name, cmd))
+		}
+	}
+	errList.Append(validNamespace(name+".namespace", u.Namespace))
+	if u.RequestsPerSec < 0 || u.BytesPerSec < 0 {
+		errList.Add(name + ": rate limits must not be negative")
+	}
+	if u.UplinkPass != "" && u.UplinkUser == "" {
+		errList.Add(name + ": uplink_pass requires uplink_user")
+	}
+	u.allKeys = false
+	for _, pattern := range u.Keys {
+		u.allKeys = u.allKeys || pattern == "*"
+		if !validGlob(pattern) {
+			errList.Add(fmt.Sprintf("%s: invalid key pattern '%s'", name, pattern))
+		}
+	}
+	return errList
+}
+
+func (u *UserConfig) SanitizedForPublication() *UserConfig {
+	res := *u
+	if res.PasswordHash != "" {
+		res.PasswordHash = SanitizedPass
+	}
+	if res.UplinkPass != "" {
+		res.UplinkPass = SanitizedPass
+	}
+	return &res
+}
+
+func isBcryptHash(hash string) bool {
+	_, err := bcrypt.Cost([]byte(hash))
+	return err == nil
+}
+
+func isSha256Hash(hash string) bool {
+	digest, err := hex.DecodeString(hash)
+	return err == nil && len(digest) == sha256.Size
+}
+
+func (u *UserConfig) CheckPassword(pass string) bool {
+	if u.PasswordHash == "" {
+		return false
+	}
+	if isBcryptHash(u.PasswordHash) {
+		return bcrypt.CompareHashAndPassword([]byte(u.PasswordHash), []byte(pass)) == nil
+	}
+	digest := sha256.Sum256([]byte(pass))
+	expected, _ := hex.DecodeString(u.PasswordHash)
+	return subtle.ConstantTimeCompare(digest[:], expected) == 1
+}
+
+// Check returns an error reply if the user may not run req.
+func (u *UserConfig) Check(req *resp.Msg) []byte {
+	cmd := req.Command()
+	names := []string{cmd}
+	if args := req.Args(); len(args) > 0 {
+		names = append(names, cmd+"|"+strings.ToUpper(args[0]))
+	}
+
+	allowed := u.allCommands
+	for _, name := range names {
+		if u.denied[name] {
+			allowed = false
+			break
+		}
+		allowed = allowed || u.allowed[name]
+	}
+	if !allowed {
+		return []byte(fmt.Sprintf("-NOPERM User %s has no permissions to run the '%s' command\r\n",
+			u.Name, strings.ToLower(cmd)))
+	}
+
+	if u.allKeys {
+		return nil
+	}
+	if !req.KeysKnown() || scriptCommands[cmd] {
+		return MsgNoKeyPermissions
+	}
+	for _, key := range req.Keys() {
+		if !u.mayAccess(key) {
+			return MsgNoKeyPermissions
+		}
+	}
+	return nil
+}
+
+func (u *UserConfig) mayAccess(key string) bool {
+	for _, pattern := range u.Keys {
+		if globMatch(pattern, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// User returns the enabled user with the given name, or nil.
+func (c *Config) User(name string) *UserConfig {
+	for i := range c.Users {
+		if c.Users[i].Name == name && c.Users[i].Enabled {
+			return &c.Users[i]
+		}
+	}
+	return nil
+}
+
+func (c *Config) prepareUsers() ErrorList {
+	errList := ErrorList{}
+	names := map[string]bool{}
+	for i := range c.Users {
+		user := &c.Users[i]
+		errList.Append(user.Prepare(fmt.Sprintf("users[%d]", i)))
+		if names[user.Name] {
+			errList.Add(fmt.Sprintf("users[%d]: duplicate name '%s'", i, user.Name))
+		}
+		names[user.Name] = true
+		if len(user.CertNames) > 0 && c.Listen.ClientAuth == "" {
+			errList.AddWarning(fmt.Sprintf("users[%d].cert_names has no effect without listen.client_auth", i))
+		}
+	}
+	return errList
+}
+
+////////////////////////////////////////
+// ClientHandler: authentication
+
+// authenticate checks credentials, and on success makes user the
+// client's user.
+func (ch *ClientHandler) authenticate(user, pass string) bool {
+	config := ch.proxy.config
+	ok := false
+	if u := config.User(user); u != nil {
+		ok = u.CheckPassword(pass)
+	} else if user == DefaultUser && config.Listen.Pass != "" {
+		ok = pass == config.Listen.Pass
+	}
+
+	ch.cliAuthenticated = ok
+	ch.certLogin = nil
+	if ok {
+		ch.userName = user
+		ch.proxy.clients.SetUser(ch.client, user)
+	}
+	return ok
+}
+
+func isAuthWithUser(req *resp.Msg) bool {
+	return req.Command() == "AUTH" && len(req.Args()) == 2
+}
+
+// handleAuth handles "AUTH <pass>" and "AUTH <user> <pass>".
+func (ch *ClientHandler) handleAuth(req *resp.Msg) []byte {
+	if req.Op() == resp.MsgOpAuth {
+		if !ch.proxy.RequiresClientAuth() {
+			return resp.MsgNoPasswordSet
+		}
+		if ch.authenticate(DefaultUser, req.FirstArg()) {
+			return resp.MsgOk
+		}
+		return resp.MsgInvalidPass
+	}
+
+	args := req.Args()
+	if !ch.proxy.RequiresClientAuth() && args[0] == DefaultUser {
+		return resp.MsgOk
+	}
+	if ch.authenticate(args[0], args[1]) {
+		return resp.MsgOk
+	}
+	return resp.MsgWrongPass
+}
+
+// checkPermissions returns an error reply if the client's user may
+// not run req.
+func (ch *ClientHandler) checkPermissions(req *resp.Msg) []byte {
+	if !ch.cliAuthenticated {
+		return nil
+	}
+	config := ch.proxy.config
+	if !ch.certLoginValid(config) {
+		// cert_names changed by RELOAD.
+		ch.cliAuthenticated = false
+		ch.certLogin = nil
+		ch.proxy.clients.SetUser(ch.client, "")
+		return resp.MsgNoAuth
+	}
+	user := config.User(ch.userName)
+	if user == nil {
+		if ch.userName == DefaultUser && config.Listen.Pass != "" {
+			return nil
+		}
+		// Removed or disabled by RELOAD.
+		ch.cliAuthenticated = false
+		return resp.MsgNoAuth
+	}
+	return user.Check(req)
+}
+
+// uplinkCredentials returns the client's user if it has its own
+// uplink credentials, or nil.
+func (ch *ClientHandler) uplinkCredentials(config *Config) *UserConfig {
+	if !ch.cliAuthenticated {
+		return nil
+	}
+	if user := config.User(ch.userName); user != nil && user.UplinkUser != "" {
+		return user
+	}
+	return nil
+}
+
+// withUplinkCredentials returns spec of a Redis server to connect to
+// on behalf of the client.
+func (ch *ClientHandler) withUplinkCredentials(config *Config, spec AddrSpec) AddrSpec {
+	if user := ch.uplinkCredentials(config); user != nil {
+		spec.User = user.UplinkUser
+		spec.Pass = user.UplinkPass
+	}
+	return spec
+}
+
+////////////////////////////////////////
+// Glob patterns
+
+// globMatch matches s against a Redis-style glob pattern: "*", "?",
+// "[abc]", "[^a-z]" and "\" escapes.
+func globMatch(pattern, s string) bool {
+	for len(pattern) > 0 {
+		switch pattern[0] {
+		case '*':
+			for len(pattern) > 0 && pattern[0] == '*' {
+				pattern = pattern[1:]
+			}
+			if len(pattern) == 0 {
+				return true
+			}
+			for i := 0; i <= len(s); i++ {
+				if globMatch(pattern, s[i:]) {
+					return true
+				}
+			}
+			return false
+		case '?':
+			if len(s) == 0 {
+				return false
+			}
+		case '[':
+			if len(s) == 0 {
+				return false
+			}
+			end, matched := matchClass(pattern, s[0])
+			if !matched {
+				return false
+			}
+			pattern = pattern[end:]
+			s = s[1:]
+			continue
+		case '\\':
+			if len(pattern) > 1 {
+				pattern = pattern[1:]
+			}
+			fallthrough
+		default:
+			if len(s) == 0 || s[0] != pattern[0] {
+				return false
+			}
+		}
+		pattern = pattern[1:]
+		s = s[1:]
+	}
+	return len(s) == 0
+}
+
+// matchClass matches c against the "[...]" class at the beginning of
+// pattern.  Returns length of the class.
+func matchClass(pattern string, c byte) (int, bool) {
+	i := 1
+	negate := i < len(pattern) && pattern[i] == '^'
+	if negate {
+		i++
+	}
+	matched := false
+	for ; i < len(pattern) && pattern[i] != ']'; i++ {
+		if pattern[i] == '\\' && i+1 < len(pattern) {
+			i++
+			matched = matched || pattern[i] == c
+		} else if i+2 < len(pattern) && pattern[i+1] == '-' && pattern[i+2] != ']' {
+			lo, hi := pattern[i], pattern[i+2]
+			if lo > hi {
+				lo, hi = hi, lo
+			}
+			matched = matched || (lo <= c && c <= hi)
+			i += 2
+		} else {
+			matched = matched || pattern[i] == c
+		}
+	}
+	if i < len(pattern) {
+		i++ // ']'
+	}
+	return i, matched != negate
+}
+
+func validGlob(pattern string) bool {
+	return pattern != ""
+}
@@ -0,0 +1,272 @@
+package rproxy
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+
+	"github.com/Codility/redis-proxy/fakeredis"
+	"github.com/Codility/redis-proxy/resp"
+	"github.com/stvp/assert"
+)
+
+func sha256Hex(pass string) string {
+	digest := sha256.Sum256([]byte(pass))
+	return hex.EncodeToString(digest[:])
+}
+
+func TestGlobMatch(t *testing.T) {
+	for _, c := range []struct {
+		pattern, s string
+		match      bool
+	}{
+		{"*", "", true},
+		{"*", "anything", true},
+		{"user:*", "user:1", true},
+		{"user:*", "session:1", false},
+		{"user:?", "user:1", true},
+		{"user:?", "user:12", false},
+		{"*:[0-9]", "user:7", true},
+		{"*:[0-9]", "user:x", false},
+		{"*:[^0-9]", "user:x", true},
+		{"h[ae]llo", "hallo", true},
+		{"h[ae]llo", "hillo", false},
+		{"a\\*", "a*", true},
+		{"a\\*", "ab", false},
+		{"*a*b", "xaxxb", true},
+		{"*a*b", "xaxxbc", false},
+	} {
+		assert.Equal(t, globMatch(c.pattern, c.s), c.match, c.pattern+" ~ "+c.s)
+	}
+}
+
+func TestUserConfigPrepare(t *testing.T) {
+	u := UserConfig{Name: "u", PasswordHash: sha256Hex("p"), Commands: []string{"*", "-flushall", "client|setname"}}
+	errList := u.Prepare("users[0]")
+	assert.True(t, errList.Ok())
+	assert.True(t, u.allCommands)
+	assert.True(t, u.denied["FLUSHALL"])
+	assert.True(t, u.allowed["CLIENT|SETNAME"])
+
+	u = UserConfig{PasswordHash: "plain", Keys: []string{""}}
+	errList = u.Prepare("users[0]")
+	assert.Equal(t, len(errList.Errors()), 3)
+	assert.False(t, u.CheckPassword("plain"))
+}
+
+func TestProxyUsers(t *testing.T) {
+	srv := fakeredis.Start("srv-1", "tcp")
+	defer srv.Stop()
+
+	bcryptHash, err := bcrypt.GenerateFromPassword([]byte("app-pass"), bcrypt.MinCost)
+	assert.Nil(t, err)
+
+	loader := &TestConfigLoader{
+		conf: &Config{
+			Uplink: AddrSpec{Addr: srv.Addr().String()},
+			Listen: AddrSpec{Addr: "127.0.0.1:0"},
+			Users: []UserConfig{
+				{
+					Name:         "app",
+					PasswordHash: string(bcryptHash),
+					Enabled:      true,
+					Commands:     []string{"*", "-FLUSHALL", "-CLIENT|KILL"},
+					Keys:         []string{"app:*"},
+				},
+				{
+					Name:         "ro",
+					PasswordHash: sha256Hex("ro-pass"),
+					Enabled:      true,
+					Commands:     []string{"GET", "MGET", "HELLO"},
+					Keys:         []string{"*"},
+				},
+				{
+					Name:         "off",
+					PasswordHash: sha256Hex("off-pass"),
+					Commands:     []string{"*"},
+					Keys:         []string{"*"},
+				},
+			},
+		},
+	}
+	proxy := mustStartTestProxy(t, loader)
+	defer proxy.Stop()
+
+	c := resp.MustDial("tcp", proxy.ListenAddr().String(), 0, false)
+	defer c.Close()
+
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("GET", "app:1")).String(), string(resp.MsgNoAuth))
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("AUTH", "app", "wrong")).String(), string(resp.MsgWrongPass))
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("AUTH", "off", "off-pass")).String(), string(resp.MsgWrongPass))
+	// No default user
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("AUTH", "app-pass")).String(), string(resp.MsgInvalidPass))
+
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("AUTH", "app", "app-pass")).String(), "+OK\r\n")
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("GET", "app:1")).String(), "$5\r\nsrv-1\r\n")
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("GET", "other:1")).String(),
+		"-NOPERM No permissions to access a key\r\n")
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("MGET", "app:1", "other:1")).String(),
+		"-NOPERM No permissions to access a key\r\n")
+	for _, req := range [][]string{
+		{"BITOP", "AND", "app:dst", "other:1"},
+		{"LCS", "app:1", "other:1"},
+		{"GEORADIUS", "app:geo", "1", "2", "3", "km", "STORE", "other:1"},
+		{"GEORADIUSBYMEMBER", "app:geo", "m", "3", "km", "STOREDIST", "other:1"},
+		{"MIGRATE", "host", "6379", "", "0", "1000", "KEYS", "app:1", "other:1"},
+		{"SORT", "app:list", "STORE", "other:1"},
+		{"SORT", "app:list", "BY", "other:*"},
+		{"SORT_RO", "app:list", "GET", "other:*->f"},
+		{"KEYS", "*"},
+		{"SCAN", "0"},
+		{"FOO.BAR", "app:1"},
+		{"EVAL", "return redis.call('GET','other:secret')", "0"},
+		{"EVAL", "return 1", "1", "app:1"},
+		{"EVALSHA_RO", "abc", "0"},
+		{"FCALL", "f", "1", "app:1"},
+		{"SCRIPT", "LOAD", "return 1"},
+		{"FUNCTION", "FLUSH"},
+	} {
+		assert.Equal(t, c.MustCall(resp.MsgFromStrings(req...)).String(),
+			"-NOPERM No permissions to access a key\r\n", req)
+	}
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("SORT", "app:list", "BY", "app:w_*", "GET", "#", "STORE", "app:dst")).String(),
+		"$5\r\nsrv-1\r\n")
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("FLUSHALL")).String(),
+		"-NOPERM User app has no permissions to run the 'flushall' command\r\n")
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("CLIENT", "KILL", "ID", "1")).String(),
+		"-NOPERM User app has no permissions to run the 'client' command\r\n")
+
+	// HELLO AUTH switches user
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("HELLO", "2", "AUTH", "ro", "ro-pass")).String(),
+		"*4\r\n$6\r\nserver\r\n$5\r\nsrv-1\r\n$5\r\nproto\r\n:2\r\n")
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("GET", "other:1")).String(), "$5\r\nsrv-1\r\n")
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("SET", "other:1", "v")).String(),
+		"-NOPERM User ro has no permissions to run the 'set' command\r\n")
+}
+
+func TestProxyUsersReload(t *testing.T) {
+	srv := fakeredis.Start("srv-1", "tcp")
+	defer srv.Stop()
+
+	user := UserConfig{
+		Name:         "app",
+		PasswordHash: sha256Hex("app-pass"),
+		Enabled:      true,
+		Commands:     []string{"GET"},
+		Keys:         []string{"*"},
+	}
+	loader := &TestConfigLoader{
+		conf: &Config{
+			Uplink: AddrSpec{Addr: srv.Addr().String()},
+			Listen: AddrSpec{Addr: "127.0.0.1:0", Pass: "secret"},
+			Users:  []UserConfig{user},
+		},
+	}
+	proxy := mustStartTestProxy(t, loader)
+	defer proxy.Stop()
+
+	app := resp.MustDial("tcp", proxy.ListenAddr().String(), 0, false)
+	defer app.Close()
+	def := resp.MustDial("tcp", proxy.ListenAddr().String(), 0, false)
+	defer def.Close()
+
+	assert.Equal(t, app.MustCall(resp.MsgFromStrings("AUTH", "app", "app-pass")).String(), "+OK\r\n")
+	assert.Equal(t, app.MustCall(resp.MsgFromStrings("SET", "k", "v")).String(),
+		"-NOPERM User app has no permissions to run the 'set' command\r\n")
+	// listen.pass is the password of the unrestricted default user
+	assert.Equal(t, def.MustCall(resp.MsgFromStrings("AUTH", "default", "secret")).String(), "+OK\r\n")
+	assert.Equal(t, def.MustCall(resp.MsgFromStrings("SET", "k", "v")).String(), "$5\r\nsrv-1\r\n")
+
+	// New permissions apply to existing connections
+	user.Commands = []string{"GET", "SET"}
+	loader.Replace(&Config{
+		Uplink: AddrSpec{Addr: srv.Addr().String()},
+		Listen: AddrSpec{Addr: "127.0.0.1:0", Pass: "secret"},
+		Users:  []UserConfig{user},
+	})
+	assert.Nil(t, proxy.Reload())
+	assert.Equal(t, app.MustCall(resp.MsgFromStrings("SET", "k", "v")).String(), "$5\r\nsrv-1\r\n")
+
+	// Disabled users have to authenticate again
+	user.Enabled = false
+	loader.Replace(&Config{
+		Uplink: AddrSpec{Addr: srv.Addr().String()},
+		Listen: AddrSpec{Addr: "127.0.0.1:0", Pass: "secret"},
+		Users:  []UserConfig{user},
+	})
+	assert.Nil(t, proxy.Reload())
+	assert.Equal(t, app.MustCall(resp.MsgFromStrings("GET", "k")).String(), string(resp.MsgNoAuth))
+	assert.Equal(t, app.MustCall(resp.MsgFromStrings("GET", "k")).String(), string(resp.MsgNoAuth))
+	assert.Equal(t, def.MustCall(resp.MsgFromStrings("GET", "k")).String(), "$5\r\nsrv-1\r\n")
+}
+
+func authRequests(srv *fakeredis.FakeRedisServer) []string {
+	res := []string{}
+	for _, req := range srv.Requests() {
+		if req.Command() == "AUTH" {
+			res = append(res, req.String())
+		}
+	}
+	return res
+}
+
+func TestProxyUsersUplinkCredentials(t *testing.T) {
+	srv_1 := fakeredis.Start("srv-1", "tcp")
+	defer srv_1.Stop()
+	srv_2 := fakeredis.Start("srv-2", "tcp")
+	defer srv_2.Stop()
+
+	user := UserConfig{
+		Name:         "team-a",
+		PasswordHash: sha256Hex("a-pass"),
+		Enabled:      true,
+		Commands:     []string{"*"},
+		Keys:         []string{"*"},
+		UplinkUser:   "redis-a",
+		UplinkPass:   "redis-a-pass",
+	}
+	loader := &TestConfigLoader{
+		conf: &Config{
+			Uplink: AddrSpec{Addr: srv_1.Addr().String(), Pass: "uplink-pass"},
+			Listen: AddrSpec{Addr: "127.0.0.1:0", Pass: "secret"},
+			Users:  []UserConfig{user},
+		},
+	}
+	proxy := mustStartTestProxy(t, loader)
+	defer proxy.Stop()
+
+	c := resp.MustDial("tcp", proxy.ListenAddr().String(), 0, false)
+	defer c.Close()
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("AUTH", "secret")).String(), "+OK\r\n")
+	c.MustCall(resp.MsgFromStrings("GET", "k"))
+	assert.Equal(t, authRequests(srv_1), []string{
+		resp.MsgFromStrings("AUTH", "uplink-pass").String(),
+	})
+
+	// Switching user reconnects with the mapped credentials
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("AUTH", "team-a", "a-pass")).String(), "+OK\r\n")
+	c.MustCall(resp.MsgFromStrings("GET", "k"))
+	assert.Equal(t, authRequests(srv_1)[1], resp.MsgFromStrings("AUTH", "redis-a", "redis-a-pass").String())
+
+	// ... and keeps them on a new uplink
+	assert.Nil(t, proxy.SetUplink(AddrSpec{Addr: srv_2.Addr().String(), Pass: "uplink-pass"}))
+	c.MustCall(resp.MsgFromStrings("GET", "k"))
+	assert.Equal(t, authRequests(srv_2), []string{
+		resp.MsgFromStrings("AUTH", "redis-a", "redis-a-pass").String(),
+	})
+
+	// New credentials from RELOAD apply to the next request
+	user.UplinkPass = "rotated"
+	loader.Replace(&Config{
+		Uplink: AddrSpec{Addr: srv_2.Addr().String(), Pass: "uplink-pass"},
+		Listen: AddrSpec{Addr: "127.0.0.1:0", Pass: "secret"},
+		Users:  []UserConfig{user},
+	})
+	assert.Nil(t, proxy.Reload())
+	c.MustCall(resp.MsgFromStrings("GET", "k"))
+	assert.Equal(t, authRequests(srv_2)[1], resp.MsgFromStrings("AUTH", "redis-a", "rotated").String())
+
+	assert.Equal(t, proxy.GetConfig().SanitizedForPublication().Users[0].UplinkPass, SanitizedPass)
+}
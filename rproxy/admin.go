@@ -1,12 +1,16 @@
 package rproxy
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"html/template"
 	"log"
 	"net"
 	"net/http"
+	"strconv"
+	"sync/atomic"
+	"time"
 
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
@@ -14,8 +18,10 @@ import (
 type AdminUI struct {
 	Addr net.Addr
 
-	proxy  *Proxy
-	server *http.Server
+	proxy    *Proxy
+	server   *http.Server
+	ln       *Listener
+	retiring int32
 }
 
 func NewAdminUI(proxy *Proxy) *AdminUI {
@@ -23,29 +29,32 @@ func NewAdminUI(proxy *Proxy) *AdminUI {
 }
 
 func (a *AdminUI) Start() error {
-	config := a.proxy.GetConfig()
+	return a.start(&a.proxy.GetConfig().Admin)
+}
 
-	ln, err := config.Admin.Listen()
+func (a *AdminUI) start(spec *AddrSpec) error {
+	ln, err := spec.Listen()
 	if err != nil {
 		return err
 	}
+	a.ln = ln
 	a.Addr = ln.Addr()
 
 	proto := "http"
-	if config.Admin.TLS {
+	if spec.TLS {
 		proto = "https"
 	}
-	log.Printf("Admin URL: %s://%s/\n", proto, config.Admin.Addr)
+	log.Printf("Admin URL: %s://%s/\n", proto, spec.Addr)
 
 	a.server = &http.Server{
-		Addr:      config.Admin.Addr,
-		TLSConfig: config.Admin.GetTLSConfig(),
+		Addr:      spec.Addr,
+		TLSConfig: ln.tlsConfig,
 		Handler:   a.buildMux(),
 	}
 
 	go func() {
 		err := a.server.Serve(ln)
-		if err != http.ErrServerClosed {
+		if err != http.ErrServerClosed && atomic.LoadInt32(&a.retiring) == 0 {
 			log.Fatal("server.Serve returned error: ", err)
 		}
 	}()
@@ -57,6 +66,14 @@ func (a *AdminUI) Stop() {
 	a.server.Close()
 }
 
+// Retire closes the listener right away, but lets requests in
+// progress (like the RELOAD that retires the server) complete.
+func (a *AdminUI) Retire() {
+	atomic.StoreInt32(&a.retiring, 1)
+	a.ln.Close()
+	go a.server.Shutdown(context.Background())
+}
+
 func (a *AdminUI) buildMux() *http.ServeMux {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/cmd/", a.handleHTTPCmd)
@@ -134,14 +151,18 @@ type JsonHttpResponse struct {
 }
 
 func respond(w http.ResponseWriter, status int, errStr string) {
-	w.Header().Set("Content-Type", "application/json")
-	w.WriteHeader(status)
-	json.NewEncoder(w).Encode(JsonHttpResponse{
+	respondJSON(w, status, JsonHttpResponse{
 		Ok:    status == http.StatusOK,
 		Error: errStr,
 	})
 }
 
+func respondJSON(w http.ResponseWriter, status int, res interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(res)
+}
+
 func call(w http.ResponseWriter, block func() error) {
 	defer func() {
 		err := recover()
@@ -173,14 +194,69 @@ func (a *AdminUI) handleHTTPCmd(w http.ResponseWriter, r *http.Request) {
 	case "unpause":
 		call(w, a.proxy.Unpause)
 	case "reload":
-		call(w, a.proxy.Reload)
+		a.reload(w)
+	case "validate":
+		a.validate(w, r)
 	case "terminate-raw-connections":
 		call(w, a.proxy.TerminateRawConnections)
+	case "switchover":
+		call(w, func() error { return a.switchover(r) })
 	default:
 		respond(w, http.StatusBadRequest, fmt.Sprintf("Unknown cmd: '%s'", cmd))
 	}
 }
 
+// reload responds like call(proxy.Reload) (`ok` and `error`), with
+// details of the attempt (see ReloadResult).
+func (a *AdminUI) reload(w http.ResponseWriter) {
+	res := a.proxy.ReloadWithResult()
+	status := http.StatusOK
+	if !res.Ok {
+		status = http.StatusBadRequest
+	}
+	respondJSON(w, status, res)
+}
+
+// validate checks the config given in `config` form field (in
+// `format`, JSON by default), without applying it.  The config is
+// taken literally and checked offline (see validate.go).
+func (a *AdminUI) validate(w http.ResponseWriter, r *http.Request) {
+	format := r.Form.Get("format")
+	if format == "" {
+		format = FormatJSON
+	}
+	newConfig, err := decodeConfigLiteral([]byte(r.Form.Get("config")), format)
+	if err != nil {
+		respond(w, http.StatusBadRequest, fmt.Sprintf("Could not parse config: %v", err))
+		return
+	}
+	res := a.proxy.ValidateConfig(newConfig)
+	status := http.StatusOK
+	if !res.Ok {
+		status = http.StatusBadRequest
+	}
+	respondJSON(w, status, res)
+}
+
+// switchover starts switching to uplink given (as JSON AddrSpec) in
+// `uplink` form field, with optional `timeout_ms`.
+func (a *AdminUI) switchover(r *http.Request) error {
+	var target AddrSpec
+	if err := json.Unmarshal([]byte(r.Form.Get("uplink")), &target); err != nil {
+		return fmt.Errorf("Could not parse uplink: %v", err)
+	}
+
+	timeout := time.Duration(0)
+	if timeoutStr := r.Form.Get("timeout_ms"); timeoutStr != "" {
+		timeoutMs, err := strconv.ParseInt(timeoutStr, 10, 64)
+		if err != nil {
+			return fmt.Errorf("Could not parse timeout_ms: %v", err)
+		}
+		timeout = time.Duration(timeoutMs) * time.Millisecond
+	}
+	return a.proxy.Switchover(target, timeout)
+}
+
 func init() {
 	var err error
 	statusTemplate, err = template.New("status").Parse(statusHtml)
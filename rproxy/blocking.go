@@ -0,0 +1,204 @@
+package rproxy
+
+import (
+	"errors"
+	"log"
+	"strconv"
+	"time"
+
+	"github.com/Codility/redis-proxy/resp"
+)
+
+// Blocking commands
+//
+// Commands like BLPOP, XREAD BLOCK or WAIT may legitimately keep the
+// uplink connection busy for much longer than read_time_limit_ms (or
+// forever), so ClientHandler sends them one at a time and gives them
+// their own timeout plus read_time_limit_ms instead.
+//
+// While such a command waits, the handler watches the proxy state.
+// When PAUSE is requested, it unblocks the command in Redis (CLIENT
+// UNBLOCK sent over a separate connection), releases execution
+// permission so that the pause can complete, and once the proxy is
+// unpaused re-issues the command with what is left of its timeout,
+// possibly on a different uplink.  If the command completed before
+// Redis got to unblock it, its reply is passed to the client as
+// usual.
+
+const blockingPollInterval = 100 * time.Millisecond
+
+var errBlockingCancelled = errors.New("blocking command unblocked for PAUSE")
+
+func isBlockingRequest(req *resp.Msg) bool {
+	_, ok := req.BlockingTimeout()
+	return ok
+}
+
+func (ch *ClientHandler) handleBlockingRequest(req *resp.Msg) {
+	startTs := time.Now()
+	redisCallDuration := time.Duration(0)
+	defer func() {
+		statRecordRequest(time.Since(startTs), redisCallDuration)
+	}()
+
+	if reply := ch.preprocessRequest(req); reply != nil {
+		ch.writeToClient(reply)
+		return
+	}
+
+	var deadline time.Time
+	if timeout, _ := req.BlockingTimeout(); timeout > 0 {
+		deadline = startTs.Add(timeout)
+	}
+
+	for {
+		if !ch.acquirePermission() {
+			ch.writeToClient(MsgTooManyWaiting)
+			return
+		}
+		res, duration, err := ch.callBlocking(req, deadline)
+		redisCallDuration += duration
+		if !ch.tx.Active() {
+			ch.releasePermission()
+		}
+
+		if err == errBlockingCancelled {
+			if !deadline.IsZero() {
+				left := deadline.Sub(time.Now())
+				if left <= 0 {
+					// Timed out while paused, res is the
+					// nil reply Redis would have sent.
+					ch.writeToClient(res.Data())
+					return
+				}
+				req = req.WithBlockingTimeout(left)
+			}
+			continue
+		}
+		if err != nil {
+			log.Printf("Error: %v\n", err)
+			ch.tx.Reset()
+			ch.releasePermission()
+			ch.done = true
+			return
+		}
+
+		ch.postprocessRequest(req, res)
+		ch.writeToClient(ch.rewriteReply(req, res).Data())
+		return
+	}
+}
+
+// callBlocking sends a blocking command to uplink and waits for its
+// reply.  Must be called with execution permission.  Returns
+// errBlockingCancelled (along with the nil reply) if the command got
+// unblocked because of PAUSE.
+func (ch *ClientHandler) callBlocking(req *resp.Msg, deadline time.Time) (*resp.Msg, time.Duration, error) {
+	config := ch.proxy.config
+	uplink := config.Uplink
+	if config.RoutesByKey() {
+		var err error
+		var errReply []byte
+		if uplink, errReply, err = ch.routeRequest(config, req); err != nil {
+			return nil, 0, err
+		}
+		if errReply != nil {
+			return resp.NewMsg(errReply), 0, nil
+		}
+	}
+
+	redisCallDuration, err := ch.ensureUplinkTo(config, uplink)
+	if err != nil {
+		return nil, redisCallDuration, err
+	}
+
+	redisReqTs := time.Now()
+
+	if ch.uplinkClientID == 0 {
+		if err := ch.fetchUplinkClientID(); err != nil {
+			return nil, time.Since(redisReqTs) + redisCallDuration, err
+		}
+	}
+
+	if _, err := ch.uplinkConn.WriteMsg(req); err != nil {
+		return nil, time.Since(redisReqTs) + redisCallDuration, err
+	}
+
+	var hardLimit time.Time
+	if limitMs := config.ReadTimeLimitMs; limitMs > 0 && !deadline.IsZero() {
+		hardLimit = deadline.Add(time.Duration(limitMs) * time.Millisecond)
+	}
+
+	unblockTried, unblocked := false, false
+	for {
+		err := ch.uplinkConn.WaitForData(blockingPollInterval)
+		if err == nil {
+			break
+		}
+		if !resp.IsNetTimeout(err) {
+			return nil, time.Since(redisReqTs) + redisCallDuration, err
+		}
+		if !hardLimit.IsZero() && time.Now().After(hardLimit) {
+			return nil, time.Since(redisReqTs) + redisCallDuration,
+				errors.New("blocking command exceeded its timeout")
+		}
+		if !unblockTried && !ch.tx.Active() && ch.proxy.State() == ProxyPausing {
+			unblockTried = true
+			unblocked = ch.unblockUplink()
+		}
+	}
+
+	res, err := ch.uplinkConn.ReadMsg()
+	duration := time.Since(redisReqTs) + redisCallDuration
+	if err != nil {
+		return nil, duration, err
+	}
+	if unblocked && res.IsNil() {
+		return res, duration, errBlockingCancelled
+	}
+	return res, duration, nil
+}
+
+// fetchUplinkClientID remembers the id Redis assigned to the uplink
+// connection, needed to unblock it.  Redis versions without CLIENT
+// ID can't be unblocked, PAUSE will then wait for blocking commands
+// to time out.
+func (ch *ClientHandler) fetchUplinkClientID() error {
+	res, err := ch.uplinkConn.Call(resp.MsgFromStrings("CLIENT", "ID"))
+	if err != nil {
+		return err
+	}
+	id, ok := res.Int()
+	if !ok {
+		log.Printf("Could not get uplink client id, blocking commands will delay PAUSE: %s\n",
+			res.String())
+		id = -1
+	}
+	ch.uplinkClientID = id
+	return nil
+}
+
+// unblockUplink asks Redis (over a separate connection) to unblock
+// the command waiting on uplink connection.  Returns true if there
+// was a command to unblock.
+func (ch *ClientHandler) unblockUplink() bool {
+	if ch.uplinkClientID <= 0 {
+		return false
+	}
+
+	rc, err := ch.uplinkConf.DialRedis(ch.proxy.config.ReadTimeLimitMs, ch.proxy.config.LogMessages)
+	if err != nil {
+		log.Printf("Could not unblock uplink connection: %v\n", err)
+		return false
+	}
+	defer rc.Close()
+
+	res, err := rc.Call(resp.MsgFromStrings("CLIENT", "UNBLOCK",
+		strconv.FormatInt(ch.uplinkClientID, 10)))
+	if err != nil {
+		log.Printf("Could not unblock uplink connection: %v\n", err)
+		return false
+	}
+	cnt, _ := res.Int()
+	return cnt == 1
+}
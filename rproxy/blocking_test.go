@@ -0,0 +1,68 @@
+package rproxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Codility/redis-proxy/fakeredis"
+	"github.com/Codility/redis-proxy/resp"
+	"github.com/stvp/assert"
+)
+
+func TestProxyBlockingCommandIgnoresTimeLimit(t *testing.T) {
+	srv := fakeredis.Start("srv", "tcp")
+	defer srv.Stop()
+
+	proxy := mustStartTestProxy(t, &TestConfigLoader{
+		conf: &Config{
+			Uplink:          AddrSpec{Addr: srv.Addr().String()},
+			Listen:          AddrSpec{Addr: "127.0.0.1:0"},
+			ReadTimeLimitMs: 100,
+		},
+	})
+	defer proxy.Stop()
+
+	c := resp.MustDial("tcp", proxy.ListenAddr().String(), 0, false)
+	startTs := time.Now()
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("BLPOP", "k", "0.3")).String(), "*-1\r\n")
+	assert.True(t, time.Since(startTs) >= 300*time.Millisecond)
+
+	// Connection is still usable
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("GET", "k")).String(), "$3\r\nsrv\r\n")
+}
+
+func TestProxyPauseUnblocksBlockingCommand(t *testing.T) {
+	srv_0 := fakeredis.Start("srv-0", "tcp")
+	defer srv_0.Stop()
+	srv_1 := fakeredis.Start("srv-1", "tcp")
+	defer srv_1.Stop()
+
+	conf := NewTestConfigLoader(srv_0.Addr().String())
+	proxy := mustStartTestProxy(t, conf)
+	defer proxy.Stop()
+
+	c := resp.MustDial("tcp", proxy.ListenAddr().String(), 0, false)
+	startTs := time.Now()
+	c.MustWriteMsg(resp.MsgFromStrings("BLPOP", "k", "1"))
+	waitUntil(t, func() bool { return proxy.GetInfo().ActiveRequests == 1 })
+
+	// Pause doesn't have to wait for the command to time out
+	assert.Nil(t, proxy.Pause())
+	waitUntil(t, func() bool { return proxy.GetInfo().State == ProxyPaused })
+	assert.True(t, time.Since(startTs) < 500*time.Millisecond)
+	assert.Equal(t, srv_0.LastRequest().Command(), "CLIENT")
+	assert.Equal(t, srv_0.LastRequest().Args()[0], "UNBLOCK")
+
+	conf.Replace(&Config{
+		Uplink: AddrSpec{Addr: srv_1.Addr().String()},
+		Listen: AddrSpec{Addr: "127.0.0.1:0"},
+	})
+	assert.Nil(t, proxy.Reload())
+	assert.Nil(t, proxy.Unpause())
+
+	// Re-issued on the new uplink, with the original timeout kept
+	assert.Equal(t, c.MustReadMsg().String(), "*-1\r\n")
+	assert.True(t, time.Since(startTs) >= time.Second)
+	assert.Equal(t, srv_1.LastRequest().Command(), "BLPOP")
+	assert.Equal(t, proxy.GetInfo().ActiveRequests, 0)
+}
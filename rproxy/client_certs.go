@@ -0,0 +1,265 @@
+package rproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/Codility/redis-proxy/resp"
+)
+
+// Client certificates
+//
+// With `client_auth` set on `listen`, `listen_raw` or `admin` (TLS
+// only), clients are asked for a certificate, which must be signed by
+// a CA in `client_cacertfile`.  With "request", clients without a
+// certificate are let in (and authenticate as usual); with "require",
+// they are not.
+//
+// On `listen`, a user with the certificate's subject CN, or one of its
+// subject alternative names (DNS name, email address, URI or IP
+// address), in `cert_names` is logged in when the client connects, so
+// it doesn't have to AUTH.  Such users don't need a password_hash.
+// After RELOAD, clients whose certificate no longer maps to their user
+// have to authenticate again.
+//
+// The identity from the certificate (the name that matched a user,
+// otherwise the CN, or the first SAN) is logged with the connection,
+// and shown in `clients` in /info.json.
+
+const (
+	ClientAuthRequest = "request"
+	ClientAuthRequire = "require"
+
+	clientHandshakeTimeout = 10 * time.Second
+)
+
+func (as *AddrSpec) clientAuthType() tls.ClientAuthType {
+	switch as.ClientAuth {
+	case ClientAuthRequest:
+		return tls.VerifyClientCertIfGiven
+	case ClientAuthRequire:
+		return tls.RequireAndVerifyClientCert
+	}
+	return tls.NoClientCert
+}
+
+func (as *AddrSpec) prepareClientAuth(name string, server, offline bool) ErrorList {
+	errList := ErrorList{}
+	if as.ClientAuth == "" {
+		if as.ClientCACertFile != "" {
+			errList.Add(name + ".client_cacertfile requires client_auth")
+		}
+		return errList
+	}
+	switch {
+	case !server:
+		errList.Add(name + ".client_auth is only supported on listening addresses")
+	case as.ClientAuth != ClientAuthRequest && as.ClientAuth != ClientAuthRequire:
+		errList.Add(name + ".client_auth must be \"request\" or \"require\"")
+	case !as.TLS:
+		errList.Add(name + ".client_auth requires tls")
+	case as.ClientCACertFile == "":
+		errList.Add(name + ".client_auth requires client_cacertfile")
+	case offline:
+	default:
+		if _, err := loadCertPool(as.ClientCACertFile); err != nil {
+			errList.Add("could not load " + name + ".client_cacertfile: " + err.Error())
+		}
+	}
+	return errList
+}
+
+func loadCertPool(fileName string) (*x509.CertPool, error) {
+	certPEM, err := ioutil.ReadFile(fileName)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(certPEM) {
+		return nil, errors.New("no certificates in " + fileName)
+	}
+	return pool, nil
+}
+
+// certNames lists the names of cert: subject CN, then subject
+// alternative names.
+func certNames(cert *x509.Certificate) []string {
+	names := []string{}
+	if cert.Subject.CommonName != "" {
+		names = append(names, cert.Subject.CommonName)
+	}
+	names = append(names, cert.DNSNames...)
+	names = append(names, cert.EmailAddresses...)
+	for _, uri := range cert.URIs {
+		names = append(names, uri.String())
+	}
+	for _, ip := range cert.IPAddresses {
+		names = append(names, ip.String())
+	}
+	return names
+}
+
+// UserByCert returns the enabled user cert maps to, or nil.
+func (c *Config) UserByCert(cert *x509.Certificate) *UserConfig {
+	_, user := c.certIdentity(cert)
+	return user
+}
+
+// certIdentity returns the name cert is known by (the one that
+// matched a user, or the first one), and the user it maps to.
+func (c *Config) certIdentity(cert *x509.Certificate) (string, *UserConfig) {
+	names := certNames(cert)
+	for _, name := range names {
+		for i := range c.Users {
+			user := &c.Users[i]
+			if !user.Enabled {
+				continue
+			}
+			for _, certName := range user.CertNames {
+				if certName == name {
+					return name, user
+				}
+			}
+		}
+	}
+	if len(names) == 0 {
+		return cert.Subject.String(), nil
+	}
+	return names[0], nil
+}
+
+// handshakeClient completes the TLS handshake of conn (if it is a
+// TLS connection), and returns the verified client certificate, if
+// there is one.
+func handshakeClient(conn net.Conn) (*x509.Certificate, error) {
+	tlsConn, ok := conn.(*tls.Conn)
+	if !ok {
+		return nil, nil
+	}
+	tlsConn.SetDeadline(time.Now().Add(clientHandshakeTimeout))
+	err := tlsConn.Handshake()
+	tlsConn.SetDeadline(time.Time{})
+	if err != nil {
+		return nil, err
+	}
+	chains := tlsConn.ConnectionState().VerifiedChains
+	if len(chains) == 0 {
+		return nil, nil
+	}
+	return chains[0][0], nil
+}
+
+////////////////////////////////////////
+// Client listing
+
+type ClientInfo struct {
+	Listener     string    `json:"listener"` // "listen" or "listen_raw"
+	Addr         string    `json:"addr"`
+	User         string    `json:"user,omitempty"`
+	CertIdentity string    `json:"cert_identity,omitempty"`
+	Since        time.Time `json:"since"`
+}
+
+// clientRegistry keeps track of connected clients, for /info.json.
+type clientRegistry struct {
+	mu      sync.Mutex
+	clients map[*ClientInfo]bool
+}
+
+func newClientRegistry() *clientRegistry {
+	return &clientRegistry{clients: map[*ClientInfo]bool{}}
+}
+
+func (cr *clientRegistry) Add(listener string, addr net.Addr, certIdentity string) *ClientInfo {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	client := &ClientInfo{
+		Listener:     listener,
+		Addr:         addr.String(),
+		CertIdentity: certIdentity,
+		Since:        time.Now(),
+	}
+	cr.clients[client] = true
+	return client
+}
+
+func (cr *clientRegistry) SetUser(client *ClientInfo, user string) {
+	if client == nil {
+		return
+	}
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	client.User = user
+}
+
+func (cr *clientRegistry) Remove(client *ClientInfo) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+	delete(cr.clients, client)
+}
+
+// List returns the clients, oldest first.
+func (cr *clientRegistry) List() []ClientInfo {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	res := []ClientInfo{}
+	for client := range cr.clients {
+		res = append(res, *client)
+	}
+	sort.Slice(res, func(i, j int) bool { return res[i].Since.Before(res[j].Since) })
+	return res
+}
+
+////////////////////////////////////////
+// ClientHandler: certificates
+
+// identify logs the client in as the user its certificate maps to
+// (if any), and registers it in the client listing.
+func (ch *ClientHandler) identify(cert *x509.Certificate) {
+	if cert != nil {
+		var user *UserConfig
+		ch.certIdentity, user = ch.proxy.config.certIdentity(cert)
+		if user != nil {
+			ch.cliAuthenticated = true
+			ch.userName = user.Name
+			ch.certLogin = cert
+			ch.certCheckedIn = ch.proxy.config
+		}
+	}
+	ch.client = ch.proxy.clients.Add("listen", ch.cliConn.RemoteAddr(), ch.certIdentity)
+	ch.proxy.clients.SetUser(ch.client, ch.userName)
+}
+
+// certLoginValid is false if the client logged in with a certificate
+// that RELOAD no longer maps to its user (checked once per config).
+func (ch *ClientHandler) certLoginValid(config *Config) bool {
+	if ch.certLogin == nil || ch.certCheckedIn == config {
+		return true
+	}
+	ch.certCheckedIn = config
+	user := config.UserByCert(ch.certLogin)
+	return user != nil && user.Name == ch.userName
+}
+
+// serveClient handles a client accepted on `listen`.
+func (proxy *Proxy) serveClient(conn net.Conn) {
+	cert, err := handshakeClient(conn)
+	if err != nil {
+		log.Printf("Client %s: TLS handshake failed: %s", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+	ch := NewClientHandler(resp.NewConn(conn, 0, proxy.config.LogMessages), proxy)
+	ch.identify(cert)
+	defer proxy.clients.Remove(ch.client)
+	ch.Run()
+}
@@ -0,0 +1,444 @@
+package rproxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Codility/redis-proxy/fakeredis"
+	"github.com/Codility/redis-proxy/resp"
+	"github.com/stvp/assert"
+)
+
+// testCA issues certificates for tests (the ones in test_data don't
+// have SANs, so they are not accepted for 127.0.0.1).
+type testCA struct {
+	cert   *x509.Certificate
+	key    *ecdsa.PrivateKey
+	dir    string
+	serial int64
+}
+
+func newTestCA(t *testing.T, dir, name string) *testCA {
+	ca := &testCA{dir: dir}
+	ca.cert, ca.key = ca.issue(t, &x509.Certificate{
+		Subject:               pkix.Name{CommonName: name},
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+		KeyUsage:              x509.KeyUsageCertSign,
+	})
+	ca.write(t, name+".pem", "CERTIFICATE", ca.cert.Raw)
+	return ca
+}
+
+func (ca *testCA) issue(t *testing.T, template *x509.Certificate) (*x509.Certificate, *ecdsa.PrivateKey) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.Nil(t, err)
+	ca.serial++
+	template.SerialNumber = big.NewInt(ca.serial)
+	template.NotBefore = time.Now().Add(-time.Hour)
+	template.NotAfter = time.Now().Add(time.Hour)
+
+	parent, parentKey := template, key
+	if ca.cert != nil {
+		parent, parentKey = ca.cert, ca.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, parent, &key.PublicKey, parentKey)
+	assert.Nil(t, err)
+	cert, err := x509.ParseCertificate(der)
+	assert.Nil(t, err)
+	return cert, key
+}
+
+func (ca *testCA) write(t *testing.T, name, pemType string, data []byte) string {
+	fileName := filepath.Join(ca.dir, name)
+	f, err := os.Create(fileName)
+	assert.Nil(t, err)
+	defer f.Close()
+	assert.Nil(t, pem.Encode(f, &pem.Block{Type: pemType, Bytes: data}))
+	return fileName
+}
+
+// issueFiles writes a certificate for template and its key to
+// <name>-cert.pem and <name>-key.pem, and returns their names.
+func (ca *testCA) issueFiles(t *testing.T, name string, template *x509.Certificate) (string, string) {
+	cert, key := ca.issue(t, template)
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	assert.Nil(t, err)
+	return ca.write(t, name+"-cert.pem", "CERTIFICATE", cert.Raw),
+		ca.write(t, name+"-key.pem", "EC PRIVATE KEY", keyDER)
+}
+
+func (ca *testCA) serverSpec(t *testing.T) AddrSpec {
+	certFile, keyFile := ca.issueFiles(t, "server", &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "proxy"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	return AddrSpec{Addr: "127.0.0.1:0", TLS: true, CertFile: certFile, KeyFile: keyFile}
+}
+
+func (ca *testCA) clientCert(t *testing.T, name string, template *x509.Certificate) tls.Certificate {
+	template.ExtKeyUsage = []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth}
+	certFile, keyFile := ca.issueFiles(t, name, template)
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	assert.Nil(t, err)
+	return cert
+}
+
+func (ca *testCA) dialTLS(addr string, certs ...tls.Certificate) (*resp.Conn, error) {
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: roots, Certificates: certs})
+	if err != nil {
+		return nil, err
+	}
+	// With TLS 1.3, a rejected certificate shows up on the first read.
+	rc := resp.NewConn(conn, 1000, false)
+	if _, err := rc.Call(resp.MsgFromStrings("PING")); err != nil {
+		rc.Close()
+		return nil, err
+	}
+	return rc, nil
+}
+
+func TestClientCertAuth(t *testing.T) {
+	dir, err := ioutil.TempDir("", "redis-proxy-certs")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	srv := fakeredis.Start("fake", "tcp")
+	defer srv.Stop()
+
+	ca := newTestCA(t, dir, "ca")
+	otherCA := newTestCA(t, dir, "other-ca")
+	listen := ca.serverSpec(t)
+	listen.ClientAuth = ClientAuthRequire
+	listen.ClientCACertFile = filepath.Join(dir, "ca.pem")
+
+	loader := &TestConfigLoader{
+		conf: &Config{
+			Uplink: AddrSpec{Addr: srv.Addr().String()},
+			Listen: listen,
+			Users: []UserConfig{
+				{Name: "app", CertNames: []string{"app.example.com"}, Enabled: true,
+					Commands: []string{"*"}, Keys: []string{"*"}},
+				{Name: "ops", PasswordHash: sha256Hex("ops-pass"), Enabled: true,
+					Commands: []string{"*"}, Keys: []string{"*"}},
+			},
+		},
+	}
+	proxy := mustStartTestProxy(t, loader)
+	defer proxy.Stop()
+	addr := proxy.ListenAddr().String()
+
+	// Mapped to a user: no AUTH needed
+	appCert := ca.clientCert(t, "app", &x509.Certificate{
+		Subject:  pkix.Name{CommonName: "app"},
+		DNSNames: []string{"app.example.com"},
+	})
+	c, err := ca.dialTLS(addr, appCert)
+	assert.Nil(t, err)
+	defer c.Close()
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("GET", "a")).String(), "$4\r\nfake\r\n")
+	clients := proxy.GetInfo().Clients
+	assert.Equal(t, len(clients), 1)
+	assert.Equal(t, clients[0].Listener, "listen")
+	assert.Equal(t, clients[0].User, "app")
+	assert.Equal(t, clients[0].CertIdentity, "app.example.com")
+
+	// Not mapped: has to AUTH, identity is the CN
+	opsCert := ca.clientCert(t, "ops", &x509.Certificate{Subject: pkix.Name{CommonName: "ops-laptop"}})
+	c2, err := ca.dialTLS(addr, opsCert)
+	assert.Nil(t, err)
+	defer c2.Close()
+	assert.Equal(t, c2.MustCall(resp.MsgFromStrings("GET", "a")).String(),
+		"-NOAUTH Authentication required.\r\n")
+	assert.Equal(t, c2.MustCall(resp.MsgFromStrings("AUTH", "ops", "ops-pass")).String(), "+OK\r\n")
+	waitUntil(t, func() bool {
+		clients := proxy.GetInfo().Clients
+		return len(clients) == 2 && clients[1].User == "ops" && clients[1].CertIdentity == "ops-laptop"
+	})
+
+	// Cert-only users can't AUTH with a password
+	assert.Equal(t, c2.MustCall(resp.MsgFromStrings("AUTH", "app", "")).String(),
+		"-WRONGPASS invalid username-password pair or user is disabled.\r\n")
+
+	// No certificate, or one from another CA
+	_, err = ca.dialTLS(addr)
+	assert.NotNil(t, err)
+	strangerCert := otherCA.clientCert(t, "stranger", &x509.Certificate{
+		Subject:  pkix.Name{CommonName: "app"},
+		DNSNames: []string{"app.example.com"},
+	})
+	_, err = ca.dialTLS(addr, strangerCert)
+	assert.NotNil(t, err)
+
+	// RELOAD that unmaps the certificate logs the client out
+	newConfig := *loader.conf
+	newConfig.Users = append([]UserConfig{}, loader.conf.Users...)
+	newConfig.Users[0].CertNames = []string{"app-2.example.com"}
+	loader.Replace(&newConfig)
+	assert.Nil(t, proxy.Reload())
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("GET", "a")).String(),
+		"-NOAUTH Authentication required.\r\n")
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("GET", "a")).String(),
+		"-NOAUTH Authentication required.\r\n")
+	assert.Equal(t, proxy.GetInfo().Clients[0].User, "")
+
+	c.Close()
+	c2.Close()
+	waitUntil(t, func() bool { return len(proxy.GetInfo().Clients) == 0 })
+}
+
+func TestClientCertRequest(t *testing.T) {
+	dir, err := ioutil.TempDir("", "redis-proxy-certs")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	srv := fakeredis.Start("fake", "tcp")
+	defer srv.Stop()
+
+	ca := newTestCA(t, dir, "ca")
+	listen := ca.serverSpec(t)
+	listen.Pass = "secret"
+	listen.ClientAuth = ClientAuthRequest
+	listen.ClientCACertFile = filepath.Join(dir, "ca.pem")
+	listenRaw := ca.serverSpec(t)
+	listenRaw.ClientAuth = ClientAuthRequire
+	listenRaw.ClientCACertFile = listen.ClientCACertFile
+	admin := ca.serverSpec(t)
+	admin.ClientAuth = ClientAuthRequire
+	admin.ClientCACertFile = listen.ClientCACertFile
+
+	proxy := mustStartTestProxy(t, &TestConfigLoader{
+		conf: &Config{
+			Uplink:    AddrSpec{Addr: srv.Addr().String()},
+			Listen:    listen,
+			ListenRaw: listenRaw,
+			Admin:     admin,
+		},
+	})
+	defer proxy.Stop()
+
+	// Without a certificate: AUTH as usual
+	c, err := ca.dialTLS(proxy.ListenAddr().String())
+	assert.Nil(t, err)
+	defer c.Close()
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("GET", "a")).String(),
+		"-NOAUTH Authentication required.\r\n")
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("AUTH", "secret")).String(), "+OK\r\n")
+	assert.Equal(t, proxy.GetInfo().Clients[0].CertIdentity, "")
+
+	// Raw: certificate required
+	clientCert := ca.clientCert(t, "client", &x509.Certificate{
+		URIs: []*url.URL{{Scheme: "spiffe", Host: "example.org", Path: "/worker"}},
+	})
+	_, err = ca.dialTLS(proxy.ListenRawAddr().String())
+	assert.NotNil(t, err)
+	raw, err := ca.dialTLS(proxy.ListenRawAddr().String(), clientCert)
+	assert.Nil(t, err)
+	defer raw.Close()
+	assert.Equal(t, raw.MustCall(resp.MsgFromStrings("GET", "a")).String(), "$4\r\nfake\r\n")
+	waitUntil(t, func() bool {
+		for _, client := range proxy.GetInfo().Clients {
+			if client.Listener == "listen_raw" {
+				return client.CertIdentity == "spiffe://example.org/worker"
+			}
+		}
+		return false
+	})
+
+	// Admin: certificate required
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	adminURL := "https://" + proxy.AdminAddr().String() + "/info.json"
+	httpClient := &http.Client{Transport: &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}}
+	_, err = httpClient.Get(adminURL)
+	assert.NotNil(t, err)
+	httpClient.Transport = &http.Transport{TLSClientConfig: &tls.Config{
+		RootCAs: roots, Certificates: []tls.Certificate{clientCert}}}
+	res, err := httpClient.Get(adminURL)
+	assert.Nil(t, err)
+	res.Body.Close()
+	assert.Equal(t, res.StatusCode, http.StatusOK)
+}
+
+func TestClientAuthValidation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "redis-proxy-certs")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	ca := newTestCA(t, dir, "ca")
+	caFile := filepath.Join(dir, "ca.pem")
+	listen := ca.serverSpec(t)
+
+	for _, c := range []struct {
+		spec   AddrSpec
+		server bool
+		err    string
+	}{
+		{AddrSpec{ClientCACertFile: caFile}, true, "listen.client_cacertfile requires client_auth"},
+		{AddrSpec{ClientAuth: "always"}, true, `listen.client_auth must be "request" or "require"`},
+		{AddrSpec{ClientAuth: ClientAuthRequire, ClientCACertFile: caFile}, false,
+			"listen.client_auth is only supported on listening addresses"},
+		{AddrSpec{Addr: "127.0.0.1:0", ClientAuth: ClientAuthRequire, ClientCACertFile: caFile}, true,
+			"listen.client_auth requires tls"},
+		{AddrSpec{ClientAuth: ClientAuthRequire}, true, "listen.client_auth requires client_cacertfile"},
+		{AddrSpec{ClientAuth: ClientAuthRequire, ClientCACertFile: listen.KeyFile}, true,
+			"could not load listen.client_cacertfile: no certificates in " + listen.KeyFile},
+	} {
+		if c.spec.Addr == "" {
+			spec := listen
+			spec.ClientAuth, spec.ClientCACertFile = c.spec.ClientAuth, c.spec.ClientCACertFile
+			c.spec = spec
+		}
+		errList := c.spec.prepareClientAuth("listen", c.server, false)
+		assert.Equal(t, errList.Errors(), []string{c.err})
+	}
+
+	// Users with certificates only
+	u := UserConfig{Name: "app", CertNames: []string{"app"}}
+	errList := u.Prepare("users[0]")
+	assert.True(t, errList.Ok())
+	assert.False(t, u.CheckPassword(""))
+	config := &Config{Users: []UserConfig{u}}
+	errList = config.prepareUsers()
+	assert.True(t, errList.Ok())
+	assert.Equal(t, errList.Items()[0].Severity, SeverityWarning)
+}
+
+func TestRelistenHandsOverAcceptedConns(t *testing.T) {
+	dir, err := ioutil.TempDir("", "redis-proxy-certs")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	ca := newTestCA(t, dir, "ca")
+
+	plain := AddrSpec{Addr: "127.0.0.1:0"}
+	old, err := plain.Listen()
+	assert.Nil(t, err)
+	plain.Addr = old.Addr().String()
+	withTLS := ca.serverSpec(t)
+	withTLS.Addr = plain.Addr
+	withTLS.ClientAuth = ClientAuthRequire
+	withTLS.ClientCACertFile = filepath.Join(dir, "ca.pem")
+
+	ln, err := relisten(old, &plain, &withTLS)
+	assert.Nil(t, err)
+	defer ln.Close()
+	assert.True(t, old.Stopped())
+
+	// The old accept loop may still get a connection: it has to be
+	// set up according to the new listener.
+	go ca.dialTLS(ln.Addr().String())
+	conn, err := old.Accept()
+	assert.Nil(t, err)
+	defer conn.Close()
+	_, err = handshakeClient(conn)
+	assert.NotNil(t, err) // no client certificate
+}
+
+func TestReloadWithBadListenKeyPair(t *testing.T) {
+	dir, err := ioutil.TempDir("", "redis-proxy-certs")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	srv := fakeredis.Start("fake", "tcp")
+	defer srv.Stop()
+
+	ca := newTestCA(t, dir, "ca")
+	listen := ca.serverSpec(t)
+	otherCert, _ := ca.issueFiles(t, "other", &x509.Certificate{Subject: pkix.Name{CommonName: "other"}})
+	mismatched := listen
+	mismatched.CertFile = otherCert
+
+	// Not accepted by validation...
+	errList := mismatched.Prepare("listen", true)
+	assert.False(t, errList.Ok())
+
+	// ...nor by the listener itself (instead of exiting)
+	_, err = mismatched.Listen()
+	assert.NotNil(t, err)
+
+	loader := &TestConfigLoader{conf: &Config{
+		Uplink: AddrSpec{Addr: srv.Addr().String()},
+		Listen: listen,
+		Admin:  AddrSpec{Addr: "127.0.0.1:0"},
+	}}
+	proxy := mustStartTestProxy(t, loader)
+	defer proxy.Stop()
+	addr := proxy.ListenAddr().String()
+
+	for _, change := range []func(c *Config){
+		func(c *Config) { c.Listen.KeyFile = mismatched.KeyFile; c.Listen.CertFile = otherCert },
+		func(c *Config) { c.Admin = mismatched; c.Admin.Addr = "127.0.0.1:0" },
+		func(c *Config) { c.ListenRaw = mismatched; c.ListenRaw.Addr = "127.0.0.1:0" },
+	} {
+		newConfig := *loader.conf
+		change(&newConfig)
+		loader.Replace(&newConfig)
+		assert.NotNil(t, proxy.Reload())
+		assert.Equal(t, proxy.State(), ProxyRunning)
+	}
+
+	c, err := ca.dialTLS(addr)
+	assert.Nil(t, err)
+	defer c.Close()
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("GET", "a")).String(), "$4\r\nfake\r\n")
+}
+
+func TestListenerServesRotatedCert(t *testing.T) {
+	dir, err := ioutil.TempDir("", "redis-proxy-certs")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	srv := fakeredis.Start("fake", "tcp")
+	defer srv.Stop()
+
+	ca := newTestCA(t, dir, "ca")
+	proxy := mustStartTestProxy(t, &TestConfigLoader{conf: &Config{
+		Uplink: AddrSpec{Addr: srv.Addr().String()},
+		Listen: ca.serverSpec(t),
+		Admin:  AddrSpec{Addr: "127.0.0.1:0"},
+	}})
+	defer proxy.Stop()
+	addr := proxy.ListenAddr().String()
+
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+	servedName := func() string {
+		conn, err := tls.Dial("tcp", addr, &tls.Config{RootCAs: roots})
+		assert.Nil(t, err)
+		defer conn.Close()
+		return conn.ConnectionState().PeerCertificates[0].Subject.CommonName
+	}
+	assert.Equal(t, servedName(), "proxy")
+
+	// Overwrite the files in place, as certificate renewal tools do.
+	ca.issueFiles(t, "server", &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "proxy-renewed"},
+		IPAddresses: []net.IP{net.ParseIP("127.0.0.1")},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	assert.Equal(t, servedName(), "proxy-renewed")
+
+	// A certificate without its key yet keeps the last good pair.
+	otherCert, _ := ca.issueFiles(t, "other", &x509.Certificate{Subject: pkix.Name{CommonName: "other"}})
+	data, err := ioutil.ReadFile(otherCert)
+	assert.Nil(t, err)
+	assert.Nil(t, ioutil.WriteFile(filepath.Join(dir, "server-cert.pem"), data, 0600))
+	assert.Equal(t, servedName(), "proxy-renewed")
+
+	c, err := ca.dialTLS(addr)
+	assert.Nil(t, err)
+	defer c.Close()
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("GET", "a")).String(), "$4\r\nfake\r\n")
+}
@@ -1,53 +1,126 @@
 package rproxy
 
 import (
+	"bytes"
+	"crypto/x509"
 	"log"
+	"sync"
 	"time"
 
 	"github.com/Codility/redis-proxy/resp"
 )
 
+const (
+	// MaxPipelineLength: maximum number of already-buffered
+	// requests that get forwarded to uplink as a single batch.
+	MaxPipelineLength = 1000
+)
+
 type ClientHandler struct {
 	proxy   *Proxy
 	cliConn *resp.Conn
+	cliMu   sync.Mutex // guards writes to cliConn
 
 	done             bool
 	cliAuthenticated bool
+	userName         string            // authenticated as
+	certIdentity     string            // from the client certificate
+	certLogin        *x509.Certificate // logged in with, until AUTH
+	certCheckedIn    *Config           // config certLogin was last checked against
+	client           *ClientInfo
 	db               int
+	proto            int // negotiated with HELLO
 	uplinkConf       *AddrSpec
 	uplinkConn       *resp.Conn
+	uplinkClientID   int64                // 0: not known yet, -1: not supported
+	pinned           bool                 // uses a dedicated uplink connection
+	nodeConns        map[string]*nodeConn // cluster/shards mode and replicas, by address
+	replica          AddrSpec             // replica the client reads from
+	primaryReads     bool                 // CLIENT REPLICA-READS OFF
+
+	holdsPermission bool
+	tx              txState
+	subs            subscriptions
+	nsQueued        []*resp.Msg // requests queued in MULTI, for namespaceReply
+	limiter         rateLimiter
 }
 
 func NewClientHandler(cliConn *resp.Conn, proxy *Proxy) *ClientHandler {
-	return &ClientHandler{cliConn: cliConn, proxy: proxy}
+	ch := &ClientHandler{
+		cliConn: cliConn,
+		proxy:   proxy,
+		subs:    newSubscriptions(),
+		proto:   DefaultProto,
+
+		nodeConns: map[string]*nodeConn{},
+	}
+	ch.tx.Reset()
+	return ch
 }
 
 func (ch *ClientHandler) Run() {
-	log.Printf("Handling new client: connection from %s", ch.cliConn.RemoteAddr())
+	if ch.certIdentity != "" {
+		log.Printf("Handling new client: connection from %s (certificate: %s)", ch.cliConn.RemoteAddr(), ch.certIdentity)
+	} else {
+		log.Printf("Handling new client: connection from %s", ch.cliConn.RemoteAddr())
+	}
 
 	defer func() {
 		ch.cliConn.Close()
 		if ch.uplinkConn != nil {
 			ch.uplinkConn.Close()
 		}
+		ch.closeNodeConns()
+		if ch.pinned {
+			ch.proxy.pool.Unpin()
+		}
+		ch.releasePermission()
 	}()
 
 	for !ch.done {
-		req := ch.readMsgFromClient()
-		if req == nil {
-			continue
+		reqs := ch.readPipelineFromClient()
+		ch.applyConnOptions()
+		for len(reqs) > 0 && !ch.done {
+			i := firstSpecialRequest(reqs)
+			switch {
+			case i > 0:
+				ch.handleRequests(reqs[:i])
+				reqs = reqs[i:]
+			case ch.tx.inMulti:
+				// Redis will just queue it.
+				ch.handleRequests(reqs[:1])
+				reqs = reqs[1:]
+			case reqs[0].Op() == resp.MsgOpSubscribe:
+				reqs = ch.runPubSub(reqs)
+			default:
+				ch.handleBlockingRequest(reqs[0])
+				reqs = reqs[1:]
+			}
 		}
-		ch.handleRequest(req)
 	}
 }
 
-func (ch *ClientHandler) dialUplink(config *Config) error {
+// firstSpecialRequest returns the index of the first request that
+// can't be forwarded as part of a batch: one that would switch the
+// client into push mode, or a blocking command.  Returns len(reqs)
+// if there is none.
+func firstSpecialRequest(reqs []*resp.Msg) int {
+	for i, req := range reqs {
+		if req.Op() == resp.MsgOpSubscribe || isBlockingRequest(req) {
+			return i
+		}
+	}
+	return len(reqs)
+}
+
+func (ch *ClientHandler) dialUplink(config *Config, uplink *AddrSpec) error {
 	if ch.uplinkConn != nil {
 		ch.uplinkConn.Close()
 		ch.uplinkConn = nil
 	}
+	ch.uplinkClientID = 0
 
-	conn, err := config.Uplink.Dial()
+	conn, err := uplink.Dial()
 	if err != nil {
 		return err
 	}
@@ -55,6 +128,9 @@ func (ch *ClientHandler) dialUplink(config *Config) error {
 		config.ReadTimeLimitMs,
 		config.LogMessages,
 	)
+	if uplink.Pass != "" || uplink.User != "" {
+		return ch.uplinkConn.AuthenticateUser(uplink.User, uplink.Pass)
+	}
 	return nil
 }
 
@@ -62,6 +138,11 @@ func (ch *ClientHandler) readMsgFromClient() *resp.Msg {
 	req, err := ch.cliConn.ReadMsg()
 	if err != nil {
 		ch.done = true
+		if ch.tx.Active() && resp.IsNetTimeout(err) {
+			log.Printf("Closing %s: transaction exceeded read_time_limit_ms\n",
+				ch.cliConn.RemoteAddr().String())
+			return nil
+		}
 		log.Printf("Could not read from %s: %v\n",
 			ch.cliConn.RemoteAddr().String(),
 			err)
@@ -70,8 +151,36 @@ func (ch *ClientHandler) readMsgFromClient() *resp.Msg {
 	return req
 }
 
-func (ch *ClientHandler) writeToClient(data []byte) bool {
+// readPipelineFromClient blocks until at least one request arrives,
+// and then collects all requests the client has already sent (up to
+// MaxPipelineLength), without waiting for more.
+func (ch *ClientHandler) readPipelineFromClient() []*resp.Msg {
+	req := ch.readMsgFromClient()
+	if req == nil {
+		return nil
+	}
+	reqs := []*resp.Msg{req}
+	for len(reqs) < MaxPipelineLength && ch.cliConn.Buffered() > 0 {
+		req := ch.readMsgFromClient()
+		if req == nil {
+			break
+		}
+		reqs = append(reqs, req)
+	}
+	return reqs
+}
+
+// sendToClient is safe to call from multiple goroutines.
+func (ch *ClientHandler) sendToClient(data []byte) error {
+	ch.cliMu.Lock()
+	defer ch.cliMu.Unlock()
+
 	_, err := ch.cliConn.Write(data)
+	return err
+}
+
+func (ch *ClientHandler) writeToClient(data []byte) bool {
+	err := ch.sendToClient(data)
 	if err != nil {
 		log.Printf("Could not write to %s: %v\n",
 			ch.cliConn.RemoteAddr().String(),
@@ -82,39 +191,103 @@ func (ch *ClientHandler) writeToClient(data []byte) bool {
 	return true
 }
 
-func (ch *ClientHandler) preprocessRequest(req *resp.Msg) bool {
+// preprocessRequest handles requests that never reach uplink.  It
+// returns nil if req should be forwarded, or the reply that should
+// be sent to the client in its place.
+func (ch *ClientHandler) preprocessRequest(req *resp.Msg) []byte {
 	if req.Op() == resp.MsgOpBroken {
-		ch.writeToClient(resp.MsgParseError)
 		ch.done = true
-		return false
+		return resp.MsgParseError
 	}
 
-	if req.Op() == resp.MsgOpAuth {
-		if ch.proxy.RequiresClientAuth() {
-			ch.cliAuthenticated = (req.FirstArg() == ch.proxy.config.Listen.Pass)
-			if ch.cliAuthenticated {
-				ch.writeToClient(resp.MsgOk)
-			} else {
-				ch.writeToClient(resp.MsgInvalidPass)
-			}
-		} else {
-			ch.writeToClient(resp.MsgNoPasswordSet)
+	switch {
+	case req.Op() == resp.MsgOpHello:
+		// Forwarded, so it goes through the checks below like any
+		// other request.
+		if reply := ch.preprocessHello(req); reply != nil {
+			return reply
 		}
-		return false
+	case req.Op() == resp.MsgOpAuth || isAuthWithUser(req):
+		return ch.handleAuth(req)
+	case ch.proxy.RequiresClientAuth() && !ch.cliAuthenticated:
+		return resp.MsgNoAuth
+	}
+	if reply := ch.applyRateLimits(req); reply != nil {
+		return reply
+	}
+	if reply := ch.checkCommandPolicy(req); reply != nil {
+		return reply
+	}
+	if reply := ch.checkPermissions(req); reply != nil {
+		return reply
 	}
 
-	if ch.proxy.RequiresClientAuth() && !ch.cliAuthenticated {
-		ch.writeToClient(resp.MsgNoAuth)
-		return false
+	if isReplicaReadsRequest(req) {
+		return ch.handleReplicaReads(req)
 	}
 
-	return true
+	if ch.proxy.config.RoutesByKey() {
+		switch req.Op() {
+		case resp.MsgOpMulti, resp.MsgOpExec, resp.MsgOpDiscard, resp.MsgOpWatch, resp.MsgOpUnwatch:
+			return MsgRoutingNoTx
+		}
+	}
+
+	if ns := ch.namespace(); ns != "" {
+		return namespaceRequest(ns, req)
+	}
+	return nil
 }
 
 func (ch *ClientHandler) postprocessRequest(req, res *resp.Msg) {
 	if (req.Op() == resp.MsgOpSelect) && res.IsOk() {
 		ch.db = req.FirstArgInt()
 	}
+	if db := ch.tx.Update(req, res); db != -1 {
+		ch.db = db
+	}
+	if proto := helloProto(req); proto != 0 && !res.IsError() && !res.IsQueued() {
+		ch.proto = proto
+	}
+}
+
+// acquirePermission returns false if the client has to be told to
+// come back later, because too many requests are waiting for the
+// proxy.
+func (ch *ClientHandler) acquirePermission() bool {
+	if !ch.holdsPermission {
+		if !ch.proxy.tryEnterExecution() {
+			return false
+		}
+		ch.holdsPermission = true
+	}
+	return true
+}
+
+func (ch *ClientHandler) releasePermission() {
+	if ch.holdsPermission {
+		ch.proxy.leaveExecution()
+		ch.holdsPermission = false
+	}
+}
+
+// updateTransactionDeadline makes sure that the client completes
+// its transaction within read_time_limit_ms, counting from the
+// request that started it.
+func (ch *ClientHandler) updateTransactionDeadline() {
+	if !ch.tx.Active() {
+		if !ch.tx.deadline.IsZero() {
+			ch.tx.deadline = time.Time{}
+			ch.cliConn.SetReadDeadline(ch.tx.deadline)
+		}
+		return
+	}
+
+	limitMs := ch.proxy.config.ReadTimeLimitMs
+	if ch.tx.deadline.IsZero() && limitMs > 0 {
+		ch.tx.deadline = time.Now().Add(time.Duration(limitMs) * time.Millisecond)
+		ch.cliConn.SetReadDeadline(ch.tx.deadline)
+	}
 }
 
 func callAndMeasure(callable func() error) (time.Duration, error) {
@@ -123,61 +296,168 @@ func callAndMeasure(callable func() error) (time.Duration, error) {
 	return time.Since(startTs), err
 }
 
-func (ch *ClientHandler) handleRequest(req *resp.Msg) {
-	startTs := time.Now()
+// ensureUplink (re)connects to uplink if there is no connection yet,
+// or if the configuration changed since the connection was made.
+// The client stays pinned to that connection from now on.  Returns
+// time spent talking to Redis.
+func (ch *ClientHandler) ensureUplink(config *Config) (time.Duration, error) {
+	return ch.ensureUplinkTo(config, config.Uplink)
+}
+
+// ensureUplinkTo works like ensureUplink, for a specific Redis server
+// (e.g. a cluster node or shard) instead of the configured uplink.
+func (ch *ClientHandler) ensureUplinkTo(config *Config, uplink AddrSpec) (time.Duration, error) {
 	redisCallDuration := time.Duration(0)
-	defer func() {
-		statRecordRequest(time.Since(startTs), redisCallDuration)
-	}()
+	uplink = ch.withUplinkCredentials(config, uplink)
 
-	if !ch.preprocessRequest(req) {
-		return
+	if !ch.pinned {
+		ch.pinned = true
+		ch.proxy.pool.Pin()
 	}
 
-	res, err := ch.proxy.CallUplink(func() (*resp.Msg, error) {
-		config := ch.proxy.config
-		currUplinkConf := &config.Uplink
-		if (ch.uplinkConf == nil) || *ch.uplinkConf != *currUplinkConf {
-			ch.uplinkConf = currUplinkConf
+	if (ch.uplinkConf != nil) && *ch.uplinkConf == uplink {
+		return redisCallDuration, nil
+	}
+	if ch.uplinkConn != nil && ch.tx.Active() {
+		// Keep the connection the transaction was started on.
+		return redisCallDuration, nil
+	}
+	ch.uplinkConf = &uplink
 
-			duration, err := callAndMeasure(func() error { return ch.dialUplink(config) })
-			redisCallDuration += duration
-			if err != nil {
-				return nil, err
-			}
+	duration, err := callAndMeasure(func() error { return ch.dialUplink(config, ch.uplinkConf) })
+	redisCallDuration += duration
+	if err != nil {
+		return redisCallDuration, err
+	}
 
-			if ch.uplinkConf.Pass != "" {
-				duration, err := callAndMeasure(func() error { return ch.uplinkConn.Authenticate(ch.uplinkConf.Pass) })
-				redisCallDuration += duration
-				if err != nil {
-					return nil, err
-				}
-			}
+	if ch.db != 0 {
+		duration, err := callAndMeasure(func() error { return ch.uplinkConn.Select(ch.db) })
+		redisCallDuration += duration
+		if err != nil {
+			return redisCallDuration, err
+		}
+	}
 
-			if ch.db != 0 {
-				duration, err := callAndMeasure(func() error { return ch.uplinkConn.Select(ch.db) })
-				redisCallDuration += duration
-				if err != nil {
-					return nil, err
-				}
-			}
+	if ch.proto != DefaultProto {
+		duration, err := callAndMeasure(func() error { return ch.uplinkConn.Hello(ch.proto) })
+		redisCallDuration += duration
+		if err != nil {
+			return redisCallDuration, err
 		}
+	}
+	return redisCallDuration, nil
+}
 
+// usePool returns true if the batch can go through a shared uplink
+// connection.
+func (ch *ClientHandler) usePool(config *Config, reqs []*resp.Msg) bool {
+	if ch.pinned || !config.Pool.Enabled() || ch.uplinkCredentials(config) != nil {
+		return false
+	}
+	for _, req := range reqs {
+		if config.Pool.Pins(req) {
+			return false
+		}
+	}
+	return true
+}
+
+// forwardToPool sends a batch of requests over a connection borrowed
+// from the pool.
+func (ch *ClientHandler) forwardToPool(config *Config, reqs []*resp.Msg) ([]*resp.Msg, time.Duration, error) {
+	redisReqTs := time.Now()
+	pc, err := ch.proxy.pool.Get(config)
+	if err != nil {
+		return nil, time.Since(redisReqTs), err
+	}
+	res, err := pc.conn.CallPipeline(reqs)
+	ch.proxy.pool.Put(pc, config, err != nil)
+	return res, time.Since(redisReqTs), err
+}
+
+// forwardToUplink sends a batch of requests to uplink and reads
+// their replies.  Must be called with execution permission.  Returns
+// time spent talking to Redis.
+func (ch *ClientHandler) forwardToUplink(reqs []*resp.Msg) ([]*resp.Msg, time.Duration, error) {
+	config := ch.proxy.config
+	if config.RoutesByKey() {
+		return ch.forwardToNodes(config, reqs)
+	}
+	if replica, ok := ch.replicaFor(config, reqs); ok {
 		redisReqTs := time.Now()
-		_, err := ch.uplinkConn.WriteMsg(req)
-		if err != nil {
-			redisCallDuration += time.Since(redisReqTs)
-			return nil, err
+		res, err := ch.callNode(config, replica, reqs)
+		if err == nil {
+			return res, time.Since(redisReqTs), nil
 		}
-		resp, err := ch.uplinkConn.ReadMsg()
-		redisCallDuration += time.Since(redisReqTs)
-		return resp, err
-	})
+		// Reads are safe to retry on uplink.
+		log.Printf("Replica %s: %v, reading from uplink\n", replica.Addr, err)
+	}
+	if ch.usePool(config, reqs) {
+		return ch.forwardToPool(config, reqs)
+	}
+
+	redisCallDuration, err := ch.ensureUplink(config)
 	if err != nil {
-		log.Printf("Error: %v\n", err)
-		ch.done = true
-		return
+		return nil, redisCallDuration, err
 	}
-	ch.postprocessRequest(req, res)
-	ch.writeToClient(res.Data())
+
+	redisReqTs := time.Now()
+	res, err := ch.uplinkConn.CallPipeline(reqs)
+	return res, redisCallDuration + time.Since(redisReqTs), err
+}
+
+// handleRequests processes a pipeline of requests read from the
+// client.  Requests that have to reach uplink are sent there in a
+// single batch, and all replies go back to the client in the order of
+// requests.
+func (ch *ClientHandler) handleRequests(reqs []*resp.Msg) {
+	startTs := time.Now()
+	redisCallDuration := time.Duration(0)
+	defer func() {
+		statRecordRequest(time.Since(startTs), redisCallDuration)
+	}()
+
+	replies := make([][]byte, 0, len(reqs))
+	forwarded := make([]*resp.Msg, 0, len(reqs))
+	forwardedIdx := make([]int, 0, len(reqs))
+	for _, req := range reqs {
+		reply := ch.preprocessRequest(req)
+		if reply == nil {
+			forwardedIdx = append(forwardedIdx, len(replies))
+			forwarded = append(forwarded, forwardedRequest(req))
+		}
+		replies = append(replies, reply)
+		if ch.done {
+			// Broken request: drop everything after it.
+			break
+		}
+	}
+
+	if len(forwarded) > 0 && !ch.acquirePermission() {
+		for _, i := range forwardedIdx {
+			replies[i] = MsgTooManyWaiting
+		}
+		forwarded = nil
+	}
+	if len(forwarded) > 0 {
+		res, duration, err := ch.forwardToUplink(forwarded)
+		redisCallDuration += duration
+		if err != nil {
+			log.Printf("Error: %v\n", err)
+			ch.tx.Reset()
+			ch.releasePermission()
+			ch.done = true
+			return
+		}
+		for i, msg := range res {
+			ch.postprocessRequest(forwarded[i], msg)
+			replies[forwardedIdx[i]] = ch.rewriteReply(forwarded[i], msg).Data()
+		}
+		if !ch.tx.Active() {
+			ch.releasePermission()
+		}
+		ch.updateTransactionDeadline()
+	}
+
+	ch.writeToClient(bytes.Join(replies, nil))
 }
@@ -0,0 +1,280 @@
+package rproxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Codility/redis-proxy/resp"
+)
+
+// Redis Cluster
+//
+// With `cluster.enabled`, `uplink` is the seed node of a Redis
+// Cluster (and the template for connections to all other nodes:
+// password, TLS etc.).  The proxy loads the slot map with CLUSTER
+// SLOTS, and routes every request to the node that owns the slot of
+// its keys, so that clients don't need to know they talk to a
+// cluster.  MOVED and ASK redirects are followed transparently, and
+// MOVED triggers a refresh of the slot map.
+//
+// Requests whose keys hash to different slots get a CROSSSLOT error
+// from the proxy.  Commands whose keys the proxy doesn't know, and
+// ones that work on the whole keyspace (KEYS, SCAN, DBSIZE, FLUSHDB,
+// RANDOMKEY...), which a single node can't answer, get an error too.
+// Transactions are not supported in cluster mode, and the connection
+// pool is not used.
+
+const (
+	DefaultClusterMaxRedirects = 5
+
+	clusterRefreshInterval = time.Second
+)
+
+var (
+	MsgCrossSlot          = []byte("-CROSSSLOT Keys in request don't hash to the same slot (redis-proxy)\r\n")
+	MsgClusterUnsupported = []byte("-ERR Command not supported in cluster mode (redis-proxy)\r\n")
+)
+
+type ClusterConfig struct {
+	Enabled      bool `json:"enabled"`
+	MaxRedirects int  `json:"max_redirects"`
+}
+
+func (cc *ClusterConfig) Prepare() ErrorList {
+	errors := ErrorList{}
+	if cc.MaxRedirects < 0 {
+		errors.Add("cluster.max_redirects must not be negative")
+	}
+	if cc.MaxRedirects == 0 {
+		cc.MaxRedirects = DefaultClusterMaxRedirects
+	}
+	return errors
+}
+
+type ClusterInfo struct {
+	Nodes        []string `json:"nodes"`
+	SlotsCovered int      `json:"slots_covered"`
+}
+
+////////////////////////////////////////
+// ClusterRouter
+
+// ClusterRouter keeps the slot map, shared by all clients.
+type ClusterRouter struct {
+	mu         sync.Mutex
+	seed       AddrSpec
+	slots      [resp.ClusterSlots]string
+	loaded     bool
+	loadedAt   time.Time
+	refreshing bool
+}
+
+func NewClusterRouter() *ClusterRouter {
+	return &ClusterRouter{}
+}
+
+// NodeFor returns address of the node serving slot (-1: any node).
+// Loads the slot map if there is none yet, or uplink changed.
+func (cr *ClusterRouter) NodeFor(config *Config, slot int) (string, error) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	if !cr.loaded || cr.seed != config.Uplink {
+		if err := cr.load(config); err != nil {
+			return "", err
+		}
+	}
+	if slot == -1 {
+		return config.Uplink.Addr, nil
+	}
+	if cr.slots[slot] == "" {
+		return "", fmt.Errorf("Slot %d is not served by any cluster node", slot)
+	}
+	return cr.slots[slot], nil
+}
+
+// Moved records a MOVED redirect, and refreshes the slot map in the
+// background.
+func (cr *ClusterRouter) Moved(config *Config, slot int, addr string) {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	cr.slots[slot] = addr
+	if cr.refreshing || time.Since(cr.loadedAt) < clusterRefreshInterval {
+		return
+	}
+	cr.refreshing = true
+	go func() {
+		cr.mu.Lock()
+		defer cr.mu.Unlock()
+		cr.load(config)
+		cr.refreshing = false
+	}()
+}
+
+func (cr *ClusterRouter) Info() *ClusterInfo {
+	cr.mu.Lock()
+	defer cr.mu.Unlock()
+
+	info := &ClusterInfo{Nodes: []string{}}
+	seen := map[string]bool{}
+	for _, addr := range cr.slots {
+		if addr == "" {
+			continue
+		}
+		info.SlotsCovered++
+		if !seen[addr] {
+			seen[addr] = true
+			info.Nodes = append(info.Nodes, addr)
+		}
+	}
+	return info
+}
+
+// load reads the slot map from the seed node, or (if that fails)
+// from any other known node.  Must be called with cr.mu held.
+func (cr *ClusterRouter) load(config *Config) error {
+	candidates := []string{config.Uplink.Addr}
+	if cr.seed == config.Uplink {
+		for _, addr := range cr.slots {
+			if addr != "" && addr != candidates[len(candidates)-1] {
+				candidates = append(candidates, addr)
+			}
+		}
+	}
+
+	var lastErr error
+	for _, addr := range candidates {
+		slots, err := loadClusterSlots(config, addr)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		cr.slots = slots
+		cr.seed = config.Uplink
+		cr.loaded = true
+		cr.loadedAt = time.Now()
+		return nil
+	}
+	cr.loadedAt = time.Now()
+	return fmt.Errorf("Could not load cluster slots: %v", lastErr)
+}
+
+func loadClusterSlots(config *Config, addr string) ([resp.ClusterSlots]string, error) {
+	var slots [resp.ClusterSlots]string
+
+	node := clusterNode(config, addr)
+	rc, err := node.DialRedis(config.ReadTimeLimitMs, config.LogMessages)
+	if err != nil {
+		return slots, err
+	}
+	defer rc.Close()
+
+	res, err := rc.Call(resp.MsgFromStrings("CLUSTER", "SLOTS"))
+	if err != nil {
+		return slots, err
+	}
+	ranges := res.Elements()
+	if ranges == nil {
+		return slots, fmt.Errorf("CLUSTER SLOTS failed: %s", strings.TrimSpace(res.String()))
+	}
+
+	seedHost, _, _ := net.SplitHostPort(addr)
+	for _, r := range ranges {
+		elems := r.Elements()
+		if len(elems) < 3 {
+			return slots, errors.New("Unexpected CLUSTER SLOTS reply: " + r.String())
+		}
+		start, ok1 := elems[0].Int()
+		end, ok2 := elems[1].Int()
+		master := elems[2].Elements()
+		if !ok1 || !ok2 || len(master) < 2 || start < 0 || end >= resp.ClusterSlots {
+			return slots, errors.New("Unexpected CLUSTER SLOTS reply: " + r.String())
+		}
+		host, _ := master[0].Str()
+		port, _ := master[1].Int()
+		if host == "" || host == "?" {
+			host = seedHost
+		}
+		nodeAddr := net.JoinHostPort(host, strconv.FormatInt(port, 10))
+		for slot := start; slot <= end; slot++ {
+			slots[slot] = nodeAddr
+		}
+	}
+	return slots, nil
+}
+
+// clusterNode returns AddrSpec of a cluster node: uplink with a
+// different address.
+func clusterNode(config *Config, addr string) AddrSpec {
+	node := config.Uplink
+	node.Addr = addr
+	return node
+}
+
+// parseRedirect parses "-MOVED <slot> <addr>" and "-ASK <slot> <addr>"
+// errors.
+func parseRedirect(msg *resp.Msg) (kind string, slot int, addr string, ok bool) {
+	if !msg.IsError() {
+		return "", 0, "", false
+	}
+	fields := strings.Fields(strings.TrimPrefix(msg.String(), "-"))
+	if len(fields) != 3 || (fields[0] != "MOVED" && fields[0] != "ASK") {
+		return "", 0, "", false
+	}
+	slot, err := strconv.Atoi(fields[1])
+	if err != nil || slot < 0 || slot >= resp.ClusterSlots {
+		return "", 0, "", false
+	}
+	return fields[0], slot, fields[2], true
+}
+
+////////////////////////////////////////
+// ClientHandler: cluster mode (see also nodes.go)
+
+// requestSlot returns the slot all keys of req hash to (-1 for
+// requests without keys), or an error reply.
+func requestSlot(req *resp.Msg) (int, []byte) {
+	if !req.KeysKnown() {
+		return 0, MsgClusterUnsupported
+	}
+	slot := -1
+	for _, key := range req.Keys() {
+		keySlot := resp.HashSlot(key)
+		if slot != -1 && keySlot != slot {
+			return 0, MsgCrossSlot
+		}
+		slot = keySlot
+	}
+	return slot, nil
+}
+
+// followRedirects re-sends requests that got MOVED or ASK errors to
+// the node the error points to.
+func (ch *ClientHandler) followRedirects(config *Config, reqs, res []*resp.Msg) error {
+	for i, req := range reqs {
+		for n := 0; n < config.Cluster.MaxRedirects; n++ {
+			kind, slot, addr, ok := parseRedirect(res[i])
+			if !ok {
+				break
+			}
+			batch := []*resp.Msg{req}
+			if kind == "MOVED" {
+				ch.proxy.cluster.Moved(config, slot, addr)
+			} else {
+				batch = []*resp.Msg{resp.MsgFromStrings("ASKING"), req}
+			}
+			replies, err := ch.callNode(config, clusterNode(config, addr), batch)
+			if err != nil {
+				return err
+			}
+			res[i] = replies[len(replies)-1]
+		}
+	}
+	return nil
+}
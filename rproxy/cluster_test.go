@@ -0,0 +1,102 @@
+package rproxy
+
+import (
+	"testing"
+
+	"github.com/Codility/redis-proxy/fakeredis"
+	"github.com/Codility/redis-proxy/resp"
+	"github.com/stvp/assert"
+)
+
+// Slots: "bar" -> 5061, "foo" -> 12182
+func startFakeCluster() (*fakeredis.FakeRedisServer, *fakeredis.FakeRedisServer) {
+	srv_a := fakeredis.Start("srv-a", "tcp")
+	srv_b := fakeredis.Start("srv-b", "tcp")
+	slots := []fakeredis.ClusterSlotRange{
+		{Start: 0, End: 8191, Addr: srv_a.Addr().String()},
+		{Start: 8192, End: 16383, Addr: srv_b.Addr().String()},
+	}
+	srv_a.SetClusterSlots(slots)
+	srv_b.SetClusterSlots(slots)
+	return srv_a, srv_b
+}
+
+func startClusterProxy(t *testing.T, seed *fakeredis.FakeRedisServer) *Proxy {
+	return mustStartTestProxy(t, &TestConfigLoader{
+		conf: &Config{
+			Uplink:  AddrSpec{Addr: seed.Addr().String()},
+			Listen:  AddrSpec{Addr: "127.0.0.1:0"},
+			Cluster: ClusterConfig{Enabled: true},
+		},
+	})
+}
+
+func TestProxyClusterRouting(t *testing.T) {
+	srv_a, srv_b := startFakeCluster()
+	defer srv_a.Stop()
+	defer srv_b.Stop()
+
+	proxy := startClusterProxy(t, srv_a)
+	defer proxy.Stop()
+
+	c := resp.MustDial("tcp", proxy.ListenAddr().String(), 0, false)
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("GET", "foo")).String(), "$5\r\nsrv-b\r\n")
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("GET", "bar")).String(), "$5\r\nsrv-a\r\n")
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("MGET", "{foo}1", "{foo}2")).String(), "$5\r\nsrv-b\r\n")
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("MGET", "foo", "bar")).String(),
+		"-CROSSSLOT Keys in request don't hash to the same slot (redis-proxy)\r\n")
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("MULTI")).String(),
+		"-ERR Transactions are not supported in cluster or shards mode (redis-proxy)\r\n")
+
+	// Requests without keys go to the seed node
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("PING")).String(), "$5\r\nsrv-a\r\n")
+
+	// Commands with unknown keys, and keyspace-wide ones, are refused
+	for _, req := range [][]string{
+		{"KEYS", "*"}, {"SCAN", "0"}, {"DBSIZE"}, {"FLUSHDB"}, {"FLUSHALL"}, {"RANDOMKEY"}, {"FOO.BAR", "foo"},
+	} {
+		assert.Equal(t, c.MustCall(resp.MsgFromStrings(req...)).String(),
+			"-ERR Command not supported in cluster mode (redis-proxy)\r\n", req)
+	}
+
+	// Pipelined requests to different nodes come back in order
+	c.MustWriteMsgs([]*resp.Msg{
+		resp.MsgFromStrings("GET", "foo"),
+		resp.MsgFromStrings("GET", "bar"),
+		resp.MsgFromStrings("GET", "foo"),
+	})
+	assert.Equal(t, c.MustReadMsg().String(), "$5\r\nsrv-b\r\n")
+	assert.Equal(t, c.MustReadMsg().String(), "$5\r\nsrv-a\r\n")
+	assert.Equal(t, c.MustReadMsg().String(), "$5\r\nsrv-b\r\n")
+
+	info := proxy.GetInfo().Cluster
+	assert.Equal(t, info.SlotsCovered, 16384)
+	assert.Equal(t, len(info.Nodes), 2)
+}
+
+func TestProxyClusterRedirects(t *testing.T) {
+	srv_a, srv_b := startFakeCluster()
+	defer srv_a.Stop()
+	defer srv_b.Stop()
+
+	proxy := startClusterProxy(t, srv_a)
+	defer proxy.Stop()
+
+	c := resp.MustDial("tcp", proxy.ListenAddr().String(), 0, false)
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("GET", "foo")).String(), "$5\r\nsrv-b\r\n")
+
+	// Slot "bar" is being migrated to srv-b
+	srv_a.SetMigrating(5061, srv_b.Addr().String())
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("GET", "bar")).String(), "$5\r\nsrv-b\r\n")
+	assert.Equal(t, srv_b.LastRequest().String(), resp.MsgFromStrings("GET", "bar").String())
+	srv_a.SetMigrating(5061, "")
+
+	// All slots moved to srv-a
+	slots := []fakeredis.ClusterSlotRange{{Start: 0, End: 16383, Addr: srv_a.Addr().String()}}
+	srv_a.SetClusterSlots(slots)
+	srv_b.SetClusterSlots(slots)
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("GET", "foo")).String(), "$5\r\nsrv-a\r\n")
+	assert.Equal(t, srv_b.LastRequest().String(), resp.MsgFromStrings("GET", "foo").String())
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("GET", "foo")).String(), "$5\r\nsrv-a\r\n")
+	assert.Equal(t, srv_b.LastRequest().String(), resp.MsgFromStrings("GET", "foo").String())
+}
@@ -8,10 +8,12 @@ const (
 	CmdReload
 	CmdStop
 	CmdTerminateRawConnections
+	CmdSetUplink
 )
 
 type commandCall struct {
 	cmd         command
+	arg         interface{}
 	respChannel chan commandResponse
 }
 
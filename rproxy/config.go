@@ -2,14 +2,20 @@ package rproxy
 
 import (
 	"crypto/tls"
-	"crypto/x509"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"io"
 	"io/ioutil"
 	"log"
 	"net"
+	"os"
+	"reflect"
 	"strings"
+	"sync"
+	"time"
+
+	"github.com/Codility/redis-proxy/resp"
 )
 
 const (
@@ -19,28 +25,56 @@ const (
 ////////////////////////////////////////
 // ErrorList
 
+const (
+	SeverityError   = "error"
+	SeverityWarning = "warning"
+)
+
+// ConfigError is an entry of ErrorList.  Field is the path of the
+// config field it's about ("listen.certfile"), if known.
+type ConfigError struct {
+	Field    string `json:"field,omitempty"`
+	Message  string `json:"message"`
+	Severity string `json:"severity"`
+}
+
 type ErrorList struct {
-	errors []string
+	items []ConfigError
 }
 
+// Errors returns messages of errors (not warnings).
 func (l *ErrorList) Errors() []string {
-	if l.errors == nil {
-		return []string{}
-	} else {
-		return l.errors
+	res := []string{}
+	for _, item := range l.items {
+		if item.Severity == SeverityError {
+			res = append(res, item.Message)
+		}
 	}
+	return res
+}
+
+// Items returns all errors and warnings.
+func (l *ErrorList) Items() []ConfigError {
+	if l.items == nil {
+		return []ConfigError{}
+	}
+	return l.items
 }
 
 func (l *ErrorList) Add(error string) {
-	l.errors = append(l.errors, error)
+	l.items = append(l.items, ConfigError{errorField(error), error, SeverityError})
+}
+
+func (l *ErrorList) AddWarning(warning string) {
+	l.items = append(l.items, ConfigError{errorField(warning), warning, SeverityWarning})
 }
 
 func (l *ErrorList) Ok() bool {
-	return l.errors == nil || len(l.errors) == 0
+	return len(l.Errors()) == 0
 }
 
 func (l *ErrorList) Append(other ErrorList) {
-	l.errors = append(l.errors, other.errors...)
+	l.items = append(l.items, other.items...)
 }
 
 func (l *ErrorList) AsError() error {
@@ -50,19 +84,49 @@ func (l *ErrorList) AsError() error {
 	return errors.New(strings.Join(l.Errors(), ", "))
 }
 
+// errorField finds the config field a message is about: the first
+// word that is a path starting with a top-level field ("listen",
+// "limits.on_exceeded", "users[alice].commands").
+func errorField(message string) string {
+	for _, word := range strings.Fields(message) {
+		word = strings.TrimRight(word, ":,")
+		top := word
+		if i := strings.IndexAny(top, ".["); i != -1 {
+			top = top[:i]
+		}
+		if _, ok := reloadableFields[top]; ok {
+			return word
+		}
+	}
+	return ""
+}
+
 ////////////////////////////////////////
 // AddrSpec
 
 type AddrSpec struct {
 	Addr    string `json:"addr"`
+	User    string `json:"user,omitempty"` // Redis ACL user, with pass
 	Pass    string `json:"pass"`
 	TLS     bool   `json:"tls"`
 	Network string `json:"network"`
 
+	// Read pass from a file or an environment variable instead
+	PassFile string `json:"pass_file,omitempty"`
+	PassEnv  string `json:"pass_env,omitempty"`
+
 	CertFile   string `json:"certfile"`
 	KeyFile    string `json:"keyfile"`
 	CACertFile string `json:"cacertfile"`
 	SkipVerify bool   `json:"skipverify,omitempty"`
+
+	ServerName    string `json:"server_name,omitempty"` // for connecting only
+	MinTLSVersion string `json:"min_tls_version,omitempty"`
+	CipherSuites  string `json:"cipher_suites,omitempty"` // comma-separated
+
+	// Client certificates (listening addresses only)
+	ClientCACertFile string `json:"client_cacertfile,omitempty"`
+	ClientAuth       string `json:"client_auth,omitempty"` // "request" or "require"
 }
 
 func (as *AddrSpec) AsJSON() string {
@@ -74,6 +138,12 @@ func (as *AddrSpec) AsJSON() string {
 }
 
 func (as *AddrSpec) Dial() (net.Conn, error) {
+	return as.DialTimeout(0)
+}
+
+// DialTimeout is Dial that gives up (including the TLS handshake)
+// after timeout, if it's not 0.
+func (as *AddrSpec) DialTimeout(timeout time.Duration) (net.Conn, error) {
 	network := "tcp"
 	if as.Network != "" {
 		network = as.Network
@@ -82,30 +152,40 @@ func (as *AddrSpec) Dial() (net.Conn, error) {
 		return nil, errors.New("Unsupported network for dialing: " + network)
 	}
 
+	dialer := &net.Dialer{Timeout: timeout}
 	if !as.TLS {
-		return net.Dial(network, as.Addr)
+		return dialer.Dial(network, as.Addr)
 	}
 
-	roots := x509.NewCertPool()
-	if !as.SkipVerify {
-		// TODO: read the PEM once, not at every accept
-		certPEM, err := ioutil.ReadFile(as.CACertFile)
-		if err != nil {
-			log.Print("Could not load cert: " + err.Error())
-			return nil, err
-		}
+	// Files are read at every dial, so rotated certs get used.
+	config, err := as.clientTLSConfig()
+	if err != nil {
+		log.Print("Could not load certs: " + err.Error())
+		return nil, err
+	}
+	return tls.DialWithDialer(dialer, network, as.Addr, config)
+}
 
-		if !roots.AppendCertsFromPEM(certPEM) {
-			err := errors.New("Could not add cert to pool")
-			log.Fatal(err)
+// DialRedis connects to Redis at this address, and authenticates if
+// there is a password.
+func (as *AddrSpec) DialRedis(readTimeLimitMs int64, logMessages bool) (*resp.Conn, error) {
+	return as.DialRedisTimeout(0, readTimeLimitMs, logMessages)
+}
+
+// DialRedisTimeout is DialRedis with a dial timeout (0: none).
+func (as *AddrSpec) DialRedisTimeout(timeout time.Duration, readTimeLimitMs int64, logMessages bool) (*resp.Conn, error) {
+	conn, err := as.DialTimeout(timeout)
+	if err != nil {
+		return nil, err
+	}
+	rc := resp.NewConn(conn, readTimeLimitMs, logMessages)
+	if as.Pass != "" || as.User != "" {
+		if err := rc.AuthenticateUser(as.User, as.Pass); err != nil {
+			rc.Close()
 			return nil, err
 		}
 	}
-
-	return tls.Dial(network, as.Addr, &tls.Config{
-		RootCAs:            roots,
-		InsecureSkipVerify: as.SkipVerify,
-	})
+	return rc, nil
 }
 
 func (as *AddrSpec) Listen() (*Listener, error) {
@@ -120,46 +200,135 @@ func (as *AddrSpec) Listen() (*Listener, error) {
 
 	ln, err := net.Listen(network, as.Addr)
 	if err != nil {
-		log.Fatalf("Could not listen: %s", err)
+		log.Printf("Could not listen: %s", err)
+		return nil, err
+	}
+	wrapped, err := as.wrapListener(ln)
+	if err != nil {
+		ln.Close()
 		return nil, err
 	}
+	return wrapped, nil
+}
 
+func (as *AddrSpec) wrapListener(ln net.Listener) (*Listener, error) {
+	tlsConfig, err := as.GetTLSConfig()
+	if err != nil {
+		return nil, err
+	}
 	// AddrDeadliner requires funcs that are implemented on both
 	// net.TCPListener and net.UnixListener.  We limit the values
-	// for `network` above, so those should be the only cases, and
-	// so it's okay to assume it will crash otherwise.
-	if !as.TLS {
-		return &Listener{ln, ln.(AddrDeadliner)}, nil
-	}
-	tlsLn := tls.NewListener(ln, as.GetTLSConfig())
-	return &Listener{tlsLn, ln.(AddrDeadliner)}, nil
+	// for `network` in Listen, so those should be the only cases,
+	// and so it's okay to assume it will crash otherwise.
+	return &Listener{socket: ln, originalListener: ln.(AddrDeadliner), tlsConfig: tlsConfig}, nil
 }
 
-func (as *AddrSpec) GetTLSConfig() *tls.Config {
+// GetTLSConfig returns the config for listening at this address (nil
+// without TLS).  Certificate, key and client CA files are checked on
+// every handshake and loaded again when they change, so rotated files
+// are used without RELOAD.
+func (as *AddrSpec) GetTLSConfig() (*tls.Config, error) {
 	if !as.TLS {
-		return nil
+		return nil, nil
 	}
+	files := &serverTLSFiles{spec: *as}
+	files.stamps = files.stat()
+	config, err := as.loadTLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	files.config = config
+	return &tls.Config{GetConfigForClient: files.get}, nil
+}
+
+func (as *AddrSpec) loadTLSConfig() (*tls.Config, error) {
 	cer, err := tls.LoadX509KeyPair(as.CertFile, as.KeyFile)
 	if err != nil {
-		log.Fatalf("Could not load key pair (%s, %s): %s",
+		return nil, fmt.Errorf("Could not load key pair (%s, %s): %s",
 			as.CertFile, as.KeyFile, err)
-		return nil
 	}
 
-	return &tls.Config{
+	config := &tls.Config{
 		Certificates: []tls.Certificate{cer},
 	}
+	if as.ClientAuth != "" {
+		pool, err := loadCertPool(as.ClientCACertFile)
+		if err != nil {
+			return nil, fmt.Errorf("Could not load client CA certs (%s): %s",
+				as.ClientCACertFile, err)
+		}
+		config.ClientCAs = pool
+		config.ClientAuth = as.clientAuthType()
+	}
+	as.applyTLSOptions(config)
+	return config, nil
+}
+
+// serverTLSFiles keeps the TLS config of a listener along with sizes
+// and modification times of the files it was loaded from.
+type serverTLSFiles struct {
+	spec AddrSpec
+
+	mu     sync.Mutex
+	config *tls.Config
+	stamps []string
+}
+
+func (f *serverTLSFiles) stat() []string {
+	stamps := []string{}
+	for _, file := range []string{f.spec.CertFile, f.spec.KeyFile, f.spec.ClientCACertFile} {
+		if file == "" {
+			continue
+		}
+		stamp := ""
+		if info, err := os.Stat(file); err == nil {
+			stamp = fmt.Sprintf("%d/%d", info.Size(), info.ModTime().UnixNano())
+		}
+		stamps = append(stamps, stamp)
+	}
+	return stamps
+}
+
+// get returns the current config, loading the files again if they
+// changed.  If they can't be loaded (e.g. when only the certificate
+// has been replaced so far), the last good config is kept.
+func (f *serverTLSFiles) get(*tls.ClientHelloInfo) (*tls.Config, error) {
+	stamps := f.stat()
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if !reflect.DeepEqual(stamps, f.stamps) {
+		config, err := f.spec.loadTLSConfig()
+		if err != nil {
+			log.Printf("Keeping previous TLS config for %s: %s", f.spec.Addr, err)
+		} else {
+			f.config = config
+			f.stamps = stamps
+		}
+	}
+	return f.config, nil
 }
 
 func (as *AddrSpec) Prepare(name string, server bool) ErrorList {
+	return as.prepare(name, server, false)
+}
+
+// prepare checks the spec; offline skips checks that read files or
+// the environment, or connect anywhere.
+func (as *AddrSpec) prepare(name string, server, offline bool) ErrorList {
 	if as.Addr == "" {
-		return ErrorList{[]string{"Missing " + name + " address"}}
+		errList := ErrorList{}
+		errList.Add("Missing " + name + " address")
+		return errList
 	}
 
 	var err error
-	errors := ErrorList{}
+	errors := as.resolvePass(name, offline)
 
 	pemFileReadable := func(name string) bool {
+		if offline {
+			return true
+		}
 		_, err = ioutil.ReadFile(name)
 		if err != nil {
 			log.Print(err)
@@ -169,16 +338,27 @@ func (as *AddrSpec) Prepare(name string, server bool) ErrorList {
 
 	if as.TLS {
 		if server {
+			filesOk := false
 			if as.CertFile == "" {
 				errors.Add(name + ".tls requires certfile")
 			} else if !pemFileReadable(as.CertFile) {
 				errors.Add("could not load " + name + ".certfile: " + as.CertFile)
+			} else {
+				filesOk = true
 			}
 
 			if as.KeyFile == "" {
 				errors.Add(name + ".tls requires keyfile")
+				filesOk = false
 			} else if !pemFileReadable(as.KeyFile) {
 				errors.Add("could not load " + name + ".keyfile: " + as.KeyFile)
+				filesOk = false
+			}
+
+			if filesOk && !offline {
+				if _, err := tls.LoadX509KeyPair(as.CertFile, as.KeyFile); err != nil {
+					errors.Add("could not load " + name + ".certfile and keyfile: " + err.Error())
+				}
 			}
 		} else {
 			if !as.SkipVerify {
@@ -191,7 +371,10 @@ func (as *AddrSpec) Prepare(name string, server bool) ErrorList {
 		}
 	}
 
-	if errors.Ok() && !server {
+	errors.Append(as.prepareTLSOptions(name, server, offline))
+	errors.Append(as.prepareClientAuth(name, server, offline))
+
+	if errors.Ok() && !server && !offline {
 		conn, err := as.Dial()
 		if err != nil {
 			log.Print(err)
@@ -207,28 +390,148 @@ func (as *AddrSpec) Prepare(name string, server bool) ErrorList {
 	return errors
 }
 
+// resolvePass sets Pass from pass_file (without the trailing
+// newline) or pass_env, if either is given (not offline).
+func (as *AddrSpec) resolvePass(name string, offline bool) ErrorList {
+	errList := ErrorList{}
+	switch {
+	case as.PassFile != "" && as.PassEnv != "":
+		errList.Add(name + ".pass_file and pass_env can't be used together")
+	case offline:
+	case as.PassFile != "":
+		pass, err := ioutil.ReadFile(as.PassFile)
+		if err != nil {
+			errList.Add("could not read " + name + ".pass_file: " + err.Error())
+		} else {
+			as.Pass = strings.TrimRight(string(pass), "\r\n")
+		}
+	case as.PassEnv != "":
+		pass, ok := os.LookupEnv(as.PassEnv)
+		if !ok {
+			errList.Add(name + ".pass_env: environment variable " + as.PassEnv + " is not set")
+		} else {
+			as.Pass = pass
+		}
+	}
+	return errList
+}
+
 func (a *AddrSpec) SanitizedForPublication() *AddrSpec {
 	return &AddrSpec{
 		Addr:       a.Addr,
+		User:       a.User,
 		Pass:       SanitizedPass,
+		PassFile:   a.PassFile,
+		PassEnv:    a.PassEnv,
 		TLS:        a.TLS,
 		Network:    a.Network,
 		CertFile:   a.CertFile,
 		KeyFile:    a.KeyFile,
 		CACertFile: a.CACertFile,
+
+		ServerName:    a.ServerName,
+		MinTLSVersion: a.MinTLSVersion,
+		CipherSuites:  a.CipherSuites,
+
+		ClientCACertFile: a.ClientCACertFile,
+		ClientAuth:       a.ClientAuth,
 	}
 }
 
+////////////////////////////////////////
+// PoolConfig
+
+// Commands (optionally with subcommand) that pin the client to a
+// dedicated uplink connection unless `pool.pin_commands` says
+// otherwise.  SELECT of a non-default db, MULTI, WATCH, blocking
+// commands, subscriptions and HELLO 3 always pin the client.
+var DefaultPinCommands = []string{"CLIENT SETNAME", "CLIENT TRACKING"}
+
+type PoolConfig struct {
+	Size          int      `json:"size"`
+	IdleTimeoutMs int64    `json:"idle_timeout_ms"`
+	PinCommands   []string `json:"pin_commands"`
+}
+
+func (pc *PoolConfig) Enabled() bool {
+	return pc.Size > 0
+}
+
+func (pc *PoolConfig) Prepare() ErrorList {
+	errors := ErrorList{}
+	if pc.Size < 0 {
+		errors.Add("pool.size must not be negative")
+	}
+	if pc.IdleTimeoutMs < 0 {
+		errors.Add("pool.idle_timeout_ms must not be negative")
+	}
+	if pc.PinCommands == nil {
+		pc.PinCommands = DefaultPinCommands
+	}
+	for _, pin := range pc.PinCommands {
+		if n := len(strings.Fields(pin)); n < 1 || n > 2 {
+			errors.Add("pool.pin_commands: invalid entry: '" + pin + "'")
+		}
+	}
+	return errors
+}
+
+// Pins returns true if req makes the client depend on the state of
+// its uplink connection.
+func (pc *PoolConfig) Pins(req *resp.Msg) bool {
+	switch req.Op() {
+	case resp.MsgOpSelect:
+		return req.FirstArgInt() != 0
+	case resp.MsgOpMulti, resp.MsgOpWatch, resp.MsgOpSubscribe:
+		return true
+	case resp.MsgOpHello:
+		return helloProto(req) > DefaultProto
+	}
+	if isBlockingRequest(req) {
+		return true
+	}
+
+	for _, pin := range pc.PinCommands {
+		if matchesCommand(pin, req) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesCommand returns true if req is the command ("CLIENT") or
+// the subcommand ("CLIENT SETNAME") entry names.
+func matchesCommand(entry string, req *resp.Msg) bool {
+	parts := strings.Fields(entry)
+	if len(parts) == 0 || !strings.EqualFold(parts[0], req.Command()) {
+		return false
+	}
+	args := req.Args()
+	return len(parts) == 1 || (len(args) > 0 && strings.EqualFold(parts[1], args[0]))
+}
+
 ////////////////////////////////////////
 // Config
 
 type Config struct {
-	Uplink          AddrSpec `json:"uplink"`
-	Listen          AddrSpec `json:"listen"`
-	ListenRaw       AddrSpec `json:"listen_raw"`
-	Admin           AddrSpec `json:"admin"`
-	ReadTimeLimitMs int64    `json:"read_time_limit_ms"`
-	LogMessages     bool     `json:"log_messages"`
+	Uplink          AddrSpec       `json:"uplink"`
+	Listen          AddrSpec       `json:"listen"`
+	ListenRaw       AddrSpec       `json:"listen_raw"`
+	Admin           AddrSpec       `json:"admin"`
+	Sentinel        SentinelConfig `json:"sentinel"`
+	Cluster         ClusterConfig  `json:"cluster"`
+	Shards          []ShardSpec    `json:"shards,omitempty"`
+	Replicas        ReplicasConfig `json:"replicas"`
+	Pool            PoolConfig     `json:"pool"`
+	Users           []UserConfig   `json:"users,omitempty"`
+	Commands        CommandPolicy  `json:"commands"`
+	ListenCommands  CommandPolicy  `json:"listen_commands"`
+	ListenNamespace string         `json:"listen_namespace,omitempty"`
+	Limits          LimitsConfig   `json:"limits"`
+	ReadTimeLimitMs int64          `json:"read_time_limit_ms"`
+	LogMessages     bool           `json:"log_messages"`
+
+	shardRing *ShardRing
 }
 
 type ConfigLoader interface {
@@ -236,16 +539,55 @@ type ConfigLoader interface {
 }
 
 func (c *Config) Prepare() ErrorList {
+	return c.prepare(false)
+}
+
+// PrepareOffline does the checks of Prepare that don't read files or
+// the environment, or connect anywhere: for configs from untrusted
+// sources, like the admin API.
+func (c *Config) PrepareOffline() ErrorList {
+	return c.prepare(true)
+}
+
+func (c *Config) prepare(offline bool) ErrorList {
 	errList := ErrorList{}
 
 	if c.Admin.Addr != "" {
-		errList.Append(c.Admin.Prepare("admin", true))
+		errList.Append(c.Admin.prepare("admin", true, offline))
+	}
+	errList.Append(c.Listen.prepare("listen", true, offline))
+	if c.Sentinel.Enabled() {
+		sentinelErrors := c.Sentinel.Prepare()
+		if sentinelErrors.Ok() && !offline {
+			addr, err := c.Sentinel.ResolveMaster()
+			if err != nil {
+				sentinelErrors.Add("could not resolve uplink via sentinel: " + err.Error())
+			} else {
+				c.Uplink.Addr = addr
+			}
+		}
+		errList.Append(sentinelErrors)
+	}
+	if c.Sharded() {
+		errList.Append(c.prepareShards(offline))
+	}
+	errList.Append(c.Uplink.prepare("uplink", false, offline))
+	errList.Append(c.Cluster.Prepare())
+	if c.Cluster.Enabled && c.Sentinel.Enabled() {
+		errList.Add("cluster and sentinel can't be used together")
 	}
-	errList.Append(c.Listen.Prepare("listen", true))
-	errList.Append(c.Uplink.Prepare("uplink", false))
+	errList.Append(c.Replicas.prepare(offline))
+	if c.Replicas.Enabled() && c.RoutesByKey() {
+		errList.Add("replicas can't be used together with cluster or shards")
+	}
+	errList.Append(c.Pool.Prepare())
+	errList.Append(c.prepareUsers())
+	errList.Append(c.prepareCommandPolicies())
+	errList.Append(validNamespace("listen_namespace", c.ListenNamespace))
+	errList.Append(c.Limits.Prepare())
 
 	if c.ListenRaw.Addr != "" {
-		if c.ListenRaw.Pass != "" {
+		if c.ListenRaw.Pass != "" || c.ListenRaw.PassFile != "" || c.ListenRaw.PassEnv != "" {
 			errList.Add("listen_raw does not support in-proxy authentication")
 		}
 	}
@@ -253,16 +595,6 @@ func (c *Config) Prepare() ErrorList {
 	return errList
 }
 
-func (c *Config) ValidateSwitchTo(new *Config) error {
-	if c.Listen != new.Listen {
-		return errors.New("New config must have the same `listen` block as the old one.")
-	}
-	if c.Admin != new.Admin {
-		return errors.New("New config must have the same `admin` block as the old one.")
-	}
-	return nil
-}
-
 func (c *Config) AsJSON() string {
 	res, err := json.Marshal(c)
 	if err != nil {
@@ -272,11 +604,30 @@ func (c *Config) AsJSON() string {
 }
 
 func (c *Config) SanitizedForPublication() *Config {
+	var shards []ShardSpec
+	for _, shard := range c.Shards {
+		shard.AddrSpec = *shard.AddrSpec.SanitizedForPublication()
+		shards = append(shards, shard)
+	}
+	var users []UserConfig
+	for i := range c.Users {
+		users = append(users, *c.Users[i].SanitizedForPublication())
+	}
 	return &Config{
 		Uplink:          *c.Uplink.SanitizedForPublication(),
 		Listen:          *c.Listen.SanitizedForPublication(),
 		ListenRaw:       *c.ListenRaw.SanitizedForPublication(),
 		Admin:           *c.Admin.SanitizedForPublication(),
+		Sentinel:        *c.Sentinel.SanitizedForPublication(),
+		Cluster:         c.Cluster,
+		Shards:          shards,
+		Replicas:        *c.Replicas.SanitizedForPublication(),
+		Pool:            c.Pool,
+		Users:           users,
+		Commands:        c.Commands,
+		ListenCommands:  c.ListenCommands,
+		ListenNamespace: c.ListenNamespace,
+		Limits:          c.Limits,
 		ReadTimeLimitMs: c.ReadTimeLimitMs,
 		LogMessages:     c.LogMessages,
 	}
@@ -285,6 +636,8 @@ func (c *Config) SanitizedForPublication() *Config {
 ////////////////////////////////////////
 // FileConfigLoader
 
+// FileConfigLoader reads JSON, YAML or TOML, depending on the
+// extension of the file (see ConfigFormat).
 type FileConfigLoader struct {
 	fileName string
 }
@@ -294,12 +647,11 @@ func NewFileConfigLoader(name string) *FileConfigLoader {
 }
 
 func (f *FileConfigLoader) Load() (*Config, error) {
-	configJson, err := ioutil.ReadFile(f.fileName)
+	data, err := ioutil.ReadFile(f.fileName)
 	if err != nil {
 		return nil, err
 	}
-	var config Config
-	return &config, json.Unmarshal(configJson, &config)
+	return decodeConfig(data, ConfigFormat(f.fileName))
 }
 
 ////////////////////////////////////////
@@ -307,11 +659,17 @@ func (f *FileConfigLoader) Load() (*Config, error) {
 
 type InputConfigLoader struct {
 	reader io.Reader
+	format string
 	loaded bool
 }
 
-func NewInputConfigLoader(reader io.Reader) *InputConfigLoader {
-	return &InputConfigLoader{reader: reader, loaded: false}
+// NewInputConfigLoader returns a loader for config in format (JSON if
+// empty) from reader.
+func NewInputConfigLoader(reader io.Reader, format string) *InputConfigLoader {
+	if format == "" {
+		format = FormatJSON
+	}
+	return &InputConfigLoader{reader: reader, format: format, loaded: false}
 }
 
 func (c *InputConfigLoader) Load() (*Config, error) {
@@ -319,12 +677,11 @@ func (c *InputConfigLoader) Load() (*Config, error) {
 		return nil, errors.New("Cannot reload config when it's read from input.")
 	}
 	c.loaded = true
-	configJson, err := ioutil.ReadAll(c.reader)
+	data, err := ioutil.ReadAll(c.reader)
 	if err != nil {
 		return nil, err
 	}
-	var config Config
-	return &config, json.Unmarshal(configJson, &config)
+	return decodeConfig(data, c.format)
 }
 
 ////////////////////////////////////////
@@ -0,0 +1,362 @@
+package rproxy
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v2"
+)
+
+// Config formats
+//
+// Config files can be JSON, YAML (.yaml, .yml) or TOML (.toml).  All
+// of them are first decoded into a generic tree, which is then
+// converted to Config through JSON, so field names are the same in
+// every format, and the result goes through the same Prepare.
+//
+// Before that, the tree is changed by the environment:
+//
+// - `${VAR}` in string values is replaced with the value of VAR (an
+//   unset variable is an error; `$${` is a literal `${`),
+//
+// - REDIS_PROXY_<PATH> overrides any field, where PATH is the field's
+//   path in upper case, with `_` between the parts and slice indexes
+//   ("REDIS_PROXY_UPLINK_ADDR", "REDIS_PROXY_LIMITS_MAX_CONNECTIONS",
+//   "REDIS_PROXY_SHARDS_0_PASS").  Values of non-string fields are
+//   JSON ("true", "1000", `["FLUSHALL"]`).
+//
+// Passwords of addresses can also be read at Prepare from a file
+// (`pass_file`) or an environment variable (`pass_env`).
+
+const (
+	FormatJSON = "json"
+	FormatYAML = "yaml"
+	FormatTOML = "toml"
+
+	EnvOverridePrefix = "REDIS_PROXY_"
+)
+
+// ConfigFormat returns the format of a config file, by its extension
+// (JSON unless it's YAML or TOML).
+func ConfigFormat(fileName string) string {
+	switch strings.ToLower(filepath.Ext(fileName)) {
+	case ".yaml", ".yml":
+		return FormatYAML
+	case ".toml":
+		return FormatTOML
+	}
+	return FormatJSON
+}
+
+// decodeConfig parses data in format, applies the environment to it,
+// and returns the resulting Config.
+func decodeConfig(data []byte, format string) (*Config, error) {
+	return decodeConfigEnv(data, format, true)
+}
+
+// decodeConfigLiteral is decodeConfig without the environment, for
+// configs from untrusted sources.
+func decodeConfigLiteral(data []byte, format string) (*Config, error) {
+	return decodeConfigEnv(data, format, false)
+}
+
+func decodeConfigEnv(data []byte, format string, withEnv bool) (*Config, error) {
+	tree, err := decodeTree(data, format)
+	if err != nil {
+		return nil, err
+	}
+	if withEnv {
+		if tree, err = expandEnv(tree); err != nil {
+			return nil, err
+		}
+	}
+	if tree == nil {
+		tree = map[string]interface{}{}
+	}
+	root, ok := tree.(map[string]interface{})
+	if !ok {
+		return nil, fmt.Errorf("Config must be an object, got %T", tree)
+	}
+	if withEnv {
+		if err := applyEnvOverrides(root, os.Environ()); err != nil {
+			return nil, err
+		}
+	}
+
+	configJson, err := json.Marshal(root)
+	if err != nil {
+		return nil, err
+	}
+	var config Config
+	return &config, json.Unmarshal(configJson, &config)
+}
+
+func decodeTree(data []byte, format string) (interface{}, error) {
+	var tree interface{}
+	switch format {
+	case FormatJSON:
+		dec := json.NewDecoder(bytes.NewReader(data))
+		dec.UseNumber()
+		if err := dec.Decode(&tree); err != nil {
+			return nil, err
+		}
+		return tree, nil
+	case FormatYAML:
+		if err := yaml.Unmarshal(data, &tree); err != nil {
+			return nil, err
+		}
+		return normalizeTree(tree)
+	case FormatTOML:
+		table := map[string]interface{}{}
+		if _, err := toml.Decode(string(data), &table); err != nil {
+			return nil, err
+		}
+		return normalizeTree(table)
+	}
+	return nil, fmt.Errorf("Unsupported config format: %s", format)
+}
+
+// normalizeTree converts objects and arrays decoded from YAML (maps
+// with keys of any type) and TOML (arrays of tables) to the types
+// JSON is decoded to.
+func normalizeTree(node interface{}) (interface{}, error) {
+	switch node := node.(type) {
+	case map[interface{}]interface{}:
+		res := map[string]interface{}{}
+		for k, v := range node {
+			key, ok := k.(string)
+			if !ok {
+				return nil, fmt.Errorf("Config keys must be strings, got %v", k)
+			}
+			val, err := normalizeTree(v)
+			if err != nil {
+				return nil, err
+			}
+			res[key] = val
+		}
+		return res, nil
+	case map[string]interface{}:
+		for k, v := range node {
+			val, err := normalizeTree(v)
+			if err != nil {
+				return nil, err
+			}
+			node[k] = val
+		}
+	case []map[string]interface{}:
+		res := make([]interface{}, len(node))
+		for i := range node {
+			val, err := normalizeTree(node[i])
+			if err != nil {
+				return nil, err
+			}
+			res[i] = val
+		}
+		return res, nil
+	case []interface{}:
+		for i := range node {
+			val, err := normalizeTree(node[i])
+			if err != nil {
+				return nil, err
+			}
+			node[i] = val
+		}
+	}
+	return node, nil
+}
+
+var envRefRegexp = regexp.MustCompile(`\$?\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandEnv replaces `${VAR}` in all strings of the tree.
+func expandEnv(node interface{}) (interface{}, error) {
+	switch node := node.(type) {
+	case string:
+		var err error
+		res := envRefRegexp.ReplaceAllStringFunc(node, func(ref string) string {
+			if strings.HasPrefix(ref, "$$") {
+				return ref[1:]
+			}
+			name := envRefRegexp.FindStringSubmatch(ref)[1]
+			val, ok := os.LookupEnv(name)
+			if !ok && err == nil {
+				err = fmt.Errorf("Environment variable %s (used in config) is not set", name)
+			}
+			return val
+		})
+		return res, err
+	case map[string]interface{}:
+		for k, v := range node {
+			val, err := expandEnv(v)
+			if err != nil {
+				return nil, err
+			}
+			node[k] = val
+		}
+	case []interface{}:
+		for i := range node {
+			val, err := expandEnv(node[i])
+			if err != nil {
+				return nil, err
+			}
+			node[i] = val
+		}
+	}
+	return node, nil
+}
+
+// applyEnvOverrides sets fields of root given by REDIS_PROXY_*
+// variables in environ.
+func applyEnvOverrides(root map[string]interface{}, environ []string) error {
+	sort.Strings(environ) // set shards_0 before shards_1
+	for _, entry := range environ {
+		kv := strings.SplitN(entry, "=", 2)
+		if len(kv) != 2 || !strings.HasPrefix(kv[0], EnvOverridePrefix) {
+			continue
+		}
+		path, leaf := overridePath(reflect.TypeOf(Config{}), strings.TrimPrefix(kv[0], EnvOverridePrefix))
+		if path == nil {
+			return fmt.Errorf("%s does not name a config field", kv[0])
+		}
+		var val interface{} = kv[1]
+		if leaf.Kind() != reflect.String {
+			dec := json.NewDecoder(strings.NewReader(kv[1]))
+			dec.UseNumber()
+			if err := dec.Decode(&val); err != nil {
+				return fmt.Errorf("%s: invalid value: %s", kv[0], err)
+			}
+		}
+		if err := setPath(root, path, val); err != nil {
+			return fmt.Errorf("%s: %s", kv[0], err)
+		}
+	}
+	return nil
+}
+
+// overridePath finds the field named by name (the upper-case path,
+// "LISTEN_RAW_ADDR") in t.  It returns the path of JSON keys (and
+// slice indexes) to it, and its type; nil if there is no such field.
+// If names overlap ("listen" and "listen_raw"), the longest one wins.
+func overridePath(t reflect.Type, name string) ([]interface{}, reflect.Type) {
+	if t.Kind() == reflect.Slice {
+		parts := strings.SplitN(name, "_", 2)
+		idx, err := strconv.Atoi(parts[0])
+		if err != nil || idx < 0 {
+			return nil, nil
+		}
+		if len(parts) == 1 {
+			return []interface{}{idx}, t.Elem()
+		}
+		rest, leaf := overridePath(t.Elem(), parts[1])
+		if rest == nil {
+			return nil, nil
+		}
+		return append([]interface{}{idx}, rest...), leaf
+	}
+	if t.Kind() != reflect.Struct {
+		return nil, nil
+	}
+
+	fields := jsonFields(t)
+	sort.Slice(fields, func(i, j int) bool { return len(fields[i].name) > len(fields[j].name) })
+	for _, f := range fields {
+		key := strings.ToUpper(f.name)
+		if name == key {
+			return []interface{}{f.name}, f.typ
+		}
+		if strings.HasPrefix(name, key+"_") {
+			rest, leaf := overridePath(f.typ, name[len(key)+1:])
+			if rest != nil {
+				return append([]interface{}{f.name}, rest...), leaf
+			}
+		}
+	}
+	return nil, nil
+}
+
+type jsonField struct {
+	name string
+	typ  reflect.Type
+}
+
+// jsonFields lists fields of struct type t as encoding/json sees
+// them (with fields of embedded structs).
+func jsonFields(t reflect.Type) []jsonField {
+	res := []jsonField{}
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		if field.Anonymous && field.Type.Kind() == reflect.Struct {
+			res = append(res, jsonFields(field.Type)...)
+			continue
+		}
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if field.PkgPath != "" || name == "-" {
+			continue
+		}
+		if name == "" {
+			name = field.Name
+		}
+		res = append(res, jsonField{name, field.Type})
+	}
+	return res
+}
+
+// setPath sets the value at path in the tree, creating objects and
+// extending arrays on the way as needed.
+func setPath(node map[string]interface{}, path []interface{}, val interface{}) error {
+	key := path[0].(string)
+	if len(path) == 1 {
+		node[key] = val
+		return nil
+	}
+	child, err := childAt(node[key], path[1:], val)
+	if err != nil {
+		return err
+	}
+	node[key] = child
+	return nil
+}
+
+func childAt(node interface{}, path []interface{}, val interface{}) (interface{}, error) {
+	switch step := path[0].(type) {
+	case string:
+		obj, ok := node.(map[string]interface{})
+		if node == nil {
+			obj, ok = map[string]interface{}{}, true
+		}
+		if !ok {
+			return nil, fmt.Errorf("%s is not an object in config", step)
+		}
+		return obj, setPath(obj, path, val)
+	case int:
+		arr, ok := node.([]interface{})
+		if node == nil {
+			ok = true
+		}
+		if !ok {
+			return nil, fmt.Errorf("element %d is not in an array in config", step)
+		}
+		for len(arr) <= step {
+			arr = append(arr, nil)
+		}
+		if len(path) == 1 {
+			arr[step] = val
+			return arr, nil
+		}
+		child, err := childAt(arr[step], path[1:], val)
+		if err != nil {
+			return nil, err
+		}
+		arr[step] = child
+		return arr, nil
+	}
+	return nil, fmt.Errorf("invalid path in config: %v", path)
+}
@@ -0,0 +1,209 @@
+package rproxy
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/stvp/assert"
+)
+
+const jsonTestConfig = `{
+  "uplink": {"addr": "127.0.0.1:6379", "pass": "${TEST_RP_PASS}"},
+  "listen": {"addr": "127.0.0.1:7010"},
+  "shards": [
+    {"addr": "127.0.0.1:6380", "name": "a"},
+    {"addr": "127.0.0.1:6381", "name": "b", "weight": 2}
+  ],
+  "commands": {"deny": ["KEYS"], "rename": {"FLUSHALL": "ADMIN-FLUSHALL"}},
+  "limits": {"max_connections": 100, "client_requests_per_sec": 0.5},
+  "read_time_limit_ms": 5000
+}`
+
+const yamlTestConfig = `
+# YAML allows comments
+uplink:
+  addr: 127.0.0.1:6379
+  pass: ${TEST_RP_PASS}
+listen:
+  addr: 127.0.0.1:7010
+shards:
+  - addr: 127.0.0.1:6380
+    name: a
+  - addr: 127.0.0.1:6381
+    name: b
+    weight: 2
+commands:
+  deny: [KEYS]
+  rename:
+    FLUSHALL: ADMIN-FLUSHALL
+limits:
+  max_connections: 100
+  client_requests_per_sec: 0.5
+read_time_limit_ms: 5000
+`
+
+const tomlTestConfig = `
+# TOML too
+read_time_limit_ms = 5000
+
+[uplink]
+addr = "127.0.0.1:6379"
+pass = "${TEST_RP_PASS}"
+
+[listen]
+addr = "127.0.0.1:7010"
+
+[[shards]]
+addr = "127.0.0.1:6380"
+name = "a"
+
+[[shards]]
+addr = "127.0.0.1:6381"
+name = "b"
+weight = 2
+
+[commands]
+deny = ["KEYS"]
+rename = { FLUSHALL = "ADMIN-FLUSHALL" }
+
+[limits]
+max_connections = 100
+client_requests_per_sec = 0.5
+`
+
+func writeTestConfig(t *testing.T, dir, name, content string) string {
+	fileName := filepath.Join(dir, name)
+	assert.Nil(t, ioutil.WriteFile(fileName, []byte(content), 0600))
+	return fileName
+}
+
+func TestConfigFormats(t *testing.T) {
+	dir, err := ioutil.TempDir("", "redis-proxy-config")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	os.Setenv("TEST_RP_PASS", "secret")
+	defer os.Unsetenv("TEST_RP_PASS")
+
+	expected := &Config{
+		Uplink: AddrSpec{Addr: "127.0.0.1:6379", Pass: "secret"},
+		Listen: AddrSpec{Addr: "127.0.0.1:7010"},
+		Shards: []ShardSpec{
+			{AddrSpec: AddrSpec{Addr: "127.0.0.1:6380"}, Name: "a"},
+			{AddrSpec: AddrSpec{Addr: "127.0.0.1:6381"}, Name: "b", Weight: 2},
+		},
+		Commands: CommandPolicy{
+			Deny:   []string{"KEYS"},
+			Rename: map[string]string{"FLUSHALL": "ADMIN-FLUSHALL"},
+		},
+		Limits:          LimitsConfig{MaxConnections: 100, ClientRequestsPerSec: 0.5},
+		ReadTimeLimitMs: 5000,
+	}
+	for name, content := range map[string]string{
+		"config.json": jsonTestConfig,
+		"config.yaml": yamlTestConfig,
+		"config.yml":  yamlTestConfig,
+		"config.toml": tomlTestConfig,
+	} {
+		config, err := NewFileConfigLoader(writeTestConfig(t, dir, name, content)).Load()
+		assert.Nil(t, err, name)
+		assert.Equal(t, config, expected, name)
+	}
+
+	config, err := NewInputConfigLoader(strings.NewReader(yamlTestConfig), FormatYAML).Load()
+	assert.Nil(t, err)
+	assert.Equal(t, config, expected)
+
+	_, err = NewFileConfigLoader(writeTestConfig(t, dir, "broken.yaml", "uplink: [")).Load()
+	assert.NotNil(t, err)
+}
+
+func TestConfigEnv(t *testing.T) {
+	os.Setenv("TEST_RP_HOST", "10.0.0.1")
+	defer os.Unsetenv("TEST_RP_HOST")
+
+	config, err := decodeConfig([]byte(`{
+		"uplink": {"addr": "${TEST_RP_HOST}:6379", "pass": "$${TEST_RP_HOST}"}
+	}`), FormatJSON)
+	assert.Nil(t, err)
+	assert.Equal(t, config.Uplink.Addr, "10.0.0.1:6379")
+	assert.Equal(t, config.Uplink.Pass, "${TEST_RP_HOST}")
+
+	_, err = decodeConfig([]byte(`{"uplink": {"addr": "${TEST_RP_MISSING}"}}`), FormatJSON)
+	assert.Equal(t, err.Error(), "Environment variable TEST_RP_MISSING (used in config) is not set")
+
+	// Overrides
+	overrides := map[string]string{
+		"REDIS_PROXY_UPLINK_ADDR":                 "10.0.0.2:6379",
+		"REDIS_PROXY_LISTEN_RAW_ADDR":             "127.0.0.1:7012",
+		"REDIS_PROXY_LIMITS_MAX_CONNECTIONS":      "10",
+		"REDIS_PROXY_SHARDS_1_WEIGHT":             "3",
+		"REDIS_PROXY_LOG_MESSAGES":                "true",
+		"REDIS_PROXY_LISTEN_COMMANDS_ALLOW":       `["GET"]`,
+		"REDIS_PROXY_LIMITS_CLIENT_BYTES_PER_SEC": "1e6",
+	}
+	environ := []string{"HOME=/root"}
+	for k, v := range overrides {
+		environ = append(environ, k+"="+v)
+	}
+	tree := map[string]interface{}{
+		"uplink": map[string]interface{}{"addr": "127.0.0.1:6379"},
+		"shards": []interface{}{map[string]interface{}{"addr": "127.0.0.1:6380"}},
+	}
+	assert.Nil(t, applyEnvOverrides(tree, environ))
+	assert.Equal(t, tree, map[string]interface{}{
+		"uplink":          map[string]interface{}{"addr": "10.0.0.2:6379"},
+		"listen_raw":      map[string]interface{}{"addr": "127.0.0.1:7012"},
+		"limits":          map[string]interface{}{"max_connections": json.Number("10"), "client_bytes_per_sec": json.Number("1e6")},
+		"shards":          []interface{}{map[string]interface{}{"addr": "127.0.0.1:6380"}, map[string]interface{}{"weight": json.Number("3")}},
+		"log_messages":    true,
+		"listen_commands": map[string]interface{}{"allow": []interface{}{"GET"}},
+	})
+
+	assert.Equal(t,
+		applyEnvOverrides(map[string]interface{}{}, []string{"REDIS_PROXY_UPLINK_ADR=x"}).Error(),
+		"REDIS_PROXY_UPLINK_ADR does not name a config field")
+	assert.NotNil(t, applyEnvOverrides(map[string]interface{}{}, []string{"REDIS_PROXY_LOG_MESSAGES=yes"}))
+	assert.NotNil(t, applyEnvOverrides(map[string]interface{}{"uplink": "x"}, []string{"REDIS_PROXY_UPLINK_ADDR=x"}))
+
+	// Through the loader
+	os.Setenv("REDIS_PROXY_READ_TIME_LIMIT_MS", "250")
+	defer os.Unsetenv("REDIS_PROXY_READ_TIME_LIMIT_MS")
+	config, err = decodeConfig([]byte("read_time_limit_ms = 5000"), FormatTOML)
+	assert.Nil(t, err)
+	assert.Equal(t, config.ReadTimeLimitMs, int64(250))
+}
+
+func TestAddrSpecPassSources(t *testing.T) {
+	dir, err := ioutil.TempDir("", "redis-proxy-config")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	spec := AddrSpec{Addr: "127.0.0.1:0", PassFile: writeTestConfig(t, dir, "pass", "from-file\n")}
+	errList := spec.Prepare("listen", true)
+	assert.True(t, errList.Ok())
+	assert.Equal(t, spec.Pass, "from-file")
+	assert.Equal(t, spec.SanitizedForPublication().PassFile, spec.PassFile)
+
+	os.Setenv("TEST_RP_PASS", "from-env")
+	defer os.Unsetenv("TEST_RP_PASS")
+	spec = AddrSpec{Addr: "127.0.0.1:0", PassEnv: "TEST_RP_PASS"}
+	errList = spec.Prepare("listen", true)
+	assert.True(t, errList.Ok())
+	assert.Equal(t, spec.Pass, "from-env")
+
+	spec = AddrSpec{Addr: "127.0.0.1:0", PassEnv: "TEST_RP_MISSING"}
+	errList = spec.Prepare("listen", true)
+	assert.Equal(t, errList.Items(), []ConfigError{{
+		Field:    "listen.pass_env",
+		Message:  "listen.pass_env: environment variable TEST_RP_MISSING is not set",
+		Severity: SeverityError,
+	}})
+
+	spec = AddrSpec{Addr: "127.0.0.1:0", PassFile: filepath.Join(dir, "missing")}
+	errList = spec.Prepare("listen", true)
+	assert.False(t, errList.Ok())
+}
@@ -0,0 +1,354 @@
+package rproxy
+
+import (
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Codility/redis-proxy/resp"
+)
+
+// Remote configs
+//
+// HTTPConfigLoader fetches the config from a URL (with a bearer token
+// and a CA certificate for HTTPS, if given).  It sends the ETag of
+// the last response in If-None-Match, so an unchanged config is not
+// transferred again.  The format is taken from Content-Type, or the
+// extension in the URL.
+//
+// RedisConfigLoader reads the config from a key in a Redis instance
+// (not the uplink).  With Watch, it subscribes to keyspace
+// notifications of the key (the instance must have them enabled,
+// e.g. `notify-keyspace-events K$`), and reloads when the value
+// changes.  Only keys in db 0 can be watched.
+
+////////////////////////////////////////
+// HTTPConfigLoader
+
+const httpConfigTimeLimitMs = 5000
+
+type HTTPConfigLoader struct {
+	url    string
+	token  string
+	format string // "": from the response
+	client *http.Client
+
+	etag       string
+	body       []byte
+	bodyFormat string
+}
+
+// NewHTTPConfigLoader returns a loader for config at rawURL.  token
+// and caCertFile are optional; an empty format is detected.
+func NewHTTPConfigLoader(rawURL, token, caCertFile, format string) (*HTTPConfigLoader, error) {
+	client, err := httpClientWithCA(caCertFile)
+	if err != nil {
+		return nil, err
+	}
+	return &HTTPConfigLoader{url: rawURL, token: token, format: format, client: client}, nil
+}
+
+func (l *HTTPConfigLoader) Load() (*Config, error) {
+	req, err := http.NewRequest("GET", l.url, nil)
+	if err != nil {
+		return nil, err
+	}
+	if l.token != "" {
+		req.Header.Set("Authorization", "Bearer "+l.token)
+	}
+	if l.etag != "" {
+		req.Header.Set("If-None-Match", l.etag)
+	}
+
+	res, err := l.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusNotModified:
+		if l.body == nil {
+			return nil, fmt.Errorf("Could not fetch config from %s: %s with nothing cached", l.url, res.Status)
+		}
+	case http.StatusOK:
+		body, err := ioutil.ReadAll(res.Body)
+		if err != nil {
+			return nil, err
+		}
+		l.body, l.etag = body, res.Header.Get("ETag")
+		l.bodyFormat = l.responseFormat(res)
+	default:
+		return nil, fmt.Errorf("Could not fetch config from %s: %s", l.url, res.Status)
+	}
+	return decodeConfig(l.body, l.bodyFormat)
+}
+
+func (l *HTTPConfigLoader) responseFormat(res *http.Response) string {
+	if l.format != "" {
+		return l.format
+	}
+	mediaType, _, _ := mime.ParseMediaType(res.Header.Get("Content-Type"))
+	for _, format := range []string{FormatYAML, FormatTOML, FormatJSON} {
+		if strings.HasSuffix(mediaType, "/"+format) || strings.HasSuffix(mediaType, "+"+format) {
+			return format
+		}
+	}
+	return ConfigFormat(res.Request.URL.Path)
+}
+
+// httpClientWithCA returns a client that verifies servers against
+// the CA cert in caCertFile (if given), and gives up on requests
+// that take longer than httpConfigTimeLimitMs.
+func httpClientWithCA(caCertFile string) (*http.Client, error) {
+	client := &http.Client{Timeout: httpConfigTimeLimitMs * time.Millisecond}
+	if caCertFile == "" {
+		return client, nil
+	}
+	certPEM, err := ioutil.ReadFile(caCertFile)
+	if err != nil {
+		return nil, err
+	}
+	roots := x509.NewCertPool()
+	if !roots.AppendCertsFromPEM(certPEM) {
+		return nil, errors.New("Could not add cert to pool")
+	}
+	client.Transport = &http.Transport{TLSClientConfig: &tls.Config{RootCAs: roots}}
+	return client, nil
+}
+
+////////////////////////////////////////
+// RedisConfigLoader
+
+const redisConfigTimeLimitMs = 5000
+
+type RedisConfigLoader struct {
+	server AddrSpec
+	key    string
+	format string
+}
+
+func NewRedisConfigLoader(server AddrSpec, key, format string) *RedisConfigLoader {
+	if format == "" {
+		format = ConfigFormat(key)
+	}
+	return &RedisConfigLoader{server: server, key: key, format: format}
+}
+
+// NewRedisConfigLoaderFromURL returns a loader for
+// `redis://[[user]:pass@]host:port/key` (`rediss://` for TLS, with
+// the server verified against caCertFile).
+func NewRedisConfigLoaderFromURL(rawURL, caCertFile, format string) (*RedisConfigLoader, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" && u.Scheme != "rediss" {
+		return nil, fmt.Errorf("Unsupported scheme for config in Redis: %s", u.Scheme)
+	}
+	key := strings.TrimPrefix(u.Path, "/")
+	if u.Host == "" || key == "" {
+		return nil, fmt.Errorf("Config URL must be redis://host:port/key, got %s", rawURL)
+	}
+	server := AddrSpec{Addr: u.Host, TLS: u.Scheme == "rediss", CACertFile: caCertFile}
+	if u.User != nil {
+		server.User = u.User.Username()
+		server.Pass, _ = u.User.Password()
+	}
+	return NewRedisConfigLoader(server, key, format), nil
+}
+
+func (l *RedisConfigLoader) Load() (*Config, error) {
+	data, err := l.get()
+	if err != nil {
+		return nil, err
+	}
+	return decodeConfig(data, l.format)
+}
+
+func (l *RedisConfigLoader) get() ([]byte, error) {
+	rc, err := l.server.DialRedis(redisConfigTimeLimitMs, false)
+	if err != nil {
+		return nil, err
+	}
+	defer rc.Close()
+	return l.getWith(rc)
+}
+
+func (l *RedisConfigLoader) getWith(rc *resp.Conn) ([]byte, error) {
+	res, err := rc.Call(resp.MsgFromStrings("GET", l.key))
+	if err != nil {
+		return nil, err
+	}
+	if res.IsNil() {
+		return nil, fmt.Errorf("Config key %s not found in Redis at %s", l.key, l.server.Addr)
+	}
+	val, ok := res.Str()
+	if !ok {
+		return nil, fmt.Errorf("Could not read config key %s: %s", l.key, strings.TrimSpace(res.String()))
+	}
+	return []byte(val), nil
+}
+
+func (l *RedisConfigLoader) source() string {
+	return "redis://" + path.Join(l.server.Addr, l.key)
+}
+
+////////////////////////////////////////
+// RedisConfigWatcher
+
+type RedisConfigWatcher struct {
+	loader   *RedisConfigLoader
+	proxy    *Proxy
+	debounce time.Duration
+	stop     chan struct{}
+	stopOnce sync.Once
+
+	mu   sync.Mutex
+	info ConfigWatchInfo
+}
+
+// Watch makes proxy reload its config when the value of the key
+// changes.  Changes are applied once there was none for `debounce`.
+func (l *RedisConfigLoader) Watch(proxy *Proxy, debounce time.Duration) *RedisConfigWatcher {
+	w := &RedisConfigWatcher{
+		loader:   l,
+		proxy:    proxy,
+		debounce: debounce,
+		stop:     make(chan struct{}),
+		info:     ConfigWatchInfo{Mode: "keyspace", Source: l.source()},
+	}
+	proxy.setConfigWatch(w)
+
+	applied, err := l.get()
+	if err != nil {
+		// follow reloads once it can read the key.
+		log.Printf("Config watch: %s: %s", w.info.Source, err)
+	}
+	go w.run(configHash(applied))
+	return w
+}
+
+func (w *RedisConfigWatcher) Stop() {
+	w.stopOnce.Do(func() { close(w.stop) })
+}
+
+func (w *RedisConfigWatcher) Info() *ConfigWatchInfo {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	info := w.info
+	return &info
+}
+
+func (w *RedisConfigWatcher) stopped() bool {
+	select {
+	case <-w.stop:
+		return true
+	default:
+		return false
+	}
+}
+
+func (w *RedisConfigWatcher) run(applied string) {
+	for !w.stopped() {
+		var err error
+		applied, err = w.follow(applied)
+		if err != nil {
+			log.Printf("Config watch: %s: %s", w.info.Source, err)
+		}
+		select {
+		case <-w.stop:
+		case <-time.After(time.Second):
+		}
+	}
+}
+
+// follow subscribes to notifications for the key, and reloads when
+// its value differs from applied (also after reconnecting, as it
+// might have changed in between).  Returns the hash of the value
+// applied last.
+func (w *RedisConfigWatcher) follow(applied string) (string, error) {
+	rc, err := w.loader.server.DialRedis(0, false)
+	if err != nil {
+		return applied, err
+	}
+	defer rc.Close()
+
+	channel := "__keyspace@0__:" + w.loader.key
+	res, err := rc.Call(resp.MsgFromStrings("SUBSCRIBE", channel))
+	if err != nil {
+		return applied, err
+	}
+	if elems := res.Elements(); len(elems) != 3 {
+		return applied, fmt.Errorf("could not subscribe: %s", strings.TrimSpace(res.String()))
+	}
+
+	changed := true
+	for !w.stopped() {
+		wait := time.Second
+		if changed {
+			wait = w.debounce
+		}
+		if err := rc.WaitForData(wait); err != nil {
+			if !resp.IsNetTimeout(err) {
+				return applied, err
+			}
+			if changed {
+				changed = false
+				applied = w.reloadIfChanged(applied)
+			}
+			continue
+		}
+		if _, err := rc.ReadMsg(); err != nil {
+			return applied, err
+		}
+		changed = true
+		w.mu.Lock()
+		w.info.LastChange = time.Now()
+		w.mu.Unlock()
+	}
+	return applied, nil
+}
+
+// reloadIfChanged reloads if the value of the key differs from the
+// one applied, and returns the hash of the value applied now.
+func (w *RedisConfigWatcher) reloadIfChanged(applied string) string {
+	data, err := w.loader.get()
+	if err != nil || configHash(data) == applied || !w.proxy.State().IsAlive() {
+		return applied
+	}
+
+	log.Printf("Config watch: %s changed, reloading", w.info.Source)
+	res := w.proxy.ReloadWithResult()
+	if res.Ok {
+		log.Printf("Config watch: reloaded, config generation %d", res.Generation)
+	} else {
+		log.Printf("Config watch: reload failed, keeping old config: %s", res.Error)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.info.Reloads++
+	w.info.LastError = res.Error
+	return configHash(data)
+}
+
+func configHash(data []byte) string {
+	if data == nil {
+		return ""
+	}
+	sum := sha256.Sum256(data)
+	return string(sum[:])
+}
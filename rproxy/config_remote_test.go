@@ -0,0 +1,128 @@
+package rproxy
+
+import (
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/Codility/redis-proxy/fakeredis"
+	"github.com/stvp/assert"
+)
+
+func TestHTTPConfigLoader(t *testing.T) {
+	var mu sync.Mutex
+	body, etag := "uplink:\n  addr: 127.0.0.1:6379\n", `"v1"`
+	notModified := 0
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if r.Header.Get("If-None-Match") == etag {
+			notModified++
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		w.Header().Set("ETag", etag)
+		w.Header().Set("Content-Type", "application/yaml")
+		w.Write([]byte(body))
+	}))
+	defer srv.Close()
+
+	caFile, err := ioutil.TempFile("", "redis-proxy-ca")
+	assert.Nil(t, err)
+	defer os.Remove(caFile.Name())
+	pem.Encode(caFile, &pem.Block{Type: "CERTIFICATE", Bytes: srv.Certificate().Raw})
+	caFile.Close()
+
+	loader, err := NewHTTPConfigLoader(srv.URL+"/config", "secret", caFile.Name(), "")
+	assert.Nil(t, err)
+	config, err := loader.Load()
+	assert.Nil(t, err)
+	assert.Equal(t, config.Uplink.Addr, "127.0.0.1:6379")
+
+	// Not modified: the cached config is used
+	config, err = loader.Load()
+	assert.Nil(t, err)
+	assert.Equal(t, config.Uplink.Addr, "127.0.0.1:6379")
+	assert.Equal(t, notModified, 1)
+
+	mu.Lock()
+	body, etag = "uplink:\n  addr: 127.0.0.1:6380\n", `"v2"`
+	mu.Unlock()
+	config, err = loader.Load()
+	assert.Nil(t, err)
+	assert.Equal(t, config.Uplink.Addr, "127.0.0.1:6380")
+
+	// Wrong token
+	loader, err = NewHTTPConfigLoader(srv.URL+"/config", "wrong", caFile.Name(), "")
+	assert.Nil(t, err)
+	_, err = loader.Load()
+	assert.Equal(t, err.Error(), fmt.Sprintf("Could not fetch config from %s/config: 401 Unauthorized", srv.URL))
+
+	// Server not verified without the CA cert
+	loader, err = NewHTTPConfigLoader(srv.URL+"/config", "secret", "", "")
+	assert.Nil(t, err)
+	_, err = loader.Load()
+	assert.NotNil(t, err)
+	assert.True(t, loader.client.Timeout > 0)
+}
+
+func TestRedisConfigLoader(t *testing.T) {
+	store := fakeredis.Start("store", "tcp")
+	defer store.Stop()
+
+	loader, err := NewRedisConfigLoaderFromURL(fmt.Sprintf("redis://:pass@%s/proxy.toml", store.Addr()), "", "")
+	assert.Nil(t, err)
+	assert.Equal(t, loader.server.Pass, "pass")
+	assert.Equal(t, loader.format, FormatTOML)
+
+	store.SetValue("proxy.toml", "[uplink]\naddr = \"127.0.0.1:6379\"\n")
+	config, err := loader.Load()
+	assert.Nil(t, err)
+	assert.Equal(t, config.Uplink.Addr, "127.0.0.1:6379")
+
+	_, err = NewRedisConfigLoaderFromURL("redis://127.0.0.1:6379/", "", "")
+	assert.NotNil(t, err)
+}
+
+func TestRedisConfigWatch(t *testing.T) {
+	store := fakeredis.Start("store", "tcp")
+	defer store.Stop()
+	srv := fakeredis.Start("srv", "tcp")
+	defer srv.Stop()
+
+	config := fmt.Sprintf(`{"uplink": {"addr": "%s"}, "listen": {"addr": "127.0.0.1:0"}, "read_time_limit_ms": %%d}`,
+		srv.Addr().String())
+	store.SetValue("proxy", fmt.Sprintf(config, 1000))
+
+	loader := NewRedisConfigLoader(AddrSpec{Addr: store.Addr().String()}, "proxy", "")
+	proxy, err := NewProxy(loader)
+	assert.Nil(t, err)
+	proxy.Start()
+	defer proxy.Stop()
+	loader.Watch(proxy, 50*time.Millisecond)
+	waitUntil(t, func() bool { return store.ConnCnt() == 1 }) // subscribed
+
+	store.SetValue("proxy", fmt.Sprintf(config, 2000))
+	waitUntil(t, func() bool { return proxy.GetConfig().ReadTimeLimitMs == 2000 })
+
+	info := proxy.GetInfo().ConfigWatch
+	assert.Equal(t, info.Mode, "keyspace")
+	assert.Equal(t, info.Source, "redis://"+store.Addr().String()+"/proxy")
+	waitUntil(t, func() bool { return proxy.GetInfo().ConfigWatch.Reloads == 1 })
+
+	// Broken config is reported, the old one stays
+	store.SetValue("proxy", "{")
+	waitUntil(t, func() bool { return proxy.GetInfo().ConfigWatch.LastError != "" })
+	assert.Equal(t, proxy.GetConfig().ReadTimeLimitMs, int64(2000))
+}
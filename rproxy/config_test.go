@@ -29,7 +29,7 @@ func TestConfigValidation(t *testing.T) {
 			expected[e] = true
 		}
 		got := map[string]bool{}
-		for _, e := range errList.errors {
+		for _, e := range errList.Errors() {
 			got[e] = true
 		}
 		if !reflect.DeepEqual(expected, got) {
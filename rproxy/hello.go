@@ -0,0 +1,120 @@
+package rproxy
+
+import (
+	"strconv"
+	"strings"
+
+	"github.com/Codility/redis-proxy/resp"
+)
+
+// HELLO and RESP3
+//
+// The proxy handles HELLO itself: AUTH is checked against the proxy's
+// own credentials (user "default", password `listen.pass`), and the
+// rest of the request (protocol version and SETNAME) is forwarded to
+// uplink, so that the client gets the real server's reply in the
+// negotiated protocol.  ClientHandler remembers the protocol, and
+// replays it on every new uplink connection (after RELOAD,
+// switchover, failover etc.).  Clients that switch to RESP3 don't use
+// the connection pool.
+//
+// Out-of-band push messages other than Pub/Sub ones (e.g. client
+// side caching invalidations) are not supported.
+
+const DefaultProto = 2
+
+type helloRequest struct {
+	proto   int // 0: not given
+	auth    bool
+	user    string
+	pass    string
+	setName string
+}
+
+// parseHello parses "HELLO [protover [AUTH user pass] [SETNAME name]]".
+// Returns an error reply if the request is not valid.
+func parseHello(req *resp.Msg) (*helloRequest, []byte) {
+	args := req.Args()
+	hello := &helloRequest{}
+	if len(args) == 0 {
+		return hello, nil
+	}
+
+	proto, err := strconv.Atoi(args[0])
+	if err != nil {
+		return nil, []byte("-ERR Protocol version is not an integer or out of range\r\n")
+	}
+	if proto != 2 && proto != 3 {
+		return nil, resp.MsgNoProto
+	}
+	hello.proto = proto
+
+	for i := 1; i < len(args); i++ {
+		switch opt := strings.ToUpper(args[i]); {
+		case opt == "AUTH" && i+2 < len(args):
+			hello.auth = true
+			hello.user, hello.pass = args[i+1], args[i+2]
+			i += 2
+		case opt == "SETNAME" && i+1 < len(args):
+			hello.setName = args[i+1]
+			i++
+		default:
+			return nil, []byte("-ERR Syntax error in HELLO option '" + args[i] + "'\r\n")
+		}
+	}
+	return hello, nil
+}
+
+// uplinkRequest returns HELLO to be sent to uplink: without AUTH.
+func (hello *helloRequest) uplinkRequest() *resp.Msg {
+	args := []string{"HELLO"}
+	if hello.proto != 0 {
+		args = append(args, strconv.Itoa(hello.proto))
+	}
+	if hello.setName != "" {
+		args = append(args, "SETNAME", hello.setName)
+	}
+	return resp.MsgFromStrings(args...)
+}
+
+// preprocessHello authenticates the client if HELLO has AUTH.
+// Returns the reply for the client if the request should not be
+// forwarded.  Otherwise HELLO is subject to rate limits, command
+// policy and the user's permissions, like other requests.
+func (ch *ClientHandler) preprocessHello(req *resp.Msg) []byte {
+	hello, errReply := parseHello(req)
+	if errReply != nil {
+		return errReply
+	}
+
+	if hello.auth && ch.proxy.RequiresClientAuth() {
+		if !ch.authenticate(hello.user, hello.pass) {
+			return resp.MsgWrongPass
+		}
+	}
+	if ch.proxy.RequiresClientAuth() && !ch.cliAuthenticated {
+		return resp.MsgNoAuthHello
+	}
+	return nil
+}
+
+// forwardedRequest returns what should be sent to uplink in place of
+// req.
+func forwardedRequest(req *resp.Msg) *resp.Msg {
+	if req.Op() != resp.MsgOpHello {
+		return req
+	}
+	hello, _ := parseHello(req)
+	return hello.uplinkRequest()
+}
+
+// helloProto returns protocol version requested by HELLO (0: none).
+func helloProto(req *resp.Msg) int {
+	if req.Op() != resp.MsgOpHello {
+		return 0
+	}
+	if hello, errReply := parseHello(req); errReply == nil {
+		return hello.proto
+	}
+	return 0
+}
@@ -0,0 +1,117 @@
+package rproxy
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Codility/redis-proxy/fakeredis"
+	"github.com/Codility/redis-proxy/resp"
+	"github.com/stvp/assert"
+)
+
+const helloReply3 = "%2\r\n$6\r\nserver\r\n$5\r\nsrv-1\r\n$5\r\nproto\r\n:3\r\n"
+
+func TestProxyHello(t *testing.T) {
+	srv := fakeredis.Start("srv-1", "tcp")
+	defer srv.Stop()
+
+	proxy := mustStartTestProxy(t, &TestConfigLoader{
+		conf: &Config{
+			Uplink: AddrSpec{Addr: srv.Addr().String()},
+			Listen: AddrSpec{Addr: "127.0.0.1:0", Pass: "secret"},
+		},
+	})
+	defer proxy.Stop()
+
+	c := resp.MustDial("tcp", proxy.ListenAddr().String(), 0, false)
+	defer c.Close()
+
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("HELLO", "3")).String(), string(resp.MsgNoAuthHello))
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("HELLO", "3", "AUTH", "default", "wrong")).String(),
+		"-WRONGPASS invalid username-password pair or user is disabled.\r\n")
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("HELLO", "4")).String(), "-NOPROTO unsupported protocol version\r\n")
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("HELLO", "3", "FOO")).String(),
+		"-ERR Syntax error in HELLO option 'FOO'\r\n")
+	assert.Equal(t, srv.ReqCnt(), 0)
+
+	// AUTH is handled by the proxy, the rest goes to uplink
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("HELLO", "3", "AUTH", "default", "secret", "SETNAME", "cli")).String(),
+		helloReply3)
+	assert.Equal(t, srv.LastRequest().String(), resp.MsgFromStrings("HELLO", "3", "SETNAME", "cli").String())
+
+	// Replies come in RESP3
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("BLPOP", "k", "0.01")).String(), "_\r\n")
+}
+
+func TestProxyHelloAfterUplinkSwitch(t *testing.T) {
+	srv_1 := fakeredis.Start("srv-1", "tcp")
+	defer srv_1.Stop()
+	srv_2 := fakeredis.Start("srv-2", "tcp")
+	defer srv_2.Stop()
+
+	proxy := mustStartTestProxy(t, &TestConfigLoader{
+		conf: &Config{
+			Uplink: AddrSpec{Addr: srv_1.Addr().String()},
+			Listen: AddrSpec{Addr: "127.0.0.1:0"},
+		},
+	})
+	defer proxy.Stop()
+
+	c := resp.MustDial("tcp", proxy.ListenAddr().String(), 0, false)
+	defer c.Close()
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("HELLO", "3")).String(), helloReply3)
+
+	// Pub/Sub messages arrive as push messages
+	c.MustWriteMsg(resp.MsgFromStrings("SUBSCRIBE", "ch"))
+	assert.Equal(t, c.MustReadMsg().String(), ">3\r\n$9\r\nsubscribe\r\n$2\r\nch\r\n:1\r\n")
+	srv_1.Publish("ch", "msg")
+	assert.Equal(t, c.MustReadMsg().String(), ">3\r\n$7\r\nmessage\r\n$2\r\nch\r\n$3\r\nmsg\r\n")
+	c.MustWriteMsg(resp.MsgFromStrings("UNSUBSCRIBE"))
+	assert.Equal(t, c.MustReadMsg().String(), ">3\r\n$11\r\nunsubscribe\r\n$2\r\nch\r\n:0\r\n")
+
+	assert.Nil(t, proxy.SetUplink(AddrSpec{Addr: srv_2.Addr().String()}))
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("BLPOP", "k", "0.01")).String(), "_\r\n")
+
+	reqs := srv_2.Requests()
+	assert.Equal(t, reqs[0].String(), resp.MsgFromStrings("HELLO", "3").String())
+
+	// Back to RESP2
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("HELLO", "2")).String(),
+		"*4\r\n$6\r\nserver\r\n$5\r\nsrv-2\r\n$5\r\nproto\r\n:2\r\n")
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("BLPOP", "k", "0.01")).String(), "*-1\r\n")
+}
+
+func TestProxyHelloChecks(t *testing.T) {
+	srv := fakeredis.Start("srv-1", "tcp")
+	defer srv.Stop()
+
+	proxy := mustStartTestProxy(t, &TestConfigLoader{
+		conf: &Config{
+			Uplink:   AddrSpec{Addr: srv.Addr().String()},
+			Listen:   AddrSpec{Addr: "127.0.0.1:0", Pass: "secret"},
+			Commands: CommandPolicy{Deny: []string{"HELLO"}},
+		},
+	})
+	defer proxy.Stop()
+
+	c := resp.MustDial("tcp", proxy.ListenAddr().String(), 0, false)
+	defer c.Close()
+
+	// Command policy
+	res := c.MustCall(resp.MsgFromStrings("HELLO", "3", "AUTH", "default", "secret")).String()
+	assert.True(t, strings.HasPrefix(res, "-"), res)
+	assert.Equal(t, srv.ReqCnt(), 0)
+
+	// Pause
+	conf := *proxy.GetConfig()
+	conf.Commands = CommandPolicy{}
+	proxy.configLoader.(*TestConfigLoader).Replace(&conf)
+	assert.Nil(t, proxy.Reload())
+	assert.Nil(t, proxy.Pause())
+	c.MustWriteMsg(resp.MsgFromStrings("HELLO", "3", "AUTH", "default", "secret"))
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, srv.ReqCnt(), 0)
+	assert.Nil(t, proxy.Unpause())
+	assert.Equal(t, c.MustReadMsg().String(), helloReply3)
+}
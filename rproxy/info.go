@@ -1,12 +1,22 @@
 package rproxy
 
 type ProxyInfo struct {
-	ActiveRequests  int        `json:"active_requests"`
-	WaitingRequests int        `json:"waiting_requests"`
-	State           ProxyState `json:"state"`
-	StateStr        string     `json:"state_str"`
-	Config          *Config    `json:"config"`
-	RawConnections  int        `json:"raw_connections"`
+	ActiveRequests  int              `json:"active_requests"`
+	WaitingRequests int              `json:"waiting_requests"`
+	State           ProxyState       `json:"state"`
+	StateStr        string           `json:"state_str"`
+	Config          *Config          `json:"config"`
+	RawConnections  int              `json:"raw_connections"`
+	Pool            PoolInfo         `json:"pool"`
+	Switchover      *SwitchoverInfo  `json:"switchover,omitempty"`
+	Cluster         *ClusterInfo     `json:"cluster,omitempty"`
+	Shards          []ShardInfo      `json:"shards,omitempty"`
+	Replicas        []ReplicaInfo    `json:"replicas,omitempty"`
+	Limits          LimitsInfo       `json:"limits"`
+	Generation      int              `json:"config_generation"`
+	Reloads         []ReloadResult   `json:"reloads"`
+	ConfigWatch     *ConfigWatchInfo `json:"config_watch,omitempty"`
+	Clients         []ClientInfo     `json:"clients"`
 }
 
 func (p *ProxyInfo) SanitizedForPublication() *ProxyInfo {
@@ -17,5 +27,15 @@ func (p *ProxyInfo) SanitizedForPublication() *ProxyInfo {
 		StateStr:        p.StateStr,
 		Config:          p.Config.SanitizedForPublication(),
 		RawConnections:  p.RawConnections,
+		Pool:            p.Pool,
+		Switchover:      p.Switchover,
+		Cluster:         p.Cluster,
+		Shards:          p.Shards,
+		Replicas:        p.Replicas,
+		Limits:          p.Limits,
+		Generation:      p.Generation,
+		Reloads:         p.Reloads,
+		ConfigWatch:     p.ConfigWatch,
+		Clients:         p.Clients,
 	}
 }
@@ -0,0 +1,318 @@
+package rproxy
+
+import (
+	"math"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/Codility/redis-proxy/resp"
+)
+
+// Limits
+//
+// `limits` protects Redis from runaway clients:
+//
+//  - `max_connections`: concurrent client connections, per listener
+//    (`listen` and `listen_raw` each),
+//  - `max_connections_per_ip`: the same, per source IP,
+//  - `max_waiting_requests`: requests waiting for the proxy (during
+//    PAUSE), see permissions.go,
+//  - `client_requests_per_sec` and `client_bytes_per_sec`: token
+//    buckets of every connection of `listen` (bursts up to one second
+//    worth of tokens).  Users can have their own
+//    `requests_per_sec` and `bytes_per_sec`, shared by all their
+//    connections.
+//
+// Connections over the limit (also new connections to `listen` while
+// the waiting requests are at their limit) get "-ERR max number of
+// clients reached" and are closed.  Requests over the limit are delayed
+// until there are enough tokens, or (with `on_exceeded: "reject"`, and
+// always inside MULTI/WATCH, so that the transaction doesn't hold up
+// PAUSE while it sleeps) get "-ERR rate limited (redis-proxy)".  Limits can be changed with
+// RELOAD, counters are in /info.json and in Prometheus metrics.
+
+const (
+	LimitDelay  = "delay"
+	LimitReject = "reject"
+)
+
+var (
+	MsgRateLimited = []byte("-ERR rate limited (redis-proxy)\r\n")
+	MsgMaxClients  = []byte("-ERR max number of clients reached (redis-proxy)\r\n")
+)
+
+type LimitsConfig struct {
+	MaxConnections       int     `json:"max_connections"`
+	MaxConnectionsPerIP  int     `json:"max_connections_per_ip"`
+	MaxWaitingRequests   int     `json:"max_waiting_requests"`
+	ClientRequestsPerSec float64 `json:"client_requests_per_sec"`
+	ClientBytesPerSec    float64 `json:"client_bytes_per_sec"`
+	OnExceeded           string  `json:"on_exceeded"`
+}
+
+func (lc *LimitsConfig) Prepare() ErrorList {
+	errors := ErrorList{}
+	if lc.MaxConnections < 0 || lc.MaxConnectionsPerIP < 0 {
+		errors.Add("limits: connection limits must not be negative")
+	}
+	if lc.MaxWaitingRequests < 0 {
+		errors.Add("limits.max_waiting_requests must not be negative")
+	}
+	if lc.ClientRequestsPerSec < 0 || lc.ClientBytesPerSec < 0 {
+		errors.Add("limits: rate limits must not be negative")
+	}
+	switch lc.OnExceeded {
+	case "":
+		lc.OnExceeded = LimitDelay
+	case LimitDelay, LimitReject:
+	default:
+		errors.Add("limits.on_exceeded must be 'delay' or 'reject'")
+	}
+	return errors
+}
+
+type LimitsInfo struct {
+	Connections         map[string]int   `json:"connections"`
+	RejectedConnections map[string]int64 `json:"rejected_connections"`
+	DelayedRequests     int64            `json:"delayed_requests"`
+	RejectedRequests    int64            `json:"rejected_requests"`
+}
+
+////////////////////////////////////////
+// Connection limits
+
+// connLimiter counts connections of one listener.
+type connLimiter struct {
+	listener string
+
+	mu       sync.Mutex
+	total    int
+	perIP    map[string]int
+	rejected int64
+}
+
+func newConnLimiter(listener string) *connLimiter {
+	return &connLimiter{listener: listener, perIP: map[string]int{}}
+}
+
+func remoteIP(addr net.Addr) string {
+	host, _, err := net.SplitHostPort(addr.String())
+	if err != nil {
+		return addr.String()
+	}
+	return host
+}
+
+// Acquire counts a new connection from addr, unless it exceeds the
+// limits.  Every successful Acquire must be followed by Release.
+func (cl *connLimiter) Acquire(limits *LimitsConfig, addr net.Addr) bool {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	ip := remoteIP(addr)
+	if (limits.MaxConnections > 0 && cl.total >= limits.MaxConnections) ||
+		(limits.MaxConnectionsPerIP > 0 && cl.perIP[ip] >= limits.MaxConnectionsPerIP) {
+		cl.rejected++
+		statRecordRejectedConnection(cl.listener)
+		return false
+	}
+	cl.total++
+	cl.perIP[ip]++
+	statRecordConnections(cl.listener, cl.total)
+	return true
+}
+
+// Reject counts a connection rejected for other reasons.
+func (cl *connLimiter) Reject() {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	cl.rejected++
+	statRecordRejectedConnection(cl.listener)
+}
+
+func (cl *connLimiter) Release(addr net.Addr) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	ip := remoteIP(addr)
+	cl.total--
+	if cl.perIP[ip]--; cl.perIP[ip] <= 0 {
+		delete(cl.perIP, ip)
+	}
+	statRecordConnections(cl.listener, cl.total)
+}
+
+func (cl *connLimiter) Info() (int, int64) {
+	cl.mu.Lock()
+	defer cl.mu.Unlock()
+
+	return cl.total, cl.rejected
+}
+
+// acceptConn applies connection limits to a freshly accepted
+// connection.  Returns false (after telling the client why) if it
+// has to be closed.
+func (proxy *Proxy) acceptConn(cl *connLimiter, conn net.Conn) bool {
+	limits := &proxy.config.Limits
+	if cl == proxy.clientConns && limits.MaxWaitingRequests > 0 {
+		if _, waiting := proxy.permissions.Counts(); waiting >= limits.MaxWaitingRequests {
+			cl.Reject()
+			return proxy.refuseConn(conn)
+		}
+	}
+	if cl.Acquire(limits, conn.RemoteAddr()) {
+		return true
+	}
+	return proxy.refuseConn(conn)
+}
+
+func (proxy *Proxy) refuseConn(conn net.Conn) bool {
+	conn.SetWriteDeadline(time.Now().Add(time.Second))
+	conn.Write(MsgMaxClients)
+	conn.Close()
+	return false
+}
+
+////////////////////////////////////////
+// Rate limits
+
+// tokenBucket holds up to one second worth of tokens.
+type tokenBucket struct {
+	mu     sync.Mutex
+	rate   float64
+	tokens float64
+	last   time.Time
+}
+
+// Take takes n tokens.  Returns how long the caller has to wait for
+// them (when delaying), or false if there are not enough of them (when
+// rejecting).  Requests bigger than the bucket are let through when
+// it's full.
+func (tb *tokenBucket) Take(rate, n float64, reject bool) (time.Duration, bool) {
+	tb.mu.Lock()
+	defer tb.mu.Unlock()
+
+	now := time.Now()
+	if tb.rate != rate {
+		// New bucket, or rate changed by RELOAD.
+		tb.rate = rate
+		tb.tokens = rate
+		tb.last = now
+	}
+	tb.tokens = math.Min(rate, tb.tokens+now.Sub(tb.last).Seconds()*rate)
+	tb.last = now
+
+	need := math.Min(n, rate)
+	if tb.tokens >= need {
+		tb.tokens -= n
+		return 0, true
+	}
+	if reject {
+		return 0, false
+	}
+	wait := time.Duration((need - tb.tokens) / rate * float64(time.Second))
+	tb.tokens -= n
+	return wait, true
+}
+
+// rateLimiter limits requests and bytes of a client or a user.
+type rateLimiter struct {
+	requests tokenBucket
+	bytes    tokenBucket
+}
+
+// Take returns the delay for req, or false if it should be rejected.
+func (rl *rateLimiter) Take(reqRate, byteRate float64, req *resp.Msg, reject bool) (time.Duration, bool) {
+	delay := time.Duration(0)
+	if reqRate > 0 {
+		wait, ok := rl.requests.Take(reqRate, 1, reject)
+		if !ok {
+			return 0, false
+		}
+		delay += wait
+	}
+	if byteRate > 0 {
+		wait, ok := rl.bytes.Take(byteRate, float64(len(req.Data())), reject)
+		if !ok {
+			return 0, false
+		}
+		delay += wait
+	}
+	return delay, true
+}
+
+// userLimiters keeps rate limiters of users, shared by all their
+// connections.
+type userLimiters struct {
+	mu       sync.Mutex
+	limiters map[string]*rateLimiter
+}
+
+func newUserLimiters() *userLimiters {
+	return &userLimiters{limiters: map[string]*rateLimiter{}}
+}
+
+func (ul *userLimiters) Get(user string) *rateLimiter {
+	ul.mu.Lock()
+	defer ul.mu.Unlock()
+
+	rl, ok := ul.limiters[user]
+	if !ok {
+		rl = &rateLimiter{}
+		ul.limiters[user] = rl
+	}
+	return rl
+}
+
+type rateLimitStats struct {
+	delayed  int64
+	rejected int64
+}
+
+func (proxy *Proxy) limitsInfo() LimitsInfo {
+	info := LimitsInfo{
+		Connections:         map[string]int{},
+		RejectedConnections: map[string]int64{},
+		DelayedRequests:     atomic.LoadInt64(&proxy.rateLimitStats.delayed),
+		RejectedRequests:    atomic.LoadInt64(&proxy.rateLimitStats.rejected),
+	}
+	for _, cl := range []*connLimiter{proxy.clientConns, proxy.rawConns} {
+		info.Connections[cl.listener], info.RejectedConnections[cl.listener] = cl.Info()
+	}
+	return info
+}
+
+////////////////////////////////////////
+// ClientHandler: rate limits
+
+// applyRateLimits delays req, or returns an error reply if it has to
+// be rejected.
+func (ch *ClientHandler) applyRateLimits(req *resp.Msg) []byte {
+	config := ch.proxy.config
+	// An open transaction holds execution permission.
+	reject := config.Limits.OnExceeded == LimitReject || ch.holdsPermission
+
+	delay, ok := ch.limiter.Take(config.Limits.ClientRequestsPerSec, config.Limits.ClientBytesPerSec, req, reject)
+	if ok && ch.cliAuthenticated {
+		if user := config.User(ch.userName); user != nil && (user.RequestsPerSec > 0 || user.BytesPerSec > 0) {
+			var userDelay time.Duration
+			userDelay, ok = ch.proxy.userLimiters.Get(user.Name).Take(user.RequestsPerSec, user.BytesPerSec, req, reject)
+			delay += userDelay
+		}
+	}
+
+	if !ok {
+		atomic.AddInt64(&ch.proxy.rateLimitStats.rejected, 1)
+		statRecordRateLimited("rejected")
+		return MsgRateLimited
+	}
+	if delay > 0 {
+		atomic.AddInt64(&ch.proxy.rateLimitStats.delayed, 1)
+		statRecordRateLimited("delayed")
+		time.Sleep(delay)
+	}
+	return nil
+}
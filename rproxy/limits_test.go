@@ -0,0 +1,181 @@
+package rproxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Codility/redis-proxy/fakeredis"
+	"github.com/Codility/redis-proxy/resp"
+	"github.com/stvp/assert"
+)
+
+func TestTokenBucket(t *testing.T) {
+	tb := &tokenBucket{}
+	for i := 0; i < 10; i++ {
+		_, ok := tb.Take(10, 1, true)
+		assert.True(t, ok)
+	}
+	_, ok := tb.Take(10, 1, true)
+	assert.False(t, ok)
+
+	wait, ok := tb.Take(10, 1, false)
+	assert.True(t, ok)
+	assert.True(t, wait > 50*time.Millisecond && wait <= 100*time.Millisecond)
+
+	// Bigger than the bucket: waits for a full one
+	tb = &tokenBucket{}
+	wait, ok = tb.Take(100, 1000, true)
+	assert.True(t, ok)
+	assert.Equal(t, wait, time.Duration(0))
+	_, ok = tb.Take(100, 1, true)
+	assert.False(t, ok)
+}
+
+func TestProxyConnectionLimits(t *testing.T) {
+	srv := fakeredis.Start("srv-1", "tcp")
+	defer srv.Stop()
+
+	loader := &TestConfigLoader{
+		conf: &Config{
+			Uplink: AddrSpec{Addr: srv.Addr().String()},
+			Listen: AddrSpec{Addr: "127.0.0.1:0"},
+			Limits: LimitsConfig{MaxConnectionsPerIP: 2},
+		},
+	}
+	proxy := mustStartTestProxy(t, loader)
+	defer proxy.Stop()
+
+	dial := func() *resp.Conn {
+		return resp.MustDial("tcp", proxy.ListenAddr().String(), 0, false)
+	}
+	c1, c2, c3 := dial(), dial(), dial()
+	defer c1.Close()
+	defer c2.Close()
+	defer c3.Close()
+
+	assert.Equal(t, c1.MustCall(resp.MsgFromStrings("GET", "a")).String(), "$5\r\nsrv-1\r\n")
+	assert.Equal(t, c2.MustCall(resp.MsgFromStrings("GET", "a")).String(), "$5\r\nsrv-1\r\n")
+	assert.Equal(t, c3.MustReadMsg().String(), string(MsgMaxClients))
+
+	info := proxy.GetInfo()
+	assert.Equal(t, info.Limits.Connections["listen"], 2)
+	assert.Equal(t, info.Limits.RejectedConnections["listen"], int64(1))
+
+	c1.Close()
+	waitUntil(t, func() bool { return proxy.GetInfo().Limits.Connections["listen"] == 1 })
+	c4 := dial()
+	defer c4.Close()
+	assert.Equal(t, c4.MustCall(resp.MsgFromStrings("GET", "a")).String(), "$5\r\nsrv-1\r\n")
+
+	// Limits from RELOAD apply to new connections
+	loader.Replace(&Config{
+		Uplink: AddrSpec{Addr: srv.Addr().String()},
+		Listen: AddrSpec{Addr: "127.0.0.1:0"},
+		Limits: LimitsConfig{MaxConnections: 3},
+	})
+	assert.Nil(t, proxy.Reload())
+	c5 := dial()
+	defer c5.Close()
+	assert.Equal(t, c5.MustCall(resp.MsgFromStrings("GET", "a")).String(), "$5\r\nsrv-1\r\n")
+}
+
+func TestProxyRateLimits(t *testing.T) {
+	srv := fakeredis.Start("srv-1", "tcp")
+	defer srv.Stop()
+
+	loader := &TestConfigLoader{
+		conf: &Config{
+			Uplink: AddrSpec{Addr: srv.Addr().String()},
+			Listen: AddrSpec{Addr: "127.0.0.1:0"},
+			Limits: LimitsConfig{ClientRequestsPerSec: 5, OnExceeded: LimitReject},
+			Users: []UserConfig{{
+				Name:           "slow",
+				PasswordHash:   sha256Hex("pass"),
+				Enabled:        true,
+				Commands:       []string{"*"},
+				Keys:           []string{"*"},
+				RequestsPerSec: 2,
+			}},
+		},
+	}
+	proxy := mustStartTestProxy(t, loader)
+	defer proxy.Stop()
+
+	c := resp.MustDial("tcp", proxy.ListenAddr().String(), 0, false)
+	defer c.Close()
+
+	c.MustCall(resp.MsgFromStrings("AUTH", "slow", "pass"))
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("GET", "a")).String(), "$5\r\nsrv-1\r\n")
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("GET", "a")).String(), "$5\r\nsrv-1\r\n")
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("GET", "a")).String(), string(MsgRateLimited))
+	assert.Equal(t, proxy.GetInfo().Limits.RejectedRequests, int64(1))
+
+	// Delay instead of rejecting
+	loader.Replace(&Config{
+		Uplink: AddrSpec{Addr: srv.Addr().String()},
+		Listen: AddrSpec{Addr: "127.0.0.1:0"},
+		Limits: LimitsConfig{ClientRequestsPerSec: 10},
+	})
+	assert.Nil(t, proxy.Reload())
+	c2 := resp.MustDial("tcp", proxy.ListenAddr().String(), 0, false)
+	defer c2.Close()
+
+	start := time.Now()
+	for i := 0; i < 15; i++ {
+		assert.Equal(t, c2.MustCall(resp.MsgFromStrings("GET", "a")).String(), "$5\r\nsrv-1\r\n")
+	}
+	assert.True(t, time.Since(start) >= 400*time.Millisecond)
+	assert.True(t, proxy.GetInfo().Limits.DelayedRequests >= 4)
+
+	// Rejected inside a transaction, which PAUSE has to wait for
+	rejected := proxy.GetInfo().Limits.RejectedRequests
+	c2.MustCallAndGetOk(resp.MsgFromStrings("MULTI"))
+	start = time.Now()
+	replies := []string{}
+	for i := 0; i < 15; i++ {
+		replies = append(replies, c2.MustCall(resp.MsgFromStrings("GET", "a")).String())
+	}
+	assert.True(t, time.Since(start) < 400*time.Millisecond)
+	assert.Equal(t, replies[len(replies)-1], string(MsgRateLimited))
+	assert.True(t, proxy.GetInfo().Limits.RejectedRequests > rejected)
+}
+
+func TestProxyMaxWaitingRequests(t *testing.T) {
+	srv := fakeredis.Start("srv-1", "tcp")
+	defer srv.Stop()
+
+	proxy := mustStartTestProxy(t, &TestConfigLoader{
+		conf: &Config{
+			Uplink: AddrSpec{Addr: srv.Addr().String()},
+			Listen: AddrSpec{Addr: "127.0.0.1:0"},
+			Limits: LimitsConfig{MaxWaitingRequests: 2},
+		},
+	})
+	defer proxy.Stop()
+
+	dial := func() *resp.Conn {
+		return resp.MustDial("tcp", proxy.ListenAddr().String(), 0, false)
+	}
+	c1, c2, c3 := dial(), dial(), dial()
+	defer c1.Close()
+	defer c2.Close()
+	defer c3.Close()
+
+	proxy.Pause()
+	c1.MustWrite(resp.MsgFromStrings("GET", "a").Data())
+	c2.MustWrite(resp.MsgFromStrings("GET", "a").Data())
+	waitUntil(t, func() bool { return proxy.GetInfo().WaitingRequests == 2 })
+
+	// Over the limit: requests and new connections are rejected
+	assert.Equal(t, c3.MustCall(resp.MsgFromStrings("GET", "a")).String(), string(MsgTooManyWaiting))
+	c4 := dial()
+	defer c4.Close()
+	assert.Equal(t, c4.MustReadMsg().String(), string(MsgMaxClients))
+	assert.Equal(t, proxy.GetInfo().WaitingRequests, 2)
+
+	proxy.Unpause()
+	assert.Equal(t, c1.MustReadMsg().String(), "$5\r\nsrv-1\r\n")
+	assert.Equal(t, c2.MustReadMsg().String(), "$5\r\nsrv-1\r\n")
+	assert.Equal(t, c3.MustCall(resp.MsgFromStrings("GET", "a")).String(), "$5\r\nsrv-1\r\n")
+	assert.Equal(t, srv.ReqCnt(), 3)
+}
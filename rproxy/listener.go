@@ -1,7 +1,10 @@
 package rproxy
 
 import (
+	"crypto/tls"
 	"net"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
@@ -12,10 +15,21 @@ import (
 // set deadlines on accept operations, but the listener from tls
 // package does not support them, and does not provide any way to get
 // to the underlying Net/UnixListener.
+//
+// On RELOAD, a listener can hand its socket over to a new one (with
+// different TLS settings) without closing it, so that no connection
+// attempt is refused in between.  Accept loops must check Stopped()
+// after every accept.  A connection the old listener still accepts
+// is set up according to the settings of the new one.
 
 type Listener struct {
-	net.Listener
+	socket           net.Listener
 	originalListener AddrDeadliner
+	tlsConfig        *tls.Config // nil: no TLS
+	stopped          int32
+
+	mu   sync.Mutex
+	next *Listener // took the socket over
 }
 
 type AddrDeadliner interface {
@@ -30,3 +44,69 @@ func (l *Listener) SetDeadline(deadline time.Time) error {
 func (l *Listener) Addr() net.Addr {
 	return l.originalListener.Addr()
 }
+
+// Accept waits for a connection, and wraps it in TLS according to
+// the listener that owns the socket now.
+func (l *Listener) Accept() (net.Conn, error) {
+	conn, err := l.socket.Accept()
+	if err != nil {
+		return nil, err
+	}
+	if config := l.owner().tlsConfig; config != nil {
+		return tls.Server(conn, config), nil
+	}
+	return conn, nil
+}
+
+func (l *Listener) Close() error {
+	atomic.StoreInt32(&l.stopped, 1)
+	return l.socket.Close()
+}
+
+// Stopped is true once the listener is closed or its socket taken
+// over by another one.
+func (l *Listener) Stopped() bool {
+	return atomic.LoadInt32(&l.stopped) != 0
+}
+
+// owner returns the last listener the socket was handed over to (l,
+// if it wasn't).
+func (l *Listener) owner() *Listener {
+	l.mu.Lock()
+	next := l.next
+	l.mu.Unlock()
+	if next == nil {
+		return l
+	}
+	return next.owner()
+}
+
+func (l *Listener) handOver(next *Listener) {
+	l.mu.Lock()
+	l.next = next
+	l.mu.Unlock()
+	atomic.StoreInt32(&l.stopped, 1)
+}
+
+// relisten returns a listener for spec that replaces old (listening
+// according to oldSpec).  If the address stays the same, the new
+// listener takes over the socket; otherwise the new socket is opened
+// before the old one is closed.
+func relisten(old *Listener, oldSpec, spec *AddrSpec) (*Listener, error) {
+	if old != nil && oldSpec.Network == spec.Network && oldSpec.Addr == spec.Addr {
+		ln, err := spec.wrapListener(old.socket)
+		if err != nil {
+			return nil, err
+		}
+		old.handOver(ln)
+		return ln, nil
+	}
+	ln, err := spec.Listen()
+	if err != nil {
+		return nil, err
+	}
+	if old != nil {
+		old.Close()
+	}
+	return ln, nil
+}
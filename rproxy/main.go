@@ -17,6 +17,7 @@ func (proxy *Proxy) Run() {
 
 	defer func() {
 		proxy.SetState(ProxyStopped)
+		proxy.stopConfigWatch()
 		proxy.listener.Close()
 		proxy.waitForShutdown()
 	}()
@@ -27,43 +28,46 @@ func (proxy *Proxy) Run() {
 	}
 
 	if proxy.config.Admin.Addr != "" {
-		proxy.adminUI = NewAdminUI(proxy)
-		if err := proxy.adminUI.Start(); err != nil {
+		adminUI := NewAdminUI(proxy)
+		if err := adminUI.Start(); err != nil {
 			log.Println("Could not start admin UI: ", err)
 			return
 		}
-
-		defer func() {
+		proxy.adminUI = adminUI
+	}
+	defer func() {
+		// RELOAD may have started, moved or stopped it.
+		if proxy.adminUI != nil {
 			proxy.adminUI.Stop()
 			proxy.adminUI = nil
-		}()
-	}
+		}
+	}()
 
 	proxy.SetState(ProxyRunning)
+	go proxy.watchSentinels()
+	go proxy.watchReplicas()
 
 	channelMap := map[ProxyState]*ProxyChannels{
 		ProxyRunning: &proxy.channels,
 		ProxyPausing: &ProxyChannels{
-			requestPermission: nil,
-			releasePermission: proxy.channels.releasePermission,
-			info:              proxy.channels.info,
-			command:           proxy.channels.command},
+			idle:    proxy.channels.idle,
+			info:    proxy.channels.info,
+			command: proxy.channels.command},
 		ProxyPaused: &ProxyChannels{
-			requestPermission: nil,
-			releasePermission: nil,
-			info:              proxy.channels.info,
-			command:           proxy.channels.command},
+			idle:    nil,
+			info:    proxy.channels.info,
+			command: proxy.channels.command},
 	}
 
 	for {
-		statRecordProxyState(proxy.activeRequests)
 		st := proxy.State()
 		if st == ProxyStopping {
 			break
 		}
+		proxy.permissions.SetGranting(st == ProxyRunning)
 		switch st {
 		case ProxyPausing:
-			if proxy.activeRequests == 0 {
+			if active, _ := proxy.permissions.Counts(); active == 0 {
 				proxy.SetState(ProxyPaused)
 				continue
 			}
@@ -76,24 +80,37 @@ func (proxy *Proxy) Run() {
 
 func (proxy *Proxy) handleChannels(channels *ProxyChannels) {
 	select {
-	case permCh := <-channels.requestPermission:
-		permCh <- struct{}{}
-		proxy.activeRequests++
-	case <-channels.releasePermission:
-		proxy.activeRequests--
+	case <-channels.idle:
+		// Re-check the state in Run.
 
 	case stateCh := <-channels.info:
 		rawConns := 0
 		if proxy.rawProxy != nil {
 			rawConns = proxy.rawProxy.GetInfo().HandlerCnt
 		}
+		var clusterInfo *ClusterInfo
+		if proxy.config.Cluster.Enabled {
+			clusterInfo = proxy.cluster.Info()
+		}
+		active, waiting := proxy.permissions.Counts()
+		generation, reloads := proxy.reloads.Info()
 		stateCh <- &ProxyInfo{
-			ActiveRequests:  proxy.activeRequests,
-			WaitingRequests: len(proxy.channels.requestPermission),
+			ActiveRequests:  active,
+			WaitingRequests: waiting,
 			State:           proxy.State(),
 			StateStr:        proxy.State().String(),
 			Config:          proxy.GetConfig(),
 			RawConnections:  rawConns,
+			Pool:            proxy.pool.Info(proxy.config),
+			Switchover:      proxy.switchoverInfo(),
+			Cluster:         clusterInfo,
+			Shards:          proxy.config.shardsInfo(proxy.nodeConnCnt),
+			Replicas:        proxy.replicas.Info(proxy.config, proxy.nodeConnCnt),
+			Limits:          proxy.limitsInfo(),
+			Generation:      generation,
+			Reloads:         reloads,
+			ConfigWatch:     proxy.configWatchInfo(),
+			Clients:         proxy.clients.List(),
 		}
 
 	case cmdPack := <-channels.command:
@@ -105,10 +122,18 @@ func (proxy *Proxy) handleChannels(channels *ProxyChannels) {
 			proxy.SetState(ProxyRunning)
 			cmdPack.Return(nil)
 		case CmdReload:
-			cmdPack.Return(proxy.ReloadConfig())
+			reload := cmdPack.arg.(*reloadRequest)
+			proxy.ReloadConfig(reload.config, reload.res)
+			cmdPack.Return(nil)
 		case CmdStop:
 			proxy.SetState(ProxyStopping)
 			cmdPack.Return(nil)
+		case CmdSetUplink:
+			newConfig := *proxy.config
+			newConfig.Uplink = cmdPack.arg.(AddrSpec)
+			proxy.config = &newConfig
+			proxy.reloads.NewGeneration()
+			cmdPack.Return(nil)
 		case CmdTerminateRawConnections:
 			proxy.rawProxy.TerminateAll()
 			cmdPack.Return(nil)
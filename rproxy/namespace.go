@@ -0,0 +1,316 @@
+package rproxy
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Codility/redis-proxy/resp"
+)
+
+// Key namespaces
+//
+// With `listen_namespace` (or `namespace` of the client's user, which
+// takes precedence) set, the proxy prepends the namespace to every key
+// the client sends, and strips it from key names in replies (KEYS,
+// SCAN, RANDOMKEY, blocking pops, XREAD), so that several tenants can
+// share one Redis without seeing each other's keys.  KEYS and SCAN
+// only look at keys in the namespace, and RANDOMKEY replies nil when
+// Redis picks a key from outside of it.
+//
+// Pub/Sub channels get the namespace too, and so do keys in keyspace
+// notification channels (__keyspace@<db>__:<key>).  Keyevent
+// notifications (__keyevent@<db>__:<event>) are delivered only for
+// keys in the namespace.
+//
+// Commands that can't be namespaced safely are rejected: scripts and
+// functions (they can compute key names), FLUSHDB, FLUSHALL, SWAPDB,
+// DBSIZE, MIGRATE, SORT with BY or GET, PUBSUB, MONITOR, and every
+// command whose key arguments the proxy doesn't know.  (SORT ... STORE
+// gets the namespace on its destination.)
+
+var namespaceUnsafeCommands = map[string]bool{}
+
+func init() {
+	for _, cmd := range strings.Fields(
+		"EVAL EVALSHA EVAL_RO EVALSHA_RO FCALL FCALL_RO SCRIPT FUNCTION " +
+			"FLUSHDB FLUSHALL SWAPDB DBSIZE MIGRATE PUBSUB MONITOR") {
+		namespaceUnsafeCommands[cmd] = true
+	}
+}
+
+const (
+	keyspaceChannelPrefix = "__keyspace@"
+	keyeventChannelPrefix = "__keyevent@"
+)
+
+func validNamespace(name, ns string) ErrorList {
+	errList := ErrorList{}
+	if strings.ContainsAny(ns, "{}") {
+		errList.Add(name + " must not contain '{' or '}' (hash tags)")
+	}
+	return errList
+}
+
+func msgNotNamespaced(req *resp.Msg) []byte {
+	return []byte(fmt.Sprintf("-ERR Command '%s' can't be used in a key namespace (redis-proxy)\r\n",
+		strings.ToLower(req.Command())))
+}
+
+// escapeGlob makes s match itself in a glob pattern.
+func escapeGlob(s string) string {
+	var b strings.Builder
+	for _, c := range s {
+		if strings.ContainsRune(`*?[]\`, c) {
+			b.WriteByte('\\')
+		}
+		b.WriteRune(c)
+	}
+	return b.String()
+}
+
+// namespacedChannel returns the name of channel (or pattern) in
+// Redis.
+func namespacedChannel(ns, channel string, pattern bool) string {
+	if pattern {
+		ns = escapeGlob(ns)
+	}
+	if strings.HasPrefix(channel, keyspaceChannelPrefix) {
+		if i := strings.Index(channel, "__:"); i != -1 {
+			return channel[:i+3] + ns + channel[i+3:]
+		}
+	}
+	if strings.HasPrefix(channel, keyeventChannelPrefix) {
+		return channel
+	}
+	return ns + channel
+}
+
+// clientChannel reverses namespacedChannel.
+func clientChannel(ns, channel string, pattern bool) string {
+	if pattern {
+		ns = escapeGlob(ns)
+	}
+	if strings.HasPrefix(channel, keyspaceChannelPrefix) {
+		if i := strings.Index(channel, "__:"); i != -1 && strings.HasPrefix(channel[i+3:], ns) {
+			return channel[:i+3] + channel[i+3+len(ns):]
+		}
+	}
+	return strings.TrimPrefix(channel, ns)
+}
+
+// namespaceRequest rewrites keys (and other names) in req.  Returns
+// an error reply if req can't be namespaced.
+func namespaceRequest(ns string, req *resp.Msg) []byte {
+	cmd := req.Command()
+	if namespaceUnsafeCommands[cmd] {
+		return msgNotNamespaced(req)
+	}
+
+	args := append([]string{}, req.Args()...)
+	switch cmd {
+	case "KEYS":
+		if len(args) > 0 {
+			args[0] = escapeGlob(ns) + args[0]
+		}
+	case "SCAN":
+		matched := false
+		for i := 1; i+1 < len(args); i++ {
+			if strings.EqualFold(args[i], "MATCH") {
+				args[i+1] = escapeGlob(ns) + args[i+1]
+				matched = true
+				i++
+			}
+		}
+		if !matched {
+			args = append(args, "MATCH", escapeGlob(ns)+"*")
+		}
+	case "RANDOMKEY":
+		// See namespaceReply.
+	case "PUBLISH", "SPUBLISH":
+		if len(args) > 0 {
+			args[0] = namespacedChannel(ns, args[0], false)
+		}
+	case "SUBSCRIBE", "UNSUBSCRIBE", "SSUBSCRIBE", "SUNSUBSCRIBE", "PSUBSCRIBE", "PUNSUBSCRIBE":
+		pattern := strings.HasPrefix(cmd, "P")
+		for i := range args {
+			args[i] = namespacedChannel(ns, args[i], pattern)
+		}
+	case "SORT", "SORT_RO":
+		// STORE destination is among key positions, BY and GET
+		// patterns are refused.
+		for _, arg := range args {
+			if strings.EqualFold(arg, "BY") || strings.EqualFold(arg, "GET") {
+				return msgNotNamespaced(req)
+			}
+		}
+		fallthrough
+	default:
+		if !req.KeysKnown() {
+			return msgNotNamespaced(req)
+		}
+		for _, pos := range req.KeyPositions() {
+			args[pos] = ns + args[pos]
+		}
+	}
+	req.SetArgs(args)
+	return nil
+}
+
+// stripKey removes the namespace from a key name in a reply.  Returns
+// nil if the key is not in the namespace.
+func stripKey(ns string, msg *resp.Msg) *resp.Msg {
+	key, ok := msg.Str()
+	if !ok || msg.IsNil() {
+		return msg
+	}
+	if !strings.HasPrefix(key, ns) {
+		return nil
+	}
+	return resp.NewBulkString(key[len(ns):])
+}
+
+// stripKeys applies stripKey to elements of an aggregate at the
+// given positions (every element if positions is nil).
+func stripKeys(ns string, msg *resp.Msg, positions func(i int) bool) *resp.Msg {
+	elems := msg.Elements()
+	if elems == nil {
+		return msg
+	}
+	for i, elem := range elems {
+		if positions != nil && !positions(i) {
+			continue
+		}
+		if stripped := stripKey(ns, elem); stripped != nil {
+			elems[i] = stripped
+		}
+	}
+	return msg.WithElements(elems)
+}
+
+// namespaceReply strips the namespace from key names in res, the
+// reply to the (already namespaced) req.
+func namespaceReply(ns string, req, res *resp.Msg, proto int) *resp.Msg {
+	if res.IsError() || res.IsNil() {
+		return res
+	}
+	first := func(i int) bool { return i == 0 }
+
+	switch req.Command() {
+	case "KEYS":
+		return stripKeys(ns, res, nil)
+	case "SCAN":
+		if elems := res.Elements(); len(elems) == 2 {
+			elems[1] = stripKeys(ns, elems[1], nil)
+			return res.WithElements(elems)
+		}
+	case "RANDOMKEY":
+		if stripped := stripKey(ns, res); stripped != nil {
+			return stripped
+		}
+		if proto > DefaultProto {
+			return resp.NewMsg([]byte("_\r\n"))
+		}
+		return resp.NewMsg([]byte("$-1\r\n"))
+	case "BLPOP", "BRPOP", "BZPOPMIN", "BZPOPMAX", "LMPOP", "BLMPOP", "ZMPOP", "BZMPOP":
+		return stripKeys(ns, res, first)
+	case "XREAD", "XREADGROUP":
+		elems := res.Elements()
+		if res.Data()[0] == '%' {
+			return stripKeys(ns, res, func(i int) bool { return i%2 == 0 })
+		}
+		for i, elem := range elems {
+			elems[i] = stripKeys(ns, elem, first)
+		}
+		return res.WithElements(elems)
+	}
+	return res
+}
+
+// namespacePush strips the namespace from a Pub/Sub message or
+// confirmation.  Returns nil if the client should not get it.
+func namespacePush(ns string, msg *resp.Msg) *resp.Msg {
+	elems := msg.Elements()
+	if len(elems) < 2 {
+		return msg
+	}
+	kind, _ := elems[0].Str()
+	kind = strings.ToLower(kind)
+
+	strip := func(i int, pattern bool) {
+		if name, ok := elems[i].Str(); ok && !elems[i].IsNil() {
+			elems[i] = resp.NewBulkString(clientChannel(ns, name, pattern))
+		}
+	}
+	switch kind {
+	case "subscribe", "unsubscribe", "ssubscribe", "sunsubscribe":
+		strip(1, false)
+	case "psubscribe", "punsubscribe":
+		strip(1, true)
+	case "message", "smessage", "pmessage":
+		chIdx := 1
+		if kind == "pmessage" {
+			if len(elems) < 4 {
+				return msg
+			}
+			strip(1, true)
+			chIdx = 2
+		}
+		if len(elems) < chIdx+2 {
+			return msg
+		}
+		if channel, _ := elems[chIdx].Str(); strings.HasPrefix(channel, keyeventChannelPrefix) {
+			payload := stripKey(ns, elems[chIdx+1])
+			if payload == nil {
+				return nil
+			}
+			elems[chIdx+1] = payload
+		}
+		strip(chIdx, false)
+	default:
+		return msg
+	}
+	return msg.WithElements(elems)
+}
+
+////////////////////////////////////////
+// ClientHandler: namespaces
+
+// namespace returns the key namespace of the client, if any.
+func (ch *ClientHandler) namespace() string {
+	config := ch.proxy.config
+	if ch.cliAuthenticated {
+		if user := config.User(ch.userName); user != nil && user.Namespace != "" {
+			return user.Namespace
+		}
+	}
+	return config.ListenNamespace
+}
+
+// rewriteReply strips the namespace from res, also from replies to
+// transactions.
+func (ch *ClientHandler) rewriteReply(req, res *resp.Msg) *resp.Msg {
+	ns := ch.namespace()
+	if ns == "" {
+		ch.nsQueued = nil
+		return res
+	}
+
+	switch {
+	case req.Op() == resp.MsgOpMulti || req.Op() == resp.MsgOpDiscard:
+		ch.nsQueued = nil
+	case req.Op() == resp.MsgOpExec:
+		queued := ch.nsQueued
+		ch.nsQueued = nil
+		if elems := res.Elements(); res.IsArray() && len(elems) == len(queued) {
+			for i, elem := range elems {
+				elems[i] = namespaceReply(ns, queued[i], elem, ch.proto)
+			}
+			return res.WithElements(elems)
+		}
+	case ch.tx.inMulti && res.IsQueued():
+		ch.nsQueued = append(ch.nsQueued, req)
+	default:
+		return namespaceReply(ns, req, res, ch.proto)
+	}
+	return res
+}
@@ -0,0 +1,129 @@
+package rproxy
+
+import (
+	"testing"
+
+	"github.com/Codility/redis-proxy/fakeredis"
+	"github.com/Codility/redis-proxy/resp"
+	"github.com/stvp/assert"
+)
+
+func TestNamespaceRequest(t *testing.T) {
+	check := func(req *resp.Msg, expected *resp.Msg) {
+		assert.Nil(t, namespaceRequest("t1:", req))
+		assert.Equal(t, req.String(), expected.String())
+	}
+	check(resp.MsgFromStrings("GET", "a"), resp.MsgFromStrings("GET", "t1:a"))
+	check(resp.MsgFromStrings("MSET", "a", "1", "b", "2"), resp.MsgFromStrings("MSET", "t1:a", "1", "t1:b", "2"))
+	check(resp.MsgFromStrings("ZUNIONSTORE", "d", "2", "a", "b"),
+		resp.MsgFromStrings("ZUNIONSTORE", "t1:d", "2", "t1:a", "t1:b"))
+	check(resp.MsgFromStrings("KEYS", "user:*"), resp.MsgFromStrings("KEYS", "t1:user:*"))
+	check(resp.MsgFromStrings("SCAN", "0"), resp.MsgFromStrings("SCAN", "0", "MATCH", "t1:*"))
+	check(resp.MsgFromStrings("SCAN", "0", "match", "u*", "COUNT", "10"),
+		resp.MsgFromStrings("SCAN", "0", "match", "t1:u*", "COUNT", "10"))
+	check(resp.MsgFromStrings("PING"), resp.MsgFromStrings("PING"))
+	check(resp.MsgFromStrings("SORT", "l", "LIMIT", "0", "5", "STORE", "d"),
+		resp.MsgFromStrings("SORT", "t1:l", "LIMIT", "0", "5", "STORE", "t1:d"))
+	check(resp.MsgFromStrings("PUBLISH", "news", "x"), resp.MsgFromStrings("PUBLISH", "t1:news", "x"))
+	check(resp.MsgFromStrings("PSUBSCRIBE", "__keyspace@0__:*"),
+		resp.MsgFromStrings("PSUBSCRIBE", "__keyspace@0__:t1:*"))
+	check(resp.MsgFromStrings("SUBSCRIBE", "__keyevent@0__:del"),
+		resp.MsgFromStrings("SUBSCRIBE", "__keyevent@0__:del"))
+
+	keys := resp.MsgFromStrings("KEYS", "*")
+	assert.Nil(t, namespaceRequest("t[1]", keys))
+	assert.Equal(t, keys.Args(), []string{`t\[1\]*`})
+
+	for _, args := range [][]string{
+		{"flushdb"},
+		{"eval", "return 1", "0"},
+		{"sort", "l", "BY", "w_*"},
+		{"newcommand", "k"},
+	} {
+		assert.Equal(t, string(namespaceRequest("t1:", resp.MsgFromStrings(args...))),
+			"-ERR Command '"+args[0]+"' can't be used in a key namespace (redis-proxy)\r\n")
+	}
+}
+
+func TestNamespaceReply(t *testing.T) {
+	check := func(req *resp.Msg, res, expected string) {
+		assert.Equal(t, namespaceReply("t1:", req, resp.NewMsg([]byte(res)), 2).String(), expected)
+	}
+	check(resp.MsgFromStrings("KEYS", "t1:*"),
+		"*2\r\n$4\r\nt1:a\r\n$4\r\nt1:b\r\n",
+		"*2\r\n$1\r\na\r\n$1\r\nb\r\n")
+	check(resp.MsgFromStrings("SCAN", "0", "MATCH", "t1:*"),
+		"*2\r\n$2\r\n17\r\n*1\r\n$4\r\nt1:a\r\n",
+		"*2\r\n$2\r\n17\r\n*1\r\n$1\r\na\r\n")
+	check(resp.MsgFromStrings("RANDOMKEY"), "$4\r\nt1:a\r\n", "$1\r\na\r\n")
+	check(resp.MsgFromStrings("RANDOMKEY"), "$4\r\nt2:a\r\n", "$-1\r\n")
+	check(resp.MsgFromStrings("BLPOP", "t1:l", "0"),
+		"*2\r\n$4\r\nt1:l\r\n$4\r\nt1:v\r\n",
+		"*2\r\n$1\r\nl\r\n$4\r\nt1:v\r\n")
+	check(resp.MsgFromStrings("XREAD", "STREAMS", "t1:s", "0"),
+		"*1\r\n*2\r\n$4\r\nt1:s\r\n*0\r\n",
+		"*1\r\n*2\r\n$1\r\ns\r\n*0\r\n")
+	check(resp.MsgFromStrings("XREAD", "STREAMS", "t1:s", "0"),
+		"%1\r\n$4\r\nt1:s\r\n*0\r\n",
+		"%1\r\n$1\r\ns\r\n*0\r\n")
+	check(resp.MsgFromStrings("GET", "t1:a"), "$4\r\nt1:a\r\n", "$4\r\nt1:a\r\n")
+}
+
+func TestProxyNamespace(t *testing.T) {
+	srv := fakeredis.Start("srv-1", "tcp")
+	defer srv.Stop()
+
+	loader := &TestConfigLoader{
+		conf: &Config{
+			Uplink:          AddrSpec{Addr: srv.Addr().String()},
+			Listen:          AddrSpec{Addr: "127.0.0.1:0"},
+			ListenNamespace: "t1:",
+			Users: []UserConfig{{
+				Name:         "t2",
+				PasswordHash: sha256Hex("t2-pass"),
+				Enabled:      true,
+				Commands:     []string{"*"},
+				Keys:         []string{"*"},
+				Namespace:    "t2:",
+			}},
+		},
+	}
+	proxy := mustStartTestProxy(t, loader)
+	defer proxy.Stop()
+
+	c := resp.MustDial("tcp", proxy.ListenAddr().String(), 0, false)
+	defer c.Close()
+
+	// Users authenticate first
+	c.MustCall(resp.MsgFromStrings("AUTH", "t2", "t2-pass"))
+	c.MustCall(resp.MsgFromStrings("GET", "a"))
+	assert.Equal(t, srv.LastRequest().String(), resp.MsgFromStrings("GET", "t2:a").String())
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("FLUSHDB")).String(),
+		"-ERR Command 'flushdb' can't be used in a key namespace (redis-proxy)\r\n")
+
+	// Keyspace notifications
+	c.MustWriteMsg(resp.MsgFromStrings("PSUBSCRIBE", "__keyspace@0__:*"))
+	assert.Equal(t, c.MustReadMsg().String(), "*3\r\n$10\r\npsubscribe\r\n$16\r\n__keyspace@0__:*\r\n:1\r\n")
+	c.MustWriteMsg(resp.MsgFromStrings("SUBSCRIBE", "__keyevent@0__:del"))
+	assert.Equal(t, c.MustReadMsg().String(), "*3\r\n$9\r\nsubscribe\r\n$18\r\n__keyevent@0__:del\r\n:2\r\n")
+
+	srv.Publish("__keyspace@0__:t2:a", "del")
+	assert.Equal(t, c.MustReadMsg().String(),
+		"*4\r\n$8\r\npmessage\r\n$16\r\n__keyspace@0__:*\r\n$16\r\n__keyspace@0__:a\r\n$3\r\ndel\r\n")
+	srv.Publish("__keyevent@0__:del", "t1:x") // other namespace
+	srv.Publish("__keyevent@0__:del", "t2:b")
+	assert.Equal(t, c.MustReadMsg().String(),
+		"*3\r\n$7\r\nmessage\r\n$18\r\n__keyevent@0__:del\r\n$1\r\nb\r\n")
+
+	// Listener namespace for clients without users
+	loader.Replace(&Config{
+		Uplink:          AddrSpec{Addr: srv.Addr().String()},
+		Listen:          AddrSpec{Addr: "127.0.0.1:0"},
+		ListenNamespace: "t3:",
+	})
+	assert.Nil(t, proxy.Reload())
+	c2 := resp.MustDial("tcp", proxy.ListenAddr().String(), 0, false)
+	defer c2.Close()
+	c2.MustCall(resp.MsgFromStrings("MGET", "a", "b"))
+	assert.Equal(t, srv.LastRequest().String(), resp.MsgFromStrings("MGET", "t3:a", "t3:b").String())
+}
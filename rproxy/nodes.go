@@ -0,0 +1,190 @@
+package rproxy
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Codility/redis-proxy/resp"
+)
+
+// Routing by key
+//
+// In cluster and shards mode, requests go to different Redis servers
+// ("nodes") depending on their keys.  Every ClientHandler keeps its
+// own connection to each node it talked to (re-SELECTing its db and
+// protocol on them as needed), and sends each batch of requests split by node.
+// Connections to replicas (see replicas.go) are handled the same way.
+
+var MsgRoutingNoTx = []byte("-ERR Transactions are not supported in cluster or shards mode (redis-proxy)\r\n")
+
+type nodeConn struct {
+	conn  *resp.Conn
+	node  AddrSpec
+	db    int
+	proto int
+}
+
+// RoutesByKey is true if requests go to different nodes depending on
+// their keys.
+func (c *Config) RoutesByKey() bool {
+	return c.Cluster.Enabled || c.Sharded()
+}
+
+// routeRequest returns the node req should be sent to, or an error
+// reply for the client.
+func (ch *ClientHandler) routeRequest(config *Config, req *resp.Msg) (AddrSpec, []byte, error) {
+	if config.Cluster.Enabled {
+		slot, errReply := requestSlot(req)
+		if errReply != nil {
+			return AddrSpec{}, errReply, nil
+		}
+		addr, err := ch.proxy.cluster.NodeFor(config, slot)
+		return clusterNode(config, addr), nil, err
+	}
+
+	shard, errReply := config.shardRing.RequestShard(req)
+	if errReply != nil {
+		return AddrSpec{}, errReply, nil
+	}
+	if shard == -1 {
+		return config.Uplink, nil, nil
+	}
+	return config.Shards[shard].AddrSpec, nil, nil
+}
+
+// nodeConn returns the client's connection to node, dialing it if
+// needed.
+func (ch *ClientHandler) nodeConn(config *Config, node AddrSpec) (*resp.Conn, error) {
+	node = ch.withUplinkCredentials(config, node)
+	nc, ok := ch.nodeConns[node.Addr]
+	if ok && nc.node != node {
+		ch.closeNodeConn(node.Addr)
+		ok = false
+	}
+	if !ok {
+		conn, err := node.DialRedis(config.ReadTimeLimitMs, config.LogMessages)
+		if err != nil {
+			return nil, err
+		}
+		nc = &nodeConn{conn: conn, node: node, proto: DefaultProto}
+		ch.nodeConns[node.Addr] = nc
+		ch.proxy.nodeConnCnt.Add(node.Addr, 1)
+	}
+	if nc.db != ch.db {
+		if err := nc.conn.Select(ch.db); err != nil {
+			ch.closeNodeConn(node.Addr)
+			return nil, err
+		}
+		nc.db = ch.db
+	}
+	if nc.proto != ch.proto {
+		if err := nc.conn.Hello(ch.proto); err != nil {
+			ch.closeNodeConn(node.Addr)
+			return nil, err
+		}
+		nc.proto = ch.proto
+	}
+	return nc.conn, nil
+}
+
+func (ch *ClientHandler) closeNodeConn(addr string) {
+	if nc, ok := ch.nodeConns[addr]; ok {
+		nc.conn.Close()
+		delete(ch.nodeConns, addr)
+		ch.proxy.nodeConnCnt.Add(addr, -1)
+	}
+}
+
+func (ch *ClientHandler) closeNodeConns() {
+	for addr := range ch.nodeConns {
+		ch.closeNodeConn(addr)
+	}
+}
+
+func (ch *ClientHandler) callNode(config *Config, node AddrSpec, reqs []*resp.Msg) ([]*resp.Msg, error) {
+	conn, err := ch.nodeConn(config, node)
+	if err != nil {
+		return nil, err
+	}
+	res, err := conn.CallPipeline(reqs)
+	if err != nil {
+		ch.closeNodeConn(node.Addr)
+	}
+	return res, err
+}
+
+// forwardToNodes sends every request to the node it routes to
+// (requests for the same node in a single batch).
+func (ch *ClientHandler) forwardToNodes(config *Config, reqs []*resp.Msg) ([]*resp.Msg, time.Duration, error) {
+	redisReqTs := time.Now()
+
+	res := make([]*resp.Msg, len(reqs))
+	batches := map[AddrSpec][]int{}
+	nodes := []AddrSpec{}
+	for i, req := range reqs {
+		node, errReply, err := ch.routeRequest(config, req)
+		if err != nil {
+			return nil, time.Since(redisReqTs), err
+		}
+		if errReply != nil {
+			res[i] = resp.NewMsg(errReply)
+			continue
+		}
+		if _, ok := batches[node]; !ok {
+			nodes = append(nodes, node)
+		}
+		batches[node] = append(batches[node], i)
+	}
+
+	for _, node := range nodes {
+		batch := make([]*resp.Msg, len(batches[node]))
+		for j, i := range batches[node] {
+			batch[j] = reqs[i]
+		}
+		replies, err := ch.callNode(config, node, batch)
+		if err != nil {
+			return nil, time.Since(redisReqTs), err
+		}
+		for j, i := range batches[node] {
+			res[i] = replies[j]
+		}
+	}
+
+	if config.Cluster.Enabled {
+		if err := ch.followRedirects(config, reqs, res); err != nil {
+			return nil, time.Since(redisReqTs), err
+		}
+	}
+	return res, time.Since(redisReqTs), nil
+}
+
+////////////////////////////////////////
+// connCounter
+
+// connCounter keeps the number of open connections per node, across
+// all clients.
+type connCounter struct {
+	mu     sync.Mutex
+	counts map[string]int
+}
+
+func newConnCounter() *connCounter {
+	return &connCounter{counts: map[string]int{}}
+}
+
+func (cc *connCounter) Add(addr string, delta int) {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	cc.counts[addr] += delta
+	if cc.counts[addr] == 0 {
+		delete(cc.counts, addr)
+	}
+}
+
+func (cc *connCounter) Get(addr string) int {
+	cc.mu.Lock()
+	defer cc.mu.Unlock()
+
+	return cc.counts[addr]
+}
@@ -0,0 +1,98 @@
+package rproxy
+
+import (
+	"sync"
+)
+
+// Execution permissions
+//
+// Requests talk to uplink only with execution permission.  While the
+// proxy is running, permissions are granted right away; PAUSE stops
+// granting them, and completes once all active requests have released
+// theirs.  Requests that arrive in the meantime wait in a queue, and
+// get their permissions (in order) on UNPAUSE.
+//
+// The queue has no fixed capacity, so the numbers of active and
+// waiting requests are exact no matter how many clients wait during a
+// long PAUSE.  `limits.max_waiting_requests` bounds it: over the
+// limit, new requests get an error, and new connections are refused.
+
+var MsgTooManyWaiting = []byte("-ERR too many requests waiting for the proxy (redis-proxy)\r\n")
+
+type permissionQueue struct {
+	mu       sync.Mutex
+	granting bool
+	active   int
+	waiting  []chan struct{}
+
+	// Gets a value when active drops to 0, so that the main loop
+	// notices PAUSE completing.
+	idle chan struct{}
+}
+
+func newPermissionQueue() *permissionQueue {
+	return &permissionQueue{idle: make(chan struct{}, 1)}
+}
+
+// Acquire waits for execution permission.  Returns false if there
+// already are maxWaiting requests in the queue (0: no limit).
+func (pq *permissionQueue) Acquire(maxWaiting int) bool {
+	pq.mu.Lock()
+	if pq.granting && len(pq.waiting) == 0 {
+		pq.active++
+		statRecordPermissions(pq.active, 0)
+		pq.mu.Unlock()
+		return true
+	}
+	if maxWaiting > 0 && len(pq.waiting) >= maxWaiting {
+		pq.mu.Unlock()
+		return false
+	}
+	ch := make(chan struct{})
+	pq.waiting = append(pq.waiting, ch)
+	statRecordPermissions(pq.active, len(pq.waiting))
+	pq.mu.Unlock()
+
+	<-ch
+	return true
+}
+
+func (pq *permissionQueue) Release() {
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+
+	pq.active--
+	statRecordPermissions(pq.active, len(pq.waiting))
+	if pq.active == 0 {
+		select {
+		case pq.idle <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// SetGranting starts (granting everything that waits) or stops
+// granting permissions.
+func (pq *permissionQueue) SetGranting(granting bool) {
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+
+	pq.granting = granting
+	if !granting {
+		return
+	}
+	for _, ch := range pq.waiting {
+		pq.active++
+		close(ch)
+	}
+	pq.waiting = nil
+	statRecordPermissions(pq.active, 0)
+}
+
+// Counts returns numbers of active and waiting requests.
+func (pq *permissionQueue) Counts() (int, int) {
+	pq.mu.Lock()
+	defer pq.mu.Unlock()
+
+	return pq.active, len(pq.waiting)
+}
@@ -0,0 +1,38 @@
+package rproxy
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stvp/assert"
+)
+
+func TestPermissionQueue(t *testing.T) {
+	pq := newPermissionQueue()
+
+	// Far more waiting requests than any channel buffer would hold
+	const n = 2000
+	wg := sync.WaitGroup{}
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			pq.Acquire(0)
+		}()
+	}
+	waitUntil(t, func() bool { _, waiting := pq.Counts(); return waiting == n })
+	assert.False(t, pq.Acquire(n))
+
+	pq.SetGranting(true)
+	wg.Wait()
+	active, waiting := pq.Counts()
+	assert.Equal(t, active, n)
+	assert.Equal(t, waiting, 0)
+
+	for i := 0; i < n; i++ {
+		pq.Release()
+	}
+	active, _ = pq.Counts()
+	assert.Equal(t, active, 0)
+	assert.True(t, pq.Acquire(1))
+}
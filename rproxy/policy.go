@@ -0,0 +1,148 @@
+package rproxy
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/Codility/redis-proxy/resp"
+)
+
+// Command policy
+//
+// `commands` (all clients) and `listen_commands` (clients of
+// `listen`, on top of `commands`) keep clients away from commands
+// like FLUSHALL, KEYS or CONFIG:
+//
+//  - `allow`: if not empty, only these commands can be used,
+//  - `deny`: these commands can't be used,
+//  - `rename`: {"FLUSHALL": "ADMIN-FLUSHALL"} makes FLUSHALL
+//    available only as ADMIN-FLUSHALL (and "" disables it), like
+//    rename-command in redis.conf.
+//
+// Entries are commands ("CONFIG") or subcommands ("CONFIG SET").
+// Allow and deny lists apply to the real names of renamed commands.
+// The proxy rejects requests itself, and counts them in the
+// rproxy_rejected_commands_total metric.  Policies can be changed
+// with RELOAD.  listen_raw can't enforce them, so it can't be used
+// together with `commands`.
+
+type CommandPolicy struct {
+	Allow  []string          `json:"allow,omitempty"`
+	Deny   []string          `json:"deny,omitempty"`
+	Rename map[string]string `json:"rename,omitempty"`
+
+	aliases map[string]string // new name -> real name
+	renamed map[string]bool   // real names not available as such
+}
+
+func (cp *CommandPolicy) Enabled() bool {
+	return len(cp.Allow) > 0 || len(cp.Deny) > 0 || len(cp.Rename) > 0
+}
+
+func (cp *CommandPolicy) Prepare(name string) ErrorList {
+	errList := ErrorList{}
+	for _, entry := range append(append([]string{}, cp.Allow...), cp.Deny...) {
+		if n := len(strings.Fields(entry)); n < 1 || n > 2 {
+			errList.Add(fmt.Sprintf("%s: invalid entry: '%s'", name, entry))
+		}
+	}
+
+	cp.aliases = map[string]string{}
+	cp.renamed = map[string]bool{}
+	for real, alias := range cp.Rename {
+		real, alias = strings.ToUpper(real), strings.ToUpper(alias)
+		if len(strings.Fields(real)) != 1 || (alias != "" && len(strings.Fields(alias)) != 1) {
+			errList.Add(fmt.Sprintf("%s.rename: invalid entry: '%s': '%s'", name, real, alias))
+			continue
+		}
+		if _, dup := cp.aliases[alias]; dup && alias != "" {
+			errList.Add(fmt.Sprintf("%s.rename: '%s' used more than once", name, alias))
+		}
+		cp.renamed[real] = true
+		if alias != "" {
+			cp.aliases[alias] = real
+		}
+	}
+	return errList
+}
+
+// check returns an error reply if the policy doesn't let req (with
+// its real command name) through.
+func (cp *CommandPolicy) check(req *resp.Msg) ([]byte, string) {
+	for _, entry := range cp.Deny {
+		if matchesCommand(entry, req) {
+			return msgCommandNotAllowed(req), "denied"
+		}
+	}
+	if len(cp.Allow) == 0 {
+		return nil, ""
+	}
+	for _, entry := range cp.Allow {
+		if matchesCommand(entry, req) {
+			return nil, ""
+		}
+	}
+	return msgCommandNotAllowed(req), "not_allowed"
+}
+
+func msgCommandNotAllowed(req *resp.Msg) []byte {
+	return []byte(fmt.Sprintf("-ERR Command '%s' is not allowed (redis-proxy)\r\n",
+		strings.ToLower(req.Command())))
+}
+
+func msgUnknownCommand(req *resp.Msg) []byte {
+	return []byte(fmt.Sprintf("-ERR unknown command '%s' (redis-proxy)\r\n",
+		strings.ToLower(req.Command())))
+}
+
+func (c *Config) prepareCommandPolicies() ErrorList {
+	errList := ErrorList{}
+	errList.Append(c.Commands.Prepare("commands"))
+	errList.Append(c.ListenCommands.Prepare("listen_commands"))
+	for real := range c.Commands.renamed {
+		if c.ListenCommands.renamed[real] {
+			errList.Add(fmt.Sprintf("command '%s' renamed in both commands and listen_commands", real))
+		}
+	}
+	if c.ListenRaw.Addr != "" && c.Commands.Enabled() {
+		errList.Add("listen_raw does not support command policies")
+	}
+	return errList
+}
+
+////////////////////////////////////////
+// ClientHandler: command policy
+
+// checkCommandPolicy renames req if it uses an alias, and returns an
+// error reply if the command policy rejects it.
+func (ch *ClientHandler) checkCommandPolicy(req *resp.Msg) []byte {
+	config := ch.proxy.config
+	policies := []*CommandPolicy{&config.Commands, &config.ListenCommands}
+
+	cmd := req.Command()
+	for _, policy := range policies {
+		if policy.renamed[cmd] {
+			statRecordRejectedCommand("renamed", cmd)
+			return msgUnknownCommand(req)
+		}
+	}
+	for _, policy := range policies {
+		if real, ok := policy.aliases[cmd]; ok {
+			req.SetCommand(real)
+			break
+		}
+	}
+
+	for _, policy := range policies {
+		if reply, reason := policy.check(req); reply != nil {
+			if reason == "not_allowed" {
+				// Anything could land here, keep the label bounded.
+				statRecordRejectedCommand(reason, "other")
+			} else {
+				statRecordRejectedCommand(reason, req.Command())
+			}
+			return reply
+		}
+	}
+	return nil
+}
@@ -0,0 +1,82 @@
+package rproxy
+
+import (
+	"testing"
+
+	"github.com/Codility/redis-proxy/fakeredis"
+	"github.com/Codility/redis-proxy/resp"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stvp/assert"
+)
+
+func rejectedCommands(reason, command string) float64 {
+	m := &dto.Metric{}
+	statRejectedCommands.WithLabelValues(reason, command).Write(m)
+	return m.GetCounter().GetValue()
+}
+
+func TestCommandPolicyPrepare(t *testing.T) {
+	c := &Config{
+		ListenRaw:      AddrSpec{Addr: "127.0.0.1:0"},
+		Commands:       CommandPolicy{Deny: []string{"CONFIG SET X"}, Rename: map[string]string{"flushall": "x"}},
+		ListenCommands: CommandPolicy{Rename: map[string]string{"FLUSHALL": "y", "KEYS": "y"}},
+	}
+	errList := c.prepareCommandPolicies()
+	assert.Equal(t, errList.Errors(), []string{
+		"commands: invalid entry: 'CONFIG SET X'",
+		"listen_commands.rename: 'Y' used more than once",
+		"command 'FLUSHALL' renamed in both commands and listen_commands",
+		"listen_raw does not support command policies",
+	})
+}
+
+func TestProxyCommandPolicy(t *testing.T) {
+	srv := fakeredis.Start("srv-1", "tcp")
+	defer srv.Stop()
+
+	conf := func(listenAllow []string) *Config {
+		return &Config{
+			Uplink: AddrSpec{Addr: srv.Addr().String()},
+			Listen: AddrSpec{Addr: "127.0.0.1:0"},
+			Commands: CommandPolicy{
+				Deny:   []string{"KEYS", "CONFIG SET"},
+				Rename: map[string]string{"FLUSHALL": "ADMIN-FLUSHALL", "DEBUG": ""},
+			},
+			ListenCommands: CommandPolicy{Allow: listenAllow},
+		}
+	}
+	loader := &TestConfigLoader{conf: conf(nil)}
+	proxy := mustStartTestProxy(t, loader)
+	defer proxy.Stop()
+
+	c := resp.MustDial("tcp", proxy.ListenAddr().String(), 0, false)
+	defer c.Close()
+
+	deniedKeys := rejectedCommands("denied", "keys")
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("KEYS", "*")).String(),
+		"-ERR Command 'keys' is not allowed (redis-proxy)\r\n")
+	assert.Equal(t, rejectedCommands("denied", "keys"), deniedKeys+1)
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("CONFIG", "SET", "a", "b")).String(),
+		"-ERR Command 'config' is not allowed (redis-proxy)\r\n")
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("CONFIG", "GET", "a")).String(), "$5\r\nsrv-1\r\n")
+
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("FLUSHALL")).String(),
+		"-ERR unknown command 'flushall' (redis-proxy)\r\n")
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("DEBUG", "SLEEP", "0")).String(),
+		"-ERR unknown command 'debug' (redis-proxy)\r\n")
+	assert.Equal(t, srv.ReqCnt(), 1)
+
+	// Aliases reach uplink under the real name
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("admin-flushall", "ASYNC")).String(), "$5\r\nsrv-1\r\n")
+	assert.Equal(t, srv.LastRequest().String(), resp.MsgFromStrings("FLUSHALL", "ASYNC").String())
+
+	// Allow list from RELOAD, checked against real names
+	loader.Replace(conf([]string{"GET", "FLUSHALL"}))
+	assert.Nil(t, proxy.Reload())
+	notAllowed := rejectedCommands("not_allowed", "other")
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("SET", "a", "b")).String(),
+		"-ERR Command 'set' is not allowed (redis-proxy)\r\n")
+	assert.Equal(t, rejectedCommands("not_allowed", "other"), notAllowed+1)
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("GET", "a")).String(), "$5\r\nsrv-1\r\n")
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("ADMIN-FLUSHALL")).String(), "$5\r\nsrv-1\r\n")
+}
@@ -0,0 +1,152 @@
+package rproxy
+
+import (
+	"sync"
+	"time"
+
+	"github.com/Codility/redis-proxy/resp"
+)
+
+// Uplink connection pool
+//
+// With `pool.size` set, requests from clients that don't depend on
+// connection state are sent over a small set of shared uplink
+// connections: a ClientHandler borrows one for every batch of
+// requests and returns it right after reading the replies.  Clients
+// that do something stateful (see PoolConfig.Pins) get pinned to a
+// dedicated connection until they disconnect.
+//
+// Idle connections are dropped after `pool.idle_timeout_ms`, and
+// connections to an old uplink as soon as the config changes.
+
+type UplinkPool struct {
+	mu   sync.Mutex
+	cond *sync.Cond
+
+	idle   []*pooledConn
+	open   int // idle + in use
+	pinned int
+}
+
+type pooledConn struct {
+	conn     *resp.Conn
+	uplink   AddrSpec
+	lastUsed time.Time
+}
+
+type PoolInfo struct {
+	Size   int `json:"size"`
+	Open   int `json:"open"`
+	Idle   int `json:"idle"`
+	InUse  int `json:"in_use"`
+	Pinned int `json:"pinned"`
+}
+
+func NewUplinkPool() *UplinkPool {
+	p := &UplinkPool{}
+	p.cond = sync.NewCond(&p.mu)
+	return p
+}
+
+// Get returns an idle connection to the current uplink, dials a new
+// one if the pool is not full yet, or waits for one to be returned.
+func (p *UplinkPool) Get(config *Config) (*pooledConn, error) {
+	p.mu.Lock()
+	for {
+		p.dropStale(config)
+		if n := len(p.idle); n > 0 {
+			pc := p.idle[n-1]
+			p.idle = p.idle[:n-1]
+			p.mu.Unlock()
+			pc.conn.SetOptions(config.ReadTimeLimitMs, config.LogMessages)
+			return pc, nil
+		}
+		if p.open < config.Pool.Size {
+			break
+		}
+		p.cond.Wait()
+	}
+	p.open++
+	p.mu.Unlock()
+
+	pc, err := dialPooledConn(config)
+	if err != nil {
+		p.mu.Lock()
+		p.open--
+		p.cond.Signal()
+		p.mu.Unlock()
+		return nil, err
+	}
+	return pc, nil
+}
+
+// Put returns a connection to the pool.  Broken connections (and
+// ones that no longer fit the config) are closed.
+func (p *UplinkPool) Put(pc *pooledConn, config *Config, broken bool) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	defer p.cond.Signal()
+
+	if broken || pc.uplink != config.Uplink || p.open > config.Pool.Size {
+		pc.conn.Close()
+		p.open--
+		return
+	}
+	pc.lastUsed = time.Now()
+	p.idle = append(p.idle, pc)
+}
+
+func (p *UplinkPool) Pin() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pinned++
+}
+
+func (p *UplinkPool) Unpin() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.pinned--
+}
+
+func (p *UplinkPool) Info(config *Config) PoolInfo {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	p.dropStale(config)
+	return PoolInfo{
+		Size:   config.Pool.Size,
+		Open:   p.open,
+		Idle:   len(p.idle),
+		InUse:  p.open - len(p.idle),
+		Pinned: p.pinned,
+	}
+}
+
+// dropStale closes idle connections that timed out, lead to an old
+// uplink, or exceed the pool size.  Must be called with p.mu held.
+func (p *UplinkPool) dropStale(config *Config) {
+	var idleLimit time.Time
+	if config.Pool.IdleTimeoutMs > 0 {
+		idleLimit = time.Now().Add(-time.Duration(config.Pool.IdleTimeoutMs) * time.Millisecond)
+	}
+
+	kept := p.idle[:0]
+	for _, pc := range p.idle {
+		if pc.uplink != config.Uplink || pc.lastUsed.Before(idleLimit) || p.open > config.Pool.Size {
+			pc.conn.Close()
+			p.open--
+			p.cond.Signal()
+			continue
+		}
+		kept = append(kept, pc)
+	}
+	p.idle = kept
+}
+
+func dialPooledConn(config *Config) (*pooledConn, error) {
+	conn, err := config.Uplink.DialRedis(config.ReadTimeLimitMs, config.LogMessages)
+	if err != nil {
+		return nil, err
+	}
+	return &pooledConn{conn: conn, uplink: config.Uplink}, nil
+}
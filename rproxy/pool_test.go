@@ -0,0 +1,99 @@
+package rproxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Codility/redis-proxy/fakeredis"
+	"github.com/Codility/redis-proxy/resp"
+	"github.com/stvp/assert"
+)
+
+func startPooledProxy(t *testing.T, srv *fakeredis.FakeRedisServer, pool PoolConfig) (*TestConfigLoader, *Proxy) {
+	conf := &TestConfigLoader{
+		conf: &Config{
+			Uplink: AddrSpec{Addr: srv.Addr().String()},
+			Listen: AddrSpec{Addr: "127.0.0.1:0"},
+			Pool:   pool,
+		},
+	}
+	return conf, mustStartTestProxy(t, conf)
+}
+
+func TestProxyPoolSharesConnections(t *testing.T) {
+	srv := fakeredis.Start("srv", "tcp")
+	defer srv.Stop()
+
+	_, proxy := startPooledProxy(t, srv, PoolConfig{Size: 2})
+	defer proxy.Stop()
+
+	clients := []*resp.Conn{}
+	for i := 0; i < 5; i++ {
+		c := resp.MustDial("tcp", proxy.ListenAddr().String(), 0, false)
+		defer c.Close()
+		clients = append(clients, c)
+	}
+
+	done := make(chan struct{})
+	for _, c := range clients {
+		go func(c *resp.Conn) {
+			for i := 0; i < 10; i++ {
+				assert.Equal(t, c.MustCall(resp.MsgFromStrings("GET", "k")).String(), "$3\r\nsrv\r\n")
+			}
+			done <- struct{}{}
+		}(c)
+	}
+	for range clients {
+		<-done
+	}
+
+	info := proxy.GetInfo().Pool
+	assert.Equal(t, info.Size, 2)
+	assert.True(t, info.Open <= 2)
+	assert.Equal(t, info.InUse, 0)
+	assert.Equal(t, info.Pinned, 0)
+	waitUntil(t, func() bool { return srv.ConnCnt() == info.Open })
+
+	// Using connection state pins the client to its own connection
+	clients[0].MustCallAndGetOk(resp.MsgFromStrings("SELECT", "1"))
+	assert.Equal(t, proxy.GetInfo().Pool.Pinned, 1)
+	waitUntil(t, func() bool { return srv.ConnCnt() == info.Open+1 })
+	assert.Equal(t, srv.LastRequest().String(), resp.MsgFromStrings("SELECT", "1").String())
+
+	clients[1].MustCallAndGetOk(resp.MsgFromStrings("SELECT", "0"))
+	clients[2].MustCall(resp.MsgFromStrings("CLIENT", "SETNAME", "c2"))
+	assert.Equal(t, proxy.GetInfo().Pool.Pinned, 2)
+
+	clients[0].Close()
+	clients[2].Close()
+	waitUntil(t, func() bool { return proxy.GetInfo().Pool.Pinned == 0 })
+}
+
+func TestProxyPoolDropsIdleConnections(t *testing.T) {
+	srv := fakeredis.Start("srv", "tcp")
+	defer srv.Stop()
+
+	conf, proxy := startPooledProxy(t, srv, PoolConfig{Size: 2, IdleTimeoutMs: 50})
+	defer proxy.Stop()
+
+	c := resp.MustDial("tcp", proxy.ListenAddr().String(), 0, false)
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("GET", "k")).String(), "$3\r\nsrv\r\n")
+	assert.Equal(t, proxy.GetInfo().Pool.Idle, 1)
+
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, proxy.GetInfo().Pool.Open, 0)
+
+	// Connections to the old uplink are not reused after reload
+	srv_1 := fakeredis.Start("srv-1", "tcp")
+	defer srv_1.Stop()
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("GET", "k")).String(), "$3\r\nsrv\r\n")
+	conf.Replace(&Config{
+		Uplink: AddrSpec{Addr: srv_1.Addr().String()},
+		Listen: AddrSpec{Addr: "127.0.0.1:0"},
+		Pool:   PoolConfig{Size: 2},
+	})
+	assert.Nil(t, proxy.Reload())
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("GET", "k")).String(), "$5\r\nsrv-1\r\n")
+	assert.Equal(t, proxy.GetInfo().Pool.Open, 1)
+	assert.Equal(t, proxy.GetInfo().Pool.Pinned, 0)
+}
@@ -0,0 +1,396 @@
+package rproxy
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Codility/redis-proxy/resp"
+)
+
+// Pub/Sub
+//
+// Once a client subscribes to anything, its uplink connection works
+// in push mode: Redis sends messages whenever they get published, not
+// in response to requests.  ClientHandler handles that in a
+// pubSubSession: a pump goroutine copies everything uplink sends to
+// the client, while the handler forwards further (un)subscribe
+// requests.  The session ends when the client unsubscribes from
+// everything, and the handler goes back to normal request-reply mode.
+//
+// The handler keeps track of subscriptions (based on confirmations
+// sent by Redis), so that after RELOAD changes uplink it can re-issue
+// all of them on the new connection, without the client noticing.
+// PAUSE holds new subscribe requests, but not delivery of messages
+// for existing subscriptions.
+
+const pubSubPollInterval = 250 * time.Millisecond
+
+// Maps (un)subscribe commands and confirmations to the kind of
+// subscription they refer to, and the kind to the command that
+// re-creates it.
+var (
+	subscriptionKinds = map[string]string{
+		"subscribe":    "subscribe",
+		"unsubscribe":  "subscribe",
+		"psubscribe":   "psubscribe",
+		"punsubscribe": "psubscribe",
+		"ssubscribe":   "ssubscribe",
+		"sunsubscribe": "ssubscribe",
+	}
+	pushMessageKinds = map[string]bool{
+		"message":  true,
+		"pmessage": true,
+		"smessage": true,
+	}
+)
+
+type subscriptions map[string]map[string]bool
+
+func newSubscriptions() subscriptions {
+	return subscriptions{
+		"subscribe":  map[string]bool{},
+		"psubscribe": map[string]bool{},
+		"ssubscribe": map[string]bool{},
+	}
+}
+
+func (s subscriptions) Count() int {
+	cnt := 0
+	for _, set := range s {
+		cnt += len(set)
+	}
+	return cnt
+}
+
+// Requests (re)creating all subscriptions.
+func (s subscriptions) Requests() []*resp.Msg {
+	res := []*resp.Msg{}
+	for _, kind := range []string{"subscribe", "psubscribe", "ssubscribe"} {
+		if len(s[kind]) == 0 {
+			continue
+		}
+		args := []string{strings.ToUpper(kind)}
+		for name := range s[kind] {
+			args = append(args, name)
+		}
+		res = append(res, resp.MsgFromStrings(args...))
+	}
+	return res
+}
+
+type pendingRequest struct {
+	command string
+	args    []string
+
+	// Number of replies still expected, -1 if not known yet.
+	left int
+}
+
+type pubSubSession struct {
+	ch *ClientHandler
+
+	mu       sync.Mutex
+	cond     *sync.Cond
+	pending  []*pendingRequest
+	finished bool
+	stopping bool
+
+	pumpDone chan struct{}
+}
+
+// runPubSub handles the client in push mode, starting with reqs[0]
+// (a subscribe request).  Returns requests that were read from the
+// client but have to be handled after the client unsubscribed from
+// everything.
+func (ch *ClientHandler) runPubSub(reqs []*resp.Msg) []*resp.Msg {
+	if reply := ch.preprocessRequest(reqs[0]); reply != nil {
+		ch.writeToClient(reply)
+		return reqs[1:]
+	}
+	if ch.tx.watching {
+		ch.writeToClient([]byte("-ERR SUBSCRIBE while WATCHing keys is not supported (redis-proxy)\r\n"))
+		return reqs[1:]
+	}
+
+	ch.proxy.enterExecution()
+	_, err := ch.ensureUplink(ch.proxy.config)
+	ch.proxy.leaveExecution()
+	if err != nil {
+		log.Printf("Error: %v\n", err)
+		ch.done = true
+		return nil
+	}
+
+	ps := &pubSubSession{ch: ch, pumpDone: make(chan struct{})}
+	ps.cond = sync.NewCond(&ps.mu)
+	go ps.pump()
+	defer ps.stop()
+
+	// reqs[0] is already preprocessed.
+	ps.dispatch(reqs[0])
+	reqs = reqs[1:]
+
+	for !ch.done {
+		var req *resp.Msg
+		if len(reqs) > 0 {
+			req, reqs = reqs[0], reqs[1:]
+		} else if req = ch.readMsgFromClient(); req == nil {
+			break
+		}
+		if !ps.handleRequest(req) {
+			return append([]*resp.Msg{req}, reqs...)
+		}
+	}
+	return nil
+}
+
+// handleRequest returns false if the session is over and req has to
+// be handled in normal mode.
+func (ps *pubSubSession) handleRequest(req *resp.Msg) bool {
+	ch := ps.ch
+	if reply := ch.preprocessRequest(req); reply != nil {
+		ch.writeToClient(reply)
+		return true
+	}
+	return ps.dispatch(req)
+}
+
+// dispatch handles a preprocessed request, see handleRequest.
+func (ps *pubSubSession) dispatch(req *resp.Msg) bool {
+	ch := ps.ch
+	switch {
+	case req.Op() == resp.MsgOpSubscribe:
+		ch.proxy.enterExecution()
+		defer ch.proxy.leaveExecution()
+		return ps.forward(req)
+	case req.Op() == resp.MsgOpUnsubscribe || req.Command() == "PING":
+		return ps.forward(req)
+	case req.Command() == "QUIT":
+		ch.writeToClient(resp.MsgOk)
+		ch.done = true
+		return true
+	}
+
+	// Anything else is allowed only after all replies to previous
+	// requests have shown that the client is no longer subscribed.
+	ps.mu.Lock()
+	for len(ps.pending) > 0 && !ps.finished {
+		ps.cond.Wait()
+	}
+	finished := ps.finished
+	ps.mu.Unlock()
+
+	if finished {
+		return false
+	}
+	ch.writeToClient([]byte(fmt.Sprintf(
+		"-ERR Can't execute '%s': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT are allowed in this context (redis-proxy)\r\n",
+		strings.ToLower(req.Command()))))
+	return true
+}
+
+func (ps *pubSubSession) forward(req *resp.Msg) bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if ps.finished {
+		return false
+	}
+	if _, err := ps.ch.uplinkConn.WriteMsg(req); err != nil {
+		log.Printf("Error: %v\n", err)
+		ps.ch.done = true
+		return true
+	}
+	ps.pending = append(ps.pending, &pendingRequest{
+		command: strings.ToLower(req.Command()),
+		args:    req.Args(),
+		left:    -1,
+	})
+	return true
+}
+
+func (ps *pubSubSession) stop() {
+	ps.mu.Lock()
+	ps.stopping = true
+	if !ps.finished {
+		// Wake up the pump if it's waiting for uplink.
+		ps.ch.uplinkConn.Close()
+	}
+	ps.mu.Unlock()
+
+	<-ps.pumpDone
+}
+
+func (ps *pubSubSession) isStopping() bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	return ps.stopping
+}
+
+func (ps *pubSubSession) pump() {
+	defer close(ps.pumpDone)
+
+	for {
+		conn := ps.ch.uplinkConn
+		err := conn.WaitForData(pubSubPollInterval)
+		if err == nil {
+			var msg *resp.Msg
+			if msg, err = conn.ReadMsg(); err == nil {
+				if !ps.handleReply(msg) {
+					return
+				}
+				continue
+			}
+		}
+
+		if ps.isStopping() {
+			return
+		}
+		if resp.IsNetTimeout(err) {
+			err = ps.maybeSwitchUplink()
+		}
+		if err != nil {
+			ps.fail(err)
+			return
+		}
+	}
+}
+
+func (ps *pubSubSession) fail(err error) {
+	log.Printf("Pub/Sub error for %s: %v\n", ps.ch.cliConn.RemoteAddr(), err)
+
+	ps.mu.Lock()
+	ps.finished = true
+	ps.cond.Broadcast()
+	ps.mu.Unlock()
+
+	// Wake up the handler if it's waiting for the client.
+	ps.ch.cliConn.Close()
+}
+
+// handleReply passes msg to the client and updates session state.
+// Returns false if the client is no longer subscribed to anything.
+func (ps *pubSubSession) handleReply(msg *resp.Msg) bool {
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	kind, name, isNil := "", "", false
+	if elements := msg.Elements(); len(elements) >= 2 {
+		kind, _ = elements[0].Str()
+		kind = strings.ToLower(kind)
+		name, _ = elements[1].Str()
+		isNil = elements[1].IsNil()
+	}
+
+	if !pushMessageKinds[kind] && len(ps.pending) > 0 {
+		head := ps.pending[0]
+		if head.left == -1 {
+			head.left = ps.expectedReplies(head)
+		}
+		head.left--
+		if head.left <= 0 || msg.IsError() {
+			ps.pending = ps.pending[1:]
+			ps.cond.Broadcast()
+		}
+	}
+
+	if set, ok := subscriptionKinds[kind]; ok && !isNil {
+		if strings.Contains(kind, "unsubscribe") {
+			delete(ps.ch.subs[set], name)
+		} else {
+			ps.ch.subs[set][name] = true
+		}
+	}
+
+	if ns := ps.ch.namespace(); ns != "" {
+		msg = namespacePush(ns, msg)
+	}
+	if msg != nil {
+		if err := ps.ch.sendToClient(msg.Data()); err != nil {
+			log.Printf("Could not write to %s: %v\n", ps.ch.cliConn.RemoteAddr(), err)
+			ps.ch.cliConn.Close()
+		}
+	}
+
+	if ps.ch.subs.Count() == 0 && len(ps.pending) == 0 {
+		ps.finished = true
+		ps.cond.Broadcast()
+		return false
+	}
+	return true
+}
+
+func (ps *pubSubSession) expectedReplies(req *pendingRequest) int {
+	if len(req.args) > 0 {
+		if _, ok := subscriptionKinds[req.command]; ok {
+			return len(req.args)
+		}
+		return 1
+	}
+	// UNSUBSCRIBE without arguments: one reply per subscription.
+	if set, ok := subscriptionKinds[req.command]; ok && len(ps.ch.subs[set]) > 0 {
+		return len(ps.ch.subs[set])
+	}
+	return 1
+}
+
+// maybeSwitchUplink re-creates all subscriptions on the new uplink
+// after config reload.
+func (ps *pubSubSession) maybeSwitchUplink() error {
+	ch := ps.ch
+	config := ch.proxy.config
+	if *ch.uplinkConf == ch.withUplinkCredentials(config, config.Uplink) {
+		return nil
+	}
+
+	ch.proxy.enterExecution()
+	defer ch.proxy.leaveExecution()
+
+	ps.mu.Lock()
+	defer ps.mu.Unlock()
+
+	if len(ps.pending) > 0 {
+		// Try again once all replies from the old uplink arrive.
+		return nil
+	}
+
+	log.Printf("Moving subscriptions of %s to new uplink", ch.cliConn.RemoteAddr())
+	if _, err := ch.ensureUplink(ch.proxy.config); err != nil {
+		return err
+	}
+
+	reqs := ch.subs.Requests()
+	if _, err := ch.uplinkConn.WriteMsgs(reqs); err != nil {
+		return err
+	}
+	for left := ch.subs.Count(); left > 0; {
+		msg, err := ch.uplinkConn.ReadMsg()
+		if err != nil {
+			return err
+		}
+		if msg.IsError() {
+			return fmt.Errorf("Could not re-subscribe: %s", msg.String())
+		}
+		if elements := msg.Elements(); len(elements) > 0 {
+			kind, _ := elements[0].Str()
+			if pushMessageKinds[strings.ToLower(kind)] {
+				if ns := ch.namespace(); ns != "" {
+					msg = namespacePush(ns, msg)
+				}
+				if msg == nil {
+					continue
+				}
+				if err := ch.sendToClient(msg.Data()); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+		left--
+	}
+	return nil
+}
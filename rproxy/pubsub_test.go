@@ -0,0 +1,105 @@
+package rproxy
+
+import (
+	"testing"
+	"time"
+
+	"github.com/Codility/redis-proxy/fakeredis"
+	"github.com/Codility/redis-proxy/resp"
+	"github.com/stvp/assert"
+)
+
+func TestProxyPubSub(t *testing.T) {
+	srv := fakeredis.Start("srv", "tcp")
+	defer srv.Stop()
+
+	proxy := mustStartTestProxy(t, NewTestConfigLoader(srv.Addr().String()))
+	defer proxy.Stop()
+
+	c := resp.MustDial("tcp", proxy.ListenAddr().String(), 0, false)
+	assert.Equal(t,
+		c.MustCall(resp.MsgFromStrings("SUBSCRIBE", "ch-a", "ch-b")).String(),
+		"*3\r\n$9\r\nsubscribe\r\n$4\r\nch-a\r\n:1\r\n")
+	assert.Equal(t, c.MustReadMsg().String(), "*3\r\n$9\r\nsubscribe\r\n$4\r\nch-b\r\n:2\r\n")
+	assert.Equal(t,
+		c.MustCall(resp.MsgFromStrings("PSUBSCRIBE", "ch-*")).String(),
+		"*3\r\n$10\r\npsubscribe\r\n$4\r\nch-*\r\n:3\r\n")
+
+	// Subscribed clients don't count as active requests
+	assert.Equal(t, proxy.GetInfo().ActiveRequests, 0)
+
+	assert.Equal(t, srv.Publish("ch-a", "hello"), 2)
+	assert.Equal(t, c.MustReadMsg().String(), "*3\r\n$7\r\nmessage\r\n$4\r\nch-a\r\n$5\r\nhello\r\n")
+	assert.Equal(t, c.MustReadMsg().String(), "*4\r\n$8\r\npmessage\r\n$4\r\nch-*\r\n$4\r\nch-a\r\n$5\r\nhello\r\n")
+
+	// Only (un)subscribe requests are allowed in push mode
+	assert.Equal(t,
+		c.MustCall(resp.MsgFromStrings("GET", "a")).String(),
+		"-ERR Can't execute 'get': only (P|S)SUBSCRIBE / (P|S)UNSUBSCRIBE / PING / QUIT are allowed in this context (redis-proxy)\r\n")
+
+	c.MustWrite(resp.MsgFromStrings("UNSUBSCRIBE").Data())
+	c.MustWrite(resp.MsgFromStrings("PUNSUBSCRIBE").Data())
+	c.MustWrite(resp.MsgFromStrings("GET", "a").Data())
+	assert.Equal(t, c.MustReadMsg().String(), "*3\r\n$11\r\nunsubscribe\r\n$4\r\nch-a\r\n:2\r\n")
+	assert.Equal(t, c.MustReadMsg().String(), "*3\r\n$11\r\nunsubscribe\r\n$4\r\nch-b\r\n:1\r\n")
+	assert.Equal(t, c.MustReadMsg().String(), "*3\r\n$12\r\npunsubscribe\r\n$4\r\nch-*\r\n:0\r\n")
+
+	// Back to normal mode
+	assert.Equal(t, c.MustReadMsg().String(), "$3\r\nsrv\r\n")
+}
+
+func TestProxyPubSubSurvivesUplinkSwitch(t *testing.T) {
+	srv_0 := fakeredis.Start("srv-0", "tcp")
+	defer srv_0.Stop()
+	srv_1 := fakeredis.Start("srv-1", "tcp")
+	defer srv_1.Stop()
+
+	conf := NewTestConfigLoader(srv_0.Addr().String())
+	proxy := mustStartTestProxy(t, conf)
+	defer proxy.Stop()
+
+	c := resp.MustDial("tcp", proxy.ListenAddr().String(), 0, false)
+	c.MustCall(resp.MsgFromStrings("SUBSCRIBE", "ch-a"))
+	c.MustCall(resp.MsgFromStrings("PSUBSCRIBE", "ch-*"))
+
+	conf.Replace(&Config{
+		Uplink: AddrSpec{Addr: srv_1.Addr().String()},
+		Listen: AddrSpec{Addr: "127.0.0.1:0"},
+	})
+	assert.Nil(t, proxy.Reload())
+	waitUntil(t, func() bool { return srv_1.ReqCnt() == 2 })
+
+	// The client gets no confirmations from the new uplink, only
+	// messages.
+	assert.Equal(t, srv_1.Publish("ch-a", "hello"), 2)
+	assert.Equal(t, c.MustReadMsg().String(), "*3\r\n$7\r\nmessage\r\n$4\r\nch-a\r\n$5\r\nhello\r\n")
+	assert.Equal(t, c.MustReadMsg().String(), "*4\r\n$8\r\npmessage\r\n$4\r\nch-*\r\n$4\r\nch-a\r\n$5\r\nhello\r\n")
+	assert.Equal(t, srv_0.Publish("ch-a", "hello"), 0)
+}
+
+func TestProxyPauseHoldsSubscribe(t *testing.T) {
+	srv := fakeredis.Start("srv", "tcp")
+	defer srv.Stop()
+
+	proxy := mustStartTestProxy(t, NewTestConfigLoader(srv.Addr().String()))
+	defer proxy.Stop()
+
+	c := resp.MustDial("tcp", proxy.ListenAddr().String(), 0, false)
+	c.MustCall(resp.MsgFromStrings("SUBSCRIBE", "ch-a"))
+
+	proxy.Pause()
+	waitUntil(t, func() bool { return proxy.GetInfo().State == ProxyPaused })
+
+	// Messages are delivered during pause...
+	srv.Publish("ch-a", "hello")
+	assert.Equal(t, c.MustReadMsg().String(), "*3\r\n$7\r\nmessage\r\n$4\r\nch-a\r\n$5\r\nhello\r\n")
+
+	// ...but new subscriptions have to wait
+	c.MustWrite(resp.MsgFromStrings("SUBSCRIBE", "ch-b").Data())
+	waitUntil(t, func() bool { return proxy.GetInfo().WaitingRequests == 1 })
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, srv.ReqCnt(), 1)
+
+	proxy.Unpause()
+	assert.Equal(t, c.MustReadMsg().String(), "*3\r\n$9\r\nsubscribe\r\n$4\r\nch-b\r\n:2\r\n")
+}
@@ -33,11 +33,28 @@ func (r *RawHandler) DialUplink() net.Conn {
 func (r *RawHandler) Run() {
 	defer func() {
 		r.cliConn.Close()
-		r.uplinkConn.Close()
+		if r.uplinkConn != nil {
+			r.uplinkConn.Close()
+		}
 		r.proxy.rawProxy.deadHandlerChan <- r
 	}()
 
+	cert, err := handshakeClient(r.cliConn)
+	if err != nil {
+		log.Printf("Raw proxy: client %s: TLS handshake failed: %s", r.cliConn.RemoteAddr(), err)
+		return
+	}
+	certIdentity := ""
+	if cert != nil {
+		certIdentity, _ = r.proxy.GetConfig().certIdentity(cert)
+	}
+	client := r.proxy.clients.Add("listen_raw", r.cliConn.RemoteAddr(), certIdentity)
+	defer r.proxy.clients.Remove(client)
+
 	r.uplinkConn = r.DialUplink()
+	if r.uplinkConn == nil {
+		return
+	}
 	doneChan := make(chan struct{})
 	terminating := false
 
@@ -49,7 +66,12 @@ func (r *RawHandler) Run() {
 		doneChan <- struct{}{}
 	}
 
-	log.Printf("Starting raw proxy for %s <-> %s", r.cliConn.RemoteAddr(), r.uplinkConn.RemoteAddr())
+	if certIdentity != "" {
+		log.Printf("Starting raw proxy for %s (certificate: %s) <-> %s",
+			r.cliConn.RemoteAddr(), certIdentity, r.uplinkConn.RemoteAddr())
+	} else {
+		log.Printf("Starting raw proxy for %s <-> %s", r.cliConn.RemoteAddr(), r.uplinkConn.RemoteAddr())
+	}
 
 	go pump(r.cliConn, r.uplinkConn)
 	go pump(r.uplinkConn, r.cliConn)
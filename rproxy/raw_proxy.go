@@ -11,6 +11,8 @@ import (
 type RawProxy struct {
 	Addr             net.Addr
 	proxy            *Proxy
+	ln               *Listener // nil when `listen_raw` is turned off
+	connections      chan net.Conn
 	terminateAllChan chan chan struct{}
 	getInfoChan      chan chan *RawProxyInfo
 	deadHandlerChan  chan *RawHandler
@@ -29,6 +31,7 @@ const (
 func NewRawProxy(proxy *Proxy) *RawProxy {
 	return &RawProxy{
 		proxy:            proxy,
+		connections:      make(chan net.Conn),
 		terminateAllChan: make(chan chan struct{}),
 		getInfoChan:      make(chan chan *RawProxyInfo),
 		deadHandlerChan:  make(chan *RawHandler),
@@ -42,43 +45,77 @@ func (r *RawProxy) Start() error {
 	if err != nil {
 		return err
 	}
-	r.Addr = ln.Addr()
-	log.Println("Raw proxy:", r.Addr)
-	go r.proxyLoop(r.startAcceptor(ln))
+	r.startAcceptor(ln)
+	go r.proxyLoop()
+	return nil
+}
+
+// Relisten moves the raw proxy to new settings of `listen_raw`, or
+// stops accepting connections if it's turned off.  Connections
+// already made are kept either way.
+func (r *RawProxy) Relisten(oldSpec, spec *AddrSpec) error {
+	if spec.Addr == "" {
+		if r.ln != nil {
+			r.ln.Close()
+		}
+		r.ln = nil
+		r.Addr = nil
+		return nil
+	}
+	ln, err := relisten(r.ln, oldSpec, spec)
+	if err != nil {
+		return err
+	}
+	r.startAcceptor(ln)
 	return nil
 }
 
-func (r *RawProxy) startAcceptor(ln *Listener) chan net.Conn {
-	connections := make(chan net.Conn)
+func (r *RawProxy) startAcceptor(ln *Listener) {
+	r.ln = ln
+	r.Addr = ln.Addr()
+	log.Println("Raw proxy:", r.Addr)
 
 	go func() {
-		defer close(connections)
-		defer ln.Close()
+		defer func() {
+			if !ln.Stopped() {
+				ln.Close()
+			}
+		}()
 
-		for r.proxy.State().IsStartingOrAlive() {
+		for r.proxy.State().IsStartingOrAlive() && !ln.Stopped() {
 			ln.SetDeadline(time.Now().Add(time.Second))
 			conn, err := ln.Accept()
 			if err != nil {
 				if resp.IsNetTimeout(err) {
 					continue
 				}
+				if ln.Stopped() {
+					return
+				}
 				log.Printf("Raw Proxy: Got an error accepting a connection: %s", err)
 			}
-			connections <- conn
+			// If ln got stopped meanwhile, conn is set up
+			// according to the listener that took the socket
+			// over, and the loop ends here.
+			r.connections <- conn
 		}
 	}()
-
-	return connections
 }
 
-func (r *RawProxy) proxyLoop(connections chan net.Conn) {
+func (r *RawProxy) proxyLoop() {
 	handlers := map[net.Addr]*RawHandler{}
 
+	// Acceptors come and go with RELOAD, so the loop checks the
+	// proxy state on its own.
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+
 loop:
 	for r.proxy.State().IsStartingOrAlive() {
 		select {
-		case conn := <-connections:
-			if conn == nil {
+		case <-ticker.C:
+		case conn := <-r.connections:
+			if conn == nil || !r.proxy.acceptConn(r.proxy.rawConns, conn) {
 				continue loop
 			}
 			h := NewRawHandler(conn, r.proxy)
@@ -91,6 +128,7 @@ loop:
 			ret <- struct{}{}
 		case dead := <-r.deadHandlerChan:
 			delete(handlers, dead.CliAddr())
+			r.proxy.rawConns.Release(dead.CliAddr())
 		case ret := <-r.getInfoChan:
 			ret <- &RawProxyInfo{HandlerCnt: len(handlers)}
 		}
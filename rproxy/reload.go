@@ -0,0 +1,326 @@
+package rproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"reflect"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Reload
+//
+// RELOAD can change every part of the config.  Each top-level field
+// is listed in reloadableFields with the way its change is applied;
+// a field missing from there (e.g. one added without reload support)
+// makes the proxy reject the new config.
+//
+// Listeners are rebound: the new socket is opened before the old one
+// is closed (or, when only TLS settings or the password change, the
+// socket is handed over to the new listener), and connections already
+// made are kept.  The admin server is restarted on the new address;
+// on the same address, the old server stops listening first, and
+// requests in progress (like the RELOAD itself) are completed.  Other
+// fields are read by clients with their next request.
+//
+// Every attempt gets a ReloadResult: each error and warning as a
+// separate item, the changes made, and the duration of each step
+// (pause, when the proxy has to drain requests first, load, validate,
+// apply).  The config in effect has a generation number, increased
+// by every successful reload (and switchover).  Recent results are
+// in /info.json.
+
+const (
+	appliedNextRequest = "applied from the next request"
+	appliedExisting    = "applied to existing connections with their next request"
+)
+
+var reloadableFields = map[string]string{
+	"uplink":             "clients switch uplink with their next request",
+	"listen":             "listener rebound, existing connections kept",
+	"listen_raw":         "raw listener rebound, existing connections kept",
+	"admin":              "admin server restarted",
+	"sentinel":           "applied from the next check",
+	"cluster":            appliedNextRequest,
+	"shards":             "shard ring rebuilt, " + appliedNextRequest,
+	"replicas":           appliedNextRequest,
+	"pool":               appliedNextRequest,
+	"users":              appliedNextRequest,
+	"commands":           appliedNextRequest,
+	"listen_commands":    appliedNextRequest,
+	"listen_namespace":   appliedNextRequest,
+	"limits":             "applied from the next request or connection",
+	"read_time_limit_ms": appliedExisting,
+	"log_messages":       appliedExisting,
+}
+
+const maxReloadHistory = 20
+
+type ReloadStep struct {
+	Name       string  `json:"name"`
+	Ok         bool    `json:"ok"`
+	DurationMs float64 `json:"duration_ms"`
+}
+
+type ReloadResult struct {
+	Time       time.Time      `json:"time"`
+	Ok         bool           `json:"ok"`
+	Error      string         `json:"error,omitempty"` // all errors, joined
+	Errors     []ConfigError  `json:"errors,omitempty"`
+	Changes    []ConfigChange `json:"changes,omitempty"`
+	Steps      []ReloadStep   `json:"steps"`
+	Generation int            `json:"generation"` // of the config in effect afterwards
+}
+
+func newReloadResult() *ReloadResult {
+	return &ReloadResult{Time: time.Now(), Steps: []ReloadStep{}}
+}
+
+func (r *ReloadResult) addStep(name string, start time.Time, ok bool) {
+	r.Steps = append(r.Steps, ReloadStep{
+		Name:       name,
+		Ok:         ok,
+		DurationMs: float64(time.Since(start)) / float64(time.Millisecond),
+	})
+}
+
+func (r *ReloadResult) fail(errList ErrorList) {
+	r.Ok = false
+	r.Error = errList.AsError().Error()
+	r.Errors = errList.Items()
+}
+
+func (r *ReloadResult) succeed(errList ErrorList, changes []ConfigChange) {
+	r.Ok = true
+	r.Errors = errList.Items()
+	r.Changes = changes
+}
+
+func (r *ReloadResult) AsError() error {
+	if r.Ok {
+		return nil
+	}
+	return errors.New(r.Error)
+}
+
+func errorListOf(err error) ErrorList {
+	errList := ErrorList{}
+	errList.Add(err.Error())
+	return errList
+}
+
+// reloadHistory keeps the config generation and recent reload
+// results.
+type reloadHistory struct {
+	mu         sync.Mutex
+	generation int
+	results    []ReloadResult
+}
+
+func newReloadHistory() *reloadHistory {
+	return &reloadHistory{generation: 1}
+}
+
+func (h *reloadHistory) NewGeneration() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.generation++
+}
+
+// Record adds res to the history, and sets its generation (a new one
+// if it succeeded).
+func (h *reloadHistory) Record(res *ReloadResult) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if res.Ok {
+		h.generation++
+	}
+	res.Generation = h.generation
+	statRecordReload(res.Ok, res.Time)
+	h.results = append(h.results, *res)
+	if len(h.results) > maxReloadHistory {
+		h.results = h.results[len(h.results)-maxReloadHistory:]
+	}
+}
+
+func (h *reloadHistory) Info() (int, []ReloadResult) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return h.generation, append([]ReloadResult{}, h.results...)
+}
+
+type ConfigChange struct {
+	Field   string `json:"field"`
+	Applied string `json:"applied"`
+}
+
+// changedFields returns JSON names of top-level fields that differ
+// between c and new.
+func (c *Config) changedFields(new *Config) []string {
+	changed := []string{}
+	oldVal, newVal := reflect.ValueOf(c).Elem(), reflect.ValueOf(new).Elem()
+	for i := 0; i < oldVal.NumField(); i++ {
+		field := oldVal.Type().Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if name == "" {
+			continue
+		}
+		oldJSON, _ := json.Marshal(oldVal.Field(i).Interface())
+		newJSON, _ := json.Marshal(newVal.Field(i).Interface())
+		if string(oldJSON) != string(newJSON) {
+			changed = append(changed, name)
+		}
+	}
+	return changed
+}
+
+// ValidateSwitchTo checks that RELOAD can apply every change from c
+// to new.
+func (c *Config) ValidateSwitchTo(new *Config) ErrorList {
+	errList := ErrorList{}
+	for _, field := range c.changedFields(new) {
+		if _, ok := reloadableFields[field]; !ok {
+			errList.items = append(errList.items, ConfigError{
+				Field:    field,
+				Message:  fmt.Sprintf("%s can't be changed on reload", field),
+				Severity: SeverityError,
+			})
+		}
+	}
+	return errList
+}
+
+// Changes describes what RELOAD from c to new changes, and how.
+func (c *Config) Changes(new *Config) []ConfigChange {
+	changes := []ConfigChange{}
+	for _, field := range c.changedFields(new) {
+		changes = append(changes, ConfigChange{Field: field, Applied: reloadableFields[field]})
+	}
+	return changes
+}
+
+// applyListeners rebinds listeners and restarts the admin server for
+// newConfig.  If any of them fails, those already moved go back to
+// the current config (failures to do that are added to errList as
+// warnings).
+func (proxy *Proxy) applyListeners(newConfig *Config, errList *ErrorList) error {
+	old := proxy.config
+	type step struct {
+		changed bool
+		apply   func(from, to *Config) error
+	}
+	steps := []step{
+		{old.Listen != newConfig.Listen, proxy.relisten},
+		{old.ListenRaw != newConfig.ListenRaw, proxy.relistenRaw},
+		{old.Admin != newConfig.Admin, proxy.restartAdmin},
+	}
+	for i, s := range steps {
+		if !s.changed {
+			continue
+		}
+		if err := s.apply(old, newConfig); err != nil {
+			for _, done := range steps[:i] {
+				if !done.changed {
+					continue
+				}
+				if undoErr := done.apply(newConfig, old); undoErr != nil {
+					errList.AddWarning("could not restore listener after failed reload: " + undoErr.Error())
+				}
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+func (proxy *Proxy) relisten(from, to *Config) error {
+	ln, err := relisten(proxy.listener, &from.Listen, &to.Listen)
+	if err != nil {
+		return err
+	}
+	proxy.listener = ln
+	go proxy.listenForClients(ln)
+	return nil
+}
+
+func (proxy *Proxy) relistenRaw(from, to *Config) error {
+	if proxy.rawProxy == nil {
+		if to.ListenRaw.Addr == "" {
+			return nil
+		}
+		rawProxy := NewRawProxy(proxy)
+		ln, err := to.ListenRaw.Listen()
+		if err != nil {
+			return err
+		}
+		rawProxy.startAcceptor(ln)
+		go rawProxy.proxyLoop()
+		proxy.rawProxy = rawProxy
+		return nil
+	}
+	return proxy.rawProxy.Relisten(&from.ListenRaw, &to.ListenRaw)
+}
+
+func (proxy *Proxy) restartAdmin(from, to *Config) error {
+	old := proxy.adminUI
+	sameAddr := from.Admin.Network == to.Admin.Network && from.Admin.Addr == to.Admin.Addr
+	if old != nil && (sameAddr || to.Admin.Addr == "") {
+		old.Retire()
+		old = nil
+	}
+	proxy.adminUI = nil
+	if to.Admin.Addr != "" {
+		adminUI := NewAdminUI(proxy)
+		if err := adminUI.start(&to.Admin); err != nil {
+			if old != nil {
+				proxy.adminUI = old
+			} else if sameAddr && from.Admin.Addr != "" {
+				// The old server is gone already, bring it back.
+				proxy.restoreAdmin(&from.Admin)
+			}
+			return err
+		}
+		proxy.adminUI = adminUI
+	}
+	if old != nil {
+		old.Retire()
+	}
+	return nil
+}
+
+// restoreAdmin starts the admin server with spec after starting it
+// with new settings failed.
+func (proxy *Proxy) restoreAdmin(spec *AddrSpec) {
+	adminUI := NewAdminUI(proxy)
+	if err := adminUI.start(spec); err != nil {
+		log.Printf("Could not restore admin server: %s", err)
+		return
+	}
+	proxy.adminUI = adminUI
+}
+
+////////////////////////////////////////
+// ClientHandler: reload
+
+// applyConnOptions makes the client's connections follow
+// `read_time_limit_ms` and `log_messages` changed by RELOAD.
+func (ch *ClientHandler) applyConnOptions() {
+	config := ch.proxy.config
+
+	ch.cliMu.Lock()
+	ch.cliConn.SetOptions(0, config.LogMessages)
+	ch.cliMu.Unlock()
+
+	if ch.uplinkConn != nil {
+		ch.uplinkConn.SetOptions(config.ReadTimeLimitMs, config.LogMessages)
+	}
+	for _, nc := range ch.nodeConns {
+		nc.conn.SetOptions(config.ReadTimeLimitMs, config.LogMessages)
+	}
+}
@@ -0,0 +1,200 @@
+package rproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/Codility/redis-proxy/fakeredis"
+	"github.com/Codility/redis-proxy/resp"
+	"github.com/stvp/assert"
+)
+
+func TestConfigChanges(t *testing.T) {
+	old := &Config{
+		Uplink: AddrSpec{Addr: "127.0.0.1:6379"},
+		Listen: AddrSpec{Addr: "127.0.0.1:7010"},
+	}
+	new := &Config{
+		Uplink:      AddrSpec{Addr: "127.0.0.1:6379"},
+		Listen:      AddrSpec{Addr: "127.0.0.1:7012"},
+		LogMessages: true,
+	}
+	errList := old.ValidateSwitchTo(new)
+	assert.True(t, errList.Ok())
+	assert.Equal(t, old.Changes(new), []ConfigChange{
+		{Field: "listen", Applied: reloadableFields["listen"]},
+		{Field: "log_messages", Applied: reloadableFields["log_messages"]},
+	})
+	assert.Equal(t, old.Changes(old), []ConfigChange{})
+
+	// Fields not whitelisted can't be changed
+	applied := reloadableFields["log_messages"]
+	delete(reloadableFields, "log_messages")
+	defer func() { reloadableFields["log_messages"] = applied }()
+	errList = old.ValidateSwitchTo(new)
+	assert.Equal(t, errList.Items(), []ConfigError{
+		{Field: "log_messages", Message: "log_messages can't be changed on reload", Severity: SeverityError},
+	})
+	errList = old.ValidateSwitchTo(old)
+	assert.True(t, errList.Ok())
+}
+
+func freeAddr(t *testing.T) string {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer ln.Close()
+	return ln.Addr().String()
+}
+
+func TestProxyReloadRebindsListeners(t *testing.T) {
+	srv := fakeredis.Start("srv", "tcp")
+	defer srv.Stop()
+
+	loader := &TestConfigLoader{
+		conf: &Config{
+			Uplink: AddrSpec{Addr: srv.Addr().String()},
+			Listen: AddrSpec{Addr: "127.0.0.1:0"},
+			Admin:  AddrSpec{Addr: "127.0.0.1:0"},
+		},
+	}
+	proxy := mustStartTestProxy(t, loader)
+	defer proxy.Stop()
+
+	oldListen := proxy.ListenAddr().String()
+	c1 := resp.MustDial("tcp", oldListen, 0, false)
+	defer c1.Close()
+	assert.Equal(t, c1.MustCall(resp.MsgFromStrings("GET", "a")).String(), "$3\r\nsrv\r\n")
+
+	listenAddr, adminAddr, rawAddr := freeAddr(t), freeAddr(t), freeAddr(t)
+	loader.Replace(&Config{
+		Uplink:      AddrSpec{Addr: srv.Addr().String()},
+		Listen:      AddrSpec{Addr: listenAddr},
+		ListenRaw:   AddrSpec{Addr: rawAddr},
+		Admin:       AddrSpec{Addr: adminAddr},
+		LogMessages: true,
+	})
+	res, err := http.PostForm(fmt.Sprintf("http://%s/cmd/", proxy.AdminAddr().String()), url.Values{
+		"cmd": {"reload"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, res.StatusCode, 200)
+	var body ReloadResult
+	assert.Nil(t, json.NewDecoder(res.Body).Decode(&body))
+	res.Body.Close()
+	assert.True(t, body.Ok)
+	fields := []string{}
+	for _, change := range body.Changes {
+		fields = append(fields, change.Field)
+	}
+	assert.Equal(t, fields, []string{"listen", "listen_raw", "admin", "log_messages"})
+
+	// Existing connections are kept, new ones go to new addresses
+	assert.Equal(t, c1.MustCall(resp.MsgFromStrings("GET", "a")).String(), "$3\r\nsrv\r\n")
+	_, err = net.Dial("tcp", oldListen)
+	assert.NotNil(t, err)
+	c2 := resp.MustDial("tcp", listenAddr, 0, false)
+	defer c2.Close()
+	assert.Equal(t, c2.MustCall(resp.MsgFromStrings("GET", "a")).String(), "$3\r\nsrv\r\n")
+	c3 := resp.MustDial("tcp", rawAddr, 0, false)
+	defer c3.Close()
+	assert.Equal(t, c3.MustCall(resp.MsgFromStrings("GET", "a")).String(), "$3\r\nsrv\r\n")
+
+	assert.Equal(t, proxy.AdminAddr().String(), adminAddr)
+	res, err = http.Get(fmt.Sprintf("http://%s/info.json", adminAddr))
+	assert.Nil(t, err)
+	assert.Equal(t, res.StatusCode, 200)
+	res.Body.Close()
+}
+
+func TestProxyReloadKeepsListenSocket(t *testing.T) {
+	srv := fakeredis.Start("srv", "tcp")
+	defer srv.Stop()
+
+	loader := &TestConfigLoader{
+		conf: &Config{
+			Uplink: AddrSpec{Addr: srv.Addr().String()},
+			Listen: AddrSpec{Addr: "127.0.0.1:0"},
+		},
+	}
+	proxy := mustStartTestProxy(t, loader)
+	defer proxy.Stop()
+	addr := proxy.ListenAddr().String()
+
+	// Same address: the socket (and its port) is handed over
+	loader.Replace(&Config{
+		Uplink: AddrSpec{Addr: srv.Addr().String()},
+		Listen: AddrSpec{Addr: "127.0.0.1:0", Pass: "new-pass"},
+	})
+	res := proxy.ReloadWithResult()
+	assert.True(t, res.Ok)
+	assert.Equal(t, len(res.Changes), 1)
+	assert.Equal(t, proxy.ListenAddr().String(), addr)
+
+	c := resp.MustDial("tcp", addr, 0, false)
+	defer c.Close()
+	c.MustCallAndGetOk(resp.MsgFromStrings("AUTH", "new-pass"))
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("GET", "a")).String(), "$3\r\nsrv\r\n")
+}
+
+func TestProxyReloadResults(t *testing.T) {
+	srv := fakeredis.Start("srv", "tcp")
+	defer srv.Stop()
+
+	loader := &TestConfigLoader{
+		conf: &Config{
+			Uplink: AddrSpec{Addr: srv.Addr().String()},
+			Listen: AddrSpec{Addr: "127.0.0.1:0"},
+			Admin:  AddrSpec{Addr: "127.0.0.1:0"},
+		},
+	}
+	proxy := mustStartTestProxy(t, loader)
+	defer proxy.Stop()
+	assert.Equal(t, proxy.GetInfo().Generation, 1)
+
+	// Broken config: every error is reported separately
+	loader.Replace(&Config{
+		Uplink: AddrSpec{Addr: srv.Addr().String()},
+		Listen: AddrSpec{Addr: "127.0.0.1:0"},
+		Admin:  AddrSpec{Addr: "127.0.0.1:0"},
+		Limits: LimitsConfig{MaxWaitingRequests: -1, OnExceeded: "drop"},
+	})
+	res, err := http.PostForm(fmt.Sprintf("http://%s/cmd/", proxy.AdminAddr().String()), url.Values{
+		"cmd": {"reload"},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, res.StatusCode, 400)
+	var body ReloadResult
+	assert.Nil(t, json.NewDecoder(res.Body).Decode(&body))
+	res.Body.Close()
+	assert.False(t, body.Ok)
+	assert.Equal(t, body.Errors, []ConfigError{
+		{Field: "limits.max_waiting_requests", Message: "limits.max_waiting_requests must not be negative", Severity: SeverityError},
+		{Field: "limits.on_exceeded", Message: "limits.on_exceeded must be 'delay' or 'reject'", Severity: SeverityError},
+	})
+	assert.Equal(t, body.Generation, 1)
+	assert.Equal(t, len(body.Steps), 2)
+	assert.Equal(t, body.Steps[1].Name, "validate")
+	assert.False(t, body.Steps[1].Ok)
+
+	// Fixed config: new generation
+	loader.Replace(&Config{
+		Uplink:          AddrSpec{Addr: srv.Addr().String()},
+		Listen:          AddrSpec{Addr: "127.0.0.1:0"},
+		Admin:           AddrSpec{Addr: "127.0.0.1:0"},
+		ReadTimeLimitMs: 1000,
+	})
+	result := proxy.ReloadWithResult()
+	assert.True(t, result.Ok)
+	assert.Equal(t, result.Generation, 2)
+	assert.Equal(t, result.Changes, []ConfigChange{{Field: "read_time_limit_ms", Applied: appliedExisting}})
+
+	info := proxy.GetInfo()
+	assert.Equal(t, info.Generation, 2)
+	assert.Equal(t, len(info.Reloads), 2)
+	assert.False(t, info.Reloads[0].Ok)
+	assert.True(t, info.Reloads[1].Ok)
+}
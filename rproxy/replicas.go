@@ -0,0 +1,320 @@
+package rproxy
+
+import (
+	"fmt"
+	"log"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Codility/redis-proxy/resp"
+)
+
+// Replicas
+//
+// With `replicas` configured, batches consisting only of read-only
+// commands (see resp.Msg.IsReadOnly) go to one of the replicas, and
+// everything else (writes, transactions, scripts, blocking commands,
+// Pub/Sub) goes to uplink.  Each client sticks to one replica as long
+// as it stays healthy.
+//
+// The proxy checks replicas every `check_interval_ms` with INFO
+// replication: a replica is taken out of rotation if it's not a
+// replica, its master_link_status is not "up", or it's more than
+// `max_lag_bytes` behind uplink.  Nodes are checked concurrently, and
+// each check (connecting and reading) must complete within
+// `check_interval_ms` (at least replicaCheckMinTimeout), or the
+// replica is taken out of rotation, so a hung node doesn't hold up
+// checks of the others.
+//
+// Clients that need to read their own writes can opt out with the
+// proxy-specific "CLIENT REPLICA-READS OFF" (and back in with "ON").
+
+const (
+	DefaultReplicaCheckIntervalMs = 1000
+
+	replicaCheckMinTimeout = 100 * time.Millisecond
+)
+
+var MsgReplicaReadsSyntax = []byte("-ERR CLIENT REPLICA-READS takes ON or OFF (redis-proxy)\r\n")
+
+type ReplicasConfig struct {
+	Nodes           []AddrSpec `json:"nodes"`
+	MaxLagBytes     int64      `json:"max_lag_bytes"` // 0: no limit
+	CheckIntervalMs int64      `json:"check_interval_ms"`
+}
+
+func (rc *ReplicasConfig) Enabled() bool {
+	return len(rc.Nodes) > 0
+}
+
+func (rc *ReplicasConfig) prepare(offline bool) ErrorList {
+	errList := ErrorList{}
+	for i := range rc.Nodes {
+		errList.Append(rc.Nodes[i].prepare(fmt.Sprintf("replicas.nodes[%d]", i), false, offline))
+	}
+	if rc.MaxLagBytes < 0 {
+		errList.Add("replicas.max_lag_bytes must not be negative")
+	}
+	if rc.CheckIntervalMs < 0 {
+		errList.Add("replicas.check_interval_ms must not be negative")
+	}
+	if rc.CheckIntervalMs == 0 {
+		rc.CheckIntervalMs = DefaultReplicaCheckIntervalMs
+	}
+	return errList
+}
+
+// checkTimeout returns the time limit for checking a single node.
+func (rc *ReplicasConfig) checkTimeout() time.Duration {
+	timeout := time.Duration(rc.CheckIntervalMs) * time.Millisecond
+	if timeout < replicaCheckMinTimeout {
+		return replicaCheckMinTimeout
+	}
+	return timeout
+}
+
+func (rc *ReplicasConfig) SanitizedForPublication() *ReplicasConfig {
+	res := *rc
+	res.Nodes = nil
+	for _, node := range rc.Nodes {
+		res.Nodes = append(res.Nodes, *node.SanitizedForPublication())
+	}
+	return &res
+}
+
+type ReplicaInfo struct {
+	Addr        string `json:"addr"`
+	Healthy     bool   `json:"healthy"`
+	LagBytes    int64  `json:"lag_bytes"`
+	Error       string `json:"error,omitempty"`
+	Connections int    `json:"connections"`
+}
+
+////////////////////////////////////////
+// ReplicaSet
+
+// ReplicaSet keeps results of replica health checks, shared by all
+// clients.
+type ReplicaSet struct {
+	mu     sync.Mutex
+	states map[AddrSpec]replicaState
+	next   int
+}
+
+type replicaState struct {
+	healthy bool
+	lag     int64
+	err     string
+}
+
+func NewReplicaSet() *ReplicaSet {
+	return &ReplicaSet{states: map[AddrSpec]replicaState{}}
+}
+
+func (rs *ReplicaSet) Healthy(node AddrSpec) bool {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	return rs.states[node].healthy
+}
+
+// Pick returns a healthy replica (round-robin), or false if there is
+// none.
+func (rs *ReplicaSet) Pick(config *Config) (AddrSpec, bool) {
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	nodes := config.Replicas.Nodes
+	for i := 0; i < len(nodes); i++ {
+		node := nodes[(rs.next+i)%len(nodes)]
+		if rs.states[node].healthy {
+			rs.next = (rs.next + i + 1) % len(nodes)
+			return node, true
+		}
+	}
+	return AddrSpec{}, false
+}
+
+func (rs *ReplicaSet) Info(config *Config, counter *connCounter) []ReplicaInfo {
+	if !config.Replicas.Enabled() {
+		return nil
+	}
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+
+	res := make([]ReplicaInfo, len(config.Replicas.Nodes))
+	for i, node := range config.Replicas.Nodes {
+		st := rs.states[node]
+		res[i] = ReplicaInfo{
+			Addr:        node.Addr,
+			Healthy:     st.healthy,
+			LagBytes:    st.lag,
+			Error:       st.err,
+			Connections: counter.Get(node.Addr),
+		}
+	}
+	return res
+}
+
+// Check runs health checks of all replicas in config.
+func (rs *ReplicaSet) Check(config *Config) {
+	type result struct {
+		offset int64
+		err    error
+	}
+	nodes := config.Replicas.Nodes
+	results := make([]result, len(nodes))
+	var masterOffset int64
+	var masterErr error
+
+	var wg sync.WaitGroup
+	wg.Add(len(nodes) + 1)
+	go func() {
+		defer wg.Done()
+		masterOffset, masterErr = checkReplicationInfo(config, config.Uplink, false)
+	}()
+	for i, node := range nodes {
+		go func(i int, node AddrSpec) {
+			defer wg.Done()
+			offset, err := checkReplicationInfo(config, node, true)
+			results[i] = result{offset, err}
+		}(i, node)
+	}
+	wg.Wait()
+
+	states := map[AddrSpec]replicaState{}
+	for i, node := range nodes {
+		st := replicaState{}
+		offset, err := results[i].offset, results[i].err
+		switch {
+		case err != nil:
+			st.err = err.Error()
+		case masterErr != nil:
+			st.err = "could not check uplink: " + masterErr.Error()
+		default:
+			st.lag = masterOffset - offset
+			if st.lag < 0 {
+				// Offsets are read concurrently, master's may be
+				// the older one.
+				st.lag = 0
+			}
+			if max := config.Replicas.MaxLagBytes; max > 0 && st.lag > max {
+				st.err = fmt.Sprintf("lag of %d bytes exceeds max_lag_bytes", st.lag)
+			} else {
+				st.healthy = true
+			}
+		}
+		states[node] = st
+
+		if old := rs.states[node]; old.healthy != st.healthy {
+			if st.healthy {
+				log.Printf("Replica %s: back in rotation", node.Addr)
+			} else {
+				log.Printf("Replica %s: out of rotation: %s", node.Addr, st.err)
+			}
+		}
+	}
+
+	rs.mu.Lock()
+	defer rs.mu.Unlock()
+	rs.states = states
+}
+
+// checkReplicationInfo returns replication offset of node, or an
+// error if its role is not what's expected, or (for replicas) its
+// link to master is down.  Gives up after the check timeout.
+func checkReplicationInfo(config *Config, node AddrSpec, replica bool) (int64, error) {
+	timeout := config.Replicas.checkTimeout()
+	rc, err := node.DialRedisTimeout(timeout, timeout.Nanoseconds()/1e6, config.LogMessages)
+	if err != nil {
+		return 0, err
+	}
+	defer rc.Close()
+
+	res, err := rc.Call(resp.MsgFromStrings("INFO", "replication"))
+	if err != nil {
+		return 0, err
+	}
+	infoStr, ok := res.Str()
+	if !ok {
+		return 0, fmt.Errorf("INFO failed: %s", strings.TrimSpace(res.String()))
+	}
+	info := parseInfo(infoStr)
+
+	if replica {
+		if info["role"] != "slave" {
+			return 0, fmt.Errorf("role is %s, not a replica", info["role"])
+		}
+		if info["master_link_status"] != "up" {
+			return 0, fmt.Errorf("master_link_status is %s", info["master_link_status"])
+		}
+	}
+	offset, err := strconv.ParseInt(info["master_repl_offset"], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("could not parse master_repl_offset: %v", err)
+	}
+	return offset, nil
+}
+
+// watchReplicas runs for the whole life of the proxy, checking
+// whatever replicas the current config lists.
+func (proxy *Proxy) watchReplicas() {
+	for proxy.State().IsAlive() {
+		config := proxy.GetConfig()
+		if config.Replicas.Enabled() {
+			proxy.replicas.Check(config)
+		}
+		time.Sleep(time.Duration(config.Replicas.CheckIntervalMs) * time.Millisecond)
+	}
+}
+
+////////////////////////////////////////
+// ClientHandler: replicas
+
+// handleReplicaReads handles "CLIENT REPLICA-READS ON|OFF".
+func (ch *ClientHandler) handleReplicaReads(req *resp.Msg) []byte {
+	args := req.Args()
+	if len(args) != 2 {
+		return MsgReplicaReadsSyntax
+	}
+	switch strings.ToUpper(args[1]) {
+	case "ON":
+		ch.primaryReads = false
+	case "OFF":
+		ch.primaryReads = true
+	default:
+		return MsgReplicaReadsSyntax
+	}
+	return resp.MsgOk
+}
+
+func isReplicaReadsRequest(req *resp.Msg) bool {
+	args := req.Args()
+	return req.Command() == "CLIENT" && len(args) > 0 && strings.EqualFold(args[0], "REPLICA-READS")
+}
+
+// replicaFor returns the replica a batch of requests should go to, or
+// false if it should go to uplink.
+func (ch *ClientHandler) replicaFor(config *Config, reqs []*resp.Msg) (AddrSpec, bool) {
+	if !config.Replicas.Enabled() || ch.primaryReads || ch.tx.Active() {
+		return AddrSpec{}, false
+	}
+	for _, req := range reqs {
+		if !req.IsReadOnly() {
+			return AddrSpec{}, false
+		}
+	}
+
+	if ch.replica.Addr != "" && ch.proxy.replicas.Healthy(ch.replica) {
+		return ch.replica, true
+	}
+	if ch.replica.Addr != "" {
+		ch.closeNodeConn(ch.replica.Addr)
+	}
+	var ok bool
+	ch.replica, ok = ch.proxy.replicas.Pick(config)
+	return ch.replica, ok
+}
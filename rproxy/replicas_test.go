@@ -0,0 +1,161 @@
+package rproxy
+
+import (
+	"net"
+	"testing"
+
+	"github.com/Codility/redis-proxy/fakeredis"
+	"github.com/Codility/redis-proxy/resp"
+	"github.com/stvp/assert"
+)
+
+func startFakeReplica(master *fakeredis.FakeRedisServer) *fakeredis.FakeRedisServer {
+	replica := fakeredis.Start("replica", "tcp")
+	host, port, _ := net.SplitHostPort(master.Addr().String())
+	c := resp.MustDial("tcp", replica.Addr().String(), 0, false)
+	defer c.Close()
+	c.MustCallAndGetOk(resp.MsgFromStrings("REPLICAOF", host, port))
+	return replica
+}
+
+func replicaHealthy(proxy *Proxy) bool {
+	return proxy.GetInfo().Replicas[0].Healthy
+}
+
+func TestProxyReplicaReads(t *testing.T) {
+	master := fakeredis.Start("master", "tcp")
+	defer master.Stop()
+	replica := startFakeReplica(master)
+	defer replica.Stop()
+
+	proxy := mustStartTestProxy(t, &TestConfigLoader{
+		conf: &Config{
+			Uplink:   AddrSpec{Addr: master.Addr().String()},
+			Listen:   AddrSpec{Addr: "127.0.0.1:0"},
+			Replicas: ReplicasConfig{Nodes: []AddrSpec{{Addr: replica.Addr().String()}}, CheckIntervalMs: 10},
+		},
+	})
+	defer proxy.Stop()
+	waitUntil(t, func() bool { return replicaHealthy(proxy) })
+
+	c := resp.MustDial("tcp", proxy.ListenAddr().String(), 0, false)
+	defer c.Close()
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("GET", "k")).String(), "$7\r\nreplica\r\n")
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("SET", "k", "v")).String(), "$6\r\nmaster\r\n")
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("EVAL_RO", "return 1", "0")).String(), "$6\r\nmaster\r\n")
+	assert.Equal(t, proxy.GetInfo().Replicas[0].Connections, 1)
+
+	// Batches with any writes go to uplink as a whole
+	c.MustWriteMsgs([]*resp.Msg{
+		resp.MsgFromStrings("SET", "k", "v"),
+		resp.MsgFromStrings("GET", "k"),
+	})
+	assert.Equal(t, c.MustReadMsg().String(), "$6\r\nmaster\r\n")
+	assert.Equal(t, c.MustReadMsg().String(), "$6\r\nmaster\r\n")
+
+	// Transactions
+	c.MustCallAndGetOk(resp.MsgFromStrings("MULTI"))
+	c.MustCall(resp.MsgFromStrings("GET", "k"))
+	c.MustCall(resp.MsgFromStrings("EXEC"))
+	assert.Equal(t, master.LastRequest().String(), resp.MsgFromStrings("EXEC").String())
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("GET", "k")).String(), "$7\r\nreplica\r\n")
+
+	// Opt-out
+	c.MustCallAndGetOk(resp.MsgFromStrings("CLIENT", "REPLICA-READS", "OFF"))
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("GET", "k")).String(), "$6\r\nmaster\r\n")
+	c.MustCallAndGetOk(resp.MsgFromStrings("CLIENT", "replica-reads", "on"))
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("GET", "k")).String(), "$7\r\nreplica\r\n")
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("CLIENT", "REPLICA-READS")).String(),
+		"-ERR CLIENT REPLICA-READS takes ON or OFF (redis-proxy)\r\n")
+}
+
+func TestProxyReplicaHealth(t *testing.T) {
+	master := fakeredis.Start("master", "tcp")
+	defer master.Stop()
+	replica := startFakeReplica(master)
+	defer replica.Stop()
+
+	proxy := mustStartTestProxy(t, &TestConfigLoader{
+		conf: &Config{
+			Uplink: AddrSpec{Addr: master.Addr().String()},
+			Listen: AddrSpec{Addr: "127.0.0.1:0"},
+			Replicas: ReplicasConfig{
+				Nodes:           []AddrSpec{{Addr: replica.Addr().String()}},
+				MaxLagBytes:     100,
+				CheckIntervalMs: 10,
+			},
+		},
+	})
+	defer proxy.Stop()
+	waitUntil(t, func() bool { return replicaHealthy(proxy) })
+
+	c := resp.MustDial("tcp", proxy.ListenAddr().String(), 0, false)
+	defer c.Close()
+
+	replica.SetMasterLinkDown(true)
+	waitUntil(t, func() bool { return !replicaHealthy(proxy) })
+	assert.Equal(t, proxy.GetInfo().Replicas[0].Error, "master_link_status is down")
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("GET", "k")).String(), "$6\r\nmaster\r\n")
+
+	replica.SetMasterLinkDown(false)
+	waitUntil(t, func() bool { return replicaHealthy(proxy) })
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("GET", "k")).String(), "$7\r\nreplica\r\n")
+
+	master.SetReplOffset(1000)
+	replica.SetReplOffset(800)
+	waitUntil(t, func() bool { return !replicaHealthy(proxy) })
+	assert.Equal(t, proxy.GetInfo().Replicas[0].LagBytes, int64(200))
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("GET", "k")).String(), "$6\r\nmaster\r\n")
+
+	replica.SetReplOffset(950)
+	waitUntil(t, func() bool { return replicaHealthy(proxy) })
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("GET", "k")).String(), "$7\r\nreplica\r\n")
+}
+
+func TestProxyReplicaCheckTimeout(t *testing.T) {
+	master := fakeredis.Start("master", "tcp")
+	defer master.Stop()
+	replica := startFakeReplica(master)
+	defer replica.Stop()
+
+	// Accepts connections, never answers
+	hung, err := net.Listen("tcp", "127.0.0.1:0")
+	assert.Nil(t, err)
+	defer hung.Close()
+	go func() {
+		conns := []net.Conn{}
+		defer func() {
+			for _, conn := range conns {
+				conn.Close()
+			}
+		}()
+		for {
+			conn, err := hung.Accept()
+			if err != nil {
+				return
+			}
+			conns = append(conns, conn)
+		}
+	}()
+
+	proxy := mustStartTestProxy(t, &TestConfigLoader{
+		conf: &Config{
+			Uplink: AddrSpec{Addr: master.Addr().String()},
+			Listen: AddrSpec{Addr: "127.0.0.1:0"},
+			Replicas: ReplicasConfig{
+				Nodes:           []AddrSpec{{Addr: hung.Addr().String()}, {Addr: replica.Addr().String()}},
+				CheckIntervalMs: 10,
+			},
+		},
+	})
+	defer proxy.Stop()
+	waitUntil(t, func() bool { return proxy.GetInfo().Replicas[1].Healthy })
+	waitUntil(t, func() bool { return proxy.GetInfo().Replicas[0].Error != "" })
+	info := proxy.GetInfo().Replicas[0]
+	assert.False(t, info.Healthy)
+	assert.Contains(t, "timeout", info.Error)
+
+	c := resp.MustDial("tcp", proxy.ListenAddr().String(), 0, false)
+	defer c.Close()
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("GET", "k")).String(), "$7\r\nreplica\r\n")
+}
@@ -1,22 +1,16 @@
 package rproxy
 
 import (
+	"errors"
+	"fmt"
 	"log"
 	"net"
+	"sync"
 	"time"
 
 	"github.com/Codility/redis-proxy/resp"
 )
 
-const (
-	// MaxConnections: not enforced, used only to ensure enough
-	// space in request/release channels to make it easy to
-	// measure current state.
-	//
-	// TODO: enforce?
-	MaxConnections = 1000
-)
-
 type ConfigHolder interface {
 	ReloadConfig()
 	GetConfig() *Config
@@ -28,17 +22,34 @@ type Proxy struct {
 	listener     *Listener
 	adminUI      *AdminUI
 	rawProxy     *RawProxy
+	pool         *UplinkPool
+	cluster      *ClusterRouter
+	nodeConnCnt  *connCounter
+	replicas     *ReplicaSet
+
+	clientConns    *connLimiter
+	rawConns       *connLimiter
+	clients        *clientRegistry
+	userLimiters   *userLimiters
+	rateLimitStats rateLimitStats
+
+	reloads *reloadHistory
 
-	channels       ProxyChannels
-	activeRequests int
-	state          ProxyState
+	watcherMu sync.Mutex
+	watcher   configWatch
+
+	switchoverMu sync.Mutex
+	switchover   *switchover
+
+	channels    ProxyChannels
+	permissions *permissionQueue
+	state       ProxyState
 }
 
 type ProxyChannels struct {
-	requestPermission chan chan struct{}
-	releasePermission chan struct{}
-	info              chan chan *ProxyInfo
-	command           chan commandCall
+	idle    chan struct{}
+	info    chan chan *ProxyInfo
+	command chan commandCall
 }
 
 ////////////////////////////////////////
@@ -57,15 +68,25 @@ func NewProxy(cl ConfigLoader) (*Proxy, error) {
 		return nil, err
 	}
 
+	permissions := newPermissionQueue()
 	proxy := &Proxy{
 		channels: ProxyChannels{
-			requestPermission: make(chan chan struct{}, MaxConnections),
-			releasePermission: make(chan struct{}, MaxConnections),
-			info:              make(chan chan *ProxyInfo),
-			command:           make(chan commandCall),
+			idle:    permissions.idle,
+			info:    make(chan chan *ProxyInfo),
+			command: make(chan commandCall),
 		},
+		permissions:  permissions,
 		configLoader: cl,
 		config:       config,
+		pool:         NewUplinkPool(),
+		cluster:      NewClusterRouter(),
+		nodeConnCnt:  newConnCounter(),
+		replicas:     NewReplicaSet(),
+		clientConns:  newConnLimiter("listen"),
+		rawConns:     newConnLimiter("listen_raw"),
+		clients:      newClientRegistry(),
+		userLimiters: newUserLimiters(),
+		reloads:      newReloadHistory(),
 	}
 	return proxy, nil
 }
@@ -93,7 +114,7 @@ func (proxy *Proxy) AdminAddr() net.Addr {
 }
 
 func (proxy *Proxy) RequiresClientAuth() bool {
-	return proxy.config.Listen.Pass != ""
+	return proxy.config.Listen.Pass != "" || len(proxy.config.Users) > 0
 }
 
 func (proxy *Proxy) State() ProxyState {
@@ -104,19 +125,42 @@ func (proxy *Proxy) SetState(st ProxyState) {
 	proxy.state = st
 }
 
-func (proxy *Proxy) ReloadConfig() error {
-	newConfig, err := proxy.configLoader.Load()
-	if err != nil {
-		log.Printf("Got an error while loading %v: %s.  Keeping old config.", proxy, err)
-		return err
+// reloadRequest is the argument of CmdReload: the loaded config, and
+// the result to fill in.
+type reloadRequest struct {
+	config *Config
+	res    *ReloadResult
+}
+
+// ReloadConfig validates and applies newConfig, filling in res step
+// by step.
+func (proxy *Proxy) ReloadConfig(newConfig *Config, res *ReloadResult) {
+	defer proxy.reloads.Record(res)
+
+	start := time.Now()
+	errList := proxy.verifyNewConfig(newConfig)
+	res.addStep("validate", start, errList.Ok())
+	if !errList.Ok() {
+		log.Printf("Can not reload into new config: %s.  Keeping old config.", errList.AsError())
+		res.fail(errList)
+		return
 	}
 
-	if err := proxy.verifyNewConfig(newConfig); err != nil {
-		log.Printf("Can not reload into new config: %s.  Keeping old config.", err)
-		return err
+	start = time.Now()
+	changes := proxy.config.Changes(newConfig)
+	err := proxy.applyListeners(newConfig, &errList)
+	res.addStep("apply", start, err == nil)
+	if err != nil {
+		log.Printf("Can not apply new config: %s.  Keeping old config.", err)
+		errList.Add(err.Error())
+		res.fail(errList)
+		return
 	}
 	proxy.config = newConfig
-	return nil
+	for _, change := range changes {
+		log.Printf("Reload: `%s` changed, %s", change.Field, change.Applied)
+	}
+	res.succeed(errList, changes)
 }
 
 func (proxy *Proxy) Pause() error {
@@ -128,7 +172,42 @@ func (proxy *Proxy) Unpause() error {
 }
 
 func (proxy *Proxy) Reload() error {
-	return proxy.command(CmdReload).err
+	return proxy.ReloadWithResult().AsError()
+}
+
+// ReloadWithResult is Reload that returns the details of the attempt.
+func (proxy *Proxy) ReloadWithResult() *ReloadResult {
+	res := newReloadResult()
+	start := time.Now()
+	newConfig, err := proxy.configLoader.Load()
+	res.addStep("load", start, err == nil)
+	if err != nil {
+		log.Printf("Got an error while loading %v: %s.  Keeping old config.", proxy, err)
+		res.fail(errorListOf(err))
+		proxy.reloads.Record(res)
+		return res
+	}
+
+	reload := &reloadRequest{config: newConfig, res: res}
+	if !proxy.config.Sharded() && !newConfig.Sharded() {
+		proxy.commandWithArg(CmdReload, reload)
+		return res
+	}
+
+	// Let requests in flight complete before the ring changes (or
+	// appears, or goes away).
+	start = time.Now()
+	err = proxy.withPause(time.Time{}, func() error {
+		res.addStep("pause", start, true)
+		proxy.commandWithArg(CmdReload, reload)
+		return nil
+	})
+	if err != nil {
+		res.addStep("pause", start, false)
+		res.fail(errorListOf(err))
+		proxy.reloads.Record(res)
+	}
+	return res
 }
 
 func (proxy *Proxy) Stop() error {
@@ -153,22 +232,57 @@ func (proxy *Proxy) GetConfig() *Config {
 	return proxy.config
 }
 
+// SetUplink replaces uplink in the current config, without
+// reloading the config file.  Clients switch to the new uplink with
+// their next request.
+func (proxy *Proxy) SetUplink(uplink AddrSpec) error {
+	return proxy.commandWithArg(CmdSetUplink, uplink).err
+}
+
 func (proxy *Proxy) command(cmd command) commandResponse {
+	return proxy.commandWithArg(cmd, nil)
+}
+
+func (proxy *Proxy) commandWithArg(cmd command, arg interface{}) commandResponse {
 	rc := make(chan commandResponse, 1)
-	proxy.channels.command <- commandCall{cmd, rc}
+	proxy.channels.command <- commandCall{cmd, arg, rc}
 	return <-rc
 }
 
+// withPause pauses the proxy (unless it's paused already), waits
+// until there are no active requests, and runs `block`.  Then it
+// unpauses the proxy, if it was running before.  Gives up if pausing
+// doesn't complete before deadline (zero: no deadline).
+func (proxy *Proxy) withPause(deadline time.Time, block func() error) error {
+	if proxy.State() == ProxyRunning {
+		if err := proxy.Pause(); err != nil {
+			return err
+		}
+		defer proxy.Unpause()
+	}
+
+	for st := proxy.State(); st != ProxyPaused; st = proxy.State() {
+		if st != ProxyPausing {
+			return fmt.Errorf("Proxy is %s, could not pause it", st)
+		}
+		if !deadline.IsZero() && time.Now().After(deadline) {
+			return errors.New("Timed out waiting for active requests to finish")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return block()
+}
+
 func (proxy *Proxy) GetInfo() *ProxyInfo {
 	ch := make(chan *ProxyInfo)
 	proxy.channels.info <- ch
 	return <-ch
 }
 
-func (proxy *Proxy) verifyNewConfig(newConfig *Config) error {
+func (proxy *Proxy) verifyNewConfig(newConfig *Config) ErrorList {
 	errList := newConfig.Prepare()
 	if !errList.Ok() {
-		return errList.AsError()
+		return errList
 	}
 
 	return proxy.config.ValidateSwitchTo(newConfig)
@@ -182,13 +296,17 @@ func (proxy *Proxy) CallUplink(block func() (*resp.Msg, error)) (*resp.Msg, erro
 }
 
 func (proxy *Proxy) enterExecution() {
-	ch := make(chan struct{})
-	proxy.channels.requestPermission <- ch
-	<-ch
+	proxy.permissions.Acquire(0)
+}
+
+// tryEnterExecution is enterExecution that gives up (returning false)
+// if too many requests are waiting already.
+func (proxy *Proxy) tryEnterExecution() bool {
+	return proxy.permissions.Acquire(proxy.config.Limits.MaxWaitingRequests)
 }
 
 func (proxy *Proxy) leaveExecution() {
-	proxy.channels.releasePermission <- struct{}{}
+	proxy.permissions.Release()
 }
 
 func (proxy *Proxy) startListening() error {
@@ -197,24 +315,27 @@ func (proxy *Proxy) startListening() error {
 		return err
 	}
 	proxy.listener = ln
-	go proxy.listenForClients()
+	go proxy.listenForClients(ln)
 	return nil
 }
 
-func (proxy *Proxy) listenForClients() {
+func (proxy *Proxy) listenForClients(ln *Listener) {
 	defer func() {
-		proxy.listener = nil
+		if proxy.listener == ln {
+			proxy.listener = nil
+		}
 	}()
 
 	for {
-		proxy.listener.SetDeadline(time.Now().Add(time.Second))
-		conn, err := proxy.listener.Accept()
+		ln.SetDeadline(time.Now().Add(time.Second))
+		conn, err := ln.Accept()
 		if err != nil {
-			// Check if we are shutting down. Ideally, we would
-			// like to check whether the error comes from
+			// Check if we are shutting down, or the listener
+			// got replaced by RELOAD. Ideally, we would like to
+			// check whether the error comes from
 			// listener.Close(), but that is not easy:
 			// http://zhen.org/blog/graceful-shutdown-of-go-net-dot-listeners/
-			if !proxy.State().IsStartingOrAlive() {
+			if !proxy.State().IsStartingOrAlive() || ln.Stopped() {
 				break
 			}
 
@@ -223,8 +344,18 @@ func (proxy *Proxy) listenForClients() {
 			}
 			log.Printf("Managed Proxy: Got an error accepting a connection: %s", err)
 		} else {
-			rc := resp.NewConn(conn, 0, proxy.config.LogMessages)
-			go NewClientHandler(rc, proxy).Run()
+			// Accepted on a socket that may have been handed
+			// over meanwhile: conn is set up according to the
+			// new listener, serve it and let that one take over.
+			if proxy.acceptConn(proxy.clientConns, conn) {
+				go func() {
+					proxy.serveClient(conn)
+					proxy.clientConns.Release(conn.RemoteAddr())
+				}()
+			}
+			if ln.Stopped() {
+				break
+			}
 		}
 	}
 }
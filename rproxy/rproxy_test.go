@@ -392,6 +392,67 @@ func TestProxyKillsConnectionOnBrokenCommands(t *testing.T) {
 	assert.Equal(t, err, io.EOF)
 }
 
+func TestProxyPipelining(t *testing.T) {
+	srv := fakeredis.Start("srv", "tcp")
+	defer srv.Stop()
+
+	proxy := mustStartTestProxy(t, &TestConfigLoader{
+		conf: &Config{
+			Uplink: AddrSpec{Addr: srv.Addr().String()},
+			Listen: AddrSpec{Addr: "127.0.0.1:0", Pass: "test-pass"},
+		},
+	})
+	defer proxy.Stop()
+
+	c := resp.MustDial("tcp", proxy.ListenAddr().String(), 0, false)
+	pipeline := [][]byte{
+		resp.MsgFromStrings("AUTH", "wrong-pass").Data(),
+		resp.MsgFromStrings("GET", "a").Data(),
+		resp.MsgFromStrings("AUTH", "test-pass").Data(),
+		resp.MsgFromStrings("GET", "a").Data(),
+		resp.MsgFromStrings("SELECT", "2").Data(),
+		resp.MsgFromStrings("GET", "b").Data(),
+	}
+	c.MustWrite(bytes.Join(pipeline, nil))
+
+	expected := []string{
+		"-ERR invalid password\r\n",
+		"-NOAUTH Authentication required.\r\n",
+		"+OK\r\n",
+		"$3\r\nsrv\r\n",
+		"+OK\r\n",
+		"$3\r\nsrv\r\n",
+	}
+	for _, exp := range expected {
+		assert.Equal(t, c.MustReadMsg().String(), exp)
+	}
+	assert.Equal(t, srv.ReqCnt(), 3)
+}
+
+func TestProxyPipelineWaitsForPause(t *testing.T) {
+	srv, proxy := startFakeredisAndProxy(t)
+	defer srv.Stop()
+	defer proxy.Stop()
+
+	c := resp.MustDial("tcp", proxy.ListenAddr().String(), 0, false)
+	c.MustCallAndGetOk(resp.MsgFromStrings("AUTH", "test-pass"))
+
+	proxy.Pause()
+	c.MustWrite(bytes.Join([][]byte{
+		resp.MsgFromStrings("GET", "a").Data(),
+		resp.MsgFromStrings("GET", "b").Data(),
+		resp.MsgFromStrings("GET", "c").Data(),
+	}, nil))
+	waitUntil(t, func() bool { return proxy.GetInfo().WaitingRequests == 1 })
+	assert.Equal(t, srv.ReqCnt(), 0)
+
+	proxy.Unpause()
+	for i := 0; i < 3; i++ {
+		assert.Equal(t, c.MustReadMsg().String(), "$3\r\nsrv\r\n")
+	}
+	assert.Equal(t, srv.ReqCnt(), 3)
+}
+
 func startFakeredisAndProxy(t *testing.T) (*fakeredis.FakeRedisServer, *Proxy) {
 	srv := fakeredis.Start("srv", "tcp")
 
@@ -0,0 +1,202 @@
+package rproxy
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/Codility/redis-proxy/resp"
+)
+
+// Redis Sentinel
+//
+// With `sentinel.master_name` set, the proxy asks sentinels for the
+// address of the current master, and uses it as `uplink.addr` (the
+// rest of `uplink`, e.g. password or TLS settings, still applies).
+// While running, it listens for +switch-master events and follows
+// the master with the usual pause, switch uplink, unpause sequence,
+// so clients re-dial, re-AUTH and re-SELECT on their next request.
+
+const sentinelDialTimeout = time.Second
+
+type SentinelConfig struct {
+	Addrs      []string `json:"addrs"`
+	MasterName string   `json:"master_name"`
+	Pass       string   `json:"pass"`
+}
+
+func (sc *SentinelConfig) Enabled() bool {
+	return sc.MasterName != ""
+}
+
+func (sc *SentinelConfig) Prepare() ErrorList {
+	errors := ErrorList{}
+	if len(sc.Addrs) == 0 {
+		errors.Add("sentinel requires addrs")
+	}
+	return errors
+}
+
+func (sc *SentinelConfig) Equal(other *SentinelConfig) bool {
+	if sc.MasterName != other.MasterName || sc.Pass != other.Pass || len(sc.Addrs) != len(other.Addrs) {
+		return false
+	}
+	for i := range sc.Addrs {
+		if sc.Addrs[i] != other.Addrs[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func (sc *SentinelConfig) SanitizedForPublication() *SentinelConfig {
+	return &SentinelConfig{
+		Addrs:      sc.Addrs,
+		MasterName: sc.MasterName,
+		Pass:       SanitizedPass,
+	}
+}
+
+func (sc *SentinelConfig) dial(addr string) (*resp.Conn, error) {
+	conn, err := net.DialTimeout("tcp", addr, sentinelDialTimeout)
+	if err != nil {
+		return nil, err
+	}
+	rc := resp.NewConn(conn, sentinelDialTimeout.Nanoseconds()/1e6, false)
+	if sc.Pass != "" {
+		if err := rc.Authenticate(sc.Pass); err != nil {
+			rc.Close()
+			return nil, err
+		}
+	}
+	return rc, nil
+}
+
+// ResolveMaster asks sentinels (in order, until one of them knows)
+// for the address of the master.
+func (sc *SentinelConfig) ResolveMaster() (string, error) {
+	var lastErr error
+	for _, addr := range sc.Addrs {
+		res, err := sc.askForMaster(addr)
+		if err == nil {
+			return res, nil
+		}
+		log.Printf("Sentinel %s: %v", addr, err)
+		lastErr = err
+	}
+	if lastErr == nil {
+		lastErr = errors.New("no sentinels configured")
+	}
+	return "", lastErr
+}
+
+func (sc *SentinelConfig) askForMaster(addr string) (string, error) {
+	rc, err := sc.dial(addr)
+	if err != nil {
+		return "", err
+	}
+	defer rc.Close()
+
+	res, err := rc.Call(resp.MsgFromStrings("SENTINEL", "get-master-addr-by-name", sc.MasterName))
+	if err != nil {
+		return "", err
+	}
+	elems := res.Elements()
+	if len(elems) != 2 {
+		return "", fmt.Errorf("unknown master '%s': %s", sc.MasterName, strings.TrimSpace(res.String()))
+	}
+	host, _ := elems[0].Str()
+	port, _ := elems[1].Str()
+	return net.JoinHostPort(host, port), nil
+}
+
+// watchSentinels runs for the whole life of the proxy, following
+// whatever sentinels the current config points to.
+func (proxy *Proxy) watchSentinels() {
+	for proxy.State().IsAlive() {
+		conf := proxy.GetConfig().Sentinel
+		if conf.Enabled() {
+			proxy.followSentinels(&conf)
+		}
+		time.Sleep(time.Second)
+	}
+}
+
+func (proxy *Proxy) followSentinels(conf *SentinelConfig) {
+	for _, addr := range conf.Addrs {
+		rc, err := conf.dial(addr)
+		if err != nil {
+			log.Printf("Sentinel %s: %v", addr, err)
+			continue
+		}
+		err = proxy.followSentinel(conf, rc)
+		rc.Close()
+		if err == nil {
+			// Config changed or the proxy is stopping.
+			return
+		}
+		log.Printf("Sentinel %s: %v", addr, err)
+	}
+}
+
+// followSentinel listens for +switch-master on rc, until the
+// sentinel config changes or the proxy stops.
+func (proxy *Proxy) followSentinel(conf *SentinelConfig, rc *resp.Conn) error {
+	res, err := rc.Call(resp.MsgFromStrings("SUBSCRIBE", "+switch-master"))
+	if err != nil {
+		return err
+	}
+	if elems := res.Elements(); len(elems) != 3 {
+		return fmt.Errorf("could not subscribe: %s", strings.TrimSpace(res.String()))
+	}
+
+	// The master might have moved before we subscribed.
+	if addr, err := conf.ResolveMaster(); err == nil {
+		proxy.followMaster(addr)
+	}
+
+	for proxy.State().IsAlive() && conf.Equal(&proxy.GetConfig().Sentinel) {
+		if err := rc.WaitForData(time.Second); err != nil {
+			if resp.IsNetTimeout(err) {
+				continue
+			}
+			return err
+		}
+		msg, err := rc.ReadMsg()
+		if err != nil {
+			return err
+		}
+
+		// message +switch-master "<name> <old-ip> <old-port> <new-ip> <new-port>"
+		elems := msg.Elements()
+		if len(elems) != 3 {
+			continue
+		}
+		payload, _ := elems[2].Str()
+		fields := strings.Fields(payload)
+		if len(fields) == 5 && fields[0] == conf.MasterName {
+			proxy.followMaster(net.JoinHostPort(fields[3], fields[4]))
+		}
+	}
+	return nil
+}
+
+// followMaster switches uplink to addr, unless it's there already.
+func (proxy *Proxy) followMaster(addr string) {
+	uplink := proxy.GetConfig().Uplink
+	if uplink.Addr == addr {
+		return
+	}
+	log.Printf("Sentinel: master moved from %s to %s, switching uplink", uplink.Addr, addr)
+
+	uplink.Addr = addr
+	err := proxy.withPause(time.Time{}, func() error {
+		return proxy.SetUplink(uplink)
+	})
+	if err != nil {
+		log.Printf("Sentinel: could not switch uplink: %v", err)
+	}
+}
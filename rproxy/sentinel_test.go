@@ -0,0 +1,69 @@
+package rproxy
+
+import (
+	"testing"
+
+	"github.com/Codility/redis-proxy/fakeredis"
+	"github.com/Codility/redis-proxy/resp"
+	"github.com/stvp/assert"
+)
+
+func TestProxySentinelFailover(t *testing.T) {
+	srv_0 := fakeredis.Start("srv-0", "tcp")
+	defer srv_0.Stop()
+	srv_1 := fakeredis.Start("srv-1", "tcp")
+	defer srv_1.Stop()
+
+	sentinel := fakeredis.Start("sentinel", "tcp")
+	defer sentinel.Stop()
+	sentinel.SetMaster("mymaster", srv_0.Addr().String())
+
+	proxy := mustStartTestProxy(t, &TestConfigLoader{
+		conf: &Config{
+			Sentinel: SentinelConfig{
+				Addrs:      []string{"127.0.0.1:1", sentinel.Addr().String()},
+				MasterName: "mymaster",
+			},
+			Listen: AddrSpec{Addr: "127.0.0.1:0"},
+		},
+	})
+	defer proxy.Stop()
+	assert.Equal(t, proxy.GetConfig().Uplink.Addr, srv_0.Addr().String())
+
+	c := resp.MustDial("tcp", proxy.ListenAddr().String(), 0, false)
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("GET", "k")).String(), "$5\r\nsrv-0\r\n")
+
+	waitUntil(t, func() bool {
+		for _, req := range sentinel.Requests() {
+			if req.Op() == resp.MsgOpSubscribe {
+				return true
+			}
+		}
+		return false
+	})
+
+	// Other masters are ignored
+	sentinel.SetMaster("other", srv_0.Addr().String())
+	sentinel.SetMaster("other", srv_1.Addr().String())
+
+	sentinel.SetMaster("mymaster", srv_1.Addr().String())
+	waitUntil(t, func() bool { return proxy.GetConfig().Uplink.Addr == srv_1.Addr().String() })
+	assert.Equal(t, proxy.State(), ProxyRunning)
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("GET", "k")).String(), "$5\r\nsrv-1\r\n")
+}
+
+func TestProxySentinelUnknownMaster(t *testing.T) {
+	sentinel := fakeredis.Start("sentinel", "tcp")
+	defer sentinel.Stop()
+
+	_, err := NewProxy(&TestConfigLoader{
+		conf: &Config{
+			Sentinel: SentinelConfig{
+				Addrs:      []string{sentinel.Addr().String()},
+				MasterName: "mymaster",
+			},
+			Listen: AddrSpec{Addr: "127.0.0.1:0"},
+		},
+	})
+	assert.NotNil(t, err)
+}
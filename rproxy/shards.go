@@ -0,0 +1,182 @@
+package rproxy
+
+import (
+	"crypto/md5"
+	"fmt"
+	"math"
+	"sort"
+
+	"github.com/Codility/redis-proxy/resp"
+)
+
+// Shards
+//
+// With `shards` set, the proxy presents several independent Redis
+// servers as one, like twemproxy does: every request is routed by its
+// keys over a consistent-hash ring (ketama, compatible with
+// twemproxy's `distribution: ketama` and `hash: md5`), with points
+// proportional to shard weights.  Requests without keys (and Pub/Sub)
+// go to `uplink`, which defaults to the first shard.
+//
+// Requests whose keys map to different shards get an error from the
+// proxy, and so do commands whose keys the proxy doesn't know, and
+// ones that work on the whole keyspace (KEYS, SCAN, DBSIZE, FLUSHDB,
+// RANDOMKEY...), which can't be answered by a single shard.
+// Transactions are not supported, and the connection pool is not
+// used.  Hash tags ("{...}") work the same way as in Redis
+// Cluster.
+//
+// Shards can be changed by reloading the config: the proxy pauses for
+// the reload, so that requests in flight complete before the ring
+// changes.
+
+const (
+	ketamaPointsPerServer = 160
+	ketamaPointsPerHash   = 4
+)
+
+var (
+	MsgCrossShard       = []byte("-ERR Keys in request don't map to the same shard (redis-proxy)\r\n")
+	MsgShardUnsupported = []byte("-ERR Command not supported in shards mode (redis-proxy)\r\n")
+)
+
+type ShardSpec struct {
+	AddrSpec
+	// Name is hashed to place the shard on the ring (default: Addr).
+	// Keep it when moving a shard to a different address.
+	Name   string `json:"name,omitempty"`
+	Weight int    `json:"weight,omitempty"`
+}
+
+type ShardInfo struct {
+	Name        string `json:"name"`
+	Addr        string `json:"addr"`
+	Weight      int    `json:"weight"`
+	Connections int    `json:"connections"`
+}
+
+func (c *Config) Sharded() bool {
+	return len(c.Shards) > 0
+}
+
+func (c *Config) prepareShards(offline bool) ErrorList {
+	errList := ErrorList{}
+	names := map[string]bool{}
+	for i := range c.Shards {
+		shard := &c.Shards[i]
+		errList.Append(shard.AddrSpec.prepare(fmt.Sprintf("shards[%d]", i), false, offline))
+		if shard.Name == "" {
+			shard.Name = shard.Addr
+		}
+		if names[shard.Name] {
+			errList.Add(fmt.Sprintf("shards[%d]: duplicate name %q", i, shard.Name))
+		}
+		names[shard.Name] = true
+		if shard.Weight < 0 {
+			errList.Add(fmt.Sprintf("shards[%d]: weight must not be negative", i))
+		}
+		if shard.Weight == 0 {
+			shard.Weight = 1
+		}
+	}
+	if !errList.Ok() {
+		return errList
+	}
+
+	if c.Uplink.Addr == "" {
+		c.Uplink = c.Shards[0].AddrSpec
+	}
+	if c.Cluster.Enabled || c.Sentinel.Enabled() {
+		errList.Add("shards can't be used together with cluster or sentinel")
+	}
+	c.shardRing = NewShardRing(c.Shards)
+	return errList
+}
+
+func (c *Config) shardsInfo(counter *connCounter) []ShardInfo {
+	if !c.Sharded() {
+		return nil
+	}
+	res := make([]ShardInfo, len(c.Shards))
+	for i, shard := range c.Shards {
+		res[i] = ShardInfo{
+			Name:        shard.Name,
+			Addr:        shard.Addr,
+			Weight:      shard.Weight,
+			Connections: counter.Get(shard.Addr),
+		}
+	}
+	return res
+}
+
+////////////////////////////////////////
+// ShardRing
+
+type ringPoint struct {
+	hash  uint32
+	shard int
+}
+
+// ShardRing maps keys to indexes in the list of shards.
+type ShardRing struct {
+	points []ringPoint
+}
+
+func NewShardRing(shards []ShardSpec) *ShardRing {
+	totalWeight := 0
+	for _, shard := range shards {
+		totalWeight += shard.Weight
+	}
+
+	ring := &ShardRing{}
+	for i, shard := range shards {
+		pct := float64(shard.Weight) / float64(totalWeight)
+		hashes := int(math.Floor(pct*ketamaPointsPerServer/ketamaPointsPerHash*float64(len(shards)) + 0.0000000001))
+		for j := 0; j < hashes; j++ {
+			digest := md5.Sum([]byte(fmt.Sprintf("%s-%d", shard.Name, j)))
+			for k := 0; k < ketamaPointsPerHash; k++ {
+				ring.points = append(ring.points, ringPoint{ketamaHash(digest, k), i})
+			}
+		}
+	}
+	sort.Slice(ring.points, func(a, b int) bool {
+		return ring.points[a].hash < ring.points[b].hash
+	})
+	return ring
+}
+
+func ketamaHash(digest [md5.Size]byte, alignment int) uint32 {
+	d := digest[alignment*4:]
+	return uint32(d[3])<<24 | uint32(d[2])<<16 | uint32(d[1])<<8 | uint32(d[0])
+}
+
+// Shard returns index of the shard key belongs to.
+func (r *ShardRing) Shard(key string) int {
+	hash := ketamaHash(md5.Sum([]byte(resp.HashTag(key))), 0)
+	i := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i].hash >= hash
+	})
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.points[i].shard
+}
+
+// RequestShard returns the shard all keys of req belong to (-1 for
+// requests without keys), or an error reply.  Commands with unknown
+// keys (including keyspace-wide ones) are refused rather than sent to
+// an arbitrary shard.
+func (r *ShardRing) RequestShard(req *resp.Msg) (int, []byte) {
+	if !req.KeysKnown() {
+		return 0, MsgShardUnsupported
+	}
+	shard := -1
+	for _, key := range req.Keys() {
+		keyShard := r.Shard(key)
+		if shard != -1 && keyShard != shard {
+			return 0, MsgCrossShard
+		}
+		shard = keyShard
+	}
+	return shard, nil
+}
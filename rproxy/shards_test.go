@@ -0,0 +1,197 @@
+package rproxy
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/Codility/redis-proxy/fakeredis"
+	"github.com/Codility/redis-proxy/resp"
+	"github.com/stvp/assert"
+)
+
+func testShards(names ...string) []ShardSpec {
+	shards := []ShardSpec{}
+	for _, name := range names {
+		shards = append(shards, ShardSpec{AddrSpec: AddrSpec{Addr: name + ":6379"}, Name: name, Weight: 1})
+	}
+	return shards
+}
+
+func shardCounts(ring *ShardRing, n, keys int) []int {
+	counts := make([]int, n)
+	for i := 0; i < keys; i++ {
+		counts[ring.Shard(fmt.Sprintf("key:%d", i))]++
+	}
+	return counts
+}
+
+func TestShardRing(t *testing.T) {
+	shards := testShards("a", "b", "c")
+	ring := NewShardRing(shards)
+	assert.Equal(t, len(ring.points), 3*ketamaPointsPerServer)
+
+	for _, cnt := range shardCounts(ring, 3, 30000) {
+		assert.True(t, cnt > 8000 && cnt < 12000, cnt)
+	}
+
+	// Hash tags
+	assert.Equal(t, ring.Shard("{user:1}:a"), ring.Shard("user:1"))
+	assert.Equal(t, ring.Shard("{user:1}:a"), ring.Shard("{user:1}:b"))
+
+	// Weights
+	shards[0].Weight = 2
+	counts := shardCounts(NewShardRing(shards), 3, 40000)
+	assert.True(t, counts[0] > 17000 && counts[0] < 23000, counts)
+
+	// Adding a shard moves only keys that go to the new one
+	grown := NewShardRing(testShards("a", "b", "c", "d"))
+	for i := 0; i < 10000; i++ {
+		key := fmt.Sprintf("key:%d", i)
+		if shard := grown.Shard(key); shard != 3 {
+			assert.Equal(t, shard, ring.Shard(key), key)
+		}
+	}
+}
+
+func startShardedProxy(t *testing.T, srvs ...*fakeredis.FakeRedisServer) (*Proxy, *TestConfigLoader) {
+	conf := &Config{Listen: AddrSpec{Addr: "127.0.0.1:0"}}
+	for _, srv := range srvs {
+		conf.Shards = append(conf.Shards, ShardSpec{AddrSpec: AddrSpec{Addr: srv.Addr().String()}})
+	}
+	loader := &TestConfigLoader{conf: conf}
+	return mustStartTestProxy(t, loader), loader
+}
+
+// keyOnShard returns a key the proxy routes to the given shard.
+func keyOnShard(proxy *Proxy, shard int) string {
+	for i := 0; ; i++ {
+		key := fmt.Sprintf("key:%d", i)
+		if proxy.GetConfig().shardRing.Shard(key) == shard {
+			return key
+		}
+	}
+}
+
+func TestProxyShardsRouting(t *testing.T) {
+	srv_a := fakeredis.Start("srv-a", "tcp")
+	defer srv_a.Stop()
+	srv_b := fakeredis.Start("srv-b", "tcp")
+	defer srv_b.Stop()
+
+	proxy, _ := startShardedProxy(t, srv_a, srv_b)
+	defer proxy.Stop()
+
+	key_a, key_b := keyOnShard(proxy, 0), keyOnShard(proxy, 1)
+
+	c := resp.MustDial("tcp", proxy.ListenAddr().String(), 0, false)
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("GET", key_a)).String(), "$5\r\nsrv-a\r\n")
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("GET", key_b)).String(), "$5\r\nsrv-b\r\n")
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("MGET", "{"+key_b+"}1", "{"+key_b+"}2")).String(),
+		"$5\r\nsrv-b\r\n")
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("MGET", key_a, key_b)).String(),
+		"-ERR Keys in request don't map to the same shard (redis-proxy)\r\n")
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("MULTI")).String(),
+		"-ERR Transactions are not supported in cluster or shards mode (redis-proxy)\r\n")
+
+	// Requests without keys go to the first shard
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("PING")).String(), "$5\r\nsrv-a\r\n")
+
+	// Commands with unknown keys, and keyspace-wide ones, are refused
+	for _, req := range [][]string{
+		{"KEYS", "*"}, {"SCAN", "0"}, {"DBSIZE"}, {"FLUSHDB"}, {"RANDOMKEY"}, {"FOO.BAR", key_b},
+	} {
+		assert.Equal(t, c.MustCall(resp.MsgFromStrings(req...)).String(),
+			"-ERR Command not supported in shards mode (redis-proxy)\r\n", req)
+	}
+
+	// Pipelined requests to different shards come back in order
+	c.MustWriteMsgs([]*resp.Msg{
+		resp.MsgFromStrings("GET", key_b),
+		resp.MsgFromStrings("GET", key_a),
+		resp.MsgFromStrings("GET", key_b),
+	})
+	assert.Equal(t, c.MustReadMsg().String(), "$5\r\nsrv-b\r\n")
+	assert.Equal(t, c.MustReadMsg().String(), "$5\r\nsrv-a\r\n")
+	assert.Equal(t, c.MustReadMsg().String(), "$5\r\nsrv-b\r\n")
+
+	// SELECT applies to all shards
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("SELECT", "3")).String(), "+OK\r\n")
+	c.MustCall(resp.MsgFromStrings("GET", key_b))
+	reqs := srv_b.Requests()
+	assert.Equal(t, reqs[len(reqs)-2].String(), resp.MsgFromStrings("SELECT", "3").String())
+	assert.Equal(t, reqs[len(reqs)-1].String(), resp.MsgFromStrings("GET", key_b).String())
+
+	info := proxy.GetInfo()
+	assert.Equal(t, len(info.Shards), 2)
+	assert.Equal(t, info.Shards[0].Addr, srv_a.Addr().String())
+	assert.Equal(t, info.Shards[0].Connections, 1)
+	assert.Equal(t, info.Shards[1].Connections, 1)
+
+	c.Close()
+	waitUntil(t, func() bool { return proxy.GetInfo().Shards[1].Connections == 0 })
+}
+
+func TestProxyShardsReload(t *testing.T) {
+	srv_a := fakeredis.Start("srv-a", "tcp")
+	defer srv_a.Stop()
+	srv_b := fakeredis.Start("srv-b", "tcp")
+	defer srv_b.Stop()
+	srv_c := fakeredis.Start("srv-c", "tcp")
+	defer srv_c.Stop()
+
+	proxy, loader := startShardedProxy(t, srv_a, srv_b)
+	defer proxy.Stop()
+
+	c := resp.MustDial("tcp", proxy.ListenAddr().String(), 0, false)
+	defer c.Close()
+	c.MustCall(resp.MsgFromStrings("GET", keyOnShard(proxy, 1)))
+
+	loader.Replace(&Config{
+		Listen: AddrSpec{Addr: "127.0.0.1:0"},
+		Shards: []ShardSpec{
+			{AddrSpec: AddrSpec{Addr: srv_a.Addr().String()}},
+			{AddrSpec: AddrSpec{Addr: srv_b.Addr().String()}},
+			{AddrSpec: AddrSpec{Addr: srv_c.Addr().String()}},
+		},
+	})
+	assert.Nil(t, proxy.Reload())
+	assert.Equal(t, proxy.State(), ProxyRunning)
+	assert.Equal(t, len(proxy.GetInfo().Shards), 3)
+
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("GET", keyOnShard(proxy, 2))).String(), "$5\r\nsrv-c\r\n")
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("GET", keyOnShard(proxy, 1))).String(), "$5\r\nsrv-b\r\n")
+}
+
+func TestProxyShardsReloadFromUnsharded(t *testing.T) {
+	srv_a := fakeredis.Start("srv-a", "tcp")
+	defer srv_a.Stop()
+	srv_b := fakeredis.Start("srv-b", "tcp")
+	defer srv_b.Stop()
+
+	loader := &TestConfigLoader{conf: &Config{
+		Uplink: AddrSpec{Addr: srv_a.Addr().String()},
+		Listen: AddrSpec{Addr: "127.0.0.1:0"},
+	}}
+	proxy := mustStartTestProxy(t, loader)
+	defer proxy.Stop()
+
+	loader.Replace(&Config{
+		Listen: AddrSpec{Addr: "127.0.0.1:0"},
+		Shards: []ShardSpec{
+			{AddrSpec: AddrSpec{Addr: srv_a.Addr().String()}},
+			{AddrSpec: AddrSpec{Addr: srv_b.Addr().String()}},
+		},
+	})
+	res := proxy.ReloadWithResult()
+	assert.True(t, res.Ok, res.Error)
+	steps := []string{}
+	for _, step := range res.Steps {
+		steps = append(steps, step.Name)
+	}
+	assert.Equal(t, steps, []string{"load", "pause", "validate", "apply"})
+	assert.Equal(t, proxy.State(), ProxyRunning)
+
+	c := resp.MustDial("tcp", proxy.ListenAddr().String(), 0, false)
+	defer c.Close()
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("GET", keyOnShard(proxy, 1))).String(), "$5\r\nsrv-b\r\n")
+}
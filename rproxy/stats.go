@@ -1,6 +1,7 @@
 package rproxy
 
 import (
+	"strings"
 	"time"
 
 	"github.com/prometheus/client_golang/prometheus"
@@ -39,6 +40,34 @@ var (
 		Name: "rproxy_active_requests",
 		Help: "Number of active requests (those currently executing a call to Redis)",
 	})
+	statWaitingRequests = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "rproxy_waiting_requests",
+		Help: "Number of requests waiting for permission to call Redis (e.g. during PAUSE)",
+	})
+	statRejectedCommands = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "rproxy_rejected_commands_total",
+		Help: "Requests rejected by command policy",
+	}, []string{"reason", "command"})
+	statConnections = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: "rproxy_client_connections",
+		Help: "Number of client connections, per listener",
+	}, []string{"listener"})
+	statRejectedConnections = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "rproxy_rejected_connections_total",
+		Help: "Client connections rejected because of connection limits, per listener",
+	}, []string{"listener"})
+	statRateLimited = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Name: "rproxy_rate_limited_requests_total",
+		Help: "Requests delayed or rejected because of rate limits",
+	}, []string{"action"})
+	statLastReloadSuccessful = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "rproxy_config_last_reload_successful",
+		Help: "Whether the last config reload succeeded (1) or failed and the old config is kept (0)",
+	})
+	statLastReloadTime = prometheus.NewGauge(prometheus.GaugeOpts{
+		Name: "rproxy_config_last_reload_timestamp_seconds",
+		Help: "Time of the last config reload attempt",
+	})
 )
 
 func init() {
@@ -46,7 +75,15 @@ func init() {
 		statDurationsHistogram,
 		statDelaysHistogram,
 		statActiveRequests,
+		statWaitingRequests,
+		statRejectedCommands,
+		statConnections,
+		statRejectedConnections,
+		statRateLimited,
+		statLastReloadSuccessful,
+		statLastReloadTime,
 	)
+	statLastReloadSuccessful.Set(1)
 }
 
 func statRecordRequest(duration, redisDuration time.Duration) {
@@ -54,6 +91,32 @@ func statRecordRequest(duration, redisDuration time.Duration) {
 	statDelaysHistogram.Observe(float64(duration - redisDuration))
 }
 
-func statRecordProxyState(activeRequests int) {
+func statRecordPermissions(activeRequests, waitingRequests int) {
 	statActiveRequests.Set(float64(activeRequests))
+	statWaitingRequests.Set(float64(waitingRequests))
+}
+
+func statRecordRejectedCommand(reason, command string) {
+	statRejectedCommands.WithLabelValues(reason, strings.ToLower(command)).Inc()
+}
+
+func statRecordConnections(listener string, cnt int) {
+	statConnections.WithLabelValues(listener).Set(float64(cnt))
+}
+
+func statRecordRejectedConnection(listener string) {
+	statRejectedConnections.WithLabelValues(listener).Inc()
+}
+
+func statRecordRateLimited(action string) {
+	statRateLimited.WithLabelValues(action).Inc()
+}
+
+func statRecordReload(ok bool, t time.Time) {
+	if ok {
+		statLastReloadSuccessful.Set(1)
+	} else {
+		statLastReloadSuccessful.Set(0)
+	}
+	statLastReloadTime.Set(float64(t.UnixNano()) / 1e9)
 }
@@ -0,0 +1,310 @@
+package rproxy
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/Codility/redis-proxy/resp"
+)
+
+// Switchover
+//
+// Moves the proxy to a new Redis server without losing data: the
+// target becomes a replica of the current uplink, and once it caught
+// up (with the master's offset from when the wait started, as under
+// write load it never stops moving), the proxy pauses, waits for the
+// last writes to replicate, promotes the target (REPLICAOF NO ONE),
+// switches uplink to it and unpauses.  Any failure or timeout aborts
+// the switchover, makes the target stop replicating, and leaves (or
+// brings) the proxy back to the running state with the old uplink.
+// Progress is reported in ProxyInfo.  Connections made for the
+// switchover give up at its deadline.  Switchover is not supported in
+// cluster or shards mode, where uplink isn't the only server.
+
+const (
+	DefaultSwitchoverTimeout = 30 * time.Second
+
+	switchoverPollInterval = 100 * time.Millisecond
+)
+
+const (
+	SwitchoverStarting  = "starting"
+	SwitchoverSyncing   = "syncing"
+	SwitchoverPausing   = "pausing"
+	SwitchoverPromoting = "promoting"
+	SwitchoverDone      = "done"
+	SwitchoverFailed    = "failed"
+)
+
+type SwitchoverInfo struct {
+	State         string `json:"state"`
+	From          string `json:"from"`
+	To            string `json:"to"`
+	MasterOffset  int64  `json:"master_offset"`
+	ReplicaOffset int64  `json:"replica_offset"`
+	Error         string `json:"error,omitempty"`
+}
+
+type switchover struct {
+	proxy  *Proxy
+	config *Config
+	target AddrSpec
+
+	deadline    time.Time
+	master      *resp.Conn
+	replica     *resp.Conn
+	replicating bool // target is a replica of uplink, until promoted
+
+	mu   sync.Mutex
+	info SwitchoverInfo
+}
+
+// Switchover starts switching uplink to target in the background,
+// see SwitchoverInfo in ProxyInfo for progress.
+func (proxy *Proxy) Switchover(target AddrSpec, timeout time.Duration) error {
+	if errList := target.Prepare("switchover target", false); !errList.Ok() {
+		return errList.AsError()
+	}
+	if timeout <= 0 {
+		timeout = DefaultSwitchoverTimeout
+	}
+
+	proxy.switchoverMu.Lock()
+	defer proxy.switchoverMu.Unlock()
+
+	if proxy.switchover != nil && proxy.switchover.InProgress() {
+		return errors.New("Switchover already in progress")
+	}
+	config := proxy.GetConfig()
+	if config.RoutesByKey() {
+		return errors.New("Switchover is not supported in cluster or shards mode")
+	}
+	if config.Uplink == target {
+		return errors.New("Switchover target is the current uplink")
+	}
+
+	so := &switchover{
+		proxy:    proxy,
+		config:   config,
+		target:   target,
+		deadline: time.Now().Add(timeout),
+		info: SwitchoverInfo{
+			State: SwitchoverStarting,
+			From:  config.Uplink.Addr,
+			To:    target.Addr,
+		},
+	}
+	proxy.switchover = so
+	go so.Run()
+	return nil
+}
+
+func (proxy *Proxy) switchoverInfo() *SwitchoverInfo {
+	proxy.switchoverMu.Lock()
+	defer proxy.switchoverMu.Unlock()
+
+	if proxy.switchover == nil {
+		return nil
+	}
+	return proxy.switchover.Info()
+}
+
+func (so *switchover) Info() *SwitchoverInfo {
+	so.mu.Lock()
+	defer so.mu.Unlock()
+
+	info := so.info
+	return &info
+}
+
+func (so *switchover) InProgress() bool {
+	st := so.Info().State
+	return st != SwitchoverDone && st != SwitchoverFailed
+}
+
+func (so *switchover) setState(state string) {
+	so.mu.Lock()
+	defer so.mu.Unlock()
+
+	log.Printf("Switchover to %s: %s", so.target.Addr, state)
+	so.info.State = state
+}
+
+func (so *switchover) Run() {
+	err := so.run()
+	if err != nil && so.replicating {
+		if stopErr := so.callReplica("REPLICAOF", "NO", "ONE"); stopErr != nil {
+			log.Printf("Switchover to %s: could not stop replication: %s", so.target.Addr, stopErr)
+		}
+	}
+	if so.master != nil {
+		so.master.Close()
+	}
+	if so.replica != nil {
+		so.replica.Close()
+	}
+
+	if err != nil {
+		so.mu.Lock()
+		so.info.Error = err.Error()
+		so.mu.Unlock()
+		so.setState(SwitchoverFailed)
+		return
+	}
+	so.setState(SwitchoverDone)
+}
+
+func (so *switchover) run() error {
+	var err error
+	if so.master, err = so.dial(so.config.Uplink); err != nil {
+		return err
+	}
+	if so.replica, err = so.dial(so.target); err != nil {
+		return err
+	}
+
+	if err := so.startReplication(); err != nil {
+		return err
+	}
+
+	so.setState(SwitchoverSyncing)
+	if err := so.waitForReplication(); err != nil {
+		return err
+	}
+
+	so.setState(SwitchoverPausing)
+	return so.proxy.withPause(so.deadline, func() error {
+		// No more writes, let the replica get the last ones.
+		if err := so.waitForReplication(); err != nil {
+			return err
+		}
+
+		so.setState(SwitchoverPromoting)
+		if err := so.callReplica("REPLICAOF", "NO", "ONE"); err != nil {
+			return err
+		}
+		so.replicating = false
+		return so.proxy.SetUplink(so.target)
+	})
+}
+
+// dial connects to node, with dial and read timeouts of the time left
+// until the deadline.
+func (so *switchover) dial(node AddrSpec) (*resp.Conn, error) {
+	timeout := time.Until(so.deadline)
+	if timeout <= 0 {
+		return nil, errors.New("Timed out before connecting")
+	}
+	readTimeLimitMs := timeout.Nanoseconds() / 1e6
+	if readTimeLimitMs == 0 {
+		readTimeLimitMs = 1
+	}
+	return node.DialRedisTimeout(timeout, readTimeLimitMs, so.config.LogMessages)
+}
+
+func (so *switchover) callReplica(args ...string) error {
+	res, err := so.replica.Call(resp.MsgFromStrings(args...))
+	if err != nil {
+		return err
+	}
+	if !res.IsOk() {
+		return fmt.Errorf("%s failed: %s", strings.Join(args, " "), strings.TrimSpace(res.String()))
+	}
+	return nil
+}
+
+func (so *switchover) startReplication() error {
+	if so.config.Uplink.Network != "" && so.config.Uplink.Network != "tcp" {
+		return errors.New("Switchover requires a TCP uplink")
+	}
+	host, port, err := net.SplitHostPort(so.config.Uplink.Addr)
+	if err != nil {
+		return err
+	}
+
+	if so.config.Uplink.User != "" {
+		if err := so.callReplica("CONFIG", "SET", "masteruser", so.config.Uplink.User); err != nil {
+			return err
+		}
+	}
+	if so.config.Uplink.Pass != "" {
+		if err := so.callReplica("CONFIG", "SET", "masterauth", so.config.Uplink.Pass); err != nil {
+			return err
+		}
+	}
+	so.replicating = true
+	return so.callReplica("REPLICAOF", host, port)
+}
+
+// waitForReplication polls INFO replication on the replica until its
+// offset reaches the master's one from when it started (and its link
+// to the master is up).
+func (so *switchover) waitForReplication() error {
+	masterOffset, err := replicationOffset(so.master)
+	if err != nil {
+		return err
+	}
+	for {
+		replicaOffset, err := replicationOffset(so.replica)
+		if err != nil {
+			return err
+		}
+
+		so.mu.Lock()
+		so.info.MasterOffset = masterOffset
+		so.info.ReplicaOffset = replicaOffset
+		so.mu.Unlock()
+
+		if replicaOffset != -1 && replicaOffset >= masterOffset {
+			return nil
+		}
+		if time.Now().After(so.deadline) {
+			return fmt.Errorf("Timed out waiting for replication (master offset: %d, replica offset: %d)",
+				masterOffset, replicaOffset)
+		}
+		time.Sleep(switchoverPollInterval)
+	}
+}
+
+func replicationOffset(rc *resp.Conn) (int64, error) {
+	res, err := rc.Call(resp.MsgFromStrings("INFO", "replication"))
+	if err != nil {
+		return 0, err
+	}
+	infoStr, ok := res.Str()
+	if !ok {
+		return 0, fmt.Errorf("INFO failed: %s", strings.TrimSpace(res.String()))
+	}
+
+	info := parseInfo(infoStr)
+	if info["role"] == "slave" && info["master_link_status"] != "up" {
+		return -1, nil
+	}
+	offset, err := strconv.ParseInt(info["master_repl_offset"], 10, 64)
+	if err != nil {
+		return 0, fmt.Errorf("INFO replication: could not parse master_repl_offset: %v", err)
+	}
+	return offset, nil
+}
+
+// parseInfo parses "key:value" lines of INFO reply.
+func parseInfo(info string) map[string]string {
+	res := map[string]string{}
+	for _, line := range strings.Split(info, "\n") {
+		line = strings.TrimSpace(line)
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) == 2 {
+			res[parts[0]] = parts[1]
+		}
+	}
+	return res
+}
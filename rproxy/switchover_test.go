@@ -0,0 +1,131 @@
+package rproxy
+
+import (
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/Codility/redis-proxy/fakeredis"
+	"github.com/Codility/redis-proxy/resp"
+	"github.com/stvp/assert"
+)
+
+func TestProxySwitchover(t *testing.T) {
+	srv_0 := fakeredis.Start("srv-0", "tcp")
+	defer srv_0.Stop()
+	srv_1 := fakeredis.Start("srv-1", "tcp")
+	defer srv_1.Stop()
+
+	proxy := mustStartTestProxy(t, &TestConfigLoader{
+		conf: &Config{
+			Uplink: AddrSpec{Addr: srv_0.Addr().String(), User: "proxy", Pass: "secret"},
+			Listen: AddrSpec{Addr: "127.0.0.1:0"},
+			Admin:  AddrSpec{Addr: "127.0.0.1:0"},
+		},
+	})
+	defer proxy.Stop()
+
+	c := resp.MustDial("tcp", proxy.ListenAddr().String(), 0, false)
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("GET", "k")).String(), "$5\r\nsrv-0\r\n")
+
+	srv_0.SetReplOffset(100)
+	srv_1.SetReplOffset(50)
+
+	res, err := http.PostForm(fmt.Sprintf("http://%s/cmd/", proxy.AdminAddr().String()), url.Values{
+		"cmd":    {"switchover"},
+		"uplink": {fmt.Sprintf(`{"addr": "%s"}`, srv_1.Addr().String())},
+	})
+	assert.Nil(t, err)
+	assert.Equal(t, res.StatusCode, http.StatusOK)
+
+	// Replica is still behind
+	waitUntil(t, func() bool { return proxy.GetInfo().Switchover.ReplicaOffset == 50 })
+	info := proxy.GetInfo()
+	assert.Equal(t, info.Switchover.State, SwitchoverSyncing)
+	assert.Equal(t, info.Switchover.MasterOffset, int64(100))
+	assert.Equal(t, srv_1.ReplicaOf(), srv_0.Addr().String())
+	assert.NotNil(t, proxy.Switchover(AddrSpec{Addr: srv_1.Addr().String()}, 0))
+
+	// Past the master's offset seen before, as under write load
+	srv_1.SetReplOffset(150)
+	waitUntil(t, func() bool { return proxy.GetInfo().Switchover.State == SwitchoverDone })
+	configSets := []string{}
+	for _, req := range srv_1.Requests() {
+		if req.Command() == "CONFIG" {
+			configSets = append(configSets, strings.Join(req.Args(), " "))
+		}
+	}
+	assert.Equal(t, configSets, []string{"SET masteruser proxy", "SET masterauth secret"})
+	assert.Equal(t, srv_1.ReplicaOf(), "")
+	assert.Equal(t, proxy.GetConfig().Uplink.Addr, srv_1.Addr().String())
+	assert.Equal(t, proxy.State(), ProxyRunning)
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("GET", "k")).String(), "$5\r\nsrv-1\r\n")
+}
+
+func TestProxySwitchoverTimeout(t *testing.T) {
+	srv_0 := fakeredis.Start("srv-0", "tcp")
+	defer srv_0.Stop()
+	srv_1 := fakeredis.Start("srv-1", "tcp")
+	defer srv_1.Stop()
+
+	proxy := mustStartTestProxy(t, NewTestConfigLoader(srv_0.Addr().String()))
+	defer proxy.Stop()
+
+	srv_0.SetReplOffset(100)
+	assert.Nil(t, proxy.Switchover(AddrSpec{Addr: srv_1.Addr().String()}, 200*time.Millisecond))
+
+	waitUntil(t, func() bool { return proxy.GetInfo().Switchover.State == SwitchoverFailed })
+	assert.True(t, strings.Contains(proxy.GetInfo().Switchover.Error, "Timed out"))
+	assert.Equal(t, srv_1.ReplicaOf(), "") // no longer replicating
+	assert.Equal(t, proxy.GetConfig().Uplink.Addr, srv_0.Addr().String())
+	assert.Equal(t, proxy.State(), ProxyRunning)
+}
+
+func TestProxySwitchoverWaitsForMasterLink(t *testing.T) {
+	srv_0 := fakeredis.Start("srv-0", "tcp")
+	defer srv_0.Stop()
+	srv_1 := fakeredis.Start("srv-1", "tcp")
+	defer srv_1.Stop()
+
+	proxy := mustStartTestProxy(t, NewTestConfigLoader(srv_0.Addr().String()))
+	defer proxy.Stop()
+
+	// A replica with its link down doesn't count as caught up, whatever
+	// the offsets.
+	srv_0.SetReplOffset(-1)
+	srv_1.SetReplOffset(150)
+	srv_1.SetMasterLinkDown(true)
+	assert.Nil(t, proxy.Switchover(AddrSpec{Addr: srv_1.Addr().String()}, 0))
+
+	waitUntil(t, func() bool { return proxy.GetInfo().Switchover.ReplicaOffset == -1 })
+	time.Sleep(3 * switchoverPollInterval)
+	assert.Equal(t, proxy.GetInfo().Switchover.State, SwitchoverSyncing)
+
+	srv_1.SetMasterLinkDown(false)
+	waitUntil(t, func() bool { return proxy.GetInfo().Switchover.State == SwitchoverDone })
+	assert.Equal(t, proxy.GetConfig().Uplink.Addr, srv_1.Addr().String())
+}
+
+func TestProxySwitchoverUnsupportedModes(t *testing.T) {
+	srv_a, srv_b := startFakeCluster()
+	defer srv_a.Stop()
+	defer srv_b.Stop()
+	target := fakeredis.Start("target", "tcp")
+	defer target.Stop()
+
+	cluster := startClusterProxy(t, srv_a)
+	defer cluster.Stop()
+	err := cluster.Switchover(AddrSpec{Addr: target.Addr().String()}, 0)
+	assert.NotNil(t, err)
+	assert.Contains(t, "cluster or shards", err.Error())
+
+	sharded, _ := startShardedProxy(t, srv_a, srv_b)
+	defer sharded.Stop()
+	err = sharded.Switchover(AddrSpec{Addr: target.Addr().String()}, 0)
+	assert.NotNil(t, err)
+	assert.Contains(t, "cluster or shards", err.Error())
+	assert.Equal(t, target.ReplicaOf(), "")
+}
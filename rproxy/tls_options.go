@@ -0,0 +1,154 @@
+package rproxy
+
+import (
+	"crypto/tls"
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// TLS options
+//
+// For connections the proxy makes (to uplink, shards, replicas, also
+// from the raw proxy), `certfile` and `keyfile` give the client
+// certificate to present, for Redis servers that require mutual TLS,
+// and `server_name` the name to send in SNI and to verify the
+// server's certificate against (instead of the host in `addr`, e.g.
+// when it's an IP address).
+//
+// `min_tls_version` ("1.0" to "1.3") and `cipher_suites` (Go names,
+// like "TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256", separated with
+// commas) apply to both connections the proxy makes and listeners.
+// Cipher suites of TLS 1.3 can't be configured.
+//
+// Certificates, keys and CA certificates are read whenever a
+// connection is made, so new connections use rotated files; RELOAD
+// with changed TLS settings makes clients reconnect to uplink.
+// Listeners check their files on every handshake and load them again
+// when they change.
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+func parseTLSVersion(version string) (uint16, error) {
+	if version == "" {
+		return 0, nil
+	}
+	if v, ok := tlsVersions[version]; ok {
+		return v, nil
+	}
+	versions := []string{}
+	for name := range tlsVersions {
+		versions = append(versions, name)
+	}
+	sort.Strings(versions)
+	return 0, fmt.Errorf("must be one of %s", strings.Join(versions, ", "))
+}
+
+// parseCipherSuites returns IDs of comma-separated cipher suites, and
+// names of those among them that are insecure.
+func parseCipherSuites(suites string) ([]uint16, []string, error) {
+	if suites == "" {
+		return nil, nil, nil
+	}
+	known := map[string]*tls.CipherSuite{}
+	for _, suite := range tls.CipherSuites() {
+		known[suite.Name] = suite
+	}
+	for _, suite := range tls.InsecureCipherSuites() {
+		known[suite.Name] = suite
+	}
+
+	ids := []uint16{}
+	insecure := []string{}
+	for _, name := range strings.Split(suites, ",") {
+		name = strings.TrimSpace(name)
+		suite, ok := known[name]
+		if !ok {
+			return nil, nil, fmt.Errorf("unknown cipher suite '%s'", name)
+		}
+		if suite.Insecure {
+			insecure = append(insecure, name)
+		}
+		ids = append(ids, suite.ID)
+	}
+	return ids, insecure, nil
+}
+
+// applyTLSOptions sets the minimal version and cipher suites in
+// config (both are validated by Prepare).
+func (as *AddrSpec) applyTLSOptions(config *tls.Config) {
+	config.MinVersion, _ = parseTLSVersion(as.MinTLSVersion)
+	config.CipherSuites, _, _ = parseCipherSuites(as.CipherSuites)
+}
+
+// clientTLSConfig returns the config for connecting to this address.
+func (as *AddrSpec) clientTLSConfig() (*tls.Config, error) {
+	config := &tls.Config{
+		ServerName:         as.ServerName,
+		InsecureSkipVerify: as.SkipVerify,
+	}
+	if !as.SkipVerify {
+		roots, err := loadCertPool(as.CACertFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = roots
+	}
+	if as.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(as.CertFile, as.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	as.applyTLSOptions(config)
+	return config, nil
+}
+
+func (as *AddrSpec) prepareTLSOptions(name string, server, offline bool) ErrorList {
+	errList := ErrorList{}
+	if !as.TLS {
+		for _, option := range []struct{ field, value string }{
+			{"server_name", as.ServerName},
+			{"min_tls_version", as.MinTLSVersion},
+			{"cipher_suites", as.CipherSuites},
+		} {
+			if option.value != "" {
+				errList.Add(name + "." + option.field + " requires tls")
+			}
+		}
+		return errList
+	}
+
+	if _, err := parseTLSVersion(as.MinTLSVersion); err != nil {
+		errList.Add(name + ".min_tls_version " + err.Error())
+	}
+	if _, insecure, err := parseCipherSuites(as.CipherSuites); err != nil {
+		errList.Add(name + ".cipher_suites: " + err.Error())
+	} else if len(insecure) > 0 {
+		errList.AddWarning(name + ".cipher_suites: insecure cipher suites: " + strings.Join(insecure, ", "))
+	}
+
+	if server {
+		if as.ServerName != "" {
+			errList.Add(name + ".server_name is only used for connecting")
+		}
+		return errList
+	}
+	switch {
+	case as.CertFile != "" && as.KeyFile == "":
+		errList.Add(name + ".certfile requires keyfile")
+	case as.KeyFile != "" && as.CertFile == "":
+		errList.Add(name + ".keyfile requires certfile")
+	case as.CertFile != "" && !offline:
+		if _, err := tls.LoadX509KeyPair(as.CertFile, as.KeyFile); err != nil {
+			errList.Add("could not load " + name + ".certfile and keyfile: " + err.Error())
+		}
+	}
+	return errList
+}
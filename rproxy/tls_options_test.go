@@ -0,0 +1,152 @@
+package rproxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+
+	"github.com/Codility/redis-proxy/fakeredis"
+	"github.com/Codility/redis-proxy/resp"
+	"github.com/stvp/assert"
+)
+
+// startMTLSRedis starts a fake Redis that requires client
+// certificates signed by ca, and records the CN of every client.
+func startMTLSRedis(t *testing.T, ca *testCA) (*fakeredis.FakeRedisServer, func() []string) {
+	certFile, keyFile := ca.issueFiles(t, "redis", &x509.Certificate{
+		DNSNames:    []string{"redis.internal"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	})
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	assert.Nil(t, err)
+	roots := x509.NewCertPool()
+	roots.AddCert(ca.cert)
+
+	var mu sync.Mutex
+	clients := []string{}
+	srv := fakeredis.StartWithTLSConfig("fake", "tcp", &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		ClientCAs:    roots,
+		ClientAuth:   tls.RequireAndVerifyClientCert,
+		MaxVersion:   tls.VersionTLS12,
+		VerifyConnection: func(cs tls.ConnectionState) error {
+			mu.Lock()
+			defer mu.Unlock()
+			clients = append(clients, cs.PeerCertificates[0].Subject.CommonName)
+			return nil
+		},
+	})
+	return srv, func() []string {
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]string{}, clients...)
+	}
+}
+
+func TestUplinkClientCert(t *testing.T) {
+	dir, err := ioutil.TempDir("", "redis-proxy-certs")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+
+	ca := newTestCA(t, dir, "ca")
+	srv, clients := startMTLSRedis(t, ca)
+	defer srv.Stop()
+	certFile, keyFile := ca.issueFiles(t, "proxy-1", &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "proxy-1"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	uplink := AddrSpec{
+		Addr:       srv.Addr().String(),
+		TLS:        true,
+		CACertFile: filepath.Join(dir, "ca.pem"),
+		ServerName: "redis.internal",
+		CertFile:   certFile,
+		KeyFile:    keyFile,
+	}
+
+	// Without a certificate, or with the wrong server name
+	noCert := uplink
+	noCert.CertFile, noCert.KeyFile = "", ""
+	errList := noCert.Prepare("uplink", false)
+	assert.False(t, errList.Ok())
+	wrongName := uplink
+	wrongName.ServerName = ""
+	errList = wrongName.Prepare("uplink", false)
+	assert.False(t, errList.Ok())
+	tooNew := uplink
+	tooNew.MinTLSVersion = "1.3"
+	errList = tooNew.Prepare("uplink", false)
+	assert.False(t, errList.Ok())
+
+	loader := &TestConfigLoader{conf: &Config{
+		Uplink:    uplink,
+		Listen:    AddrSpec{Addr: "127.0.0.1:0"},
+		ListenRaw: AddrSpec{Addr: "127.0.0.1:0"},
+	}}
+	proxy := mustStartTestProxy(t, loader)
+	defer proxy.Stop()
+
+	c := resp.MustDial("tcp", proxy.ListenAddr().String(), 1000, false)
+	defer c.Close()
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("GET", "a")).String(), "$4\r\nfake\r\n")
+	raw := resp.MustDial("tcp", proxy.ListenRawAddr().String(), 1000, false)
+	defer raw.Close()
+	assert.Equal(t, raw.MustCall(resp.MsgFromStrings("GET", "a")).String(), "$4\r\nfake\r\n")
+
+	// Rotated with RELOAD
+	certFile, keyFile = ca.issueFiles(t, "proxy-2", &x509.Certificate{
+		Subject:     pkix.Name{CommonName: "proxy-2"},
+		ExtKeyUsage: []x509.ExtKeyUsage{x509.ExtKeyUsageClientAuth},
+	})
+	newConfig := *loader.conf
+	newConfig.Uplink.CertFile, newConfig.Uplink.KeyFile = certFile, keyFile
+	newConfig.Uplink.CipherSuites = "TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384"
+	loader.Replace(&newConfig)
+	res := proxy.ReloadWithResult()
+	assert.True(t, res.Ok, res.Error)
+
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("GET", "a")).String(), "$4\r\nfake\r\n")
+	seen := clients()
+	assert.Equal(t, seen[len(seen)-1], "proxy-2")
+	assert.Equal(t, seen[0], "proxy-1")
+}
+
+func TestTLSOptionsValidation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "redis-proxy-certs")
+	assert.Nil(t, err)
+	defer os.RemoveAll(dir)
+	ca := newTestCA(t, dir, "ca")
+	listen := ca.serverSpec(t)
+
+	for _, c := range []struct {
+		spec   AddrSpec
+		server bool
+		err    string
+	}{
+		{AddrSpec{ServerName: "redis"}, false, "uplink.server_name requires tls"},
+		{AddrSpec{TLS: true, MinTLSVersion: "1.4"}, false, "uplink.min_tls_version must be one of 1.0, 1.1, 1.2, 1.3"},
+		{AddrSpec{TLS: true, CipherSuites: "TLS_AES_128_GCM_SHA256, NULL"}, false,
+			"uplink.cipher_suites: unknown cipher suite 'NULL'"},
+		{AddrSpec{TLS: true, CertFile: listen.CertFile}, false, "uplink.certfile requires keyfile"},
+		{AddrSpec{TLS: true, CertFile: listen.CertFile, KeyFile: listen.CertFile}, false,
+			"could not load uplink.certfile and keyfile: tls: found a certificate rather than a key in the PEM for the private key"},
+		{AddrSpec{TLS: true, ServerName: "redis"}, true, "uplink.server_name is only used for connecting"},
+	} {
+		errList := c.spec.prepareTLSOptions("uplink", c.server, false)
+		assert.Equal(t, errList.Errors(), []string{c.err})
+	}
+
+	spec := AddrSpec{TLS: true, MinTLSVersion: "1.2", CipherSuites: "TLS_RSA_WITH_RC4_128_SHA,TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256"}
+	errList := spec.prepareTLSOptions("uplink", false, false)
+	assert.True(t, errList.Ok())
+	assert.Equal(t, errList.Items()[0].Severity, SeverityWarning)
+	config := &tls.Config{}
+	spec.applyTLSOptions(config)
+	assert.Equal(t, config.MinVersion, uint16(tls.VersionTLS12))
+	assert.Equal(t, config.CipherSuites, []uint16{tls.TLS_RSA_WITH_RC4_128_SHA, tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256})
+}
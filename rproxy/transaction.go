@@ -0,0 +1,80 @@
+package rproxy
+
+import (
+	"time"
+
+	"github.com/Codility/redis-proxy/resp"
+)
+
+// Transaction tracking
+//
+// A client that sent MULTI or WATCH depends on state kept by its
+// uplink connection until EXEC/DISCARD/UNWATCH.  If the proxy
+// switched uplinks in the meantime, EXEC would reach a Redis that has
+// never seen MULTI.  To prevent that, ClientHandler keeps its
+// execution permission (and its uplink connection) for the entire
+// transaction, so PAUSE waits for transactions to finish.  The
+// transaction must complete within read_time_limit_ms, otherwise the
+// client gets disconnected.
+
+type txState struct {
+	inMulti  bool
+	watching bool
+
+	// Database selected by a SELECT queued after MULTI, -1 if
+	// none.  It becomes current only after successful EXEC.
+	queuedDB int
+
+	deadline time.Time
+}
+
+func (tx *txState) Active() bool {
+	return tx.inMulti || tx.watching
+}
+
+func (tx *txState) Reset() {
+	*tx = txState{queuedDB: -1}
+}
+
+// Update tracks transaction state based on request and its reply.
+// Returns the database selected by EXEC, or -1 if EXEC did not change
+// it.
+func (tx *txState) Update(req, res *resp.Msg) int {
+	switch req.Op() {
+	case resp.MsgOpMulti:
+		if res.IsOk() {
+			tx.inMulti = true
+			tx.queuedDB = -1
+		}
+	case resp.MsgOpExec:
+		if tx.inMulti {
+			db := -1
+			if res.IsArray() {
+				db = tx.queuedDB
+			}
+			tx.inMulti = false
+			tx.watching = false
+			tx.queuedDB = -1
+			return db
+		}
+	case resp.MsgOpDiscard:
+		if tx.inMulti {
+			tx.inMulti = false
+			tx.watching = false
+			tx.queuedDB = -1
+		}
+	case resp.MsgOpWatch:
+		if res.IsOk() {
+			tx.watching = true
+		}
+	case resp.MsgOpUnwatch:
+		if res.IsOk() && !tx.inMulti {
+			tx.watching = false
+		}
+	case resp.MsgOpSelect:
+		if tx.inMulti && res.IsQueued() {
+			tx.queuedDB = req.FirstArgInt()
+		}
+	}
+	return -1
+}
@@ -0,0 +1,116 @@
+package rproxy
+
+import (
+	"io"
+	"testing"
+	"time"
+
+	"github.com/Codility/redis-proxy/fakeredis"
+	"github.com/Codility/redis-proxy/resp"
+	"github.com/stvp/assert"
+)
+
+func TestProxyTransactionSurvivesUplinkSwitch(t *testing.T) {
+	srv_0 := fakeredis.Start("srv-0", "tcp")
+	defer srv_0.Stop()
+	srv_1 := fakeredis.Start("srv-1", "tcp")
+	defer srv_1.Stop()
+
+	conf := NewTestConfigLoader(srv_0.Addr().String())
+	proxy := mustStartTestProxy(t, conf)
+	defer proxy.Stop()
+
+	c := resp.MustDial("tcp", proxy.ListenAddr().String(), 0, false)
+	c.MustCallAndGetOk(resp.MsgFromStrings("MULTI"))
+
+	conf.Replace(&Config{
+		Uplink: AddrSpec{Addr: srv_1.Addr().String()},
+		Listen: AddrSpec{Addr: "127.0.0.1:0"},
+	})
+	assert.Nil(t, proxy.Reload())
+
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("SET", "k", "v")).String(), "+QUEUED\r\n")
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("EXEC")).String(), "*1\r\n$5\r\nsrv-0\r\n")
+	assert.Equal(t, srv_0.ReqCnt(), 3)
+	assert.Equal(t, srv_1.ReqCnt(), 0)
+
+	// Transaction is over, switch to the new uplink
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("GET", "k")).String(), "$5\r\nsrv-1\r\n")
+}
+
+func TestProxyWatchSurvivesUplinkSwitch(t *testing.T) {
+	srv_0 := fakeredis.Start("srv-0", "tcp")
+	defer srv_0.Stop()
+	srv_1 := fakeredis.Start("srv-1", "tcp")
+	defer srv_1.Stop()
+
+	conf := NewTestConfigLoader(srv_0.Addr().String())
+	proxy := mustStartTestProxy(t, conf)
+	defer proxy.Stop()
+
+	c := resp.MustDial("tcp", proxy.ListenAddr().String(), 0, false)
+	c.MustCallAndGetOk(resp.MsgFromStrings("WATCH", "k"))
+	assert.Equal(t, proxy.GetInfo().ActiveRequests, 1)
+
+	conf.Replace(&Config{
+		Uplink: AddrSpec{Addr: srv_1.Addr().String()},
+		Listen: AddrSpec{Addr: "127.0.0.1:0"},
+	})
+	assert.Nil(t, proxy.Reload())
+
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("GET", "k")).String(), "$5\r\nsrv-0\r\n")
+	c.MustCallAndGetOk(resp.MsgFromStrings("UNWATCH"))
+	assert.Equal(t, proxy.GetInfo().ActiveRequests, 0)
+
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("GET", "k")).String(), "$5\r\nsrv-1\r\n")
+}
+
+func TestProxyPauseWaitsForTransaction(t *testing.T) {
+	srv, proxy := startFakeredisAndProxy(t)
+	defer srv.Stop()
+	defer proxy.Stop()
+
+	c := resp.MustDial("tcp", proxy.ListenAddr().String(), 0, false)
+	c.MustCallAndGetOk(resp.MsgFromStrings("AUTH", "test-pass"))
+	c.MustCallAndGetOk(resp.MsgFromStrings("MULTI"))
+	assert.Equal(t, proxy.GetInfo().ActiveRequests, 1)
+
+	proxy.Pause()
+	time.Sleep(100 * time.Millisecond)
+	assert.Equal(t, proxy.GetInfo().State, ProxyPausing)
+
+	// The transaction can still finish while the proxy is pausing
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("SET", "k", "v")).String(), "+QUEUED\r\n")
+	assert.Equal(t, c.MustCall(resp.MsgFromStrings("EXEC")).String(), "*1\r\n$3\r\nsrv\r\n")
+	waitUntil(t, func() bool { return proxy.GetInfo().State == ProxyPaused })
+	assert.Equal(t, proxy.GetInfo().ActiveRequests, 0)
+
+	proxy.Unpause()
+	c.MustCallAndGetOk(resp.MsgFromStrings("MULTI"))
+	c.MustCallAndGetOk(resp.MsgFromStrings("DISCARD"))
+	assert.Equal(t, proxy.GetInfo().ActiveRequests, 0)
+}
+
+func TestProxyTransactionTimeLimit(t *testing.T) {
+	srv := fakeredis.Start("srv", "tcp")
+	defer srv.Stop()
+
+	proxy := mustStartTestProxy(t, &TestConfigLoader{
+		conf: &Config{
+			Uplink:          AddrSpec{Addr: srv.Addr().String()},
+			Listen:          AddrSpec{Addr: "127.0.0.1:0"},
+			ReadTimeLimitMs: 100,
+		},
+	})
+	defer proxy.Stop()
+
+	c := resp.MustDial("tcp", proxy.ListenAddr().String(), 0, false)
+	c.MustCallAndGetOk(resp.MsgFromStrings("MULTI"))
+	proxy.Pause()
+	assert.Equal(t, proxy.GetInfo().State, ProxyPausing)
+
+	// Client took too long, proxy disconnects it and finishes pausing
+	waitUntil(t, func() bool { return proxy.GetInfo().State == ProxyPaused })
+	_, err := c.ReadMsg()
+	assert.Equal(t, err, io.EOF)
+}
@@ -0,0 +1,94 @@
+package rproxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// Config validation
+//
+// A config can be checked without loading it: `redis-proxy -check`
+// and `cmd=validate` in the admin API run the checks done at startup
+// (Config.Prepare, which also connects to uplink), and those done on
+// reload (ValidateSwitchTo) against the running config, and list the
+// fields RELOAD would change.  Passwords are not compared: the
+// running config fetched from the admin API has them removed.
+//
+// A config posted to the admin API comes from outside, so it is taken
+// literally (no `${VAR}` expansion or REDIS_PROXY_* overrides) and
+// only checked offline (Config.PrepareOffline): files named in it are
+// not read, pass_env is not looked up, and uplink, shards, replicas
+// and sentinels are not contacted.  That way it can't be used to read
+// the proxy's environment or probe its hosts and files.
+
+type ValidationResult struct {
+	Ok      bool           `json:"ok"`
+	Errors  []ConfigError  `json:"errors"`
+	Changes []ConfigChange `json:"changes,omitempty"`
+}
+
+// ValidateConfig checks newConfig, and (if running is not nil)
+// switching to it from running.
+func ValidateConfig(newConfig, running *Config) *ValidationResult {
+	return validateConfig(newConfig.Prepare(), newConfig, running)
+}
+
+func validateConfig(errList ErrorList, newConfig, running *Config) *ValidationResult {
+	res := &ValidationResult{}
+	if running != nil {
+		errList.Append(running.ValidateSwitchTo(newConfig))
+		res.Changes = running.SanitizedForPublication().Changes(newConfig.SanitizedForPublication())
+	}
+	res.Ok = errList.Ok()
+	res.Errors = errList.Items()
+	return res
+}
+
+// ValidateConfig checks newConfig offline, and switching to it from
+// the running config.
+func (proxy *Proxy) ValidateConfig(newConfig *Config) *ValidationResult {
+	return validateConfig(newConfig.PrepareOffline(), newConfig, proxy.GetConfig())
+}
+
+// FetchRunningConfig gets the (sanitized) config of a proxy from its
+// admin API at adminURL.  With admin TLS, the server is verified
+// against admin.cacertfile, if given.
+func FetchRunningConfig(adminURL string, admin *AddrSpec) (*Config, error) {
+	caCertFile := ""
+	if admin.TLS {
+		caCertFile = admin.CACertFile
+	}
+	client, err := httpClientWithCA(caCertFile)
+	if err != nil {
+		return nil, err
+	}
+
+	res, err := client.Get(strings.TrimSuffix(adminURL, "/") + "/info.json")
+	if err != nil {
+		return nil, err
+	}
+	defer res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("Could not fetch running config: %s", res.Status)
+	}
+
+	var info ProxyInfo
+	if err := json.NewDecoder(res.Body).Decode(&info); err != nil {
+		return nil, err
+	}
+	if info.Config == nil {
+		return nil, errors.New("Could not fetch running config: no config in info.json")
+	}
+	return info.Config, nil
+}
+
+// AdminURL returns the URL of the admin API for admin config.
+func (as *AddrSpec) AdminURL() string {
+	if as.TLS {
+		return "https://" + as.Addr
+	}
+	return "http://" + as.Addr
+}
@@ -0,0 +1,83 @@
+package rproxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/Codility/redis-proxy/fakeredis"
+	"github.com/stvp/assert"
+)
+
+func TestProxyValidateConfig(t *testing.T) {
+	srv := fakeredis.Start("srv", "tcp")
+	defer srv.Stop()
+
+	proxy := mustStartTestProxy(t, &TestConfigLoader{
+		conf: &Config{
+			Uplink: AddrSpec{Addr: srv.Addr().String(), Pass: "redis-pass"},
+			Listen: AddrSpec{Addr: "127.0.0.1:0"},
+			Admin:  AddrSpec{Addr: "127.0.0.1:0"},
+		},
+	})
+	defer proxy.Stop()
+	adminURL := fmt.Sprintf("http://%s", proxy.AdminAddr().String())
+
+	validate := func(config string) (int, *ValidationResult) {
+		res, err := http.PostForm(adminURL+"/cmd/", url.Values{
+			"cmd":    {"validate"},
+			"config": {config},
+		})
+		assert.Nil(t, err)
+		defer res.Body.Close()
+		var body ValidationResult
+		assert.Nil(t, json.NewDecoder(res.Body).Decode(&body))
+		return res.StatusCode, &body
+	}
+
+	status, res := validate(fmt.Sprintf(`{"uplink": {"addr": "%s", "pass": "redis-pass"}, "listen": {"addr": "127.0.0.1:0"}, "log_messages": true}`,
+		srv.Addr().String()))
+	assert.Equal(t, status, 200)
+	assert.True(t, res.Ok)
+	assert.Equal(t, res.Errors, []ConfigError{})
+	assert.Equal(t, res.Changes, []ConfigChange{
+		{Field: "admin", Applied: reloadableFields["admin"]},
+		{Field: "log_messages", Applied: reloadableFields["log_messages"]},
+	})
+
+	status, res = validate(`{"uplink": {"addr": "127.0.0.1:0"}, "listen": {"addr": ""}}`)
+	assert.Equal(t, status, 400)
+	assert.False(t, res.Ok)
+	assert.Equal(t, res.Errors, []ConfigError{{Field: "listen", Message: "Missing listen address", Severity: SeverityError}})
+
+	// Posted configs are taken literally and checked offline: no
+	// environment, no files, no connections.
+	os.Setenv("TEST_RP_UPLINK", srv.Addr().String())
+	defer os.Unsetenv("TEST_RP_UPLINK")
+	status, res = validate(`{"uplink": {"addr": "${TEST_RP_UPLINK}", "pass": "redis-pass"}, "listen": {"addr": "127.0.0.1:0"}}`)
+	assert.Equal(t, status, 200)
+	assert.True(t, res.Ok)
+	fields := []string{}
+	for _, change := range res.Changes {
+		fields = append(fields, change.Field)
+	}
+	assert.Contains(t, "uplink", strings.Join(fields, " "))
+
+	status, res = validate(`{"uplink": {"addr": "127.0.0.1:1", "pass_file": "/nonexistent/pass",
+		"tls": true, "cacertfile": "/nonexistent/ca.pem"}, "listen": {"addr": "127.0.0.1:0"}}`)
+	assert.Equal(t, status, 200)
+	assert.True(t, res.Ok)
+
+	// Nothing was applied
+	assert.False(t, proxy.GetConfig().LogMessages)
+
+	// -check gets the running config from the admin API
+	running, err := FetchRunningConfig(adminURL, &AddrSpec{})
+	assert.Nil(t, err)
+	assert.Equal(t, running.Uplink.Addr, srv.Addr().String())
+	assert.Equal(t, running.Uplink.Pass, SanitizedPass)
+}
@@ -0,0 +1,295 @@
+package rproxy
+
+import (
+	"crypto/sha256"
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Config file watching
+//
+// With watching enabled (`redis-proxy -watch`), the proxy reloads when
+// the config file, or a file it refers to (certificates, keys, CA
+// certificates, password files), changes.  Changes are noticed with
+// inotify on the directories of the files (so files replaced by
+// rename, as editors and Kubernetes do, are noticed too), or by
+// polling where inotify is not available.  Contents are compared, so
+// touching a file does not reload, and a reload waits until no change
+// was seen for the debounce period, so a file written in several
+// steps is not loaded half-written.
+//
+// The reload goes the same way as RELOAD: a broken config is
+// rejected, and the old one stays in effect.  Results are in
+// `reloads` in /info.json, the state of the watcher in
+// `config_watch`, and the outcome of the last reload in the
+// rproxy_config_last_reload_successful gauge.
+
+const (
+	DefaultWatchDebounce = 500 * time.Millisecond
+
+	watchPollInterval = time.Second
+	// With inotify, polling only catches what it can't see (like a
+	// directory replaced as a whole).
+	watchInotifyPollInterval = 10 * time.Second
+)
+
+// dirNotifier tells (through Events) that something in one of the
+// directories changed.
+type dirNotifier interface {
+	SetDirs(dirs []string) error
+	Events() <-chan struct{}
+	Close() error
+}
+
+// configWatch is a watcher of config changes (of a file, or a key in
+// Redis, see RedisConfigLoader).
+type configWatch interface {
+	Info() *ConfigWatchInfo
+	Stop()
+}
+
+type ConfigWatchInfo struct {
+	Mode       string    `json:"mode"` // "inotify", "poll" or "keyspace"
+	Source     string    `json:"source"`
+	Files      []string  `json:"files,omitempty"`
+	Reloads    int       `json:"reloads"`
+	LastChange time.Time `json:"last_change,omitempty"`
+	LastError  string    `json:"last_error,omitempty"` // of the last reload it triggered
+}
+
+type ConfigWatcher struct {
+	proxy      *Proxy
+	configFile string
+	debounce   time.Duration
+	notifier   dirNotifier
+	stop       chan struct{}
+	stopOnce   sync.Once
+
+	mu   sync.Mutex
+	info ConfigWatchInfo
+}
+
+// Watch makes proxy reload its config when the file, or a file it
+// refers to, changes.  Changes are applied once there was none for
+// `debounce`.
+func (f *FileConfigLoader) Watch(proxy *Proxy, debounce time.Duration) *ConfigWatcher {
+	notifier, err := newDirNotifier()
+	if err != nil {
+		log.Printf("Config watch: inotify not available (%s), polling files instead", err)
+	}
+	return f.watch(proxy, debounce, notifier)
+}
+
+// watch is Watch with the given notifier (nil: poll).
+func (f *FileConfigLoader) watch(proxy *Proxy, debounce time.Duration, notifier dirNotifier) *ConfigWatcher {
+	w := &ConfigWatcher{
+		proxy:      proxy,
+		configFile: f.fileName,
+		debounce:   debounce,
+		notifier:   notifier,
+		stop:       make(chan struct{}),
+		info:       ConfigWatchInfo{Mode: "inotify", Source: f.fileName},
+	}
+	if notifier == nil {
+		w.info.Mode = "poll"
+	}
+	proxy.setConfigWatch(w)
+
+	files := w.watchFiles()
+	go w.run(files, hashFiles(files))
+	return w
+}
+
+func (w *ConfigWatcher) Stop() {
+	w.stopOnce.Do(func() {
+		close(w.stop)
+		if w.notifier != nil {
+			w.notifier.Close()
+		}
+	})
+}
+
+func (w *ConfigWatcher) Info() *ConfigWatchInfo {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	info := w.info
+	return &info
+}
+
+// run reloads on changes of files (with hashes applied at the start).
+func (w *ConfigWatcher) run(files []string, applied map[string][]byte) {
+	seen := applied
+
+	pollInterval := watchInotifyPollInterval
+	var events <-chan struct{}
+	if w.notifier != nil {
+		events = w.notifier.Events()
+	} else {
+		pollInterval = watchPollInterval
+	}
+	poll := time.NewTicker(pollInterval)
+	defer poll.Stop()
+
+	debounce := time.NewTimer(w.debounce)
+	debounce.Stop()
+
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-events:
+		case <-poll.C:
+		case <-debounce.C:
+			if !reflect.DeepEqual(seen, applied) {
+				w.reload()
+				// Changes made during the reload are seen with
+				// the next check; only files the new config
+				// refers to are taken as they are now.
+				files = w.watchFiles()
+				seen = hashNewFiles(files, seen)
+			}
+			applied = seen
+			continue
+		}
+
+		if current := hashFiles(files); !reflect.DeepEqual(current, seen) {
+			seen = current
+			w.mu.Lock()
+			w.info.LastChange = time.Now()
+			w.mu.Unlock()
+			debounce.Reset(w.debounce)
+		}
+	}
+}
+
+func (w *ConfigWatcher) reload() {
+	if !w.proxy.State().IsAlive() {
+		return
+	}
+	log.Printf("Config watch: %s or a file it refers to changed, reloading", w.configFile)
+	res := w.proxy.ReloadWithResult()
+	if res.Ok {
+		log.Printf("Config watch: reloaded, config generation %d", res.Generation)
+	} else {
+		log.Printf("Config watch: reload failed, keeping old config: %s", res.Error)
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.info.Reloads++
+	w.info.LastError = res.Error
+}
+
+// watchFiles lists the files to watch for the current config, and
+// starts watching their directories.
+func (w *ConfigWatcher) watchFiles() []string {
+	files := append([]string{w.configFile}, w.proxy.GetConfig().referencedFiles()...)
+	if w.notifier != nil {
+		dirs := map[string]bool{}
+		for _, file := range files {
+			dirs[filepath.Dir(file)] = true
+		}
+		dirList := []string{}
+		for dir := range dirs {
+			dirList = append(dirList, dir)
+		}
+		if err := w.notifier.SetDirs(dirList); err != nil {
+			log.Printf("Config watch: %s", err)
+		}
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	w.info.Files = files
+	return files
+}
+
+// hashFiles returns hashes of contents of files (nil for those that
+// can't be read).
+func hashFiles(files []string) map[string][]byte {
+	res := map[string][]byte{}
+	for _, file := range files {
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			res[file] = nil
+			continue
+		}
+		sum := sha256.Sum256(data)
+		res[file] = sum[:]
+	}
+	return res
+}
+
+// hashNewFiles returns hashes of files, taking those already in
+// hashes from there.
+func hashNewFiles(files []string, hashes map[string][]byte) map[string][]byte {
+	res := map[string][]byte{}
+	for _, file := range files {
+		if hash, ok := hashes[file]; ok {
+			res[file] = hash
+		} else {
+			res[file] = hashFiles([]string{file})[file]
+		}
+	}
+	return res
+}
+
+// referencedFiles lists files named in the config (certificates,
+// keys, password files).
+func (c *Config) referencedFiles() []string {
+	specs := []AddrSpec{c.Uplink, c.Listen, c.ListenRaw, c.Admin}
+	for _, shard := range c.Shards {
+		specs = append(specs, shard.AddrSpec)
+	}
+	specs = append(specs, c.Replicas.Nodes...)
+
+	seen := map[string]bool{}
+	files := []string{}
+	for _, spec := range specs {
+		for _, file := range []string{spec.CertFile, spec.KeyFile, spec.CACertFile, spec.ClientCACertFile, spec.PassFile} {
+			if file != "" && !seen[file] {
+				seen[file] = true
+				files = append(files, file)
+			}
+		}
+	}
+	sort.Strings(files)
+	return files
+}
+
+// setConfigWatch makes w the watcher of the proxy, stopping the
+// previous one.
+func (proxy *Proxy) setConfigWatch(w configWatch) {
+	proxy.watcherMu.Lock()
+	defer proxy.watcherMu.Unlock()
+
+	if proxy.watcher != nil {
+		proxy.watcher.Stop()
+	}
+	proxy.watcher = w
+}
+
+func (proxy *Proxy) configWatchInfo() *ConfigWatchInfo {
+	proxy.watcherMu.Lock()
+	defer proxy.watcherMu.Unlock()
+
+	if proxy.watcher == nil {
+		return nil
+	}
+	return proxy.watcher.Info()
+}
+
+func (proxy *Proxy) stopConfigWatch() {
+	proxy.watcherMu.Lock()
+	defer proxy.watcherMu.Unlock()
+
+	if proxy.watcher != nil {
+		proxy.watcher.Stop()
+	}
+}
@@ -0,0 +1,85 @@
+package rproxy
+
+import (
+	"os"
+	"sync"
+	"syscall"
+)
+
+const inotifyMask = syscall.IN_MODIFY | syscall.IN_ATTRIB | syscall.IN_CLOSE_WRITE |
+	syscall.IN_CREATE | syscall.IN_DELETE | syscall.IN_MOVED_FROM | syscall.IN_MOVED_TO
+
+// inotifyNotifier watches directories with inotify.  Events are not
+// parsed: any of them means the watcher should look at its files.
+type inotifyNotifier struct {
+	fd     int
+	file   *os.File // fd, read through the runtime poller
+	events chan struct{}
+
+	mu   sync.Mutex
+	dirs map[string]int // watch descriptors
+}
+
+func newDirNotifier() (dirNotifier, error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, os.NewSyscallError("inotify_init1", err)
+	}
+	n := &inotifyNotifier{
+		fd:     fd,
+		file:   os.NewFile(uintptr(fd), "inotify"),
+		events: make(chan struct{}, 1),
+		dirs:   map[string]int{},
+	}
+	go n.read()
+	return n, nil
+}
+
+func (n *inotifyNotifier) read() {
+	buf := make([]byte, 64*1024)
+	for {
+		if _, err := n.file.Read(buf); err != nil {
+			return
+		}
+		select {
+		case n.events <- struct{}{}:
+		default:
+		}
+	}
+}
+
+func (n *inotifyNotifier) SetDirs(dirs []string) error {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	var firstErr error
+	keep := map[string]bool{}
+	for _, dir := range dirs {
+		keep[dir] = true
+		// Adding a watch again is harmless, and brings it back if
+		// the directory was replaced.
+		wd, err := syscall.InotifyAddWatch(n.fd, dir, inotifyMask)
+		if err != nil {
+			if firstErr == nil {
+				firstErr = os.NewSyscallError("inotify_add_watch "+dir, err)
+			}
+			continue
+		}
+		n.dirs[dir] = wd
+	}
+	for dir, wd := range n.dirs {
+		if !keep[dir] {
+			syscall.InotifyRmWatch(n.fd, uint32(wd))
+			delete(n.dirs, dir)
+		}
+	}
+	return firstErr
+}
+
+func (n *inotifyNotifier) Events() <-chan struct{} {
+	return n.events
+}
+
+func (n *inotifyNotifier) Close() error {
+	return n.file.Close()
+}
@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package rproxy
+
+import "errors"
+
+func newDirNotifier() (dirNotifier, error) {
+	return nil, errors.New("inotify is only available on Linux")
+}
@@ -0,0 +1,109 @@
+package rproxy
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/Codility/redis-proxy/fakeredis"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/stvp/assert"
+)
+
+func lastReloadSuccessful() float64 {
+	m := &dto.Metric{}
+	statLastReloadSuccessful.Write(m)
+	return m.GetGauge().GetValue()
+}
+
+func waitFor(t *testing.T, duration time.Duration, expr func() bool) {
+	deadline := time.Now().Add(duration)
+	for time.Now().Before(deadline) {
+		if expr() {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Condition not met within %v", duration)
+}
+
+func startWatchedProxy(t *testing.T, notifier dirNotifier) (*Proxy, string, string, func()) {
+	srv := fakeredis.Start("srv", "tcp")
+	dir, err := ioutil.TempDir("", "redis-proxy-watch")
+	assert.Nil(t, err)
+	passFile := writeTestConfig(t, dir, "pass", "pass-1\n")
+	configFmt := `{
+		"uplink": {"addr": "%s"},
+		"listen": {"addr": "127.0.0.1:0", "pass_file": "%s"},
+		"read_time_limit_ms": %%d
+	}`
+	config := fmt.Sprintf(configFmt, srv.Addr().String(), passFile)
+	configFile := writeTestConfig(t, dir, "config.json", fmt.Sprintf(config, 1000))
+
+	loader := NewFileConfigLoader(configFile)
+	proxy, err := NewProxy(loader)
+	assert.Nil(t, err)
+	proxy.Start()
+	loader.watch(proxy, 50*time.Millisecond, notifier)
+
+	return proxy, config, dir, func() {
+		proxy.Stop()
+		srv.Stop()
+		os.RemoveAll(dir)
+	}
+}
+
+func TestConfigWatch(t *testing.T) {
+	notifier, err := newDirNotifier()
+	assert.Nil(t, err)
+	proxy, config, dir, cleanup := startWatchedProxy(t, notifier)
+	defer cleanup()
+	configFile := filepath.Join(dir, "config.json")
+
+	info := proxy.GetInfo().ConfigWatch
+	assert.Equal(t, info.Mode, "inotify")
+	assert.Equal(t, info.Files, []string{configFile, filepath.Join(dir, "pass")})
+
+	// Config file changed
+	writeTestConfig(t, dir, "config.json", fmt.Sprintf(config, 2000))
+	waitUntil(t, func() bool { return proxy.GetConfig().ReadTimeLimitMs == 2000 })
+	assert.Equal(t, proxy.GetInfo().Generation, 2)
+
+	// Same content: no reload
+	writeTestConfig(t, dir, "config.json", fmt.Sprintf(config, 2000))
+	time.Sleep(200 * time.Millisecond)
+	assert.Equal(t, proxy.GetInfo().ConfigWatch.Reloads, 1)
+
+	// Referenced file replaced by rename
+	newPass := writeTestConfig(t, dir, "pass.new", "pass-2\n")
+	assert.Nil(t, os.Rename(newPass, filepath.Join(dir, "pass")))
+	waitUntil(t, func() bool { return proxy.GetConfig().Listen.Pass == "pass-2" })
+
+	// Broken config: old one stays
+	writeTestConfig(t, dir, "config.json", "{\"uplink\": ")
+	waitUntil(t, func() bool { return proxy.GetInfo().ConfigWatch.LastError != "" })
+	assert.Equal(t, proxy.GetConfig().ReadTimeLimitMs, int64(2000))
+	info = proxy.GetInfo().ConfigWatch
+	assert.Equal(t, info.Reloads, 3)
+	reloads := proxy.GetInfo().Reloads
+	assert.False(t, reloads[len(reloads)-1].Ok)
+	assert.Equal(t, lastReloadSuccessful(), 0.0)
+
+	// Fixed
+	writeTestConfig(t, dir, "config.json", fmt.Sprintf(config, 3000))
+	waitUntil(t, func() bool { return proxy.GetConfig().ReadTimeLimitMs == 3000 })
+	waitUntil(t, func() bool { return proxy.GetInfo().ConfigWatch.LastError == "" })
+	assert.Equal(t, lastReloadSuccessful(), 1.0)
+}
+
+func TestConfigWatchPolling(t *testing.T) {
+	proxy, config, dir, cleanup := startWatchedProxy(t, nil)
+	defer cleanup()
+	assert.Equal(t, proxy.GetInfo().ConfigWatch.Mode, "poll")
+
+	writeTestConfig(t, dir, "config.json", fmt.Sprintf(config, 2000))
+	waitFor(t, 3*time.Second, func() bool { return proxy.GetConfig().ReadTimeLimitMs == 2000 })
+}